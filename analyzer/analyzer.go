@@ -1,6 +1,7 @@
 package analyzer
 
 import (
+	"shadownet/types"
 	"shadownet/utils"
 	"sync"
 	"time"
@@ -67,6 +68,21 @@ func (a *Analyzer) AddAttack(ip, attackType string) {
     threat.Risk = a.calculateRisk(threat)
 }
 
+// HandleEvent feeds a honeypot event into the threat model, under its classified
+// attack types or else its service
+func (a *Analyzer) HandleEvent(ev types.Event) {
+    if ev.Src.IP == "" {
+        return
+    }
+    attackTypes := types.AttackTypesOf(ev)
+    if len(attackTypes) == 0 {
+        attackTypes = []string{ev.Service}
+    }
+    for _, attackType := range attackTypes {
+        a.AddAttack(ev.Src.IP, attackType)
+    }
+}
+
 // calculateRisk determines the threat level of an attacker
 func (a *Analyzer) calculateRisk(t *Threat) float64 {
     // Base risk starts at 0.1
@@ -123,4 +139,4 @@ func (a *Analyzer) GetThreatByIP(ip string) (Threat, bool) {
         return *threat, true
     }
     return Threat{}, false
-}
\ No newline at end of file
+}
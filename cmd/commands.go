@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// command is an administrative subcommand such as `shadownet replay`
+type command struct {
+    usage string
+    run   func(args []string) error
+}
+
+// commands lists the subcommands available besides running the sensor
+var commands = map[string]command{
+    "replay": {
+        usage: "replay [-speed N] [-dir DIR] <session-id>   play back a recorded honeypot session",
+        run:   runReplay,
+    },
+    "rotate-hostkeys": {
+        usage: "rotate-hostkeys [-dir DIR]                  replace the persistent SSH host keys",
+        run:   runRotateHostKeys,
+    },
+}
+
+// runCommand executes a subcommand and returns the process exit code
+func runCommand(name string, args []string) int {
+    cmd, ok := commands[name]
+    if !ok {
+        fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", name, commandUsage())
+        return 2
+    }
+    if err := cmd.run(args); err != nil {
+        fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+        return 1
+    }
+    return 0
+}
+
+// commandUsage lists every subcommand
+func commandUsage() string {
+    names := make([]string, 0, len(commands))
+    for name := range commands {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    var b strings.Builder
+    b.WriteString("Usage:\n  shadownet                 run the sensor\n")
+    for _, name := range names {
+        fmt.Fprintf(&b, "  shadownet %s\n", commands[name].usage)
+    }
+    return b.String()
+}
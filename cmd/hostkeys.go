@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"shadownet/config"
+	"shadownet/honeypot"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// runRotateHostKeys implements `shadownet rotate-hostkeys`
+func runRotateHostKeys(args []string) error {
+    fs := flag.NewFlagSet("rotate-hostkeys", flag.ContinueOnError)
+    dir := fs.String("dir", "", "directory with the SSH host keys (default: ssh.host_key_dir from the config)")
+    if err := fs.Parse(args); err != nil {
+        return err
+    }
+    if fs.NArg() != 0 {
+        return errors.New("usage: shadownet rotate-hostkeys [-dir DIR]")
+    }
+
+    if *dir == "" {
+        cfg, err := config.LoadConfig()
+        if err != nil {
+            return fmt.Errorf("failed to load configuration: %v", err)
+        }
+        *dir = cfg.SSH.HostKeyDir
+    }
+
+    signers, err := honeypot.RotateHostKeys(*dir)
+    if err != nil {
+        return err
+    }
+    for _, signer := range signers {
+        fmt.Printf("%s %s\n", signer.PublicKey().Type(), ssh.FingerprintSHA256(signer.PublicKey()))
+    }
+    fmt.Println("Restart the sensor to serve the new host keys.")
+    return nil
+}
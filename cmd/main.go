@@ -6,24 +6,25 @@ import (
 	"os/signal"
 	"shadownet/ai"
 	"shadownet/analyzer"
+	"shadownet/classify"
 	"shadownet/config"
 	"shadownet/countermeasures"
 	"shadownet/db"
+	"shadownet/events"
 	"shadownet/honeypot"
+	"shadownet/persona"
 	"shadownet/utils"
-	"sync"
 	"syscall"
 	"time"
 )
 
-// ServiceStatus tracks the state of each honeypot
-type ServiceStatus struct {
-	Name   string
-	Status bool
-	Errors []string
-}
-
 func main() {
+    // Administrative subcommands run instead of the sensor
+    if len(os.Args) > 1 {
+        utils.InitLogger()
+        os.Exit(runCommand(os.Args[1], os.Args[2:]))
+    }
+
     // Create a base context that can be cancelled
     ctx, cancel := context.WithCancel(context.Background())
     defer cancel()
@@ -49,16 +50,6 @@ func main() {
     metrics := utils.NewMetricsCollector()
     go metrics.Start(ctx)
     
-    // Initialize services tracker
-    services := make(map[string]*ServiceStatus)
-    servicesMutex := &sync.RWMutex{}
-    
-    // Start honeypots with configuration values and track their status
-    startServices(ctx, cfg, services, servicesMutex)
-    
-    // Start service health checker
-    go checkServicesHealth(ctx, services, servicesMutex)
-    
     // Create a new analyzer with context and metrics
     analyzer := analyzer.NewAnalyzer()
     go func() {
@@ -67,6 +58,34 @@ func main() {
         }
     }()
     
+    // Classify honeypot events, then fan them out to storage, analysis and metrics
+    bus := events.NewBus(cfg.Events.BufferSize)
+    classifier, err := classify.Load(cfg.Classification.Rules)
+    if err != nil {
+        utils.Log.Fatalf("Failed to load classification rules: %v", err)
+    }
+    bus.Use(classifier.Classify)
+    bus.SubscribeBlocking("db", db.NewEventWriter(db.GetDB()))
+    bus.Subscribe("analyzer", analyzer)
+    bus.Subscribe("metrics", metrics)
+    
+    // Cap connections so one scanner cannot exhaust the sensor
+    limiter, err := honeypot.NewLimiter(cfg.RateLimit)
+    if err != nil {
+        utils.Log.Fatalf("Invalid rate limit configuration: %v", err)
+    }
+    
+    // Every honeypot presents the same device so their fingerprints agree
+    profile, err := persona.Load(cfg.Persona.Name, cfg.Persona.Dir)
+    if err != nil {
+        utils.Log.Fatalf("Failed to load persona: %v", err)
+    }
+    utils.Log.Infof("Presenting persona %s (%s)", profile.Name, profile.Description)
+    
+    // Start honeypots under a supervisor that restarts them when they crash
+    supervisor := honeypot.NewSupervisor(restartPolicy(cfg))
+    startServices(ctx, cfg, supervisor, bus, limiter, profile)
+    
     // Initialize threat intelligence feed
     threatIntel := utils.NewThreatIntelligence()
     go threatIntel.Start(ctx)
@@ -108,7 +127,7 @@ func main() {
     }()
     
     // Set up API server for monitoring and control
-    go initAPIServer(ctx, cfg.API.Port, services, servicesMutex)
+    go startAPIServer(ctx, cfg.API.Port, supervisor, metrics, db.GetDB())
     
     utils.Log.Info("ShadowNet initialized. Waiting for attackers...")
     
@@ -123,8 +142,14 @@ func main() {
     // Cancel context to inform all goroutines
     cancel()
     
-    // Give goroutines time to clean up
-    time.Sleep(2 * time.Second)
+    // Wait for honeypots to stop accepting and drain their active sessions
+    supervisor.Wait()
+    if cutOff := supervisor.CutOffSessions(); cutOff > 0 {
+        utils.Log.Warningf("%d attacker sessions were cut off at shutdown", cutOff)
+    }
+    
+    // Flush queued events before the database goes away
+    bus.Close()
     
     // Close database connection
     if err := db.Close(); err != nil {
@@ -134,143 +159,30 @@ func main() {
     utils.Log.Info("ShadowNet shutdown complete")
 }
 
-// startServices launches all honeypot services with proper error handling
-func startServices(ctx context.Context, cfg *config.Config, services map[string]*ServiceStatus, mu *sync.RWMutex) {
-    // Start SSH honeypot
-    go func() {
-        mu.Lock()
-        services["ssh"] = &ServiceStatus{Name: "SSH", Status: true}
-        mu.Unlock()
-        
-        sshServer, err := honeypot.NewSSHServer(db.GetDB(), cfg.Honeypots.SSHPort)
+// startServices builds every enabled honeypot from the registry and hands it to the supervisor
+func startServices(ctx context.Context, cfg *config.Config, supervisor *honeypot.Supervisor, bus *events.Bus, limiter *honeypot.Limiter, profile *persona.Persona) {
+    deps := honeypot.Deps{Config: cfg, DB: db.GetDB(), Events: bus, Limiter: limiter, Persona: profile}
+
+    for _, name := range honeypot.Enabled(cfg) {
+        hp, err := honeypot.Build(name, deps)
         if err != nil {
-            utils.Log.Errorf("Failed to create SSH honeypot: %v", err)
-            mu.Lock()
-            services["ssh"].Status = false
-            services["ssh"].Errors = append(services["ssh"].Errors, err.Error())
-            mu.Unlock()
-            return
+            utils.Log.Errorf("Failed to create %s honeypot: %v", name, err)
+            supervisor.AddFailed(name, err)
+            continue
         }
+        supervisor.Add(name, hp)
+    }
 
-        if err := sshServer.Start(); err != nil {
-            utils.Log.Errorf("SSH honeypot error: %v", err)
-            mu.Lock()
-            services["ssh"].Status = false
-            services["ssh"].Errors = append(services["ssh"].Errors, err.Error())
-            mu.Unlock()
-        }
-    }()
-    
-    // Start HTTP honeypot
-    go func() {
-        mu.Lock()
-        services["http"] = &ServiceStatus{Name: "HTTP", Status: true}
-        mu.Unlock()
-        
-        if err := honeypot.StartHTTPServer(cfg.Honeypots.HTTPPort); err != nil {
-            utils.Log.Errorf("HTTP honeypot error: %v", err)
-            mu.Lock()
-            services["http"].Status = false
-            services["http"].Errors = append(services["http"].Errors, err.Error())
-            mu.Unlock()
-        }
-    }()
-    
-    // Start FTP honeypot
-    go func() {
-        mu.Lock()
-        services["ftp"] = &ServiceStatus{Name: "FTP", Status: true}
-        mu.Unlock()
-        
-        if err := honeypot.StartFTPServer(cfg.Honeypots.FTPPort); err != nil {
-            utils.Log.Errorf("FTP honeypot error: %v", err)
-            mu.Lock()
-            services["ftp"].Status = false
-            services["ftp"].Errors = append(services["ftp"].Errors, err.Error())
-            mu.Unlock()
-        }
-    }()
-    
-    // Start RDP honeypot
-    go func() {
-        mu.Lock()
-        services["rdp"] = &ServiceStatus{Name: "RDP", Status: true}
-        mu.Unlock()
-        
-        if err := honeypot.StartRDPServer(cfg.Honeypots.RDPPort); err != nil {
-            utils.Log.Errorf("RDP honeypot error: %v", err)
-            mu.Lock()
-            services["rdp"].Status = false
-            services["rdp"].Errors = append(services["rdp"].Errors, err.Error())
-            mu.Unlock()
-        }
-    }()
-    
-    // Start SMB honeypot
-    go func() {
-        mu.Lock()
-        services["smb"] = &ServiceStatus{Name: "SMB", Status: true}
-        mu.Unlock()
-        
-        if err := honeypot.StartSMBServer(cfg.Honeypots.SMBPort); err != nil {
-            utils.Log.Errorf("SMB honeypot error: %v", err)
-            mu.Lock()
-            services["smb"].Status = false
-            services["smb"].Errors = append(services["smb"].Errors, err.Error())
-            mu.Unlock()
-        }
-    }()
-    
-    // Start Modbus honeypot
-    go func() {
-        mu.Lock()
-        services["modbus"] = &ServiceStatus{Name: "Modbus", Status: true}
-        mu.Unlock()
-        
-        if err := honeypot.StartModbusServer(cfg.Honeypots.ModbusPort); err != nil {
-            utils.Log.Errorf("Modbus honeypot error: %v", err)
-            mu.Lock()
-            services["modbus"].Status = false
-            services["modbus"].Errors = append(services["modbus"].Errors, err.Error())
-            mu.Unlock()
-        }
-    }()
-    
-    // Start MQTT honeypot
-    go func() {
-        mu.Lock()
-        services["mqtt"] = &ServiceStatus{Name: "MQTT", Status: true}
-        mu.Unlock()
-        
-        if err := honeypot.StartMQTTServer(cfg.Honeypots.MQTTPort); err != nil {
-            utils.Log.Errorf("MQTT honeypot error: %v", err)
-            mu.Lock()
-            services["mqtt"].Status = false
-            services["mqtt"].Errors = append(services["mqtt"].Errors, err.Error())
-            mu.Unlock()
-        }
-    }()
+    supervisor.Run(ctx)
 }
 
-// checkServicesHealth periodically checks if honeypots are still running
-func checkServicesHealth(ctx context.Context, services map[string]*ServiceStatus, mu *sync.RWMutex) {
-    ticker := time.NewTicker(30 * time.Second)
-    defer ticker.Stop()
-    
-    for {
-        select {
-        case <-ctx.Done():
-            return
-        case <-ticker.C:
-            mu.RLock()
-            for name, service := range services {
-                if !service.Status {
-                    utils.Log.Warningf("Service %s is down. Attempting to restart...", name)
-                    // Implement restart logic here
-                }
-            }
-            mu.RUnlock()
-        }
+// restartPolicy converts the supervisor configuration into a restart policy
+func restartPolicy(cfg *config.Config) honeypot.RestartPolicy {
+    return honeypot.RestartPolicy{
+        InitialBackoff: cfg.Supervisor.InitialBackoff,
+        MaxBackoff:     cfg.Supervisor.MaxBackoff,
+        MaxRestarts:    cfg.Supervisor.MaxRestarts,
+        Window:         cfg.Supervisor.RestartWindow,
     }
 }
 
@@ -287,13 +199,3 @@ func connectWithRetry(attempts int) error {
     }
     return err
 }
-
-// startAPIServer starts a simple HTTP server for monitoring and control
-func initAPIServer(ctx context.Context, port int, services map[string]*ServiceStatus, mu *sync.RWMutex) {
-    // Implement a simple HTTP server with endpoints like:
-    // - /health for system status
-    // - /services for service status
-    // - /metrics for telemetry
-    // - /threats for current threat information
-    utils.Log.Infof("API server started on port %d", port)
-}
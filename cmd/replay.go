@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"shadownet/config"
+	"shadownet/recording"
+)
+
+// runReplay implements `shadownet replay <session-id>`
+func runReplay(args []string) error {
+    fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+    speed := fs.Float64("speed", 1, "playback speed for terminal sessions, 0 prints immediately")
+    dir := fs.String("dir", "", "directory with session recordings (default: recording.dir from the config)")
+    if err := fs.Parse(args); err != nil {
+        return err
+    }
+    if fs.NArg() != 1 {
+        return errors.New("usage: shadownet replay [-speed N] [-dir DIR] <session-id>")
+    }
+
+    if *dir == "" {
+        cfg, err := config.LoadConfig()
+        if err != nil {
+            return fmt.Errorf("failed to load configuration: %v", err)
+        }
+        *dir = cfg.Recording.Dir
+    }
+
+    header, frames, err := recording.Load(recording.Path(*dir, fs.Arg(0)))
+    if err != nil {
+        return err
+    }
+    return recording.Replay(os.Stdout, header, frames, *speed)
+}
@@ -4,22 +4,216 @@ import (
 	"errors"
 	"io/ioutil"
 	"os"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
 
+// ListenerConfig holds per-listener network settings, keyed by honeypot name
+type ListenerConfig struct {
+	// ProxyProtocol expects PROXY protocol v1/v2 headers from TrustedProxies
+	ProxyProtocol bool `yaml:"proxy_protocol"`
+	// TrustedProxies lists the IPs or CIDRs allowed to send PROXY headers
+	TrustedProxies []string `yaml:"trusted_proxies"`
+	// TLS wraps every connection in TLS from the first byte (HTTPS, FTPS, MQTT on 8883)
+	TLS bool `yaml:"tls"`
+	// StartTLS lets line protocols upgrade a plain connection, e.g. FTP AUTH TLS
+	StartTLS bool `yaml:"starttls"`
+}
+
+// SSHLogin is a username and password accepted by the SSH honeypot
+type SSHLogin struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// FTPLogin is a username and password accepted by the FTP honeypot
+type FTPLogin struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// AuthRule lets in or keeps out username and password pairs matching its patterns,
+// in which * matches any run of characters and ? a single character
+type AuthRule struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// Deny rejects matching pairs, e.g. to keep out a password every other rule would accept
+	Deny bool `yaml:"deny"`
+}
+
+// SSHUser overrides the emulated account of one username
+type SSHUser struct {
+	Username string `yaml:"username"`
+	// Home defaults to /root for root and /home/<username> for everyone else
+	Home string `yaml:"home"`
+	// Hostname defaults to the shell hostname
+	Hostname string `yaml:"hostname"`
+}
+
+// ForwardResponse is the canned answer to forwarded SSH connections for one destination port
+type ForwardResponse struct {
+	Port int `yaml:"port"`
+	// Banner is sent as soon as the channel opens, e.g. an SMTP greeting
+	Banner string `yaml:"banner"`
+	// Reply is sent after the first payload from the client, e.g. an HTTP response
+	Reply string `yaml:"reply"`
+}
+
+// CertPersona describes the self-signed certificate presented by TLS listeners.
+// It should look like the certificate of the emulated device.
+type CertPersona struct {
+	CommonName         string   `yaml:"common_name"`
+	Organization       string   `yaml:"organization"`
+	OrganizationalUnit string   `yaml:"organizational_unit"`
+	Country            string   `yaml:"country"`
+	Province           string   `yaml:"province"`
+	Locality           string   `yaml:"locality"`
+	DNSNames           []string `yaml:"dns_names"`
+	// IssuerCommonName and IssuerOrganization name the CA that appears to have signed the certificate
+	IssuerCommonName   string `yaml:"issuer_common_name"`
+	IssuerOrganization string `yaml:"issuer_organization"`
+	// ValidDays is the certificate lifetime; AgeDays backdates it so it does not look freshly minted
+	ValidDays int `yaml:"valid_days"`
+	AgeDays   int `yaml:"age_days"`
+}
+
+// RateLimitConfig caps how many connections the sensor accepts.
+// Zero values disable the corresponding limit.
+type RateLimitConfig struct {
+	// MaxConnections caps concurrent connections across all honeypots
+	MaxConnections int `yaml:"max_connections"`
+	// MaxConnectionsPerIP caps concurrent connections from one source
+	MaxConnectionsPerIP int `yaml:"max_connections_per_ip"`
+	// Rate is the number of new connections per second accepted across all honeypots
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+	// RatePerIP is the number of new connections per second accepted from one source
+	RatePerIP  float64 `yaml:"rate_per_ip"`
+	BurstPerIP int     `yaml:"burst_per_ip"`
+	// Action is what happens to connections over the limit: drop, delay or tarpit
+	Action string `yaml:"action"`
+	// MaxDelay is how long a delayed connection waits for capacity before it is dropped
+	MaxDelay time.Duration `yaml:"max_delay"`
+	// TarpitDuration is how long a tarpitted connection is held open
+	TarpitDuration time.Duration `yaml:"tarpit_duration"`
+	// MaxHeld caps the connections being delayed or tarpitted at once; the rest are dropped
+	MaxHeld int `yaml:"max_held"`
+}
+
 // Config represents the application configuration
 type Config struct {
 	Honeypots struct {
-		SSHPort    int `yaml:"ssh_port"`
-		HTTPPort   int `yaml:"http_port"`
-		FTPPort    int `yaml:"ftp_port"`
-		RDPPort    int `yaml:"rdp_port"`
-		SMBPort    int `yaml:"smb_port"`
-		ModbusPort int `yaml:"modbus_port"`
-		MQTTPort   int `yaml:"mqtt_port"`
+		// Enabled lists the honeypots to run on this sensor; empty means all registered
+		Enabled    []string `yaml:"enabled"`
+		SSHPort    int      `yaml:"ssh_port"`
+		HTTPPort   int      `yaml:"http_port"`
+		FTPPort    int      `yaml:"ftp_port"`
+		RDPPort    int      `yaml:"rdp_port"`
+		SMBPort    int      `yaml:"smb_port"`
+		ModbusPort int      `yaml:"modbus_port"`
+		MQTTPort   int      `yaml:"mqtt_port"`
+		// DrainTimeout is how long sessions may continue after shutdown before being cut off
+		DrainTimeout time.Duration `yaml:"drain_timeout"`
 	} `yaml:"honeypots"`
 
+	Listeners map[string]ListenerConfig `yaml:"listeners"`
+
+	// Persona picks the device profile every honeypot presents, so the banners
+	// and fingerprints of all services agree
+	Persona struct {
+		Name string `yaml:"name"`
+		// Dir holds custom profiles named <name>.yaml, which override built-in ones
+		Dir string `yaml:"dir"`
+	} `yaml:"persona"`
+
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
+
+	SSH struct {
+		// HostKeyDir holds the persistent SSH host keys
+		HostKeyDir string `yaml:"host_key_dir"`
+		// Shell lets the listed logins into an emulated Linux shell instead of rejecting every password
+		Shell struct {
+			Enabled  bool       `yaml:"enabled"`
+			Hostname string     `yaml:"hostname"`
+			Logins   []SSHLogin `yaml:"logins"`
+			Users    []SSHUser  `yaml:"users"`
+		} `yaml:"shell"`
+		// Auth decides which attempts beyond the shell logins get in, like cowrie's userdb
+		Auth struct {
+			// Rules are checked in order before anything else; the first match decides
+			Rules []AuthRule `yaml:"rules"`
+			// AcceptAfter lets an IP in once it has failed this many times (0 disables)
+			AcceptAfter int `yaml:"accept_after"`
+			// RandomPassword lets each IP in on a random attempt up to MaxAttempts and
+			// from then on only accepts the username and password that got it in
+			RandomPassword struct {
+				Enabled     bool `yaml:"enabled"`
+				MaxAttempts int  `yaml:"max_attempts"`
+			} `yaml:"random_password"`
+		} `yaml:"auth"`
+		// Forwarding accepts direct-tcpip channels and tcpip-forward requests from shell
+		// logins without ever connecting out, to see what attackers want to proxy to
+		Forwarding struct {
+			Enabled bool `yaml:"enabled"`
+			// CaptureBytes is how much of the first payload of a forwarded connection is kept
+			CaptureBytes int               `yaml:"capture_bytes"`
+			Responses    []ForwardResponse `yaml:"responses"`
+		} `yaml:"forwarding"`
+	} `yaml:"ssh"`
+
+	// HTTP serves fake web applications from app packs
+	HTTP struct {
+		// Apps are the packs to serve, in order of precedence; omitted uses the persona's
+		Apps []string `yaml:"apps"`
+		// AppDir holds custom packs named <name>.yaml, which override built-in ones
+		AppDir string `yaml:"app_dir"`
+		// MaxBodySize caps the captured and decoded body of a request
+		MaxBodySize int64 `yaml:"max_body_size"`
+	} `yaml:"http"`
+
+	// FTP configures the logins and data connections of the FTP honeypot
+	FTP struct {
+		// Anonymous lets the anonymous and ftp users in with any password, confined to /srv/ftp
+		Anonymous bool `yaml:"anonymous"`
+		// Logins get into the fake filesystem, starting in their home directory
+		Logins []FTPLogin `yaml:"logins"`
+		// PassivePorts are the first and last port of passive data connections; empty picks any free port
+		PassivePorts []int `yaml:"passive_ports"`
+		// MaxUploadSize caps the bytes read from a single upload
+		MaxUploadSize int64 `yaml:"max_upload_size"`
+		// MaxSessionSize caps the bytes all uploads of a session keep in its fake filesystem
+		MaxSessionSize int64 `yaml:"max_session_size"`
+	} `yaml:"ftp"`
+
+	// Modbus serves the register map of a PLC profile
+	Modbus struct {
+		// Profile names the PLC profile; omitted uses the persona's
+		Profile string `yaml:"profile"`
+		// ProfileDir holds custom profiles named <name>.yaml, which override built-in ones
+		ProfileDir string `yaml:"profile_dir"`
+		// Simulate drives the register values with the process model of the profile
+		Simulate bool `yaml:"simulate"`
+	} `yaml:"modbus"`
+
+	TLS struct {
+		// CertDir persists the generated certificates across restarts
+		CertDir string      `yaml:"cert_dir"`
+		Persona CertPersona `yaml:"persona"`
+		// Clients names the tools behind JA4 or JA3 fingerprints, e.g. a
+		// scanner seen in the wild; they extend the built-in table
+		Clients map[string]string `yaml:"clients"`
+	} `yaml:"tls"`
+
+	// UDP bounds the per-source pseudo-sessions of datagram honeypots
+	UDP struct {
+		IdleTimeout     time.Duration `yaml:"idle_timeout"`
+		MaxSessions     int           `yaml:"max_sessions"`
+		MaxResponseSize int           `yaml:"max_response_size"`
+		// MaxAmplification caps bytes sent to a source relative to bytes received from it
+		MaxAmplification float64 `yaml:"max_amplification"`
+	} `yaml:"udp"`
+
 	Database struct {
 		Host     string `yaml:"host"`
 		Port     int    `yaml:"port"`
@@ -40,6 +234,42 @@ type Config struct {
 	API struct {
 		Port int `yaml:"port"`
 	} `yaml:"api"`
+
+	Recording struct {
+		// Enabled captures the full byte stream of every honeypot session
+		Enabled bool   `yaml:"enabled"`
+		Dir     string `yaml:"dir"`
+		// MaxBytes caps the captured payload per session (0 means unlimited)
+		MaxBytes int64 `yaml:"max_bytes"`
+	} `yaml:"recording"`
+
+	// Quarantine stores files uploaded by attackers, keyed by SHA-256
+	Quarantine struct {
+		Dir string `yaml:"dir"`
+		// MaxFileSize caps the stored size of a single upload (0 means unlimited)
+		MaxFileSize int64 `yaml:"max_file_size"`
+		// MaxTotalSize caps all stored samples; the least recently seen are evicted (0 means unlimited)
+		MaxTotalSize int64 `yaml:"max_total_size"`
+	} `yaml:"quarantine"`
+
+	Events struct {
+		// BufferSize is the per-subscriber event queue length
+		BufferSize int `yaml:"buffer_size"`
+	} `yaml:"events"`
+
+	// Classification tags events with attack types and a severity before they are stored
+	Classification struct {
+		// Rules is a YAML rule file added to the built-in rules; a rule with the id
+		// of a built-in one replaces it
+		Rules string `yaml:"rules"`
+	} `yaml:"classification"`
+
+	Supervisor struct {
+		InitialBackoff time.Duration `yaml:"initial_backoff"`
+		MaxBackoff     time.Duration `yaml:"max_backoff"`
+		MaxRestarts    int           `yaml:"max_restarts"`
+		RestartWindow  time.Duration `yaml:"restart_window"`
+	} `yaml:"supervisor"`
 }
 
 // LoadConfig reads the configuration file and returns a Config struct
@@ -70,6 +300,84 @@ func LoadConfig() (*Config, error) {
 	if config.API.Port == 0 {
 		config.API.Port = 8000
 	}
+	if config.Recording.Dir == "" {
+		config.Recording.Dir = "data/sessions"
+	}
+	if config.Quarantine.Dir == "" {
+		config.Quarantine.Dir = "data/quarantine"
+	}
+	if config.Quarantine.MaxFileSize == 0 {
+		config.Quarantine.MaxFileSize = 64 << 20
+	}
+	if config.Quarantine.MaxTotalSize == 0 {
+		config.Quarantine.MaxTotalSize = 4 << 30
+	}
+	if config.SSH.HostKeyDir == "" {
+		config.SSH.HostKeyDir = "data/ssh"
+	}
+	if config.SSH.Forwarding.CaptureBytes == 0 {
+		config.SSH.Forwarding.CaptureBytes = 4096
+	}
+	if config.SSH.Auth.RandomPassword.MaxAttempts == 0 {
+		config.SSH.Auth.RandomPassword.MaxAttempts = 5
+	}
+	if config.HTTP.AppDir == "" {
+		config.HTTP.AppDir = "config/apps"
+	}
+	if config.HTTP.MaxBodySize == 0 {
+		config.HTTP.MaxBodySize = 1 << 20
+	}
+	if config.Modbus.ProfileDir == "" {
+		config.Modbus.ProfileDir = "config/plc"
+	}
+	if config.Persona.Dir == "" {
+		config.Persona.Dir = "config/personas"
+	}
+	if config.FTP.MaxUploadSize == 0 {
+		config.FTP.MaxUploadSize = 16 << 20
+	}
+	if config.Classification.Rules == "" {
+		config.Classification.Rules = "config/classification.yaml"
+	}
+	if config.TLS.CertDir == "" {
+		config.TLS.CertDir = "data/certs"
+	}
+	if config.TLS.Persona.CommonName == "" {
+		config.TLS.Persona.CommonName = "localhost"
+	}
+	if config.TLS.Persona.ValidDays == 0 {
+		config.TLS.Persona.ValidDays = 3650
+	}
+	if config.Events.BufferSize == 0 {
+		config.Events.BufferSize = 1024
+	}
+	if config.Honeypots.DrainTimeout == 0 {
+		config.Honeypots.DrainTimeout = 10 * time.Second
+	}
+	if config.RateLimit.Action == "" {
+		config.RateLimit.Action = "drop"
+	}
+	if config.RateLimit.MaxDelay == 0 {
+		config.RateLimit.MaxDelay = 5 * time.Second
+	}
+	if config.RateLimit.TarpitDuration == 0 {
+		config.RateLimit.TarpitDuration = 2 * time.Minute
+	}
+	if config.RateLimit.MaxHeld == 0 {
+		config.RateLimit.MaxHeld = 256
+	}
+	if config.Supervisor.InitialBackoff == 0 {
+		config.Supervisor.InitialBackoff = time.Second
+	}
+	if config.Supervisor.MaxBackoff == 0 {
+		config.Supervisor.MaxBackoff = time.Minute
+	}
+	if config.Supervisor.MaxRestarts == 0 {
+		config.Supervisor.MaxRestarts = 5
+	}
+	if config.Supervisor.RestartWindow == 0 {
+		config.Supervisor.RestartWindow = 10 * time.Minute
+	}
 
 	return &config, nil
 }
@@ -3,10 +3,14 @@ package db
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"shadownet/config"
 	"shadownet/types"
 	"shadownet/utils"
+	"sort"
+	"strings"
+	"time"
 
 	_ "github.com/jackc/pgx/v5/stdlib"
 )
@@ -71,13 +75,43 @@ func InitTestDB() error {
             ip_address TEXT NOT NULL,
             details TEXT,
             timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
-            session_duration INTEGER DEFAULT 0
+            session_duration INTEGER DEFAULT 0,
+            severity INTEGER DEFAULT 1
         )
     `)
     if err != nil {
         return fmt.Errorf("failed to create attacks table: %v", err)
     }
 
+    _, err = db.ExecContext(ctx, `
+        CREATE TABLE events (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            session_id TEXT,
+            service TEXT NOT NULL,
+            event_kind TEXT NOT NULL,
+            src_ip TEXT NOT NULL,
+            src_port INTEGER,
+            dst_ip TEXT,
+            dst_port INTEGER,
+            username TEXT,
+            password TEXT,
+            auth_method TEXT,
+            key_type TEXT,
+            key_fingerprint TEXT,
+            hassh TEXT,
+            hassh_server TEXT,
+            ja3 TEXT,
+            ja4 TEXT,
+            payload BLOB,
+            details TEXT,
+            fields TEXT,
+            timestamp DATETIME DEFAULT CURRENT_TIMESTAMP
+        )
+    `)
+    if err != nil {
+        return fmt.Errorf("failed to create events table: %v", err)
+    }
+
     _, err = db.ExecContext(ctx, `
         CREATE TABLE threat_intel (
             id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -153,6 +187,190 @@ func Connect() error {
     return nil
 }
 
+// recordTimeout bounds how long RecordEvent waits on the database, so a hung
+// server backs up the event queue for a while instead of for good
+const recordTimeout = 10 * time.Second
+
+// FingerprintFields are the event fields stored in their own indexed columns
+var FingerprintFields = []string{"hassh", "hassh_server", "ja3", "ja4"}
+
+// RecordEvent stores a structured honeypot event, and an attack row for each
+// attack type the classifier found in it
+func RecordEvent(db *sql.DB, ev types.Event) error {
+    if db == nil {
+        return fmt.Errorf("database connection not initialized")
+    }
+
+    var creds types.Credentials
+    if ev.Credentials != nil {
+        creds = *ev.Credentials
+    }
+
+    fields := ""
+    if len(ev.Fields) > 0 {
+        encoded, err := json.Marshal(ev.Fields)
+        if err != nil {
+            return fmt.Errorf("failed to encode event fields: %v", err)
+        }
+        fields = string(encoded)
+    }
+
+    // Fingerprints get their own columns so sessions can be looked up by index
+    fingerprints := make([]interface{}, len(FingerprintFields))
+    for i, field := range FingerprintFields {
+        if v := ev.Fields[field]; v != "" {
+            fingerprints[i] = v
+        }
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), recordTimeout)
+    defer cancel()
+    _, err := db.ExecContext(ctx,
+        `INSERT INTO events
+        (session_id, service, event_kind, src_ip, src_port, dst_ip, dst_port,
+         username, password, auth_method, key_type, key_fingerprint,
+         hassh, hassh_server, ja3, ja4,
+         payload, details, fields, timestamp)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20)`,
+        ev.SessionID, ev.Service, string(ev.Kind),
+        ev.Src.IP, ev.Src.Port, ev.Dst.IP, ev.Dst.Port,
+        creds.Username, creds.Password, creds.Method, creds.KeyType, creds.KeyFingerprint,
+        fingerprints[0], fingerprints[1], fingerprints[2], fingerprints[3],
+        ev.Payload, ev.Details, fields, ev.Timestamp,
+    )
+    if err != nil {
+        return fmt.Errorf("failed to record event: %v", err)
+    }
+
+    // Keep the attacks table populated for the summary views and the AI trainer.
+    // Connections, reads and other events nobody classified are not attacks.
+    severity, ok := types.SeverityLevel(ev.Fields[types.FieldSeverity])
+    if !ok {
+        severity = 1
+    }
+    for _, attackType := range types.AttackTypesOf(ev) {
+        _, err = db.ExecContext(ctx,
+            "INSERT INTO attacks (ip_address, attack_type, details, severity, timestamp) VALUES ($1, $2, $3, $4, $5)",
+            ev.Src.IP, attackType, ev.Details, severity, ev.Timestamp,
+        )
+        if err != nil {
+            return fmt.Errorf("failed to record attack: %v", err)
+        }
+    }
+    return nil
+}
+
+// FindSessionsByField returns the most recent sessions with an event whose fingerprint
+// field key equals value, such as every SSH session with a given HASSH fingerprint
+func FindSessionsByField(db *sql.DB, key, value string, limit int) ([]types.SessionSummary, error) {
+    if db == nil {
+        return nil, fmt.Errorf("database connection not initialized")
+    }
+    if !isFingerprintField(key) {
+        return nil, fmt.Errorf("sessions cannot be looked up by %q", key)
+    }
+
+    // Pick the sessions in SQL so only their events are loaded. The column name
+    // comes from FingerprintFields, never from the caller.
+    limitClause := ""
+    if limit > 0 {
+        limitClause = fmt.Sprintf(" LIMIT %d", limit)
+    }
+    ctx := context.Background()
+    rows, err := db.QueryContext(ctx, `
+        SELECT session_id, service, src_ip, fields, timestamp
+        FROM events
+        WHERE session_id IN (
+            SELECT session_id FROM events
+            WHERE `+key+` = $1 AND session_id <> ''
+            GROUP BY session_id
+            ORDER BY MAX(timestamp) DESC`+limitClause+`
+        )
+        ORDER BY timestamp`,
+        value,
+    )
+    if err != nil {
+        return nil, fmt.Errorf("failed to query sessions: %v", err)
+    }
+    defer rows.Close()
+
+    var order []string
+    sessions := make(map[string]*types.SessionSummary)
+    for rows.Next() {
+        var sessionID, service, srcIP string
+        var fields sql.NullString
+        var timestamp time.Time
+        if err := rows.Scan(&sessionID, &service, &srcIP, &fields, &timestamp); err != nil {
+            return nil, fmt.Errorf("failed to read session event: %v", err)
+        }
+
+        summary := sessions[sessionID]
+        if summary == nil {
+            summary = &types.SessionSummary{
+                SessionID: sessionID,
+                Service:   service,
+                SrcIP:     srcIP,
+                FirstSeen: timestamp,
+                Fields:    make(map[string]string),
+            }
+            sessions[sessionID] = summary
+            order = append(order, sessionID)
+        }
+        summary.LastSeen = timestamp
+        summary.Events++
+
+        if fields.String != "" {
+            var decoded map[string]string
+            if err := json.Unmarshal([]byte(fields.String), &decoded); err == nil {
+                for k, v := range decoded {
+                    if _, ok := summary.Fields[k]; !ok {
+                        summary.Fields[k] = v
+                    }
+                }
+            }
+        }
+    }
+    if err := rows.Err(); err != nil {
+        return nil, fmt.Errorf("failed to query sessions: %v", err)
+    }
+
+    // Newest sessions first
+    result := make([]types.SessionSummary, 0, len(order))
+    for _, sessionID := range order {
+        result = append(result, *sessions[sessionID])
+    }
+    sort.SliceStable(result, func(i, j int) bool {
+        return result[i].LastSeen.After(result[j].LastSeen)
+    })
+    return result, nil
+}
+
+func isFingerprintField(key string) bool {
+    for _, field := range FingerprintFields {
+        if field == key {
+            return true
+        }
+    }
+    return false
+}
+
+// EventWriter is an event bus subscriber that persists every event
+type EventWriter struct {
+    DB *sql.DB
+}
+
+// NewEventWriter creates a writer for the given database
+func NewEventWriter(db *sql.DB) *EventWriter {
+    return &EventWriter{DB: db}
+}
+
+// HandleEvent stores the event, logging failures instead of blocking the bus
+func (w *EventWriter) HandleEvent(ev types.Event) {
+    if err := RecordEvent(w.DB, ev); err != nil {
+        utils.Log.Errorf("Failed to store %s event from %s: %v", ev.Service, ev.Src.IP, err)
+    }
+}
+
 // LogAttack records attack attempts with proper error handling
 func LogAttack(ip, attackType, details string) error {
     if dbInstance == nil {
@@ -221,13 +439,65 @@ func Migrate() error {
             ip_address TEXT NOT NULL,
             details TEXT,
             timestamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-            session_duration INTEGER DEFAULT 0
+            session_duration INTEGER DEFAULT 0,
+            severity INTEGER DEFAULT 1
         )
     `)
     if err != nil {
         return fmt.Errorf("failed to create attacks table: %v", err)
     }
 
+    // Databases created before classification lack the severity column
+    _, err = dbInstance.ExecContext(ctx, "ALTER TABLE attacks ADD COLUMN severity INTEGER DEFAULT 1")
+    if err != nil && !strings.Contains(err.Error(), "already exists") && !strings.Contains(err.Error(), "duplicate column") {
+        return fmt.Errorf("failed to add attacks.severity column: %v", err)
+    }
+
+    // Create events table if it doesn't exist
+    _, err = dbInstance.ExecContext(ctx, `
+        CREATE TABLE IF NOT EXISTS events (
+            id SERIAL PRIMARY KEY,
+            session_id TEXT,
+            service TEXT NOT NULL,
+            event_kind TEXT NOT NULL,
+            src_ip TEXT NOT NULL,
+            src_port INTEGER,
+            dst_ip TEXT,
+            dst_port INTEGER,
+            username TEXT,
+            password TEXT,
+            auth_method TEXT,
+            key_type TEXT,
+            key_fingerprint TEXT,
+            hassh TEXT,
+            hassh_server TEXT,
+            ja3 TEXT,
+            ja4 TEXT,
+            payload BYTEA,
+            details TEXT,
+            fields TEXT,
+            timestamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+        )
+    `)
+    if err != nil {
+        return fmt.Errorf("failed to create events table: %v", err)
+    }
+
+    // Databases created before credential capture lack the authentication and fingerprint columns.
+    // SQLite has no ADD COLUMN IF NOT EXISTS, so an existing column is detected from the error.
+    for _, column := range append([]string{"auth_method", "key_type", "key_fingerprint"}, FingerprintFields...) {
+        _, err = dbInstance.ExecContext(ctx, "ALTER TABLE events ADD COLUMN "+column+" TEXT")
+        if err != nil && !strings.Contains(err.Error(), "already exists") && !strings.Contains(err.Error(), "duplicate column") {
+            return fmt.Errorf("failed to add events.%s column: %v", column, err)
+        }
+    }
+    for _, column := range FingerprintFields {
+        _, err = dbInstance.ExecContext(ctx, "CREATE INDEX IF NOT EXISTS idx_events_"+column+" ON events("+column+")")
+        if err != nil {
+            return fmt.Errorf("failed to index events.%s: %v", column, err)
+        }
+    }
+
     // Create threat_intel table if it doesn't exist
     _, err = dbInstance.ExecContext(ctx, `
         CREATE TABLE IF NOT EXISTS threat_intel (
@@ -96,3 +96,164 @@ func TestGetLatestAttack(t *testing.T) {
     assert.Equal(t, types.AttackTypeSQLInjection, latest.Type)
     assert.Equal(t, "Second attack", latest.Details)
 }
+
+func TestRecordEvent(t *testing.T) {
+    // Initialize test database
+    err := InitTestDB()
+    assert.NoError(t, err)
+    defer GetTestDB().Close()
+
+    ev := types.Event{
+        SessionID:   "a1b2c3d4",
+        Service:     "ftp",
+        Kind:        types.EventLogin,
+        Src:         types.Endpoint{IP: "203.0.113.7", Port: 51234},
+        Dst:         types.Endpoint{IP: "10.0.0.10", Port: 21},
+        Credentials: &types.Credentials{Username: "admin", Password: "admin123"},
+        Details:     "user:admin,pass:admin123",
+        Fields:      map[string]string{"client": "ncftp"},
+        Timestamp:   time.Now(),
+    }
+    err = RecordEvent(GetTestDB(), ev)
+    assert.NoError(t, err)
+
+    // Verify the structured event was stored
+    var sessionID, kind, srcIP, username, password, fields string
+    var srcPort int
+    err = GetTestDB().QueryRow(
+        "SELECT session_id, event_kind, src_ip, src_port, username, password, fields FROM events",
+    ).Scan(&sessionID, &kind, &srcIP, &srcPort, &username, &password, &fields)
+    assert.NoError(t, err)
+    assert.Equal(t, "a1b2c3d4", sessionID)
+    assert.Equal(t, "login", kind)
+    assert.Equal(t, "203.0.113.7", srcIP)
+    assert.Equal(t, 51234, srcPort)
+    assert.Equal(t, "admin", username)
+    assert.Equal(t, "admin123", password)
+    assert.JSONEq(t, `{"client":"ncftp"}`, fields)
+
+    // An event the classifier did not flag is not an attack
+    var attacks int
+    err = GetTestDB().QueryRow("SELECT COUNT(*) FROM attacks").Scan(&attacks)
+    assert.NoError(t, err)
+    assert.Zero(t, attacks)
+}
+
+func TestRecordEventClassified(t *testing.T) {
+    err := InitTestDB()
+    assert.NoError(t, err)
+    defer GetTestDB().Close()
+
+    ev := types.Event{
+        Service: "http",
+        Kind:    types.EventRequest,
+        Src:     types.Endpoint{IP: "198.51.100.4", Port: 40000},
+        Details: "GET /?id=1%20UNION%20SELECT%20password%20FROM%20users HTTP/1.1",
+        Fields: map[string]string{
+            types.FieldAttackTypes: "sql_injection,xss",
+            types.FieldSeverity:    "high",
+        },
+        Timestamp: time.Now(),
+    }
+    err = RecordEvent(GetTestDB(), ev)
+    assert.NoError(t, err)
+
+    // Every attack type gets its own row
+    rows, err := GetTestDB().Query("SELECT attack_type FROM attacks ORDER BY id")
+    assert.NoError(t, err)
+    defer rows.Close()
+    var attackTypes []string
+    for rows.Next() {
+        var attackType string
+        assert.NoError(t, rows.Scan(&attackType))
+        attackTypes = append(attackTypes, attackType)
+    }
+    assert.Equal(t, []string{types.AttackTypeSQLInjection, types.AttackTypeXSS}, attackTypes)
+
+    // The classified severity lands in the severity column, 3 being high
+    var severity int
+    err = GetTestDB().QueryRow("SELECT MIN(severity) FROM attacks").Scan(&severity)
+    assert.NoError(t, err)
+    assert.Equal(t, 3, severity)
+}
+
+func TestRecordEventPublicKey(t *testing.T) {
+    err := InitTestDB()
+    assert.NoError(t, err)
+    defer GetTestDB().Close()
+
+    ev := types.Event{
+        Service: "ssh",
+        Kind:    types.EventLogin,
+        Src:     types.Endpoint{IP: "203.0.113.7", Port: 40022},
+        Credentials: &types.Credentials{
+            Username:       "root",
+            Method:         types.AuthPublicKey,
+            KeyType:        "ssh-rsa",
+            KeyFingerprint: "SHA256:mVPwvezndPv/ARoIadVY98vAC0g+P/5633yTC4d/wXE",
+        },
+        Timestamp: time.Now(),
+    }
+    err = RecordEvent(GetTestDB(), ev)
+    assert.NoError(t, err)
+
+    var method, keyType, fingerprint string
+    err = GetTestDB().QueryRow(
+        "SELECT auth_method, key_type, key_fingerprint FROM events",
+    ).Scan(&method, &keyType, &fingerprint)
+    assert.NoError(t, err)
+    assert.Equal(t, "publickey", method)
+    assert.Equal(t, "ssh-rsa", keyType)
+    assert.Equal(t, "SHA256:mVPwvezndPv/ARoIadVY98vAC0g+P/5633yTC4d/wXE", fingerprint)
+}
+
+func TestFindSessionsByField(t *testing.T) {
+    err := InitTestDB()
+    assert.NoError(t, err)
+    defer GetTestDB().Close()
+
+    start := time.Now().Add(-time.Hour)
+    record := func(session string, offset time.Duration, kind types.EventKind, fields map[string]string) {
+        err := RecordEvent(GetTestDB(), types.Event{
+            SessionID: session,
+            Service:   "ssh",
+            Kind:      kind,
+            Src:       types.Endpoint{IP: "203.0.113.7", Port: 40022},
+            Fields:    fields,
+            Timestamp: start.Add(offset),
+        })
+        assert.NoError(t, err)
+    }
+    record("s1", 0, types.EventConnect, map[string]string{"hassh": "ec7378c1a92f5a8dde7e8b7a1ddf33d1"})
+    record("s1", time.Second, types.EventLogin, map[string]string{"hassh": "ec7378c1a92f5a8dde7e8b7a1ddf33d1", "result": "rejected"})
+    record("s2", time.Minute, types.EventConnect, map[string]string{"hassh": "b5752e36ba6c5979a575e43178908adf"})
+    record("s3", 2*time.Minute, types.EventConnect, map[string]string{"hassh": "ec7378c1a92f5a8dde7e8b7a1ddf33d1"})
+
+    sessions, err := FindSessionsByField(GetTestDB(), "hassh", "ec7378c1a92f5a8dde7e8b7a1ddf33d1", 10)
+    assert.NoError(t, err)
+    if assert.Len(t, sessions, 2) {
+        assert.Equal(t, "s3", sessions[0].SessionID)
+        assert.Equal(t, "s1", sessions[1].SessionID)
+        assert.Equal(t, 2, sessions[1].Events)
+        assert.Equal(t, "rejected", sessions[1].Fields["result"])
+        assert.True(t, sessions[1].LastSeen.After(sessions[1].FirstSeen))
+    }
+
+    sessions, err = FindSessionsByField(GetTestDB(), "hassh", "ec7378c1a92f5a8dde7e8b7a1ddf33d1", 1)
+    assert.NoError(t, err)
+    if assert.Len(t, sessions, 1) {
+        assert.Equal(t, "s3", sessions[0].SessionID)
+    }
+
+    var indexed int
+    err = GetTestDB().QueryRow("SELECT COUNT(*) FROM events WHERE hassh = $1", "ec7378c1a92f5a8dde7e8b7a1ddf33d1").Scan(&indexed)
+    assert.NoError(t, err)
+    assert.Equal(t, 3, indexed)
+
+    _, err = FindSessionsByField(GetTestDB(), "result", "rejected", 10)
+    assert.Error(t, err)
+
+    sessions, err = FindSessionsByField(GetTestDB(), "hassh", "%", 10)
+    assert.NoError(t, err)
+    assert.Empty(t, sessions)
+}
@@ -0,0 +1,183 @@
+package events
+
+import (
+	"shadownet/types"
+	"shadownet/utils"
+	"sync"
+	"sync/atomic"
+)
+
+// Subscriber receives every event published on a Bus
+type Subscriber interface {
+    HandleEvent(ev types.Event)
+}
+
+// SubscriberFunc adapts a plain function to the Subscriber interface
+type SubscriberFunc func(ev types.Event)
+
+// HandleEvent calls f(ev)
+func (f SubscriberFunc) HandleEvent(ev types.Event) {
+    f(ev)
+}
+
+// Stage rewrites an event before subscribers see it, e.g. to classify it
+type Stage func(ev *types.Event)
+
+// subscription is a subscriber with its own delivery queue
+type subscription struct {
+    name    string
+    sub     Subscriber
+    queue   chan types.Event
+    dropped uint64
+    // blocking makes Publish wait for room in the queue instead of dropping
+    blocking bool
+}
+
+// Bus fans out honeypot events to subscribers.
+// Each subscriber gets its own buffered queue so a slow consumer never blocks a
+// honeypot, except blocking subscribers that must see every event.
+type Bus struct {
+    buffer int
+    stages []Stage
+    subs   []*subscription
+    closed bool
+    // closing releases publishers waiting on a blocking subscriber at shutdown
+    closing chan struct{}
+    // publishing counts the Publish calls in flight, which Close waits for
+    publishing sync.WaitGroup
+    mu         sync.RWMutex
+    wg         sync.WaitGroup
+}
+
+// NewBus creates an event bus with the given per-subscriber queue size
+func NewBus(buffer int) *Bus {
+    if buffer <= 0 {
+        buffer = 1024
+    }
+    return &Bus{buffer: buffer, closing: make(chan struct{})}
+}
+
+// Subscribe registers a subscriber under a name used in logs and drop counters.
+// Events are dropped for it while its queue is full.
+func (b *Bus) Subscribe(name string, sub Subscriber) {
+    b.subscribe(name, sub, false)
+}
+
+// SubscribeBlocking registers a subscriber that never misses an event, such as
+// the database writer. Publish waits while its queue is full, so a stalled
+// subscriber slows the honeypots down instead of losing events.
+func (b *Bus) SubscribeBlocking(name string, sub Subscriber) {
+    b.subscribe(name, sub, true)
+}
+
+// subscribe adds a subscription and starts its delivery goroutine
+func (b *Bus) subscribe(name string, sub Subscriber, blocking bool) {
+    s := &subscription{
+        name:     name,
+        sub:      sub,
+        queue:    make(chan types.Event, b.buffer),
+        blocking: blocking,
+    }
+
+    b.mu.Lock()
+    if b.closed {
+        b.mu.Unlock()
+        return
+    }
+    b.subs = append(b.subs, s)
+    b.wg.Add(1)
+    b.mu.Unlock()
+
+    go b.deliver(s)
+}
+
+// Use adds a stage that every published event passes through, in the order added.
+// Stages run on the publishing goroutine, outside the bus lock, so they must be quick.
+func (b *Bus) Use(stage Stage) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    b.stages = append(b.stages, stage)
+}
+
+// deliver feeds queued events to a subscriber until the bus is closed
+func (b *Bus) deliver(s *subscription) {
+    defer b.wg.Done()
+    for ev := range s.queue {
+        func() {
+            defer func() {
+                if r := recover(); r != nil {
+                    utils.Log.Errorf("Event subscriber %s panic: %v", s.name, r)
+                }
+            }()
+            s.sub.HandleEvent(ev)
+        }()
+    }
+}
+
+// Publish hands an event to every subscriber. Events are dropped for subscribers
+// whose queue is full, except blocking ones, which Publish waits for until the
+// bus is closed. The bus lock is not held while waiting, so Close never blocks on it.
+func (b *Bus) Publish(ev types.Event) {
+    b.mu.RLock()
+    if b.closed {
+        b.mu.RUnlock()
+        return
+    }
+    stages, subs := b.stages, b.subs
+    b.publishing.Add(1)
+    b.mu.RUnlock()
+    defer b.publishing.Done()
+
+    for _, stage := range stages {
+        stage(&ev)
+    }
+    for _, s := range subs {
+        if s.blocking {
+            select {
+            case s.queue <- ev:
+            case <-b.closing:
+                atomic.AddUint64(&s.dropped, 1)
+            }
+            continue
+        }
+        select {
+        case s.queue <- ev:
+        default:
+            if atomic.AddUint64(&s.dropped, 1) == 1 {
+                utils.Log.Warningf("Event subscriber %s is falling behind, dropping events", s.name)
+            }
+        }
+    }
+}
+
+// Dropped returns the number of events dropped per subscriber
+func (b *Bus) Dropped() map[string]uint64 {
+    b.mu.RLock()
+    defer b.mu.RUnlock()
+
+    dropped := make(map[string]uint64, len(b.subs))
+    for _, s := range b.subs {
+        dropped[s.name] = atomic.LoadUint64(&s.dropped)
+    }
+    return dropped
+}
+
+// Close stops accepting events and waits until subscribers have drained their queues.
+// Publishers still waiting on a blocking subscriber give up their event.
+func (b *Bus) Close() {
+    b.mu.Lock()
+    if b.closed {
+        b.mu.Unlock()
+        return
+    }
+    b.closed = true
+    subs := b.subs
+    b.mu.Unlock()
+
+    close(b.closing)
+    b.publishing.Wait()
+    for _, s := range subs {
+        close(s.queue)
+    }
+    b.wg.Wait()
+}
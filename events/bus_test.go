@@ -0,0 +1,147 @@
+package events
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"shadownet/types"
+	"shadownet/utils"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// collector records every event it receives
+type collector struct {
+    mu     sync.Mutex
+    events []types.Event
+}
+
+func (c *collector) HandleEvent(ev types.Event) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.events = append(c.events, ev)
+}
+
+func TestBusFansOutToEverySubscriber(t *testing.T) {
+    utils.InitTestLogger()
+
+    bus := NewBus(16)
+    first, second := &collector{}, &collector{}
+    bus.Subscribe("first", first)
+    bus.Subscribe("second", second)
+
+    for i := 0; i < 10; i++ {
+        bus.Publish(types.Event{Service: "ssh", Kind: types.EventLogin})
+    }
+    bus.Close()
+
+    assert.Len(t, first.events, 10)
+    assert.Len(t, second.events, 10)
+    assert.Equal(t, map[string]uint64{"first": 0, "second": 0}, bus.Dropped())
+}
+
+func TestBusDropsInsteadOfBlocking(t *testing.T) {
+    utils.InitTestLogger()
+
+    bus := NewBus(1)
+    release := make(chan struct{})
+    bus.Subscribe("slow", SubscriberFunc(func(ev types.Event) { <-release }))
+
+    for i := 0; i < 5; i++ {
+        bus.Publish(types.Event{Service: "http"})
+    }
+    close(release)
+    bus.Close()
+
+    assert.NotZero(t, bus.Dropped()["slow"])
+
+    // Publishing after Close is a no-op
+    bus.Publish(types.Event{Service: "http"})
+}
+
+func TestBlockingSubscriberSeesEveryEvent(t *testing.T) {
+    utils.InitTestLogger()
+
+    bus := NewBus(1)
+    release := make(chan struct{})
+    db := &collector{}
+    bus.SubscribeBlocking("db", SubscriberFunc(func(ev types.Event) {
+        <-release
+        db.HandleEvent(ev)
+    }))
+    bus.Subscribe("slow", SubscriberFunc(func(ev types.Event) { <-release }))
+
+    published := make(chan struct{})
+    go func() {
+        for i := 0; i < 5; i++ {
+            bus.Publish(types.Event{Service: "http"})
+        }
+        close(published)
+    }()
+
+    // Publish waits for the full queue instead of dropping
+    select {
+    case <-published:
+        t.Fatal("publish did not wait for the blocking subscriber")
+    case <-time.After(50 * time.Millisecond):
+    }
+    close(release)
+    <-published
+    bus.Close()
+
+    assert.Len(t, db.events, 5)
+    assert.Zero(t, bus.Dropped()["db"])
+    assert.NotZero(t, bus.Dropped()["slow"])
+}
+
+func TestCloseReleasesPublishersOfAStalledSubscriber(t *testing.T) {
+    utils.InitTestLogger()
+
+    bus := NewBus(1)
+    release := make(chan struct{})
+    bus.SubscribeBlocking("db", SubscriberFunc(func(ev types.Event) { <-release }))
+
+    published := make(chan struct{})
+    go func() {
+        for i := 0; i < 3; i++ {
+            bus.Publish(types.Event{Service: "http"})
+        }
+        close(published)
+    }()
+    time.Sleep(50 * time.Millisecond)
+
+    // Other readers of the bus are not held up by the waiting publisher
+    assert.Len(t, bus.Dropped(), 1)
+
+    closed := make(chan struct{})
+    go func() {
+        bus.Close()
+        close(closed)
+    }()
+    select {
+    case <-published:
+    case <-time.After(time.Second):
+        t.Fatal("Close did not release the waiting publisher")
+    }
+    close(release)
+    <-closed
+    assert.NotZero(t, bus.Dropped()["db"])
+}
+
+func TestBusStagesRunBeforeSubscribers(t *testing.T) {
+    utils.InitTestLogger()
+
+    bus := NewBus(4)
+    sink := &collector{}
+    bus.Subscribe("sink", sink)
+    bus.Use(func(ev *types.Event) { ev.Fields = map[string]string{"stage": "first"} })
+    bus.Use(func(ev *types.Event) { ev.Fields["stage"] += ",second" })
+
+    bus.Publish(types.Event{Service: "http"})
+    bus.Close()
+
+    if assert.Len(t, sink.events, 1) {
+        assert.Equal(t, "first,second", sink.events[0].Fields["stage"])
+    }
+}
@@ -3,12 +3,47 @@ package honeypot
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"net"
+	"shadownet/events"
+	"shadownet/persona"
+	"shadownet/quarantine"
+	"shadownet/recording"
+	"shadownet/shell"
+	"shadownet/types"
 	"shadownet/utils"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
+// State describes where a honeypot is in its lifecycle
+type State string
+
+const (
+    StateStopped    State = "stopped"
+    StateStarting   State = "starting"
+    StateListening  State = "listening"
+    StateFailed     State = "failed"
+    StateBackingOff State = "backing-off"
+)
+
+// Honeypot is the common interface implemented by every protocol emulator
+type Honeypot interface {
+    // Name returns the human readable service name, e.g. "SSH"
+    Name() string
+    // Start binds the listener and serves connections until ctx is cancelled or Stop is called
+    Start(ctx context.Context) error
+    // Stop closes the listener
+    Stop() error
+    // Addr returns the bound listener address, or nil when not listening
+    Addr() net.Addr
+    // Status reports the current lifecycle state
+    Status() State
+}
+
 // HoneypotConnection represents a connection to a honeypot
 type HoneypotConnection struct {
     IP        string
@@ -20,92 +55,509 @@ type HoneypotConnection struct {
 
 // BaseHoneypot provides common functionality for all honeypots
 type BaseHoneypot struct {
-    Name     string
     Port     int
     Listener net.Listener
     Timeout  time.Duration
     DB       *sql.DB
+    Handler  func(net.Conn)
+    // DrainTimeout is how long active sessions may continue after shutdown before being force-closed
+    DrainTimeout time.Duration
+    // Events receives every structured event the honeypot observes
+    Events *events.Bus
+    // RecordMode selects how recorded sessions of this service are replayed
+    RecordMode recording.Mode
+    // RecordDecoded makes the handler record decoded data with Session.RecordOutput
+    // instead of the raw socket bytes, e.g. the plaintext of an encrypted SSH channel
+    RecordDecoded bool
+    // Network is NetworkTCP or NetworkUDP; datagram sources are served as pseudo-sessions
+    Network string
+
+    name     string
+    state    State
+    observer func(State)
+    sessions map[*Session]struct{}
+    cutOff   int
+    record   recordSettings
+    proxy    proxySettings
+    limiter  *Limiter
+    packet   packetSettings
+    tls      tlsSettings
+    // quarantine keeps files uploaded by attackers, nil when not configured
+    quarantine *quarantine.Store
+    // persona supplies the banners and fingerprints the honeypot presents
+    persona *persona.Persona
+    mu         sync.RWMutex
 }
 
 // NewBaseHoneypot creates a new base honeypot instance
 func NewBaseHoneypot(name string, port int, db *sql.DB) *BaseHoneypot {
     return &BaseHoneypot{
-        Name:    name,
-        Port:    port,
-        DB:      db,
-        Timeout: 30 * time.Second,
+        name:         name,
+        Port:         port,
+        DB:           db,
+        Timeout:      30 * time.Second,
+        DrainTimeout: 10 * time.Second,
+        Network:      NetworkTCP,
+        state:        StateStopped,
+        sessions:     make(map[*Session]struct{}),
+        packet:       defaultPacketSettings,
+        persona:      persona.Default(),
+    }
+}
+
+// recordSettings controls full session capture
+type recordSettings struct {
+    enabled  bool
+    dir      string
+    maxBytes int64
+}
+
+// Base returns the embedded base honeypot so the registry can apply shared settings
+func (b *BaseHoneypot) Base() *BaseHoneypot {
+    return b
+}
+
+// configure applies the settings shared by every honeypot
+func (b *BaseHoneypot) configure(deps Deps) error {
+    b.Events = deps.Events
+    b.limiter = deps.Limiter
+    if deps.Config == nil {
+        return nil
+    }
+
+    listener := deps.Config.Listeners[strings.ToLower(b.name)]
+    proxy, err := newProxySettings(listener.ProxyProtocol, listener.TrustedProxies)
+    if err != nil {
+        return fmt.Errorf("%s listener: %v", b.name, err)
+    }
+    b.proxy = proxy
+
+    if deps.Persona != nil {
+        b.persona = deps.Persona
+    }
+    certPersona := deps.Config.TLS.Persona
+    if b.persona.TLS != nil {
+        certPersona = *b.persona.TLS
+    }
+    b.tls, err = newTLSSettings(listener, deps.Config.TLS.CertDir, certPersona)
+    if err != nil {
+        return fmt.Errorf("%s listener: %v", b.name, err)
+    }
+    b.tls.clients = deps.Config.TLS.Clients
+
+    if deps.Config.Honeypots.DrainTimeout > 0 {
+        b.DrainTimeout = deps.Config.Honeypots.DrainTimeout
+    }
+    udp := deps.Config.UDP
+    if udp.IdleTimeout > 0 {
+        b.packet.idleTimeout = udp.IdleTimeout
+    }
+    if udp.MaxSessions > 0 {
+        b.packet.maxSessions = udp.MaxSessions
+    }
+    if udp.MaxResponseSize > 0 {
+        b.packet.maxResponseSize = udp.MaxResponseSize
+    }
+    if udp.MaxAmplification > 0 {
+        b.packet.maxAmplification = udp.MaxAmplification
+    }
+    b.record = recordSettings{
+        enabled:  deps.Config.Recording.Enabled,
+        dir:      deps.Config.Recording.Dir,
+        maxBytes: deps.Config.Recording.MaxBytes,
+    }
+    b.quarantine = quarantine.NewStore(deps.Config.Quarantine.Dir, deps.Config.Quarantine.MaxFileSize, deps.Config.Quarantine.MaxTotalSize)
+    return nil
+}
+
+// Persona returns the device profile the honeypot presents
+func (b *BaseHoneypot) Persona() *persona.Persona {
+    return b.persona
+}
+
+// shellSystem returns the operating system of the persona as the fake shell and
+// filesystem present it
+func (b *BaseHoneypot) shellSystem() shell.System {
+    os := b.persona.OS
+    return shell.System{
+        Name:          os.Name,
+        Kernel:        os.Kernel,
+        KernelVersion: os.KernelVersion,
+        KernelBuild:   os.KernelBuild,
+        Machine:       os.Machine,
+        Release:       os.Release,
+        Issue:         os.Issue,
+        CPUInfo:       os.CPUInfo,
+        Motd:          os.Motd,
     }
 }
 
+// Name returns the service name of the honeypot
+func (b *BaseHoneypot) Name() string {
+    return b.name
+}
+
+// Status returns the current lifecycle state
+func (b *BaseHoneypot) Status() State {
+    b.mu.RLock()
+    defer b.mu.RUnlock()
+    return b.state
+}
+
+// Observe registers a callback invoked on every lifecycle transition
+func (b *BaseHoneypot) Observe(fn func(State)) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    b.observer = fn
+}
+
+// setState records a lifecycle transition
+func (b *BaseHoneypot) setState(state State) {
+    b.mu.Lock()
+    b.state = state
+    observer := b.observer
+    b.mu.Unlock()
+
+    if observer != nil {
+        observer(state)
+    }
+}
+
+// Addr returns the address the listener is bound to
+func (b *BaseHoneypot) Addr() net.Addr {
+    b.mu.RLock()
+    defer b.mu.RUnlock()
+    if b.Listener == nil {
+        return nil
+    }
+    return b.Listener.Addr()
+}
+
 // Initialize sets up the base honeypot
 func (b *BaseHoneypot) Initialize(port int) error {
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
-	if err != nil {
-		return fmt.Errorf("failed to start %s honeypot on port %d: %v", b.Name, port, err)
-	}
-	
-	b.Listener = listener
-	b.Port = port
-	if b.Timeout == 0 {
-		b.Timeout = 30 * time.Second
-	}
-	
-	return nil
-}
-
-// Start begins accepting connections with context for graceful shutdown
-func (b *BaseHoneypot) Start(ctx context.Context, handler func(net.Conn)) error {
-	utils.Log.Infof("%s honeypot running on port %d", b.Name, b.Port)
-	
-	go func() {
-		<-ctx.Done()
-		b.Listener.Close()
-	}()
-	
-	for {
-		// Use deadline to prevent blocking forever on accept
-		b.Listener.(*net.TCPListener).SetDeadline(time.Now().Add(1 * time.Second))
-		
-		conn, err := b.Listener.Accept()
-		if err != nil {
-			if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
-				// Check if context is cancelled
-				select {
-				case <-ctx.Done():
-					return nil
-				default:
-					continue
-				}
-			}
-			utils.Log.Errorf("%s honeypot accept error: %v", b.Name, err)
-			continue
-		}
-		
-		// Set connection timeout
-		conn.SetDeadline(time.Now().Add(b.Timeout))
-		
-		go func(c net.Conn) {
-			defer func() {
-				if r := recover(); r != nil {
-					utils.Log.Errorf("%s honeypot handler panic: %v", b.Name, r)
-				}
-			}()
-			
-			handler(c)
-		}(conn)
-	}
-}
-
-// LogConnection records connection details
+    b.setState(StateStarting)
+
+    listener, err := b.listen(port)
+    if err != nil {
+        b.setState(StateFailed)
+        return fmt.Errorf("failed to start %s honeypot on port %d: %v", b.name, port, err)
+    }
+
+    b.mu.Lock()
+    b.Listener = listener
+    b.Port = port
+    if b.Timeout == 0 {
+        b.Timeout = 30 * time.Second
+    }
+    b.mu.Unlock()
+
+    return nil
+}
+
+// listen binds a stream listener, or a datagram socket demultiplexed into pseudo-sessions
+func (b *BaseHoneypot) listen(port int) (net.Listener, error) {
+    addr := fmt.Sprintf(":%d", port)
+    switch b.Network {
+    case "", NetworkTCP:
+        return net.Listen("tcp", addr)
+    case NetworkUDP:
+        conn, err := net.ListenPacket("udp", addr)
+        if err != nil {
+            return nil, err
+        }
+        return newPacketListener(conn, b.packet), nil
+    default:
+        return nil, fmt.Errorf("unsupported network %q", b.Network)
+    }
+}
+
+// Start binds the listener and serves connections with Handler
+func (b *BaseHoneypot) Start(ctx context.Context) error {
+    if b.Handler == nil {
+        return fmt.Errorf("%s honeypot has no connection handler", b.name)
+    }
+    if err := b.Initialize(b.Port); err != nil {
+        return err
+    }
+    return b.Serve(ctx, b.Handler)
+}
+
+// Stop closes the listener, which ends Serve
+func (b *BaseHoneypot) Stop() error {
+    b.mu.Lock()
+    if b.state == StateStopped {
+        b.mu.Unlock()
+        return nil
+    }
+    listener := b.Listener
+    b.mu.Unlock()
+
+    b.setState(StateStopped)
+    if listener == nil {
+        return nil
+    }
+    return listener.Close()
+}
+
+// Serve accepts connections on the initialized listener until ctx is cancelled or Stop is called.
+// Once accepting stops, active sessions are drained before Serve returns.
+func (b *BaseHoneypot) Serve(ctx context.Context, handler func(net.Conn)) error {
+    b.setState(StateListening)
+    utils.Log.Infof("%s honeypot running on port %d", b.name, b.Port)
+
+    done := make(chan struct{})
+    defer close(done)
+    go func() {
+        select {
+        case <-ctx.Done():
+            b.Stop()
+        case <-done:
+        }
+    }()
+
+    // Handlers can outlive their session, e.g. when a protocol library closes
+    // the connection itself, so Serve also waits for them before returning
+    var handlers sync.WaitGroup
+    defer handlers.Wait()
+
+    listener := b.SessionListener()
+    defer listener.Close()
+    for {
+        conn, err := listener.Accept()
+        if err != nil {
+            if b.Status() == StateStopped {
+                b.drain()
+                return nil
+            }
+            var netErr net.Error
+            if errors.As(err, &netErr) && netErr.Timeout() {
+                continue
+            }
+            b.Listener.Close()
+            b.setState(StateFailed)
+            b.drain()
+            return fmt.Errorf("%s honeypot accept error: %v", b.name, err)
+        }
+
+        // Set connection timeout
+        conn.SetDeadline(time.Now().Add(b.Timeout))
+
+        handlers.Add(1)
+        go func(c net.Conn) {
+            defer handlers.Done()
+            defer c.Close()
+            defer func() {
+                if r := recover(); r != nil {
+                    utils.Log.Errorf("%s honeypot handler panic: %v", b.name, r)
+                }
+            }()
+
+            handler(c)
+        }(conn)
+    }
+}
+
+// SessionListener returns the listener wrapped so accepted connections are tracked sessions
+func (b *BaseHoneypot) SessionListener() net.Listener {
+    return newSessionListener(b.Listener, b)
+}
+
+// track starts tracking an accepted connection as a session accounted to limitKey
+func (b *BaseHoneypot) track(conn net.Conn, limitKey string) *Session {
+    s := &Session{
+        Conn:     conn,
+        ID:       newSessionID(),
+        Started:  time.Now(),
+        owner:    b,
+        limitKey: limitKey,
+    }
+    b.mu.Lock()
+    b.sessions[s] = struct{}{}
+    b.mu.Unlock()
+    return s
+}
+
+// newRecorder creates the recorder for a session, or nil when recording is disabled
+func (b *BaseHoneypot) newRecorder(s *Session) *recording.Recorder {
+    if !b.record.enabled {
+        return nil
+    }
+    mode := b.RecordMode
+    if mode == "" {
+        mode = recording.ModeTerminal
+    }
+    return recording.NewRecorder(b.record.dir, recording.Header{
+        SessionID: s.ID,
+        Service:   strings.ToLower(b.name),
+        Src:       s.remoteAddr().String(),
+        Dst:       s.localAddr().String(),
+        Mode:      mode,
+        Started:   s.Started,
+    }, b.record.maxBytes)
+}
+
+// rejectProxyHeader closes a session whose untrusted source tried to spoof its address
+func (b *BaseHoneypot) rejectProxyHeader(s *Session, data []byte) {
+    utils.Log.Warningf("%s rejected PROXY protocol header from untrusted source %s", b.name, s.Conn.RemoteAddr())
+    b.Emit(s, types.Event{
+        Kind:    types.EventPayload,
+        Payload: append([]byte(nil), data...),
+        Details: "PROXY protocol header from untrusted source rejected",
+        Fields:  map[string]string{"reason": "untrusted_proxy_header"},
+    })
+    s.Conn.Close()
+}
+
+// untrack forgets a closed session
+func (b *BaseHoneypot) untrack(s *Session) {
+    b.mu.Lock()
+    delete(b.sessions, s)
+    b.mu.Unlock()
+}
+
+// ActiveSessions returns the number of sessions currently open
+func (b *BaseHoneypot) ActiveSessions() int {
+    b.mu.RLock()
+    defer b.mu.RUnlock()
+    return len(b.sessions)
+}
+
+// CutOffSessions returns how many sessions were force-closed at the last shutdown
+func (b *BaseHoneypot) CutOffSessions() int {
+    b.mu.RLock()
+    defer b.mu.RUnlock()
+    return b.cutOff
+}
+
+// drain waits up to DrainTimeout for active sessions to finish, then force-closes the rest
+func (b *BaseHoneypot) drain() int {
+    deadline := time.Now().Add(b.DrainTimeout)
+    for b.ActiveSessions() > 0 && time.Now().Before(deadline) {
+        time.Sleep(50 * time.Millisecond)
+    }
+    return b.forceClose()
+}
+
+// forceClose closes every session still open and records how many were cut off
+func (b *BaseHoneypot) forceClose() int {
+    b.mu.RLock()
+    remaining := make([]*Session, 0, len(b.sessions))
+    for s := range b.sessions {
+        remaining = append(remaining, s)
+    }
+    b.mu.RUnlock()
+
+    for _, s := range remaining {
+        s.Close()
+    }
+
+    b.mu.Lock()
+    b.cutOff = len(remaining)
+    b.mu.Unlock()
+
+    if len(remaining) > 0 {
+        utils.Log.Warningf("%s honeypot cut off %d active sessions at shutdown", b.name, len(remaining))
+    }
+    return len(remaining)
+}
+
+// Emit publishes an event observed on conn, filling in the session and endpoint details
+func (b *BaseHoneypot) Emit(conn net.Conn, ev types.Event) {
+    if sess := SessionOf(conn); sess != nil {
+        if ev.SessionID == "" {
+            ev.SessionID = sess.ID
+        }
+        for k, v := range sess.Tags() {
+            if ev.Fields == nil {
+                ev.Fields = make(map[string]string)
+            }
+            if _, ok := ev.Fields[k]; !ok {
+                ev.Fields[k] = v
+            }
+        }
+    }
+    if conn != nil {
+        if ev.Src.IP == "" {
+            ev.Src = types.EndpointFromAddr(conn.RemoteAddr())
+        }
+        if ev.Dst.IP == "" {
+            ev.Dst = types.EndpointFromAddr(conn.LocalAddr())
+        }
+    }
+    if ev.Service == "" {
+        ev.Service = strings.ToLower(b.name)
+    }
+    if ev.Timestamp.IsZero() {
+        ev.Timestamp = time.Now()
+    }
+
+    if b.Events == nil {
+        utils.Log.Debugf("%s event from %s dropped: no event bus", b.name, ev.Src.IP)
+        return
+    }
+    b.Events.Publish(ev)
+}
+
+// Quarantine stores a file an attacker delivered on conn and publishes an upload event.
+// The file is still hashed and reported when no quarantine store is configured.
+func (b *BaseHoneypot) Quarantine(conn net.Conn, filename string, data []byte) {
+    fields := map[string]string{
+        "filename": filename,
+        "size":     strconv.Itoa(len(data)),
+        "sha256":   quarantine.Sum(data),
+    }
+
+    if b.quarantine != nil {
+        upload := quarantine.Upload{
+            Filename:  filename,
+            Service:   strings.ToLower(b.name),
+            Src:       conn.RemoteAddr().String(),
+            Timestamp: time.Now(),
+        }
+        if sess := SessionOf(conn); sess != nil {
+            upload.SessionID = sess.ID
+        }
+        sample, err := b.quarantine.Save(data, upload)
+        if err != nil {
+            utils.Log.Errorf("%s failed to quarantine %s from %s: %v", b.name, filename, conn.RemoteAddr(), err)
+        } else {
+            fields["sha256"] = sample.SHA256
+            fields["path"] = b.quarantine.Path(sample.SHA256)
+            if last := sample.Uploads[len(sample.Uploads)-1]; last.Truncated {
+                fields["truncated"] = "true"
+            }
+        }
+    }
+
+    utils.Log.Warningf("%s received file %s (%d bytes, sha256 %s) from %s",
+        b.name, filename, len(data), fields["sha256"], conn.RemoteAddr())
+    b.Emit(conn, types.Event{
+        Kind:    types.EventUpload,
+        Details: fmt.Sprintf("upload:%s,sha256:%s", filename, fields["sha256"]),
+        Fields:  fields,
+    })
+}
+
+// LogConnection records connection details and publishes a connect event
 func (b *BaseHoneypot) LogConnection(conn net.Conn, data []byte) *HoneypotConnection {
-	hc := &HoneypotConnection{
-		IP:        conn.RemoteAddr().String(),
-		Port:      b.Port,
-		Service:   b.Name,
-		Timestamp: time.Now(),
-		Data:      data,
-	}
-	
-	utils.Log.Warningf("%s connection attempt from %s", b.Name, hc.IP)
-	return hc
+    hc := &HoneypotConnection{
+        IP:        conn.RemoteAddr().String(),
+        Port:      b.Port,
+        Service:   b.name,
+        Timestamp: time.Now(),
+        Data:      data,
+    }
+
+    utils.Log.Warningf("%s connection attempt from %s", b.name, hc.IP)
+
+    ev := types.Event{
+        Kind:    types.EventConnect,
+        Payload: data,
+        Details: fmt.Sprintf("%s connection from %s", b.name, hc.IP),
+    }
+    if sess := SessionOf(conn); sess != nil && sess.Recording() != "" {
+        ev.Fields = map[string]string{"recording": sess.Recording()}
+    }
+    b.Emit(conn, ev)
+    return hc
 }
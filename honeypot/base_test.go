@@ -0,0 +1,96 @@
+package honeypot
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"shadownet/utils"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMain sets the logger up once for the package, since honeypots started by one
+// test may still be logging while the next one runs
+func TestMain(m *testing.M) {
+    utils.InitTestLogger()
+    os.Exit(m.Run())
+}
+
+// startHoneypot serves hp until the returned func stops it and waits for it to finish
+func startHoneypot(t *testing.T, hp Honeypot) func() {
+    ctx, cancel := context.WithCancel(context.Background())
+    done := make(chan struct{})
+    go func() {
+        hp.Start(ctx)
+        close(done)
+    }()
+    require.Eventually(t, func() bool { return hp.Status() == StateListening }, 5*time.Second, 10*time.Millisecond)
+    return func() {
+        cancel()
+        <-done
+    }
+}
+
+func TestBaseHoneypotLifecycle(t *testing.T) {
+    hp := NewBaseHoneypot("Test", 0, nil)
+    hp.Handler = func(c net.Conn) { c.Close() }
+    assert.Equal(t, StateStopped, hp.Status())
+    assert.Nil(t, hp.Addr())
+
+    ctx, cancel := context.WithCancel(context.Background())
+    errc := make(chan error, 1)
+    go func() { errc <- hp.Start(ctx) }()
+
+    require.Eventually(t, func() bool { return hp.Status() == StateListening }, time.Second, 10*time.Millisecond)
+    conn, err := net.Dial("tcp", hp.Addr().String())
+    require.NoError(t, err)
+    conn.Close()
+
+    cancel()
+    select {
+    case err := <-errc:
+        assert.NoError(t, err)
+    case <-time.After(2 * time.Second):
+        t.Fatal("honeypot did not stop after context cancellation")
+    }
+    assert.Equal(t, StateStopped, hp.Status())
+}
+
+func TestBaseHoneypotDrainsAndCutsOffSessions(t *testing.T) {
+    hp := NewBaseHoneypot("Test", 0, nil)
+    hp.DrainTimeout = 100 * time.Millisecond
+    hp.Handler = func(c net.Conn) {
+        // Block like an attacker session that never ends on its own
+        buf := make([]byte, 1)
+        c.Read(buf)
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    errc := make(chan error, 1)
+    go func() { errc <- hp.Start(ctx) }()
+    require.Eventually(t, func() bool { return hp.Status() == StateListening }, time.Second, 10*time.Millisecond)
+
+    conn, err := net.Dial("tcp", hp.Addr().String())
+    require.NoError(t, err)
+    defer conn.Close()
+    require.Eventually(t, func() bool { return hp.ActiveSessions() == 1 }, time.Second, 10*time.Millisecond)
+
+    cancel()
+    select {
+    case err := <-errc:
+        assert.NoError(t, err)
+    case <-time.After(2 * time.Second):
+        t.Fatal("honeypot did not finish draining")
+    }
+    assert.Equal(t, 1, hp.CutOffSessions())
+    assert.Equal(t, 0, hp.ActiveSessions())
+
+    // The attacker side sees the connection closed
+    conn.SetReadDeadline(time.Now().Add(time.Second))
+    _, err = conn.Read(make([]byte, 1))
+    assert.Error(t, err)
+}
@@ -0,0 +1,197 @@
+package honeypot
+
+import (
+	"fmt"
+	"net"
+	"shadownet/types"
+	"shadownet/utils"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxBounceTargets caps the bounce targets remembered per server; the least
+// recently seen one is forgotten to make room
+const maxBounceTargets = 10000
+
+// BounceTarget is a third-party address FTP clients asked the honeypot to
+// connect to with PORT or EPRT, aggregated over all sessions
+type BounceTarget struct {
+    Target    string    `json:"target"`
+    Host      string    `json:"host"`
+    Port      int       `json:"port"`
+    Attempts  int       `json:"attempts"`
+    Sources   []string  `json:"sources"`
+    FirstSeen time.Time `json:"first_seen"`
+    LastSeen  time.Time `json:"last_seen"`
+}
+
+// bounceReporter is implemented by honeypots that aggregate FTP bounce targets
+type bounceReporter interface {
+    BounceTargets() []BounceTarget
+}
+
+// bounceEntry is the aggregate kept for one target
+type bounceEntry struct {
+    host      string
+    port      int
+    attempts  int
+    sources   map[string]struct{}
+    firstSeen time.Time
+    lastSeen  time.Time
+}
+
+// bounceLog aggregates bounce targets across the sessions of a server
+type bounceLog struct {
+    targets map[string]*bounceEntry
+    mu      sync.Mutex
+}
+
+// record counts an attempt from source and returns the attempts and distinct sources so far
+func (l *bounceLog) record(host string, port int, source string, now time.Time) (attempts, sources int) {
+    target := net.JoinHostPort(host, strconv.Itoa(port))
+
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if l.targets == nil {
+        l.targets = make(map[string]*bounceEntry)
+    }
+    entry, ok := l.targets[target]
+    if !ok {
+        if len(l.targets) >= maxBounceTargets {
+            l.evictOldest()
+        }
+        entry = &bounceEntry{host: host, port: port, sources: make(map[string]struct{}), firstSeen: now}
+        l.targets[target] = entry
+    }
+    entry.attempts++
+    entry.sources[source] = struct{}{}
+    entry.lastSeen = now
+    return entry.attempts, len(entry.sources)
+}
+
+// evictOldest forgets the least recently seen target
+func (l *bounceLog) evictOldest() {
+    oldest := ""
+    for target, entry := range l.targets {
+        if oldest == "" || entry.lastSeen.Before(l.targets[oldest].lastSeen) {
+            oldest = target
+        }
+    }
+    delete(l.targets, oldest)
+}
+
+// snapshot returns the targets, most attempted first
+func (l *bounceLog) snapshot() []BounceTarget {
+    l.mu.Lock()
+    targets := make([]BounceTarget, 0, len(l.targets))
+    for target, entry := range l.targets {
+        sources := make([]string, 0, len(entry.sources))
+        for source := range entry.sources {
+            sources = append(sources, source)
+        }
+        sort.Strings(sources)
+        targets = append(targets, BounceTarget{
+            Target:    target,
+            Host:      entry.host,
+            Port:      entry.port,
+            Attempts:  entry.attempts,
+            Sources:   sources,
+            FirstSeen: entry.firstSeen,
+            LastSeen:  entry.lastSeen,
+        })
+    }
+    l.mu.Unlock()
+
+    sortBounceTargets(targets)
+    return targets
+}
+
+// sortBounceTargets orders targets by attempts, then by address
+func sortBounceTargets(targets []BounceTarget) {
+    sort.Slice(targets, func(i, j int) bool {
+        if targets[i].Attempts != targets[j].Attempts {
+            return targets[i].Attempts > targets[j].Attempts
+        }
+        return targets[i].Target < targets[j].Target
+    })
+}
+
+// BounceTargets returns the third-party addresses clients tried to bounce through this server
+func (s *FTPServer) BounceTargets() []BounceTarget {
+    return s.bounces.snapshot()
+}
+
+// emitBounce records a PORT or EPRT aimed at somebody other than the client and
+// publishes it as a proxy_abuse event, which the classifier turns into ftp_bounce
+func (f *ftpSession) emitBounce(cmd, host string, port int) {
+    source := hostOf(f.conn.RemoteAddr())
+    attempts, sources := f.s.bounces.record(host, port, source, time.Now())
+    dest := net.JoinHostPort(host, strconv.Itoa(port))
+    utils.Log.Warningf("FTP bounce from %s (%s) to %s", f.conn.RemoteAddr(), f.user, dest)
+
+    f.s.Emit(f.conn, types.Event{
+        Kind:    types.EventProxyAbuse,
+        Details: fmt.Sprintf("%s %s", cmd, dest),
+        Fields: map[string]string{
+            "type":            cmd,
+            "dest_host":       host,
+            "dest_port":       strconv.Itoa(port),
+            "username":        f.user,
+            "target_attempts": strconv.Itoa(attempts),
+            "target_sources":  strconv.Itoa(sources),
+        },
+    })
+}
+
+// MergeBounceTargets merges the FTP bounce targets of the honeypots that track them
+func MergeBounceTargets(honeypots []Honeypot) []BounceTarget {
+    merged := make(map[string]*BounceTarget)
+    for _, hp := range honeypots {
+        r, ok := hp.(bounceReporter)
+        if !ok {
+            continue
+        }
+        for _, target := range r.BounceTargets() {
+            m, ok := merged[target.Target]
+            if !ok {
+                t := target
+                merged[target.Target] = &t
+                continue
+            }
+            m.Attempts += target.Attempts
+            m.Sources = mergeSorted(m.Sources, target.Sources)
+            if target.FirstSeen.Before(m.FirstSeen) {
+                m.FirstSeen = target.FirstSeen
+            }
+            if target.LastSeen.After(m.LastSeen) {
+                m.LastSeen = target.LastSeen
+            }
+        }
+    }
+
+    targets := make([]BounceTarget, 0, len(merged))
+    for _, target := range merged {
+        targets = append(targets, *target)
+    }
+    sortBounceTargets(targets)
+    return targets
+}
+
+// mergeSorted returns the sorted union of two sorted string lists
+func mergeSorted(a, b []string) []string {
+    out := make([]string, 0, len(a)+len(b))
+    for len(a) > 0 && len(b) > 0 {
+        switch {
+        case a[0] < b[0]:
+            out, a = append(out, a[0]), a[1:]
+        case a[0] > b[0]:
+            out, b = append(out, b[0]), b[1:]
+        default:
+            out, a, b = append(out, a[0]), a[1:], b[1:]
+        }
+    }
+    out = append(out, a...)
+    return append(out, b...)
+}
@@ -0,0 +1,212 @@
+package honeypot
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ftpDataTimeout is how long a data connection may take to be established
+const ftpDataTimeout = 30 * time.Second
+
+// errBadDataAddress is returned for a malformed PORT or EPRT argument
+var errBadDataAddress = errors.New("malformed data address")
+
+// ftpDataChannel is the data connection the next transfer uses: a passive
+// listener the client connects to, or an active address the server dials
+type ftpDataChannel struct {
+    passive net.Listener
+    active  string
+}
+
+// reset closes a pending passive listener and forgets an active address
+func (d *ftpDataChannel) reset() {
+    if d.passive != nil {
+        d.passive.Close()
+        d.passive = nil
+    }
+    d.active = ""
+}
+
+// enterPassive opens a listener for the next transfer and tells the client where, for PASV or EPSV
+func (f *ftpSession) enterPassive(extended bool) {
+    f.data.reset()
+
+    // Advertise the address the client connected to, but listen where the socket really is
+    advertised := hostOf(f.conn.LocalAddr())
+    listenHost := advertised
+    if sess := SessionOf(f.conn); sess != nil {
+        listenHost = hostOf(sess.Conn.LocalAddr())
+    }
+    ip := net.ParseIP(advertised).To4()
+    if !extended && ip == nil {
+        f.reply("425 Use EPSV with IPv6.")
+        return
+    }
+
+    l, err := f.s.listenPassive(listenHost)
+    if err != nil {
+        f.reply("425 Could not open passive connection.")
+        return
+    }
+    f.data.passive = l
+    port := l.Addr().(*net.TCPAddr).Port
+    if extended {
+        f.reply(fmt.Sprintf("229 Entering Extended Passive Mode (|||%d|)", port))
+        return
+    }
+    f.reply(fmt.Sprintf("227 Entering Passive Mode (%d,%d,%d,%d,%d,%d).", ip[0], ip[1], ip[2], ip[3], port>>8, port&0xff))
+}
+
+// listenPassive listens on a free port of the passive range
+func (s *FTPServer) listenPassive(host string) (net.Listener, error) {
+    if s.passiveMin == 0 {
+        return net.Listen("tcp", net.JoinHostPort(host, "0"))
+    }
+    // Start at a random port so concurrent sessions do not race for the same one
+    count := s.passiveMax - s.passiveMin + 1
+    start := rand.Intn(count)
+    var err error
+    for i := 0; i < count; i++ {
+        port := s.passiveMin + (start+i)%count
+        var l net.Listener
+        if l, err = net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port))); err == nil {
+            return l, nil
+        }
+    }
+    return nil, err
+}
+
+// enterActive takes the address of a PORT or EPRT command for the next transfer.
+// Only the client's own address is accepted, as vsftpd does; any other target
+// is a bounce attempt and is reported, never connected to.
+func (f *ftpSession) enterActive(arg string, extended bool) {
+    f.data.reset()
+
+    parse, name := parsePORT, "PORT"
+    if extended {
+        parse, name = parseEPRT, "EPRT"
+    }
+    host, port, err := parse(arg)
+    own := err == nil && sameHost(host, hostOf(f.conn.RemoteAddr()))
+    if err == nil && !own {
+        f.emitBounce(name, host, port)
+    }
+    if !own || port == 0 {
+        f.reply(fmt.Sprintf("500 Illegal %s command.", name))
+        return
+    }
+    f.data.active = net.JoinHostPort(host, strconv.Itoa(port))
+    if extended {
+        f.reply("200 EPRT command successful. Consider using EPSV.")
+    } else {
+        f.reply("200 PORT command successful. Consider using PASV.")
+    }
+}
+
+// openData sends the preliminary reply and connects the data channel. On
+// failure the client has been answered and ok is false.
+func (f *ftpSession) openData(preliminary string) (conn net.Conn, ok bool) {
+    passive, active := f.data.passive, f.data.active
+    f.data.passive, f.data.active = nil, ""
+    if passive == nil && active == "" {
+        f.reply("425 Use PORT or PASV first.")
+        return nil, false
+    }
+
+    var err error
+    if passive != nil {
+        defer passive.Close()
+        conn, err = f.acceptData(passive)
+    } else {
+        conn, err = net.DialTimeout("tcp", active, ftpDataTimeout)
+    }
+    if err != nil {
+        f.reply("425 Failed to establish connection.")
+        return nil, false
+    }
+    conn.SetDeadline(time.Now().Add(f.s.Timeout))
+    f.reply(preliminary)
+    return conn, true
+}
+
+// acceptData waits for the client on a passive listener. Connections from any
+// other address are turned away so nobody can steal the transfer.
+func (f *ftpSession) acceptData(l net.Listener) (net.Conn, error) {
+    if tl, ok := l.(*net.TCPListener); ok {
+        tl.SetDeadline(time.Now().Add(ftpDataTimeout))
+    }
+    client := hostOf(f.conn.RemoteAddr())
+    for {
+        conn, err := l.Accept()
+        if err != nil {
+            return nil, err
+        }
+        if sameHost(hostOf(conn.RemoteAddr()), client) {
+            return conn, nil
+        }
+        conn.Close()
+    }
+}
+
+// parsePORT decodes the h1,h2,h3,h4,p1,p2 argument of PORT
+func parsePORT(arg string) (string, int, error) {
+    parts := strings.Split(strings.TrimSpace(arg), ",")
+    if len(parts) != 6 {
+        return "", 0, errBadDataAddress
+    }
+    var values [6]int
+    for i, part := range parts {
+        v, err := strconv.Atoi(strings.TrimSpace(part))
+        if err != nil || v < 0 || v > 255 {
+            return "", 0, errBadDataAddress
+        }
+        values[i] = v
+    }
+    host := fmt.Sprintf("%d.%d.%d.%d", values[0], values[1], values[2], values[3])
+    return host, values[4]<<8 | values[5], nil
+}
+
+// parseEPRT decodes the |proto|address|port| argument of EPRT (RFC 2428)
+func parseEPRT(arg string) (string, int, error) {
+    arg = strings.TrimSpace(arg)
+    if len(arg) < 2 {
+        return "", 0, errBadDataAddress
+    }
+    // The first character is the delimiter, usually |
+    parts := strings.Split(arg[1:], arg[:1])
+    if len(parts) != 4 || parts[3] != "" {
+        return "", 0, errBadDataAddress
+    }
+    ip := net.ParseIP(parts[1])
+    if ip == nil || (parts[0] == "1") != (ip.To4() != nil) || (parts[0] != "1" && parts[0] != "2") {
+        return "", 0, errBadDataAddress
+    }
+    port, err := strconv.Atoi(parts[2])
+    if err != nil || port < 0 || port > 65535 {
+        return "", 0, errBadDataAddress
+    }
+    return ip.String(), port, nil
+}
+
+// hostOf returns the IP of an address without its port
+func hostOf(addr net.Addr) string {
+    if addr == nil {
+        return ""
+    }
+    host, _, err := net.SplitHostPort(addr.String())
+    if err != nil {
+        return addr.String()
+    }
+    return host
+}
+
+// sameHost reports whether two IP strings are the same address, also across IPv4-mapped IPv6 forms
+func sameHost(a, b string) bool {
+    ipA, ipB := net.ParseIP(a), net.ParseIP(b)
+    return ipA != nil && ipB != nil && ipA.Equal(ipB)
+}
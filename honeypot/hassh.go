@@ -0,0 +1,172 @@
+package honeypot
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strings"
+)
+
+// SSH_MSG_KEXINIT message number
+const msgKexInit = 20
+
+// maxKexInitPacket bounds how much of the handshake is buffered while looking for KEXINIT
+const maxKexInitPacket = 35000
+
+// errNotKexInit is returned when the first packet of a peer is not a KEXINIT
+var errNotKexInit = errors.New("first SSH packet is not KEXINIT")
+
+// kexInit holds the algorithm lists a peer offers in its KEXINIT message
+type kexInit struct {
+    kex            string
+    hostKey        string
+    ciphersC2S     string
+    ciphersS2C     string
+    macsC2S        string
+    macsS2C        string
+    compressionC2S string
+    compressionS2C string
+}
+
+// parseKexInit decodes the name-lists of a KEXINIT payload
+func parseKexInit(payload []byte) (*kexInit, error) {
+    if len(payload) < 17 || payload[0] != msgKexInit {
+        return nil, errNotKexInit
+    }
+    rest := payload[17:]
+
+    lists := make([]string, 8)
+    for i := range lists {
+        if len(rest) < 4 {
+            return nil, errors.New("truncated KEXINIT")
+        }
+        n := binary.BigEndian.Uint32(rest)
+        if uint64(n) > uint64(len(rest)-4) {
+            return nil, errors.New("truncated KEXINIT")
+        }
+        lists[i] = string(rest[4 : 4+n])
+        rest = rest[4+n:]
+    }
+    return &kexInit{
+        kex:            lists[0],
+        hostKey:        lists[1],
+        ciphersC2S:     lists[2],
+        ciphersS2C:     lists[3],
+        macsC2S:        lists[4],
+        macsS2C:        lists[5],
+        compressionC2S: lists[6],
+        compressionS2C: lists[7],
+    }, nil
+}
+
+// ClientAlgorithms returns the HASSH algorithm string of a client KEXINIT
+func (k *kexInit) ClientAlgorithms() string {
+    return strings.Join([]string{k.kex, k.ciphersC2S, k.macsC2S, k.compressionC2S}, ";")
+}
+
+// ServerAlgorithms returns the HASSHServer algorithm string of a server KEXINIT
+func (k *kexInit) ServerAlgorithms() string {
+    return strings.Join([]string{k.kex, k.ciphersS2C, k.macsS2C, k.compressionS2C}, ";")
+}
+
+// hassh hashes an algorithm string into a HASSH fingerprint
+func hassh(algorithms string) string {
+    sum := md5.Sum([]byte(algorithms))
+    return hex.EncodeToString(sum[:])
+}
+
+// kexSniffer follows one direction of an SSH connection until it has seen the
+// peer's KEXINIT, which is sent in the clear right after the version line
+type kexSniffer struct {
+    buf     []byte
+    version bool
+    done    bool
+    found   func(*kexInit)
+}
+
+// feed inspects the next bytes sent in this direction
+func (k *kexSniffer) feed(data []byte) {
+    if k.done || len(data) == 0 {
+        return
+    }
+    k.buf = append(k.buf, data...)
+
+    // Skip the version line, and any banner lines a server sends before it
+    for !k.version {
+        end := bytes.IndexByte(k.buf, '\n')
+        if end < 0 {
+            k.giveUpIfFull()
+            return
+        }
+        line := k.buf[:end]
+        k.buf = k.buf[end+1:]
+        k.version = bytes.HasPrefix(line, []byte("SSH-"))
+    }
+
+    // Binary packet: uint32 length, byte padding length, payload, padding
+    if len(k.buf) < 5 {
+        return
+    }
+    length := binary.BigEndian.Uint32(k.buf)
+    padding := uint32(k.buf[4])
+    if length > maxKexInitPacket || padding+1 > length {
+        k.stop()
+        return
+    }
+    if uint32(len(k.buf)) < 4+length {
+        return
+    }
+
+    payload := k.buf[5 : 4+length-padding]
+    k.stop()
+    if init, err := parseKexInit(payload); err == nil {
+        k.found(init)
+    }
+}
+
+// giveUpIfFull stops sniffing a peer that never sends a sensible handshake
+func (k *kexSniffer) giveUpIfFull() {
+    if len(k.buf) > maxKexInitPacket {
+        k.stop()
+    }
+}
+
+// stop ends sniffing and releases the buffer
+func (k *kexSniffer) stop() {
+    k.done = true
+    k.buf = nil
+}
+
+// hasshConn passes an SSH connection through while capturing the KEXINIT of
+// each side. x/crypto/ssh keeps the algorithm lists to itself, so they are
+// read off the wire instead.
+type hasshConn struct {
+    net.Conn
+    client kexSniffer
+    server kexSniffer
+}
+
+// newHASSHConn wraps conn, calling onClient and onServer with the KEXINIT each side sends
+func newHASSHConn(conn net.Conn, onClient, onServer func(*kexInit)) *hasshConn {
+    return &hasshConn{
+        Conn:   conn,
+        client: kexSniffer{found: onClient},
+        server: kexSniffer{found: onServer},
+    }
+}
+
+// Read reads from the client, watching for its KEXINIT
+func (c *hasshConn) Read(p []byte) (int, error) {
+    n, err := c.Conn.Read(p)
+    c.client.feed(p[:n])
+    return n, err
+}
+
+// Write writes to the client, watching for our own KEXINIT
+func (c *hasshConn) Write(p []byte) (int, error) {
+    c.server.feed(p)
+    return c.Conn.Write(p)
+}
@@ -0,0 +1,93 @@
+package honeypot
+
+import (
+	"encoding/binary"
+	"shadownet/events"
+	"shadownet/types"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+// kexInitPacket frames a KEXINIT with the given name-lists as an unencrypted SSH packet
+func kexInitPacket(lists ...string) []byte {
+    payload := append([]byte{msgKexInit}, make([]byte, 16)...)
+    for _, list := range lists {
+        payload = binary.BigEndian.AppendUint32(payload, uint32(len(list)))
+        payload = append(payload, list...)
+    }
+    payload = append(payload, 0, 0, 0, 0, 0)
+
+    padding := 8 - (len(payload)+5)%8 + 4
+    packet := binary.BigEndian.AppendUint32(nil, uint32(len(payload)+padding+1))
+    packet = append(packet, byte(padding))
+    packet = append(packet, payload...)
+    return append(packet, make([]byte, padding)...)
+}
+
+func TestKexSnifferParsesFragmentedHandshake(t *testing.T) {
+    var found *kexInit
+    sniffer := kexSniffer{found: func(k *kexInit) { found = k }}
+
+    stream := append([]byte("SSH-2.0-OpenSSH_8.9p1\r\n"), kexInitPacket(
+        "curve25519-sha256,diffie-hellman-group14-sha256", "ssh-ed25519",
+        "aes128-ctr,aes256-ctr", "aes256-ctr", "hmac-sha2-256", "hmac-sha1", "none", "zlib",
+    )...)
+    for _, b := range stream {
+        sniffer.feed([]byte{b})
+    }
+
+    require.NotNil(t, found)
+    assert.Equal(t, "curve25519-sha256,diffie-hellman-group14-sha256;aes128-ctr,aes256-ctr;hmac-sha2-256;none", found.ClientAlgorithms())
+    assert.Equal(t, "curve25519-sha256,diffie-hellman-group14-sha256;aes256-ctr;hmac-sha1;zlib", found.ServerAlgorithms())
+    assert.Equal(t, "e43f5f36f5e718da5a7810ac99fa0938", hassh(found.ClientAlgorithms()))
+    assert.True(t, sniffer.done)
+}
+
+func TestKexSnifferIgnoresGarbage(t *testing.T) {
+    called := false
+    sniffer := kexSniffer{found: func(*kexInit) { called = true }}
+
+    sniffer.feed([]byte("SSH-2.0-scanner\r\n\xff\xff\xff\xff\x04garbage"))
+    assert.True(t, sniffer.done)
+    assert.False(t, called)
+}
+
+func TestSSHEventsCarryFingerprints(t *testing.T) {
+    bus := events.NewBus(16)
+    published := make(chan types.Event, 8)
+    bus.Subscribe("test", events.SubscriberFunc(func(ev types.Event) {
+        published <- ev
+    }))
+    defer bus.Close()
+
+    server, stop := startShellHoneypot(t, bus)
+    defer stop()
+
+    config := &ssh.ClientConfig{
+        User:            "root",
+        Auth:            []ssh.AuthMethod{ssh.Password("wrong")},
+        HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+        Timeout:         5 * time.Second,
+    }
+    config.Ciphers = []string{"aes128-ctr"}
+    config.MACs = []string{"hmac-sha2-256"}
+    _, err := ssh.Dial("tcp", server.Addr().String(), config)
+    require.Error(t, err)
+
+    for _, kind := range []types.EventKind{types.EventConnect, types.EventLogin} {
+        select {
+        case ev := <-published:
+            assert.Equal(t, kind, ev.Kind)
+            assert.Contains(t, ev.Fields["hassh_algorithms"], ";aes128-ctr;hmac-sha2-256;none")
+            assert.Equal(t, hassh(ev.Fields["hassh_algorithms"]), ev.Fields["hassh"])
+            assert.Equal(t, hassh(ev.Fields["hassh_server_algorithms"]), ev.Fields["hassh_server"])
+            assert.NotEmpty(t, ev.Fields["hassh_server"])
+        case <-time.After(2 * time.Second):
+            t.Fatalf("no %s event published", kind)
+        }
+    }
+}
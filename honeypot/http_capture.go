@@ -0,0 +1,142 @@
+package honeypot
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// defaultMaxBodySize caps a captured HTTP request body when not configured
+const defaultMaxBodySize = 1 << 20
+
+// httpUpload is a file sent in a multipart request
+type httpUpload struct {
+    filename string
+    data     []byte
+}
+
+// httpCapture is everything kept of a request beyond its request line
+type httpCapture struct {
+    // body is the request body after undoing chunking and Content-Encoding
+    body      []byte
+    truncated bool
+    // form holds the decoded url-encoded or multipart fields of the body
+    form    url.Values
+    uploads []httpUpload
+}
+
+// captureRequest reads up to limit bytes of the body and decodes its fields.
+// net/http has already removed chunked transfer encoding; gzip is undone here.
+// The body is replaced so handlers can still parse the form.
+func captureRequest(r *http.Request, limit int64) *httpCapture {
+    c := &httpCapture{form: url.Values{}}
+    if r.Body == nil || r.Body == http.NoBody {
+        return c
+    }
+
+    c.body, c.truncated = readLimited(r.Body, limit)
+    switch strings.ToLower(r.Header.Get("Content-Encoding")) {
+    case "gzip", "x-gzip":
+        // A small compressed body can expand to anything, so the limit applies again
+        if zr, err := gzip.NewReader(bytes.NewReader(c.body)); err == nil {
+            decoded, truncated := readLimited(zr, limit)
+            c.body, c.truncated = decoded, c.truncated || truncated
+        }
+    }
+    r.Body = io.NopCloser(bytes.NewReader(c.body))
+
+    mediaType, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+    switch {
+    case mediaType == "application/x-www-form-urlencoded":
+        if values, err := url.ParseQuery(string(c.body)); err == nil {
+            c.form = values
+        }
+    case strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "":
+        c.readMultipart(r)
+        r.Body = io.NopCloser(bytes.NewReader(c.body))
+    }
+    return c
+}
+
+// readMultipart splits a multipart body into form values and uploaded files.
+// Parts are kept up to a truncated or malformed one.
+func (c *httpCapture) readMultipart(r *http.Request) {
+    reader, err := r.MultipartReader()
+    if err != nil {
+        return
+    }
+    for {
+        part, err := reader.NextPart()
+        if err != nil {
+            break
+        }
+        data, err := io.ReadAll(part)
+        if part.FileName() != "" {
+            if len(data) > 0 {
+                c.uploads = append(c.uploads, httpUpload{filename: part.FileName(), data: data})
+            }
+        } else if part.FormName() != "" {
+            c.form.Add(part.FormName(), string(data))
+        }
+        if err != nil {
+            break
+        }
+    }
+
+    // Login forms are matched on the parsed form, which net/http cannot build
+    // for a body that was already consumed
+    r.PostForm = c.form
+    r.Form = r.URL.Query()
+    for key, values := range c.form {
+        r.Form[key] = append(r.Form[key], values...)
+    }
+}
+
+// fields describes the capture as event fields
+func (c *httpCapture) fields(r *http.Request) map[string]string {
+    fields := map[string]string{"headers": encodeJSON(r.Header)}
+    if cookies := r.Cookies(); len(cookies) > 0 {
+        jar := make(map[string]string, len(cookies))
+        for _, cookie := range cookies {
+            jar[cookie.Name] = cookie.Value
+        }
+        fields["cookies"] = encodeJSON(jar)
+    }
+    if len(c.body) > 0 {
+        fields["body_size"] = strconv.Itoa(len(c.body))
+    }
+    if c.truncated {
+        fields["body_truncated"] = "true"
+    }
+    if encoding := r.Header.Get("Content-Encoding"); encoding != "" {
+        fields["content_encoding"] = encoding
+    }
+    if len(c.form) > 0 {
+        fields["form"] = encodeJSON(c.form)
+    }
+    return fields
+}
+
+// readLimited reads r up to limit bytes and reports whether there was more
+func readLimited(r io.Reader, limit int64) ([]byte, bool) {
+    data, _ := io.ReadAll(io.LimitReader(r, limit+1))
+    if int64(len(data)) > limit {
+        return data[:limit], true
+    }
+    return data, false
+}
+
+// encodeJSON renders v compactly for an event field
+func encodeJSON(v interface{}) string {
+    data, err := json.Marshal(v)
+    if err != nil {
+        return ""
+    }
+    return string(data)
+}
@@ -2,89 +2,268 @@ package honeypot
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
-	"shadownet/db"
+	"shadownet/types"
 	"shadownet/utils"
+	"shadownet/webapp"
 	"strings"
+	"sync"
+	"time"
 )
 
+
+// connContextKey stores the accepted connection in each request context
+type connContextKey struct{}
+
 // HTTPServer implements a fake HTTP server
 type HTTPServer struct {
-    BaseHoneypot
+    *BaseHoneypot
+    // MaxBodySize caps how much of a request body is captured and decoded
+    MaxBodySize int64
+    // server, drained and stopOnce belong to the current start and are guarded by mu
+    server   *http.Server
+    drained  chan struct{}
+    stopOnce *sync.Once
+    // apps routes requests to fake web applications; nil serves only the persona's pages
+    apps     *webapp.Set
+    notFound *webapp.Page
+}
+
+func init() {
+    Register("http", func(deps Deps) (Honeypot, error) {
+        server := NewHTTPServer(deps.DB, deps.Config.Honeypots.HTTPPort)
+        if size := deps.Config.HTTP.MaxBodySize; size > 0 {
+            server.MaxBodySize = size
+        }
+        names := deps.Config.HTTP.Apps
+        if names == nil {
+            names = deps.persona().HTTP.Apps
+        }
+        apps, err := webapp.Load(names, deps.Config.HTTP.AppDir)
+        if err != nil {
+            return nil, err
+        }
+        server.EnableApps(apps)
+        return server, nil
+    })
 }
 
-// StartHTTPServer starts a fake HTTP server with proper error handling
-func StartHTTPServer(port int) error {
+// NewHTTPServer creates a new HTTP honeypot
+func NewHTTPServer(db *sql.DB, port int) *HTTPServer {
     httpServer := &HTTPServer{
-        BaseHoneypot: BaseHoneypot{
-            Name: "HTTP",
-            Port: port,
-        },
+        BaseHoneypot: NewBaseHoneypot("HTTP", port, db),
+        MaxBodySize:  defaultMaxBodySize,
     }
+    return httpServer
+}
 
-    // Create HTTP server
-    server := &http.Server{
-        Addr: fmt.Sprintf(":%d", port),
-        Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-            // Extract real IP address
-            ip := r.RemoteAddr
-            if idx := strings.LastIndex(ip, ":"); idx != -1 {
-                ip = ip[:idx]
-            }
-            if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
-                ip = forwarded
-            }
-
-            // Log the attack details
-            attackData := fmt.Sprintf("%s %s %s\nUser-Agent: %s\nReferer: %s",
-                r.Method,
-                r.URL.String(),
-                r.Proto,
-                r.UserAgent(),
-                r.Referer(),
-            )
-
-            utils.Log.Warningf("HTTP attack attempt from %s: %s %s",
-                ip, r.Method, r.URL.String())
-
-            // Log to database
-            db.LogAttack(ip, attackData, "http")
-
-            // Send a generic response
-            w.Header().Set("Server", "Apache/2.4.41 (Ubuntu)")
-            w.Header().Set("Content-Type", "text/html")
-            w.WriteHeader(http.StatusOK)
-            w.Write([]byte("<html><body><h1>It works!</h1></body></html>"))
-        }),
-    }
-
-    // Initialize the base honeypot
-    if err := httpServer.Initialize(port); err != nil {
+// EnableApps serves the routes of the given app packs
+func (s *HTTPServer) EnableApps(apps *webapp.Set) {
+    s.apps = apps
+}
+
+// Start serves HTTP on the base listener until ctx is cancelled or Stop is called
+func (s *HTTPServer) Start(ctx context.Context) error {
+    // The persona is only final once the honeypot is configured
+    notFound, err := webapp.ParsePage("not_found", s.Persona().HTTP.NotFound)
+    if err != nil {
+        return fmt.Errorf("persona 404 page: %v", err)
+    }
+    s.notFound = notFound
+
+    if err := s.Initialize(s.Port); err != nil {
         return err
     }
 
-    // Create a context for graceful shutdown
-    ctx, cancel := context.WithCancel(context.Background())
-    defer cancel()
+    // An http.Server cannot be reused after Shutdown, so build a fresh one per start
+    server := &http.Server{
+        Addr:    fmt.Sprintf(":%d", s.Port),
+        Handler: http.HandlerFunc(s.handleHTTP),
+        ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+            return context.WithValue(ctx, connContextKey{}, c)
+        },
+    }
+    drained := make(chan struct{})
+    s.mu.Lock()
+    s.server, s.drained, s.stopOnce = server, drained, &sync.Once{}
+    s.mu.Unlock()
 
+    done := make(chan struct{})
+    defer close(done)
     go func() {
-        utils.Log.Infof("HTTP honeypot running on port %d", port)
-        if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-            utils.Log.Errorf("HTTP server error: %v", err)
+        select {
+        case <-ctx.Done():
+            s.Stop()
+        case <-done:
         }
     }()
 
-    // Handle graceful shutdown
-    go func() {
-        <-ctx.Done()
-        shutdownCtx, cancel := context.WithTimeout(context.Background(), httpServer.Timeout)
-        defer cancel()
-        
-        if err := server.Shutdown(shutdownCtx); err != nil {
-            utils.Log.Errorf("Error shutting down HTTP server: %v", err)
+    s.setState(StateListening)
+    utils.Log.Infof("HTTP honeypot running on port %d", s.Port)
+    err = server.Serve(s.SessionListener())
+    if err == http.ErrServerClosed {
+        // Serve returns as soon as Shutdown begins; wait for the drain to finish
+        <-drained
+        return nil
+    }
+    s.setState(StateFailed)
+    s.forceClose()
+    return fmt.Errorf("HTTP server error: %v", err)
+}
+
+// Stop gracefully shuts down the HTTP server. Concurrent calls shut it down once.
+func (s *HTTPServer) Stop() error {
+    s.mu.RLock()
+    server, drained, once := s.server, s.drained, s.stopOnce
+    s.mu.RUnlock()
+    if server == nil {
+        return s.BaseHoneypot.Stop()
+    }
+
+    var err error
+    once.Do(func() { err = s.shutdown(server, drained) })
+    return err
+}
+
+// shutdown drains the sessions of a started server, then closes it and drained
+func (s *HTTPServer) shutdown(server *http.Server, drained chan struct{}) error {
+    s.setState(StateStopped)
+    defer close(drained)
+
+    shutdownCtx, cancel := context.WithTimeout(context.Background(), s.DrainTimeout)
+    defer cancel()
+
+    err := server.Shutdown(shutdownCtx)
+    s.forceClose()
+    if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+        return fmt.Errorf("error shutting down HTTP server: %v", err)
+    }
+    return server.Close()
+}
+
+func (s *HTTPServer) handleHTTP(w http.ResponseWriter, r *http.Request) {
+    // Extract real IP address
+    ip := r.RemoteAddr
+    if idx := strings.LastIndex(ip, ":"); idx != -1 {
+        ip = ip[:idx]
+    }
+    forwarded := r.Header.Get("X-Forwarded-For")
+    if forwarded != "" {
+        ip = forwarded
+    }
+
+    // Log the attack details
+    attackData := fmt.Sprintf("%s %s %s\nUser-Agent: %s\nReferer: %s",
+        r.Method,
+        r.URL.String(),
+        r.Proto,
+        r.UserAgent(),
+        r.Referer(),
+    )
+
+    utils.Log.Warningf("HTTP attack attempt from %s: %s %s",
+        ip, r.Method, r.URL.String())
+
+    // Keep the whole request: webshell uploads and exploit payloads travel in the body
+    capture := captureRequest(r, s.MaxBodySize)
+    fields := capture.fields(r)
+    fields["method"] = r.Method
+    fields["url"] = r.URL.String()
+    fields["host"] = r.Host
+    fields["user_agent"] = r.UserAgent()
+    if forwarded != "" {
+        // X-Forwarded-For is attacker controlled, so keep it as metadata only
+        fields["x_forwarded_for"] = forwarded
+    }
+    conn, _ := r.Context().Value(connContextKey{}).(net.Conn)
+    route := s.apps.Match(r.Method, r.URL.Path)
+    if route != nil {
+        fields["app"] = route.Pack()
+    }
+    s.Emit(conn, types.Event{
+        Kind:    types.EventRequest,
+        Payload: capture.body,
+        Details: attackData,
+        Fields:  fields,
+    })
+    for _, upload := range capture.uploads {
+        s.Quarantine(conn, upload.filename, upload.data)
+    }
+
+    // Answer like the web server of the persona
+    profile := s.Persona().HTTP
+    for key, value := range profile.Headers {
+        w.Header().Set(key, value)
+    }
+    w.Header().Set("Server", profile.Server)
+    data := s.templateData(r, conn)
+
+    var err error
+    switch {
+    case route != nil:
+        if route.Login != nil {
+            r.ParseForm()
+            data.Form = r.Form
         }
-    }()
+        if user, pass, ok := route.Credentials(r); ok {
+            data.Username = user
+            s.emitWebLogin(conn, r, route, user, pass)
+        }
+        err = route.Render(w, data)
+    case r.URL.Path == "/":
+        w.Header().Set("Content-Type", "text/html")
+        w.WriteHeader(http.StatusOK)
+        _, err = w.Write([]byte(profile.Index))
+    default:
+        err = s.notFound.Render(w, http.StatusNotFound, data)
+    }
+    if err != nil {
+        utils.Log.Debugf("HTTP response to %s failed: %v", ip, err)
+    }
+}
+
+// templateData describes a request to the page templates
+func (s *HTTPServer) templateData(r *http.Request, conn net.Conn) webapp.Data {
+    data := webapp.Data{
+        Method:     r.Method,
+        Host:       r.Host,
+        ServerName: r.Host,
+        Port:       s.Port,
+        Path:       r.URL.Path,
+        Query:      r.URL.Query(),
+        Hostname:   s.Persona().OS.Hostname,
+        Server:     s.Persona().HTTP.Server,
+        Now:        time.Now(),
+    }
+    if host, _, err := net.SplitHostPort(r.Host); err == nil {
+        data.ServerName = host
+    }
+    if conn != nil {
+        data.Port = types.EndpointFromAddr(conn.LocalAddr()).Port
+    }
+    return data
+}
 
-    return nil
-}
\ No newline at end of file
+// emitWebLogin publishes credentials submitted to a fake web application
+func (s *HTTPServer) emitWebLogin(conn net.Conn, r *http.Request, route *webapp.Route, user, pass string) {
+    method := types.AuthHTTPForm
+    if _, _, basic := r.BasicAuth(); basic && route.BasicAuth != "" {
+        method = types.AuthHTTPBasic
+    }
+    utils.Log.Warningf("HTTP %s login attempt on %s from %s: user=%s", route.Pack(), r.URL.Path, r.RemoteAddr, user)
+
+    s.Emit(conn, types.Event{
+        Kind:        types.EventLogin,
+        Credentials: &types.Credentials{Username: user, Password: pass, Method: method},
+        Details:     fmt.Sprintf("user:%s,pass:%s", user, pass),
+        Fields: map[string]string{
+            "app":    route.Pack(),
+            "path":   r.URL.Path,
+            "method": method,
+        },
+    })
+}
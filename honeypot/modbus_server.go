@@ -2,100 +2,189 @@ package honeypot
 
 import (
 	"context"
+	"database/sql"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"net"
-	"shadownet/db"
+	"shadownet/plc"
+	"shadownet/recording"
+	"shadownet/types"
 	"shadownet/utils"
+	"strconv"
+	"strings"
 )
 
-// ModbusServer implements a fake Modbus server
+// Modbus function codes
+const (
+    modbusReadCoils              = 0x01
+    modbusReadDiscreteInputs     = 0x02
+    modbusReadHoldingRegisters   = 0x03
+    modbusReadInputRegisters     = 0x04
+    modbusWriteSingleCoil        = 0x05
+    modbusWriteSingleRegister    = 0x06
+    modbusWriteMultipleCoils     = 0x0f
+    modbusWriteMultipleRegisters = 0x10
+    modbusReadWriteRegisters     = 0x17
+    modbusEncapsulatedTransport  = 0x2b
+)
+
+// meiReadDeviceID is the MEI type of Read Device Identification within function 43
+const meiReadDeviceID = 0x0e
+
+// Modbus exception codes
+const (
+    modbusIllegalFunction     = 0x01
+    modbusIllegalDataAddress  = 0x02
+    modbusIllegalDataValue    = 0x03
+    modbusGatewayTargetFailed = 0x0b
+)
+
+// modbusFunctionNames name the supported function codes in events
+var modbusFunctionNames = map[byte]string{
+    modbusReadCoils:              "read_coils",
+    modbusReadDiscreteInputs:     "read_discrete_inputs",
+    modbusReadHoldingRegisters:   "read_holding_registers",
+    modbusReadInputRegisters:     "read_input_registers",
+    modbusWriteSingleCoil:        "write_single_coil",
+    modbusWriteSingleRegister:    "write_single_register",
+    modbusWriteMultipleCoils:     "write_multiple_coils",
+    modbusWriteMultipleRegisters: "write_multiple_registers",
+    modbusReadWriteRegisters:     "read_write_multiple_registers",
+    modbusEncapsulatedTransport:  "read_device_identification",
+}
+
+// errModbusException carries the exception code a request is answered with
+type errModbusException byte
+
+func (e errModbusException) Error() string {
+    return fmt.Sprintf("modbus exception 0x%02x", byte(e))
+}
+
+// ModbusServer implements a Modbus/TCP PLC serving the register map of a profile
 type ModbusServer struct {
-    BaseHoneypot
+    *BaseHoneypot
+
+    // device is the PLC memory, shared by all connections so writes persist like on a real PLC
+    device *plc.Device
+    // simulate runs the process of the profile while the honeypot is up
+    simulate bool
+}
+
+func init() {
+    Register("modbus", func(deps Deps) (Honeypot, error) {
+        server := NewModbusServer(deps.DB, deps.Config.Honeypots.ModbusPort)
+        name := deps.Config.Modbus.Profile
+        if name == "" {
+            name = deps.persona().Modbus.Profile
+        }
+        profile, err := plc.Load(name, deps.Config.Modbus.ProfileDir)
+        if err != nil {
+            return nil, err
+        }
+        server.EnableDevice(plc.NewDevice(profile))
+        server.simulate = deps.Config.Modbus.Simulate
+        return server, nil
+    })
 }
 
-// StartModbusServer starts a fake Modbus server with proper error handling
-func StartModbusServer(port int) error {
+// NewModbusServer creates a new Modbus honeypot running the default PLC profile
+func NewModbusServer(db *sql.DB, port int) *ModbusServer {
     modbusServer := &ModbusServer{
-        BaseHoneypot: BaseHoneypot{
-            Name: "Modbus",
-            Port: port,
-        },
+        BaseHoneypot: NewBaseHoneypot("Modbus", port, db),
+        device:       plc.NewDevice(plc.Default()),
     }
+    modbusServer.RecordMode = recording.ModeBinary
+    modbusServer.Handler = modbusServer.handleModbus
+    return modbusServer
+}
 
-    if err := modbusServer.Initialize(port); err != nil {
-        return err
-    }
+// EnableDevice replaces the emulated PLC
+func (s *ModbusServer) EnableDevice(device *plc.Device) {
+    s.device = device
+}
 
-    ctx, cancel := context.WithCancel(context.Background())
-    defer cancel()
+// Device returns the emulated PLC
+func (s *ModbusServer) Device() *plc.Device {
+    return s.device
+}
 
-    return modbusServer.Start(ctx, modbusServer.handleModbus)
+// Start serves Modbus and, when enabled, drives the simulated process until the honeypot stops
+func (s *ModbusServer) Start(ctx context.Context) error {
+    if s.simulate {
+        simulation, cancel := context.WithCancel(ctx)
+        defer cancel()
+        go s.device.Simulate(simulation)
+    }
+    return s.BaseHoneypot.Start(ctx)
+}
+
+// modbusOp is one read, write or identification a request performed
+type modbusOp struct {
+    operation string
+    table     plc.Table
+    address   uint16
+    values    []uint16
+    // alerts are the critical or unsafe writes among values
+    alerts []plc.Alert
+    // deviceIDCode and objectID are the arguments of a device identification
+    deviceIDCode byte
+    objectID     byte
 }
 
 func (s *ModbusServer) handleModbus(conn net.Conn) {
     defer conn.Close()
 
     // Log the connection
-    s.LogConnection(conn, []byte("Modbus connection established"))
-
-    // Buffer for reading Modbus MBAP header (7 bytes) and PDU
-    buf := make([]byte, 260) // Max Modbus message size
+    s.LogConnection(conn, nil)
 
+    header := make([]byte, 7)
     for {
-        // Read MBAP header (7 bytes)
-        n, err := conn.Read(buf[:7])
-        if err != nil || n != 7 {
+        // Read the MBAP header; frames may arrive split or coalesced
+        if _, err := io.ReadFull(conn, header); err != nil {
             utils.Log.Debugf("Modbus read error: %v", err)
             return
         }
 
         // Parse MBAP header
-        transactionID := binary.BigEndian.Uint16(buf[0:2])
-        protocolID := binary.BigEndian.Uint16(buf[2:4])
-        length := binary.BigEndian.Uint16(buf[4:6])
-        unitID := buf[6]
+        transactionID := binary.BigEndian.Uint16(header[0:2])
+        protocolID := binary.BigEndian.Uint16(header[2:4])
+        length := binary.BigEndian.Uint16(header[4:6])
+        unitID := header[6]
 
         // Read PDU
         pduLen := int(length) - 1 // subtract unitID length
-        if pduLen <= 0 || pduLen > 253 {
-            utils.Log.Warningf("Invalid Modbus message length: %d", pduLen)
+        if protocolID != 0 || pduLen <= 0 || pduLen > 253 {
+            utils.Log.Warningf("Invalid Modbus frame from %s: protocol=%d, length=%d", conn.RemoteAddr(), protocolID, length)
             return
         }
-
-        n, err = conn.Read(buf[7 : 7+pduLen])
-        if err != nil || n != pduLen {
+        frame := make([]byte, 7+pduLen)
+        copy(frame, header)
+        if _, err := io.ReadFull(conn, frame[7:]); err != nil {
             utils.Log.Debugf("Modbus PDU read error: %v", err)
             return
         }
+        pdu := frame[7:]
+        functionCode := pdu[0]
 
-        // Get function code
-        functionCode := buf[7]
+        utils.Log.Warningf("Modbus request from %s: Function=0x%02x, Unit=%d",
+            conn.RemoteAddr(), functionCode, unitID)
 
-        // Log the attack
-        ip := conn.RemoteAddr().String()
-        if idx := net.JoinHostPort("", ip); idx != "" {
-            ip = idx
+        reply, ops, err := s.serve(unitID, pdu)
+        var exception errModbusException
+        if errors.As(err, &exception) {
+            reply = []byte{functionCode | 0x80, byte(exception)}
         }
-
-        attackData := make([]byte, 7+pduLen)
-        copy(attackData, buf[:7+pduLen])
-        
-        utils.Log.Warningf("Modbus request from %s: Function=0x%02x, Unit=%d",
-            ip, functionCode, unitID)
-        
-        db.LogAttack(ip, 
-            fmt.Sprintf("function:0x%02x,unit:%d,transaction:%d",
-                functionCode, unitID, transactionID),
-            "modbus")
+        s.emitRequest(conn, frame, ops, exception)
 
         // Prepare response
-        response := make([]byte, 8) // MBAP header + function code + error code
+        response := make([]byte, 7, 7+len(reply))
         binary.BigEndian.PutUint16(response[0:2], transactionID)
         binary.BigEndian.PutUint16(response[2:4], protocolID)
-        binary.BigEndian.PutUint16(response[4:6], 2) // length of unit ID + PDU
+        binary.BigEndian.PutUint16(response[4:6], uint16(len(reply)+1)) // length of unit ID + PDU
         response[6] = unitID
-        response[7] = functionCode | 0x80 // Set error bit
+        response = append(response, reply...)
 
         // Send response
         if _, err := conn.Write(response); err != nil {
@@ -103,4 +192,311 @@ func (s *ModbusServer) handleModbus(conn net.Conn) {
             return
         }
     }
-}
\ No newline at end of file
+}
+
+// serve executes a request PDU against the device and returns the response PDU
+// with the operations performed, or an errModbusException
+func (s *ModbusServer) serve(unitID byte, pdu []byte) ([]byte, []modbusOp, error) {
+    profile := s.device.Profile()
+    if profile.UnitID != 0 && unitID != profile.UnitID && unitID != 0 && unitID != 0xff {
+        return nil, nil, errModbusException(modbusGatewayTargetFailed)
+    }
+
+    functionCode := pdu[0]
+    switch functionCode {
+    case modbusReadCoils, modbusReadDiscreteInputs:
+        table := plc.Coils
+        if functionCode == modbusReadDiscreteInputs {
+            table = plc.DiscreteInputs
+        }
+        return s.readRange(pdu, table, 2000, packBits)
+
+    case modbusReadHoldingRegisters, modbusReadInputRegisters:
+        table := plc.HoldingRegisters
+        if functionCode == modbusReadInputRegisters {
+            table = plc.InputRegisters
+        }
+        return s.readRange(pdu, table, 125, packRegisters)
+
+    case modbusWriteSingleCoil, modbusWriteSingleRegister:
+        if len(pdu) != 5 {
+            return nil, nil, errModbusException(modbusIllegalDataValue)
+        }
+        address, value := binary.BigEndian.Uint16(pdu[1:3]), binary.BigEndian.Uint16(pdu[3:5])
+        table := plc.HoldingRegisters
+        if functionCode == modbusWriteSingleCoil {
+            // A coil is switched with FF00 or 0000 and nothing else
+            if value != 0xff00 && value != 0x0000 {
+                return nil, nil, errModbusException(modbusIllegalDataValue)
+            }
+            table, value = plc.Coils, value>>15
+        }
+        op, err := s.write(table, address, []uint16{value})
+        if err != nil {
+            return nil, nil, err
+        }
+        return append([]byte(nil), pdu...), []modbusOp{op}, nil
+
+    case modbusWriteMultipleCoils, modbusWriteMultipleRegisters:
+        if len(pdu) < 6 {
+            return nil, nil, errModbusException(modbusIllegalDataValue)
+        }
+        address, quantity, byteCount := binary.BigEndian.Uint16(pdu[1:3]), int(binary.BigEndian.Uint16(pdu[3:5])), int(pdu[5])
+        data := pdu[6:]
+        var values []uint16
+        var table plc.Table
+        if functionCode == modbusWriteMultipleCoils {
+            if quantity < 1 || quantity > 1968 || byteCount != (quantity+7)/8 || len(data) != byteCount {
+                return nil, nil, errModbusException(modbusIllegalDataValue)
+            }
+            table, values = plc.Coils, unpackBits(data, quantity)
+        } else {
+            if quantity < 1 || quantity > 123 || byteCount != 2*quantity || len(data) != byteCount {
+                return nil, nil, errModbusException(modbusIllegalDataValue)
+            }
+            table, values = plc.HoldingRegisters, unpackRegisters(data)
+        }
+        op, err := s.write(table, address, values)
+        if err != nil {
+            return nil, nil, err
+        }
+        return append([]byte(nil), pdu[:5]...), []modbusOp{op}, nil
+
+    case modbusReadWriteRegisters:
+        if len(pdu) < 10 {
+            return nil, nil, errModbusException(modbusIllegalDataValue)
+        }
+        readAddress, readQuantity := binary.BigEndian.Uint16(pdu[1:3]), int(binary.BigEndian.Uint16(pdu[3:5]))
+        writeAddress, writeQuantity := binary.BigEndian.Uint16(pdu[5:7]), int(binary.BigEndian.Uint16(pdu[7:9]))
+        byteCount, data := int(pdu[9]), pdu[10:]
+        if readQuantity < 1 || readQuantity > 125 || writeQuantity < 1 || writeQuantity > 121 ||
+            byteCount != 2*writeQuantity || len(data) != byteCount {
+            return nil, nil, errModbusException(modbusIllegalDataValue)
+        }
+        if !s.device.Contains(plc.HoldingRegisters, readAddress, readQuantity) ||
+            !s.device.Contains(plc.HoldingRegisters, writeAddress, writeQuantity) {
+            return nil, nil, errModbusException(modbusIllegalDataAddress)
+        }
+        // The write happens before the read, so the read sees the new values
+        write, err := s.write(plc.HoldingRegisters, writeAddress, unpackRegisters(data))
+        if err != nil {
+            return nil, nil, err
+        }
+        values, err := s.device.Read(plc.HoldingRegisters, readAddress, uint16(readQuantity))
+        if err != nil {
+            return nil, []modbusOp{write}, errModbusException(modbusIllegalDataAddress)
+        }
+        read := modbusOp{operation: "read", table: plc.HoldingRegisters, address: readAddress, values: values}
+        return append([]byte{functionCode, byte(2 * readQuantity)}, packRegisters(values)...), []modbusOp{write, read}, nil
+
+    case modbusEncapsulatedTransport:
+        return s.identify(pdu)
+    }
+    return nil, nil, errModbusException(modbusIllegalFunction)
+}
+
+// readRange serves a read of up to limit coils, inputs or registers
+func (s *ModbusServer) readRange(pdu []byte, table plc.Table, limit int, pack func([]uint16) []byte) ([]byte, []modbusOp, error) {
+    if len(pdu) != 5 {
+        return nil, nil, errModbusException(modbusIllegalDataValue)
+    }
+    address, quantity := binary.BigEndian.Uint16(pdu[1:3]), binary.BigEndian.Uint16(pdu[3:5])
+    if quantity < 1 || int(quantity) > limit {
+        return nil, nil, errModbusException(modbusIllegalDataValue)
+    }
+    values, err := s.device.Read(table, address, quantity)
+    if err != nil {
+        return nil, nil, errModbusException(modbusIllegalDataAddress)
+    }
+    data := pack(values)
+    reply := append([]byte{pdu[0], byte(len(data))}, data...)
+    return reply, []modbusOp{{operation: "read", table: table, address: address, values: values}}, nil
+}
+
+// write stores values in the device
+func (s *ModbusServer) write(table plc.Table, address uint16, values []uint16) (modbusOp, error) {
+    alerts, err := s.device.Write(table, address, values)
+    if err != nil {
+        return modbusOp{}, errModbusException(modbusIllegalDataAddress)
+    }
+    return modbusOp{operation: "write", table: table, address: address, values: values, alerts: alerts}, nil
+}
+
+// identify serves Read Device Identification (function 43, MEI type 14) from the profile
+func (s *ModbusServer) identify(pdu []byte) ([]byte, []modbusOp, error) {
+    if len(pdu) < 2 || pdu[1] != meiReadDeviceID {
+        return nil, nil, errModbusException(modbusIllegalFunction)
+    }
+    if len(pdu) != 4 {
+        return nil, nil, errModbusException(modbusIllegalDataValue)
+    }
+    code, objectID := pdu[2], pdu[3]
+    objects := s.device.Profile().Identity.Objects()
+
+    // Basic identification is objects 0-2; regular adds the rest, and there is no extended
+    first, last := int(objectID), 2
+    switch code {
+    case 1:
+    case 2, 3:
+        last = len(objects) - 1
+    case 4:
+        if int(objectID) >= len(objects) {
+            return nil, nil, errModbusException(modbusIllegalDataAddress)
+        }
+        last = first
+    default:
+        return nil, nil, errModbusException(modbusIllegalDataValue)
+    }
+    // A stream request for an unknown object starts over at the first one
+    if first > last {
+        first = 0
+    }
+
+    // Conformity level 0x82: regular identification, stream and individual access
+    reply := []byte{modbusEncapsulatedTransport, meiReadDeviceID, code, 0x82, 0x00, 0x00, byte(last - first + 1)}
+    for id := first; id <= last; id++ {
+        value := objects[id]
+        if len(value) > 64 {
+            value = value[:64]
+        }
+        reply = append(reply, byte(id), byte(len(value)))
+        reply = append(reply, value...)
+    }
+    op := modbusOp{operation: "identify", deviceIDCode: code, objectID: objectID}
+    return reply, []modbusOp{op}, nil
+}
+
+// emitRequest publishes an event for every operation of a request, or one for a request that performed none
+func (s *ModbusServer) emitRequest(conn net.Conn, frame []byte, ops []modbusOp, exception errModbusException) {
+    transactionID := binary.BigEndian.Uint16(frame[0:2])
+    unitID := frame[6]
+    functionCode := frame[7]
+
+    base := func() map[string]string {
+        fields := map[string]string{
+            "function":    fmt.Sprintf("0x%02x", functionCode),
+            "unit":        fmt.Sprintf("%d", unitID),
+            "transaction": fmt.Sprintf("%d", transactionID),
+        }
+        if name, ok := modbusFunctionNames[functionCode]; ok {
+            fields["function_name"] = name
+        }
+        if exception != 0 {
+            fields["exception"] = fmt.Sprintf("0x%02x", byte(exception))
+        }
+        return fields
+    }
+    details := fmt.Sprintf("function:0x%02x,unit:%d,transaction:%d", functionCode, unitID, transactionID)
+
+    if len(ops) == 0 {
+        s.Emit(conn, types.Event{
+            Kind:    types.EventRequest,
+            Payload: frame,
+            Details: details,
+            Fields:  base(),
+        })
+        return
+    }
+    for _, op := range ops {
+        fields := base()
+        fields["operation"] = op.operation
+        opDetails := details
+        if op.operation == "identify" {
+            fields["device_id_code"] = strconv.Itoa(int(op.deviceIDCode))
+            fields["object_id"] = strconv.Itoa(int(op.objectID))
+        } else {
+            values := formatValues(op.values)
+            fields["table"] = op.table.String()
+            fields["address"] = strconv.Itoa(int(op.address))
+            fields["quantity"] = strconv.Itoa(len(op.values))
+            fields["values"] = values
+            if points := s.device.Names(op.table, op.address, len(op.values)); len(points) > 0 {
+                fields["points"] = strings.Join(points, ",")
+            }
+            opDetails += fmt.Sprintf(",%s:%s,address:%d,quantity:%d", op.operation, op.table, op.address, len(op.values))
+            utils.Log.Warningf("Modbus %s from %s: %s %d+%d [%s]",
+                op.operation, conn.RemoteAddr(), op.table, op.address, len(op.values), values)
+        }
+        s.Emit(conn, types.Event{
+            Kind:    types.EventRequest,
+            Payload: frame,
+            Details: opDetails,
+            Fields:  fields,
+        })
+        for _, alert := range op.alerts {
+            s.emitAlert(conn, frame, base(), alert)
+        }
+    }
+}
+
+// emitAlert publishes a write to a critical point or outside a safe range as a
+// process_alert event, which the classifier rates as ICS tampering
+func (s *ModbusServer) emitAlert(conn net.Conn, frame []byte, fields map[string]string, alert plc.Alert) {
+    fields["alert"] = alert.Reason
+    fields["point"] = alert.Point.Name
+    fields["table"] = alert.Table.String()
+    fields["address"] = strconv.Itoa(int(alert.Point.Address))
+    fields["value"] = strconv.Itoa(int(alert.Value))
+    fields["previous"] = strconv.Itoa(int(alert.Previous))
+    details := fmt.Sprintf("%s write %s=%d (was %d)", alert.Reason, alert.Point.Name, alert.Value, alert.Previous)
+    if safe := alert.Point.Safe; safe != nil {
+        fields["safe_min"] = strconv.Itoa(int(safe.Min))
+        fields["safe_max"] = strconv.Itoa(int(safe.Max))
+        details += fmt.Sprintf(", safe %d-%d", safe.Min, safe.Max)
+    }
+    utils.Log.Warningf("Modbus %s from %s", details, conn.RemoteAddr())
+
+    s.Emit(conn, types.Event{
+        Kind:    types.EventProcessAlert,
+        Payload: frame,
+        Details: details,
+        Fields:  fields,
+    })
+}
+
+// formatValues renders values as a comma separated list
+func formatValues(values []uint16) string {
+    parts := make([]string, len(values))
+    for i, v := range values {
+        parts[i] = strconv.Itoa(int(v))
+    }
+    return strings.Join(parts, ",")
+}
+
+// packBits packs coils or inputs eight to a byte, the first in the lowest bit
+func packBits(values []uint16) []byte {
+    data := make([]byte, (len(values)+7)/8)
+    for i, v := range values {
+        if v != 0 {
+            data[i/8] |= 1 << (i % 8)
+        }
+    }
+    return data
+}
+
+// unpackBits is the inverse of packBits for count values
+func unpackBits(data []byte, count int) []uint16 {
+    values := make([]uint16, count)
+    for i := range values {
+        values[i] = uint16(data[i/8]>>(i%8)) & 1
+    }
+    return values
+}
+
+// packRegisters encodes registers big-endian
+func packRegisters(values []uint16) []byte {
+    data := make([]byte, 2*len(values))
+    for i, v := range values {
+        binary.BigEndian.PutUint16(data[2*i:], v)
+    }
+    return data
+}
+
+// unpackRegisters decodes big-endian registers
+func unpackRegisters(data []byte) []uint16 {
+    values := make([]uint16, len(data)/2)
+    for i := range values {
+        values[i] = binary.BigEndian.Uint16(data[2*i:])
+    }
+    return values
+}
@@ -0,0 +1,249 @@
+package honeypot
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"shadownet/classify"
+	"shadownet/events"
+	"shadownet/plc"
+	"shadownet/types"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startModbusHoneypot runs a Modbus honeypot with the given PLC profile
+func startModbusHoneypot(t *testing.T, bus *events.Bus, profile string) (*ModbusServer, func()) {
+    p, err := plc.Load(profile, "")
+    require.NoError(t, err)
+    server := NewModbusServer(nil, 0)
+    server.EnableDevice(plc.NewDevice(p))
+    server.Events = bus
+
+    return server, startHoneypot(t, server)
+}
+
+// modbusClient speaks Modbus/TCP in tests
+type modbusClient struct {
+    t           *testing.T
+    conn        net.Conn
+    transaction uint16
+    unit        byte
+}
+
+// frame wraps a PDU in an MBAP header
+func (c *modbusClient) frame(pdu ...byte) []byte {
+    c.transaction++
+    header := make([]byte, 7)
+    binary.BigEndian.PutUint16(header[0:2], c.transaction)
+    binary.BigEndian.PutUint16(header[4:6], uint16(len(pdu)+1))
+    header[6] = c.unit
+    return append(header, pdu...)
+}
+
+// read returns the PDU of the next response, checking its header
+func (c *modbusClient) read() []byte {
+    c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+    header := make([]byte, 7)
+    _, err := io.ReadFull(c.conn, header)
+    require.NoError(c.t, err)
+    assert.Equal(c.t, c.transaction, binary.BigEndian.Uint16(header[0:2]))
+    assert.Equal(c.t, c.unit, header[6])
+    pdu := make([]byte, binary.BigEndian.Uint16(header[4:6])-1)
+    _, err = io.ReadFull(c.conn, pdu)
+    require.NoError(c.t, err)
+    return pdu
+}
+
+// request sends a PDU and returns the response PDU
+func (c *modbusClient) request(pdu ...byte) []byte {
+    _, err := c.conn.Write(c.frame(pdu...))
+    require.NoError(c.t, err)
+    return c.read()
+}
+
+func TestModbusRegisterMap(t *testing.T) {
+    server, stop := startModbusHoneypot(t, nil, "schneider-m340")
+    defer stop()
+    conn, err := net.Dial("tcp", server.Addr().String())
+    require.NoError(t, err)
+    defer conn.Close()
+    c := &modbusClient{t: t, conn: conn, unit: 1}
+
+    // pump_1_run, pump_2_run, inlet and outlet valves, chlorine dosing
+    assert.Equal(t, []byte{0x01, 1, 0x1d}, c.request(0x01, 0, 0, 0, 5))
+    assert.Equal(t, []byte{0x02, 1, 0x01}, c.request(0x02, 0, 0, 0, 3))
+    // tank_level_cm 412 and inlet_flow_lpm 1830
+    assert.Equal(t, []byte{0x04, 4, 0x01, 0x9c, 0x07, 0x26}, c.request(0x04, 0, 0, 0, 2))
+    assert.Equal(t, []byte{0x03, 2, 0x01, 0xc2}, c.request(0x03, 0, 0, 0, 1))
+    // Unnamed addresses inside the table read as 0, addresses beyond it are illegal
+    assert.Equal(t, []byte{0x03, 2, 0, 0}, c.request(0x03, 0, 200, 0, 1))
+    assert.Equal(t, []byte{0x83, 0x02}, c.request(0x03, 0x01, 0x00, 0, 1))
+    assert.Equal(t, []byte{0x83, 0x03}, c.request(0x03, 0, 0, 0, 126))
+
+    // Writes are echoed and stick
+    assert.Equal(t, []byte{0x05, 0, 1, 0xff, 0}, c.request(0x05, 0, 1, 0xff, 0))
+    assert.Equal(t, []byte{0x85, 0x03}, c.request(0x05, 0, 1, 0x12, 0x34))
+    assert.Equal(t, []byte{0x06, 0, 3, 0, 100}, c.request(0x06, 0, 3, 0, 100))
+    assert.Equal(t, []byte{0x0f, 0, 2, 0, 3}, c.request(0x0f, 0, 2, 0, 3, 1, 0x04))
+    assert.Equal(t, []byte{0x01, 1, 0x13}, c.request(0x01, 0, 0, 0, 5))
+    assert.Equal(t, []byte{0x10, 0, 5, 0, 2}, c.request(0x10, 0, 5, 0, 2, 4, 0, 200, 0x02, 0x58))
+    assert.Equal(t, []byte{0x90, 0x03}, c.request(0x10, 0, 5, 0, 2, 3, 0, 200, 0x02))
+
+    // Read/write multiple writes first, then reads
+    assert.Equal(t, []byte{0x17, 6, 0, 100, 0, 7, 0, 200}, c.request(0x17, 0, 3, 0, 3, 0, 4, 0, 1, 2, 0, 7))
+
+    // Other connections see the same memory
+    other, err := net.Dial("tcp", server.Addr().String())
+    require.NoError(t, err)
+    defer other.Close()
+    o := &modbusClient{t: t, conn: other, unit: 1}
+    assert.Equal(t, []byte{0x03, 2, 0, 7}, o.request(0x03, 0, 4, 0, 1))
+
+    assert.Equal(t, []byte{0x88, 0x01}, c.request(0x08, 0, 0, 0x12, 0x34))
+}
+
+func TestModbusDeviceIdentification(t *testing.T) {
+    server, stop := startModbusHoneypot(t, nil, "siemens-s7-1200")
+    defer stop()
+    conn, err := net.Dial("tcp", server.Addr().String())
+    require.NoError(t, err)
+    defer conn.Close()
+    c := &modbusClient{t: t, conn: conn, unit: 1}
+
+    // Basic stream: vendor, product code and revision
+    reply := c.request(0x2b, 0x0e, 1, 0)
+    require.True(t, len(reply) > 7)
+    assert.Equal(t, []byte{0x2b, 0x0e, 1, 0x82, 0, 0, 3}, reply[:7])
+    assert.Equal(t, append([]byte{0, 7}, "Siemens"...), reply[7:16])
+    assert.Contains(t, string(reply), "6ES7 214-1AG40-0XB0")
+    assert.Contains(t, string(reply), "V4.4.0")
+
+    // Individual access to the model name, and an unknown object
+    assert.Equal(t, append([]byte{0x2b, 0x0e, 4, 0x82, 0, 0, 1, 5, 18}, "CPU 1214C DC/DC/DC"...), c.request(0x2b, 0x0e, 4, 5))
+    assert.Equal(t, []byte{0xab, 0x02}, c.request(0x2b, 0x0e, 4, 0x80))
+    assert.Equal(t, []byte{0xab, 0x01}, c.request(0x2b, 0x0d, 1, 0))
+
+    // The profile answers as unit 1 only
+    c.unit = 7
+    assert.Equal(t, []byte{0x83, 0x0b}, c.request(0x03, 0, 0, 0, 1))
+}
+
+func TestModbusSplitFramesAndEvents(t *testing.T) {
+    bus := events.NewBus(16)
+    published := make(chan types.Event, 16)
+    bus.Subscribe("test", events.SubscriberFunc(func(ev types.Event) {
+        published <- ev
+    }))
+    defer bus.Close()
+
+    server, stop := startModbusHoneypot(t, bus, "schneider-m340")
+    defer stop()
+    conn, err := net.Dial("tcp", server.Addr().String())
+    require.NoError(t, err)
+    defer conn.Close()
+    c := &modbusClient{t: t, conn: conn, unit: 1}
+
+    // A write sent a byte at a time is still one request
+    write := c.frame(0x10, 0, 0, 0, 2, 4, 0x01, 0xf4, 0x02, 0x26)
+    for _, b := range write {
+        conn.Write([]byte{b})
+        time.Sleep(time.Millisecond)
+    }
+    assert.Equal(t, []byte{0x10, 0, 0, 0, 2}, c.read())
+    read := c.frame(0x03, 0, 0, 0, 2)
+    conn.Write(read)
+    assert.Equal(t, []byte{0x03, 4, 0x01, 0xf4, 0x02, 0x26}, c.read())
+
+    var got []types.Event
+    for len(got) < 2 {
+        select {
+        case ev := <-published:
+            if ev.Kind == types.EventRequest {
+                got = append(got, ev)
+            }
+        case <-time.After(5 * time.Second):
+            t.Fatal("no event published")
+        }
+    }
+    assert.Equal(t, "0x10", got[0].Fields["function"])
+    assert.Equal(t, "write_multiple_registers", got[0].Fields["function_name"])
+    assert.Equal(t, "write", got[0].Fields["operation"])
+    assert.Equal(t, "holding_registers", got[0].Fields["table"])
+    assert.Equal(t, "0", got[0].Fields["address"])
+    assert.Equal(t, "2", got[0].Fields["quantity"])
+    assert.Equal(t, "500,550", got[0].Fields["values"])
+    assert.Equal(t, "tank_level_setpoint_cm,tank_high_alarm_cm", got[0].Fields["points"])
+    assert.Equal(t, write, got[0].Payload)
+    assert.Equal(t, "read", got[1].Fields["operation"])
+    assert.Equal(t, "500,550", got[1].Fields["values"])
+}
+
+func TestModbusWriteAlerts(t *testing.T) {
+    bus := events.NewBus(16)
+    classifier, err := classify.Load("")
+    require.NoError(t, err)
+    bus.Use(classifier.Classify)
+    alerts := make(chan types.Event, 16)
+    bus.Subscribe("test", events.SubscriberFunc(func(ev types.Event) {
+        if ev.Kind == types.EventProcessAlert {
+            alerts <- ev
+        }
+    }))
+    defer bus.Close()
+
+    server, stop := startModbusHoneypot(t, bus, "schneider-m340")
+    defer stop()
+    conn, err := net.Dial("tcp", server.Addr().String())
+    require.NoError(t, err)
+    defer conn.Close()
+    c := &modbusClient{t: t, conn: conn, unit: 1}
+
+    // pump_1_speed_pct within range is quiet, then both tank alarms and pump_1_speed_pct at 150%
+    c.request(0x06, 0, 3, 0, 90)
+    c.request(0x10, 0, 1, 0, 3, 6, 0x01, 0xf4, 0, 120, 0, 150)
+    c.request(0x05, 0, 17, 0, 0)
+
+    expected := []struct {
+        point, alert, severity, value string
+    }{
+        {"tank_high_alarm_cm", "critical", "high", "500"},
+        {"tank_low_alarm_cm", "critical", "high", "120"},
+        {"pump_1_speed_pct", "unsafe", "critical", "150"},
+        {"remote_control", "critical", "high", "0"},
+    }
+    for _, want := range expected {
+        select {
+        case ev := <-alerts:
+            assert.Equal(t, want.point, ev.Fields["point"])
+            assert.Equal(t, want.alert, ev.Fields["alert"])
+            assert.Equal(t, want.value, ev.Fields["value"])
+            assert.Equal(t, types.AttackTypeICSTampering, ev.Fields[types.FieldAttackTypes])
+            assert.Equal(t, want.severity, ev.Fields[types.FieldSeverity])
+            if want.alert == "unsafe" {
+                assert.Equal(t, "90", ev.Fields["previous"])
+                assert.Equal(t, "100", ev.Fields["safe_max"])
+                assert.Equal(t, "unsafe write pump_1_speed_pct=150 (was 90), safe 0-100", ev.Details)
+            }
+        case <-time.After(5 * time.Second):
+            t.Fatalf("no alert for %s", want.point)
+        }
+    }
+}
+
+func TestModbusSimulationRunsWhileServing(t *testing.T) {
+    p, err := plc.Parse([]byte("name: x\ninput_registers:\n  points:\n    - {address: 0, name: counter}\nprocess:\n  interval: 5ms\n  signals:\n    - kind: integrate\n      point: counter\n      terms: [{rate: 1}]\n"))
+    require.NoError(t, err)
+    server := NewModbusServer(nil, 0)
+    server.EnableDevice(plc.NewDevice(p))
+    server.simulate = true
+    defer startHoneypot(t, server)()
+
+    require.Eventually(t, func() bool {
+        values, _ := server.Device().Read(plc.InputRegisters, 0, 1)
+        return values[0] >= 3
+    }, 5*time.Second, 10*time.Millisecond)
+}
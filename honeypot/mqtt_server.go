@@ -1,34 +1,31 @@
 package honeypot
 
 import (
-	"context"
+	"database/sql"
 	"net"
-	"shadownet/db"
+	"shadownet/recording"
 	"shadownet/utils"
 )
 
 // MQTTServer implements a fake MQTT broker
 type MQTTServer struct {
-    BaseHoneypot
+    *BaseHoneypot
 }
 
-// StartMQTTServer starts a fake MQTT listener with proper error handling
-func StartMQTTServer(port int) error {
-    mqtt := &MQTTServer{
-        BaseHoneypot: BaseHoneypot{
-            Name: "MQTT",
-            Port: port,
-        },
-    }
+func init() {
+    Register("mqtt", func(deps Deps) (Honeypot, error) {
+        return NewMQTTServer(deps.DB, deps.Config.Honeypots.MQTTPort), nil
+    })
+}
 
-    if err := mqtt.Initialize(port); err != nil {
-        return err
+// NewMQTTServer creates a new MQTT honeypot
+func NewMQTTServer(db *sql.DB, port int) *MQTTServer {
+    mqtt := &MQTTServer{
+        BaseHoneypot: NewBaseHoneypot("MQTT", port, db),
     }
-
-    ctx, cancel := context.WithCancel(context.Background())
-    defer cancel()
-
-    return mqtt.Start(ctx, mqtt.handleMQTT)
+    mqtt.RecordMode = recording.ModeBinary
+    mqtt.Handler = mqtt.handleMQTT
+    return mqtt
 }
 
 func (s *MQTTServer) handleMQTT(conn net.Conn) {
@@ -41,11 +38,8 @@ func (s *MQTTServer) handleMQTT(conn net.Conn) {
         return
     }
 
-    // Log the connection attempt
-    hc := s.LogConnection(conn, buf[:n])
-    
-    // Log to database
-    db.LogAttack(hc.IP, "N/A", "mqtt")
+    // Log the connection attempt along with the first bytes sent
+    s.LogConnection(conn, buf[:n])
 
     // Send MQTT CONNECT acknowledgment packet
     // Fixed header: Packet type CONNACK (0x20), Remaining length 2 (0x02)
@@ -54,4 +48,4 @@ func (s *MQTTServer) handleMQTT(conn net.Conn) {
     if _, err := conn.Write(mqttResponse); err != nil {
         utils.Log.Errorf("MQTT write error: %v", err)
     }
-}
\ No newline at end of file
+}
@@ -0,0 +1,298 @@
+package honeypot
+
+import (
+	"errors"
+	"net"
+	"os"
+	"shadownet/utils"
+	"sync"
+	"time"
+)
+
+// Listener networks supported by BaseHoneypot
+const (
+    NetworkTCP = "tcp"
+    NetworkUDP = "udp"
+)
+
+// maxDatagramSize is the largest UDP payload the listener reads
+const maxDatagramSize = 65535
+
+// packetQueueSize is how many unread datagrams a pseudo-session buffers before dropping
+const packetQueueSize = 64
+
+// errResponseLimit is returned when a reply would exceed the reflection limits
+var errResponseLimit = errors.New("response exceeds the UDP reflection limits")
+
+// packetSettings bounds the pseudo-sessions of a datagram honeypot
+type packetSettings struct {
+    // idleTimeout expires a pseudo-session that has been silent this long
+    idleTimeout time.Duration
+    // maxSessions caps the sources tracked at once; datagrams from new sources are dropped beyond it
+    maxSessions int
+    // maxResponseSize caps a single reply datagram
+    maxResponseSize int
+    // maxAmplification caps the bytes sent to a source relative to the bytes it sent,
+    // so spoofed requests cannot turn the sensor into a reflector
+    maxAmplification float64
+}
+
+// defaultPacketSettings are used when the configuration leaves them out
+var defaultPacketSettings = packetSettings{
+    idleTimeout:      time.Minute,
+    maxSessions:      4096,
+    maxResponseSize:  1232,
+    maxAmplification: 3,
+}
+
+// packetListener turns a datagram socket into a net.Listener. Each source address
+// becomes a pseudo-session that is accepted like a TCP connection, so datagram
+// emulators share the session tracking, rate limiting, recording and events of
+// the stream honeypots.
+type packetListener struct {
+    conn     net.PacketConn
+    settings packetSettings
+    sessions map[string]*packetConn
+    incoming chan *packetConn
+    done     chan struct{}
+    err      error
+    closed   bool
+    mu       sync.Mutex
+}
+
+// newPacketListener starts demultiplexing datagrams received on conn
+func newPacketListener(conn net.PacketConn, settings packetSettings) *packetListener {
+    l := &packetListener{
+        conn:     conn,
+        settings: settings,
+        sessions: make(map[string]*packetConn),
+        incoming: make(chan *packetConn),
+        done:     make(chan struct{}),
+    }
+    go l.readLoop()
+    return l
+}
+
+// readLoop routes every datagram to the pseudo-session of its source
+func (l *packetListener) readLoop() {
+    buf := make([]byte, maxDatagramSize)
+    for {
+        n, addr, err := l.conn.ReadFrom(buf)
+        if err != nil {
+            var netErr net.Error
+            if errors.As(err, &netErr) && netErr.Timeout() {
+                continue
+            }
+            l.mu.Lock()
+            l.err = err
+            l.mu.Unlock()
+            close(l.done)
+            return
+        }
+
+        sess, isNew := l.session(addr)
+        if sess == nil {
+            utils.Log.Debugf("Dropping datagram from %s: too many UDP sessions", addr)
+            continue
+        }
+        sess.enqueue(append([]byte(nil), buf[:n]...))
+        if isNew {
+            select {
+            case l.incoming <- sess:
+            case <-l.done:
+                return
+            }
+        }
+    }
+}
+
+// session returns the pseudo-session of addr, creating it if there is room
+func (l *packetListener) session(addr net.Addr) (*packetConn, bool) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    key := addr.String()
+    if sess, ok := l.sessions[key]; ok {
+        return sess, false
+    }
+    if l.closed || (l.settings.maxSessions > 0 && len(l.sessions) >= l.settings.maxSessions) {
+        return nil, false
+    }
+    sess := &packetConn{
+        listener: l,
+        remote:   addr,
+        queue:    make(chan []byte, packetQueueSize),
+        closed:   make(chan struct{}),
+    }
+    l.sessions[key] = sess
+    return sess, true
+}
+
+// forget removes a closed pseudo-session so its source can start a new one
+func (l *packetListener) forget(sess *packetConn) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if l.sessions[sess.remote.String()] == sess {
+        delete(l.sessions, sess.remote.String())
+    }
+}
+
+// Accept waits for a datagram from a new source
+func (l *packetListener) Accept() (net.Conn, error) {
+    select {
+    case sess := <-l.incoming:
+        return sess, nil
+    case <-l.done:
+        l.mu.Lock()
+        defer l.mu.Unlock()
+        return nil, l.err
+    }
+}
+
+// Close closes the socket, which ends every pseudo-session
+func (l *packetListener) Close() error {
+    l.mu.Lock()
+    if l.closed {
+        l.mu.Unlock()
+        return nil
+    }
+    l.closed = true
+    sessions := make([]*packetConn, 0, len(l.sessions))
+    for _, sess := range l.sessions {
+        sessions = append(sessions, sess)
+    }
+    l.mu.Unlock()
+
+    err := l.conn.Close()
+    for _, sess := range sessions {
+        sess.Close()
+    }
+    return err
+}
+
+// Addr returns the local address of the socket
+func (l *packetListener) Addr() net.Addr {
+    return l.conn.LocalAddr()
+}
+
+// packetConn is the pseudo-session of one source address. Each Read returns one
+// datagram; each Write sends one datagram back, within the reflection limits.
+type packetConn struct {
+    listener *packetListener
+    remote   net.Addr
+    queue    chan []byte
+    closed   chan struct{}
+    once     sync.Once
+
+    received     int64
+    sent         int64
+    readDeadline time.Time
+    mu           sync.Mutex
+}
+
+// enqueue buffers a datagram for Read, dropping it when the handler falls behind
+func (c *packetConn) enqueue(data []byte) {
+    c.mu.Lock()
+    c.received += int64(len(data))
+    c.mu.Unlock()
+
+    select {
+    case c.queue <- data:
+    case <-c.closed:
+    default:
+        utils.Log.Debugf("Dropping datagram from %s: session queue full", c.remote)
+    }
+}
+
+// Read returns the next datagram, truncated to len(p). It fails with a timeout
+// once the source has been idle for the idle timeout or the read deadline passes.
+func (c *packetConn) Read(p []byte) (int, error) {
+    c.mu.Lock()
+    deadline := c.readDeadline
+    c.mu.Unlock()
+
+    wait := c.listener.settings.idleTimeout
+    if !deadline.IsZero() {
+        if until := time.Until(deadline); wait <= 0 || until < wait {
+            wait = until
+        }
+    }
+    var timeout <-chan time.Time
+    if wait > 0 {
+        timer := time.NewTimer(wait)
+        defer timer.Stop()
+        timeout = timer.C
+    } else if !deadline.IsZero() {
+        return 0, os.ErrDeadlineExceeded
+    }
+
+    select {
+    case data := <-c.queue:
+        return copy(p, data), nil
+    case <-c.closed:
+        return 0, net.ErrClosed
+    case <-timeout:
+        return 0, os.ErrDeadlineExceeded
+    }
+}
+
+// Write sends p to the source as one datagram unless it would exceed the
+// response size cap or the amplification budget of the session
+func (c *packetConn) Write(p []byte) (int, error) {
+    select {
+    case <-c.closed:
+        return 0, net.ErrClosed
+    default:
+    }
+
+    settings := c.listener.settings
+    c.mu.Lock()
+    budget := int64(settings.maxAmplification * float64(c.received))
+    if (settings.maxResponseSize > 0 && len(p) > settings.maxResponseSize) ||
+        (settings.maxAmplification > 0 && c.sent+int64(len(p)) > budget) {
+        c.mu.Unlock()
+        utils.Log.Debugf("Suppressed %d byte reply to %s: %v", len(p), c.remote, errResponseLimit)
+        return 0, errResponseLimit
+    }
+    c.sent += int64(len(p))
+    c.mu.Unlock()
+
+    return c.listener.conn.WriteTo(p, c.remote)
+}
+
+// Close ends the pseudo-session; later datagrams from the source start a new one
+func (c *packetConn) Close() error {
+    c.once.Do(func() {
+        close(c.closed)
+        c.listener.forget(c)
+    })
+    return nil
+}
+
+// LocalAddr returns the address of the honeypot socket
+func (c *packetConn) LocalAddr() net.Addr {
+    return c.listener.conn.LocalAddr()
+}
+
+// RemoteAddr returns the source address of the pseudo-session
+func (c *packetConn) RemoteAddr() net.Addr {
+    return c.remote
+}
+
+// SetDeadline sets the read deadline; writes never block
+func (c *packetConn) SetDeadline(t time.Time) error {
+    return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline bounds how long Read waits for the next datagram
+func (c *packetConn) SetReadDeadline(t time.Time) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.readDeadline = t
+    return nil
+}
+
+// SetWriteDeadline is a no-op since datagram writes never block
+func (c *packetConn) SetWriteDeadline(t time.Time) error {
+    return nil
+}
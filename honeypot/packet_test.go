@@ -0,0 +1,114 @@
+package honeypot
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startUDPHoneypot runs a datagram honeypot that answers every datagram with reply(datagram)
+func startUDPHoneypot(t *testing.T, settings packetSettings, reply func([]byte) []byte) (*BaseHoneypot, func()) {
+    hp := NewBaseHoneypot("Test", 0, nil)
+    hp.Network = NetworkUDP
+    hp.packet = settings
+    hp.Handler = func(c net.Conn) {
+        buf := make([]byte, maxDatagramSize)
+        for {
+            n, err := c.Read(buf)
+            if err != nil {
+                return
+            }
+            c.Write(reply(buf[:n]))
+        }
+    }
+
+    return hp, startHoneypot(t, hp)
+}
+
+// roundTrip sends a datagram and waits briefly for the answer; it returns nil when none arrives
+func roundTrip(t *testing.T, conn net.Conn, data []byte) []byte {
+    _, err := conn.Write(data)
+    require.NoError(t, err)
+    conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+    buf := make([]byte, maxDatagramSize)
+    n, err := conn.Read(buf)
+    if err != nil {
+        return nil
+    }
+    return buf[:n]
+}
+
+func TestUDPPseudoSessions(t *testing.T) {
+    hp, stop := startUDPHoneypot(t, defaultPacketSettings, func(data []byte) []byte {
+        return bytes.ToUpper(data)
+    })
+    defer stop()
+
+    conn, err := net.Dial("udp", hp.Addr().String())
+    require.NoError(t, err)
+    defer conn.Close()
+
+    assert.Equal(t, []byte("PING"), roundTrip(t, conn, []byte("ping")))
+    assert.Equal(t, []byte("PONG"), roundTrip(t, conn, []byte("pong")))
+    assert.Equal(t, 1, hp.ActiveSessions(), "datagrams from one source share a session")
+
+    other, err := net.Dial("udp", hp.Addr().String())
+    require.NoError(t, err)
+    defer other.Close()
+    assert.Equal(t, []byte("HI"), roundTrip(t, other, []byte("hi")))
+    assert.Equal(t, 2, hp.ActiveSessions())
+}
+
+func TestUDPIdleSessionsExpire(t *testing.T) {
+    settings := defaultPacketSettings
+    settings.idleTimeout = 100 * time.Millisecond
+    hp, stop := startUDPHoneypot(t, settings, func(data []byte) []byte { return data })
+    defer stop()
+
+    conn, err := net.Dial("udp", hp.Addr().String())
+    require.NoError(t, err)
+    defer conn.Close()
+
+    assert.Equal(t, []byte("x"), roundTrip(t, conn, []byte("x")))
+    require.Eventually(t, func() bool { return hp.ActiveSessions() == 0 }, 2*time.Second, 20*time.Millisecond)
+
+    // The source starts a fresh session with its next datagram
+    assert.Equal(t, []byte("y"), roundTrip(t, conn, []byte("y")))
+}
+
+func TestUDPAmplificationCap(t *testing.T) {
+    settings := defaultPacketSettings
+    settings.maxAmplification = 3
+    hp, stop := startUDPHoneypot(t, settings, func(data []byte) []byte {
+        return bytes.Repeat(data, 10)
+    })
+    defer stop()
+
+    conn, err := net.Dial("udp", hp.Addr().String())
+    require.NoError(t, err)
+    defer conn.Close()
+
+    assert.Nil(t, roundTrip(t, conn, []byte("abcd")), "a reply 10x the request must not be sent")
+}
+
+func TestUDPResponseSizeCap(t *testing.T) {
+    settings := defaultPacketSettings
+    settings.maxAmplification = 20
+    settings.maxResponseSize = 64
+    hp, stop := startUDPHoneypot(t, settings, func(data []byte) []byte {
+        return bytes.Repeat(data, 10)
+    })
+    defer stop()
+
+    conn, err := net.Dial("udp", hp.Addr().String())
+    require.NoError(t, err)
+    defer conn.Close()
+
+    assert.Len(t, roundTrip(t, conn, []byte("abcd")), 40)
+    assert.Nil(t, roundTrip(t, conn, []byte("abcdefgh")), "replies larger than max_response_size are suppressed")
+}
@@ -0,0 +1,137 @@
+package honeypot
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"shadownet/config"
+	"shadownet/persona"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+// startWithPersona starts hp presenting profile and returns a stop func
+func startWithPersona(t *testing.T, hp Honeypot, base *BaseHoneypot, profile *persona.Persona) func() {
+    base.persona = profile
+    return startHoneypot(t, hp)
+}
+
+func TestSSHPresentsPersona(t *testing.T) {
+    for _, name := range persona.Builtin() {
+        t.Run(name, func(t *testing.T) {
+            profile, err := persona.Load(name, "")
+            require.NoError(t, err)
+
+            server, err := NewSSHServer(nil, 0, t.TempDir())
+            require.NoError(t, err)
+            defer startWithPersona(t, server, server.BaseHoneypot, profile)()
+
+            var hostKeyType string
+            _, err = ssh.Dial("tcp", server.Addr().String(), &ssh.ClientConfig{
+                User: "root",
+                Auth: []ssh.AuthMethod{ssh.Password("root")},
+                HostKeyCallback: func(_ string, _ net.Addr, key ssh.PublicKey) error {
+                    hostKeyType = key.Type()
+                    return nil
+                },
+                Timeout: 5 * time.Second,
+            })
+            // The handshake completes with the persona's algorithms; only the login fails
+            require.ErrorContains(t, err, "unable to authenticate")
+            assert.Contains(t, profile.SSH.HostKeys, hostKeyType)
+
+            conn, err := net.Dial("tcp", server.Addr().String())
+            require.NoError(t, err)
+            defer conn.Close()
+            version, err := bufio.NewReader(conn).ReadString('\n')
+            require.NoError(t, err)
+            assert.Equal(t, profile.SSH.Version+"\r\n", version)
+        })
+    }
+}
+
+func TestShellPresentsPersona(t *testing.T) {
+    profile, err := persona.Load("siemens-plc", "")
+    require.NoError(t, err)
+
+    server, err := NewSSHServer(nil, 0, t.TempDir())
+    require.NoError(t, err)
+    server.EnableShell(profile.OS.Hostname, []config.SSHLogin{{Username: "root", Password: "123456"}}, nil)
+    defer startWithPersona(t, server, server.BaseHoneypot, profile)()
+
+    client, err := dialSSH(server.Addr().String(), "root", "123456")
+    require.NoError(t, err)
+    defer client.Close()
+    session, err := client.NewSession()
+    require.NoError(t, err)
+    defer session.Close()
+    output, err := session.Output("uname -a; cat /etc/issue /proc/version /etc/os-release")
+    require.NoError(t, err)
+
+    text := string(output)
+    assert.True(t, strings.HasPrefix(text, "Linux plc-line1 4.9.88-rt62 #1 PREEMPT RT Wed Mar 10 09:12:44 CET 2021 armv7l GNU/Linux\n"), text)
+    assert.Contains(t, text, "Siemens SIMATIC S7-1200 firmware V4.4 \\n \\l\n")
+    assert.Contains(t, text, "Linux version 4.9.88-rt62 (builder@simatic)")
+    assert.Contains(t, text, "ID=simatic\n")
+    assert.NotContains(t, text, "Ubuntu")
+
+    // The FTP server shares the filesystem of the same system
+    ftp := NewFTPServer(nil, 0)
+    ftp.EnableLogins(false, []config.FTPLogin{{Username: "admin", Password: "admin"}})
+    defer startWithPersona(t, ftp, ftp.BaseHoneypot, profile)()
+    c := dialFTP(t, ftp)
+    defer c.conn.Close()
+    c.cmd("USER admin")
+    c.cmd("PASS admin")
+    assert.Equal(t, "215 UNIX Type: L8", c.cmd("SYST"))
+    data := c.pasv()
+    assert.True(t, strings.HasPrefix(c.cmd("RETR /proc/version"), "150"))
+    version, _ := io.ReadAll(data)
+    assert.Equal(t, "226 Transfer complete.", c.read())
+    assert.Contains(t, string(version), "4.9.88-rt62")
+}
+
+func TestFTPAndHTTPPresentPersona(t *testing.T) {
+    profile, err := persona.Load("siemens-plc", "")
+    require.NoError(t, err)
+
+    ftp := NewFTPServer(nil, 0)
+    defer startWithPersona(t, ftp, ftp.BaseHoneypot, profile)()
+
+    conn, err := net.Dial("tcp", ftp.Addr().String())
+    require.NoError(t, err)
+    defer conn.Close()
+    r := bufio.NewReader(conn)
+    banner, err := r.ReadString('\n')
+    require.NoError(t, err)
+    assert.Equal(t, "220 CP 1243-1 FTP server ready\r\n", banner)
+    conn.Write([]byte("USER admin\r\n"))
+    reply, err := r.ReadString('\n')
+    require.NoError(t, err)
+    assert.Equal(t, "331 Password required\r\n", reply)
+
+    web := NewHTTPServer(nil, 0)
+    defer startWithPersona(t, web, web.BaseHoneypot, profile)()
+
+    conn, err = net.Dial("tcp", web.Addr().String())
+    require.NoError(t, err)
+    defer conn.Close()
+    conn.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+    response := new(strings.Builder)
+    buf := make([]byte, 4096)
+    for {
+        n, err := conn.Read(buf)
+        response.Write(buf[:n])
+        if err != nil {
+            break
+        }
+    }
+    assert.Contains(t, response.String(), "Server: Siemens, SIMATIC\r\n")
+    assert.Contains(t, response.String(), "Cache-Control: no-cache\r\n")
+    assert.Contains(t, response.String(), "SIMATIC 1200 Station")
+}
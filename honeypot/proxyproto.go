@@ -0,0 +1,202 @@
+package honeypot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyV2Signature starts every PROXY protocol v2 header
+var proxyV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// proxyV1Prefix starts every PROXY protocol v1 header
+var proxyV1Prefix = []byte("PROXY ")
+
+const (
+    // proxyV1MaxLength is the longest valid v1 header including CRLF
+    proxyV1MaxLength = 107
+    // proxyHeaderTimeout bounds how long a trusted proxy may take to send its header
+    proxyHeaderTimeout = 5 * time.Second
+)
+
+// errNoProxyHeader is returned when a connection does not start with a PROXY header
+var errNoProxyHeader = errors.New("connection does not start with a PROXY protocol header")
+
+// proxySettings is the parsed PROXY protocol configuration of a listener
+type proxySettings struct {
+    enabled bool
+    trusted []*net.IPNet
+}
+
+// newProxySettings parses the trusted proxy list; bare IPs are treated as single-host networks
+func newProxySettings(enabled bool, trusted []string) (proxySettings, error) {
+    settings := proxySettings{enabled: enabled}
+    for _, entry := range trusted {
+        entry = strings.TrimSpace(entry)
+        if !strings.Contains(entry, "/") {
+            ip := net.ParseIP(entry)
+            if ip == nil {
+                return settings, fmt.Errorf("invalid trusted proxy %q", entry)
+            }
+            bits := 32
+            if ip.To4() == nil {
+                bits = 128
+            }
+            entry = fmt.Sprintf("%s/%d", entry, bits)
+        }
+        _, network, err := net.ParseCIDR(entry)
+        if err != nil {
+            return settings, fmt.Errorf("invalid trusted proxy %q: %v", entry, err)
+        }
+        settings.trusted = append(settings.trusted, network)
+    }
+    return settings, nil
+}
+
+// trusts reports whether addr belongs to a trusted proxy
+func (p proxySettings) trusts(addr net.Addr) bool {
+    tcp, ok := addr.(*net.TCPAddr)
+    if !ok {
+        return false
+    }
+    for _, network := range p.trusted {
+        if network.Contains(tcp.IP) {
+            return true
+        }
+    }
+    return false
+}
+
+// looksLikeProxyHeader reports whether data is, or starts like, a PROXY protocol header
+func looksLikeProxyHeader(data []byte) bool {
+    if bytes.HasPrefix(data, proxyV1Prefix) {
+        return true
+    }
+    n := len(data)
+    if n > len(proxyV2Signature) {
+        n = len(proxyV2Signature)
+    }
+    return n >= 4 && bytes.Equal(data[:n], proxyV2Signature[:n])
+}
+
+// readProxyHeader consumes a v1 or v2 PROXY header from r without reading past it.
+// It returns nil addresses for LOCAL commands and UNKNOWN families, which keep the
+// connection's own addresses.
+func readProxyHeader(r io.Reader) (src, dst net.Addr, err error) {
+    prefix := make([]byte, len(proxyV1Prefix))
+    if _, err := io.ReadFull(r, prefix); err != nil {
+        return nil, nil, fmt.Errorf("failed to read PROXY header: %v", err)
+    }
+
+    switch {
+    case bytes.Equal(prefix, proxyV1Prefix):
+        return readProxyV1(r)
+    case bytes.Equal(prefix, proxyV2Signature[:len(prefix)]):
+        return readProxyV2(r)
+    default:
+        return nil, nil, errNoProxyHeader
+    }
+}
+
+// readProxyV1 parses the remainder of a text header such as
+// "PROXY TCP4 203.0.113.7 10.0.0.10 51234 22\r\n"
+func readProxyV1(r io.Reader) (net.Addr, net.Addr, error) {
+    line := make([]byte, 0, proxyV1MaxLength)
+    line = append(line, proxyV1Prefix...)
+    b := make([]byte, 1)
+    for !bytes.HasSuffix(line, []byte("\r\n")) {
+        if len(line) >= proxyV1MaxLength {
+            return nil, nil, errors.New("PROXY v1 header too long")
+        }
+        if _, err := io.ReadFull(r, b); err != nil {
+            return nil, nil, fmt.Errorf("failed to read PROXY v1 header: %v", err)
+        }
+        line = append(line, b[0])
+    }
+
+    fields := strings.Fields(string(line))
+    if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+        return nil, nil, nil
+    }
+    if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+        return nil, nil, fmt.Errorf("malformed PROXY v1 header %q", strings.TrimSpace(string(line)))
+    }
+
+    src, err := proxyTCPAddr(fields[2], fields[4])
+    if err != nil {
+        return nil, nil, err
+    }
+    dst, err := proxyTCPAddr(fields[3], fields[5])
+    if err != nil {
+        return nil, nil, err
+    }
+    return src, dst, nil
+}
+
+// proxyTCPAddr parses an address and port from a v1 header
+func proxyTCPAddr(host, port string) (*net.TCPAddr, error) {
+    ip := net.ParseIP(host)
+    if ip == nil {
+        return nil, fmt.Errorf("invalid PROXY v1 address %q", host)
+    }
+    p, err := strconv.Atoi(port)
+    if err != nil || p < 0 || p > 65535 {
+        return nil, fmt.Errorf("invalid PROXY v1 port %q", port)
+    }
+    return &net.TCPAddr{IP: ip, Port: p}, nil
+}
+
+// readProxyV2 parses the remainder of a binary header
+func readProxyV2(r io.Reader) (net.Addr, net.Addr, error) {
+    rest := make([]byte, 16-len(proxyV1Prefix))
+    if _, err := io.ReadFull(r, rest); err != nil {
+        return nil, nil, fmt.Errorf("failed to read PROXY v2 header: %v", err)
+    }
+    if !bytes.Equal(rest[:6], proxyV2Signature[len(proxyV1Prefix):]) {
+        return nil, nil, errNoProxyHeader
+    }
+
+    verCmd, family := rest[6], rest[7]
+    length := binary.BigEndian.Uint16(rest[8:10])
+    if verCmd>>4 != 2 {
+        return nil, nil, fmt.Errorf("unsupported PROXY protocol version %d", verCmd>>4)
+    }
+
+    body := make([]byte, length)
+    if _, err := io.ReadFull(r, body); err != nil {
+        return nil, nil, fmt.Errorf("failed to read PROXY v2 addresses: %v", err)
+    }
+
+    switch verCmd & 0x0F {
+    case 0x0: // LOCAL: health checks from the proxy itself
+        return nil, nil, nil
+    case 0x1: // PROXY
+    default:
+        return nil, nil, fmt.Errorf("unsupported PROXY v2 command %d", verCmd&0x0F)
+    }
+
+    switch family >> 4 {
+    case 0x1: // AF_INET
+        if len(body) < 12 {
+            return nil, nil, errors.New("short PROXY v2 IPv4 address block")
+        }
+        src := &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}
+        dst := &net.TCPAddr{IP: net.IP(body[4:8]), Port: int(binary.BigEndian.Uint16(body[10:12]))}
+        return src, dst, nil
+    case 0x2: // AF_INET6
+        if len(body) < 36 {
+            return nil, nil, errors.New("short PROXY v2 IPv6 address block")
+        }
+        src := &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}
+        dst := &net.TCPAddr{IP: net.IP(body[16:32]), Port: int(binary.BigEndian.Uint16(body[34:36]))}
+        return src, dst, nil
+    default: // AF_UNSPEC or AF_UNIX carry no usable client address
+        return nil, nil, nil
+    }
+}
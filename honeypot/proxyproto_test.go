@@ -0,0 +1,108 @@
+package honeypot
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func proxyV2Header(src, dst *net.TCPAddr) []byte {
+    header := append([]byte(nil), proxyV2Signature...)
+    header = append(header, 0x21, 0x11, 0x00, 0x0C)
+    header = append(header, src.IP.To4()...)
+    header = append(header, dst.IP.To4()...)
+    header = binary.BigEndian.AppendUint16(header, uint16(src.Port))
+    header = binary.BigEndian.AppendUint16(header, uint16(dst.Port))
+    return header
+}
+
+func TestReadProxyHeaderV1(t *testing.T) {
+    r := bytes.NewBufferString("PROXY TCP4 203.0.113.7 10.0.0.10 51234 22\r\nSSH-2.0-libssh\r\n")
+    src, dst, err := readProxyHeader(r)
+    require.NoError(t, err)
+    assert.Equal(t, "203.0.113.7:51234", src.String())
+    assert.Equal(t, "10.0.0.10:22", dst.String())
+    assert.Equal(t, "SSH-2.0-libssh\r\n", r.String(), "payload after the header must be left unread")
+}
+
+func TestReadProxyHeaderV2(t *testing.T) {
+    src := &net.TCPAddr{IP: net.ParseIP("198.51.100.20"), Port: 40000}
+    dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.10"), Port: 502}
+    r := bytes.NewBuffer(append(proxyV2Header(src, dst), 0x00, 0x01))
+
+    gotSrc, gotDst, err := readProxyHeader(r)
+    require.NoError(t, err)
+    assert.Equal(t, src.String(), gotSrc.String())
+    assert.Equal(t, dst.String(), gotDst.String())
+    assert.Equal(t, []byte{0x00, 0x01}, r.Bytes())
+}
+
+func TestReadProxyHeaderV2Local(t *testing.T) {
+    header := append(append([]byte(nil), proxyV2Signature...), 0x20, 0x00, 0x00, 0x00)
+    src, dst, err := readProxyHeader(bytes.NewBuffer(header))
+    require.NoError(t, err)
+    assert.Nil(t, src)
+    assert.Nil(t, dst)
+}
+
+func TestReadProxyHeaderRejectsPlainTraffic(t *testing.T) {
+    _, _, err := readProxyHeader(bytes.NewBufferString("GET / HTTP/1.1\r\n\r\n"))
+    assert.Equal(t, errNoProxyHeader, err)
+}
+
+// startEchoAddrHoneypot runs a honeypot that writes the client address it sees
+func startEchoAddrHoneypot(t *testing.T, trusted []string) (*BaseHoneypot, context.CancelFunc) {
+    hp := NewBaseHoneypot("Test", 0, nil)
+    proxy, err := newProxySettings(true, trusted)
+    require.NoError(t, err)
+    hp.proxy = proxy
+    hp.Handler = func(c net.Conn) {
+        c.Write([]byte(c.RemoteAddr().String() + "\n"))
+        io.Copy(io.Discard, c)
+    }
+
+    // Stopping waits for every session to finish so nothing outlives the test
+    return hp, startHoneypot(t, hp)
+}
+
+func TestTrustedProxyAnnouncesClientAddress(t *testing.T) {
+    hp, cancel := startEchoAddrHoneypot(t, []string{"127.0.0.0/8", "::1"})
+    defer cancel()
+
+    conn, err := net.Dial("tcp", hp.Addr().String())
+    require.NoError(t, err)
+    defer conn.Close()
+
+    conn.Write([]byte("PROXY TCP4 203.0.113.7 10.0.0.10 51234 22\r\n"))
+    line, err := bufio.NewReader(conn).ReadString('\n')
+    require.NoError(t, err)
+    assert.Equal(t, "203.0.113.7:51234\n", line)
+}
+
+func TestUntrustedProxyHeaderIsRejected(t *testing.T) {
+    hp, cancel := startEchoAddrHoneypot(t, []string{"192.0.2.1"})
+    defer cancel()
+
+    conn, err := net.Dial("tcp", hp.Addr().String())
+    require.NoError(t, err)
+    defer conn.Close()
+
+    reader := bufio.NewReader(conn)
+    line, err := reader.ReadString('\n')
+    require.NoError(t, err)
+    assert.NotContains(t, line, "203.0.113.7", "direct connections keep their own address")
+
+    conn.Write([]byte("PROXY TCP4 203.0.113.7 10.0.0.10 51234 22\r\n"))
+    conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+    _, err = reader.ReadByte()
+    assert.Equal(t, io.EOF, err, "the honeypot should close the connection")
+}
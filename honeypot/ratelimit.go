@@ -0,0 +1,449 @@
+package honeypot
+
+import (
+	"fmt"
+	"net"
+	"shadownet/config"
+	"shadownet/types"
+	"shadownet/utils"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LimitAction is what happens to a connection over a rate limit
+type LimitAction string
+
+const (
+    // LimitDrop closes the connection immediately
+    LimitDrop LimitAction = "drop"
+    // LimitDelay holds the connection until capacity frees up, for at most MaxDelay
+    LimitDelay LimitAction = "delay"
+    // LimitTarpit holds the connection open without serving it to waste the client's time
+    LimitTarpit LimitAction = "tarpit"
+)
+
+// Reasons reported in rate_limited events
+const (
+    limitMaxConnections      = "max_connections"
+    limitMaxConnectionsPerIP = "max_connections_per_ip"
+    limitRate                = "rate"
+    limitRatePerIP           = "rate_per_ip"
+)
+
+// limitReportQueue is how many rate_limited events wait to be published; beyond
+// it they are counted and reported with the next one
+const limitReportQueue = 256
+
+// sourceIdleTimeout is how long per-IP state is kept after a source goes quiet
+const sourceIdleTimeout = 5 * time.Minute
+
+// tokenBucket refills at rate tokens per second up to burst
+type tokenBucket struct {
+    rate   float64
+    burst  float64
+    tokens float64
+    last   time.Time
+}
+
+// newTokenBucket creates a full bucket, or nil when rate is not limited
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+    if rate <= 0 {
+        return nil
+    }
+    b := float64(burst)
+    if b < 1 {
+        b = rate
+        if b < 1 {
+            b = 1
+        }
+    }
+    return &tokenBucket{rate: rate, burst: b, tokens: b, last: now}
+}
+
+// refill adds the tokens accumulated since the last call
+func (t *tokenBucket) refill(now time.Time) {
+    if t == nil {
+        return
+    }
+    if elapsed := now.Sub(t.last).Seconds(); elapsed > 0 {
+        t.tokens += elapsed * t.rate
+        if t.tokens > t.burst {
+            t.tokens = t.burst
+        }
+    }
+    t.last = now
+}
+
+// wait returns how long until a token is available; 0 means one is available now
+func (t *tokenBucket) wait() time.Duration {
+    if t == nil || t.tokens >= 1 {
+        return 0
+    }
+    return time.Duration((1 - t.tokens) / t.rate * float64(time.Second))
+}
+
+// take consumes a token
+func (t *tokenBucket) take() {
+    if t != nil {
+        t.tokens--
+    }
+}
+
+// full reports whether the bucket has refilled completely
+func (t *tokenBucket) full() bool {
+    return t == nil || t.tokens >= t.burst
+}
+
+// source is the accounting for one client IP
+type source struct {
+    bucket *tokenBucket
+    active int
+}
+
+// Limiter enforces global and per-IP caps on concurrent connections and on new
+// connections per second. One Limiter is shared by every honeypot of a sensor so
+// a single scanner cannot starve the other services.
+type Limiter struct {
+    maxConns       int
+    maxConnsPerIP  int
+    ratePerIP      float64
+    burstPerIP     int
+    action         LimitAction
+    maxDelay       time.Duration
+    tarpitDuration time.Duration
+    maxHeld        int
+
+    bucket    *tokenBucket
+    sources   map[string]*source
+    active    int
+    held      int
+    lastPrune time.Time
+    now       func() time.Time
+    mu        sync.Mutex
+}
+
+// NewLimiter creates a limiter from the rate limit configuration
+func NewLimiter(cfg config.RateLimitConfig) (*Limiter, error) {
+    action := LimitAction(cfg.Action)
+    switch action {
+    case "":
+        action = LimitDrop
+    case LimitDrop, LimitDelay, LimitTarpit:
+    default:
+        return nil, fmt.Errorf("unknown rate limit action %q", cfg.Action)
+    }
+
+    l := &Limiter{
+        maxConns:       cfg.MaxConnections,
+        maxConnsPerIP:  cfg.MaxConnectionsPerIP,
+        ratePerIP:      cfg.RatePerIP,
+        burstPerIP:     cfg.BurstPerIP,
+        action:         action,
+        maxDelay:       cfg.MaxDelay,
+        tarpitDuration: cfg.TarpitDuration,
+        maxHeld:        cfg.MaxHeld,
+        sources:        make(map[string]*source),
+        now:            time.Now,
+    }
+    l.bucket = newTokenBucket(cfg.Rate, cfg.Burst, l.now())
+    l.lastPrune = l.now()
+    return l, nil
+}
+
+// Action returns what happens to connections over the limit
+func (l *Limiter) Action() LimitAction {
+    if l == nil {
+        return LimitDrop
+    }
+    return l.action
+}
+
+// acquire admits a new connection from ip when every limit allows it.
+// An empty ip only applies the global limits. On refusal it returns the limit
+// that was hit and, for rate limits, how long until a retry can succeed.
+func (l *Limiter) acquire(ip string) (reason string, wait time.Duration) {
+    if l == nil {
+        return "", 0
+    }
+
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    now := l.now()
+    l.prune(now)
+
+    var src *source
+    if ip != "" {
+        src = l.sources[ip]
+        if src == nil {
+            src = &source{bucket: newTokenBucket(l.ratePerIP, l.burstPerIP, now)}
+            l.sources[ip] = src
+        }
+    }
+
+    if l.maxConns > 0 && l.active >= l.maxConns {
+        return limitMaxConnections, 0
+    }
+    if src != nil && l.maxConnsPerIP > 0 && src.active >= l.maxConnsPerIP {
+        return limitMaxConnectionsPerIP, 0
+    }
+    l.bucket.refill(now)
+    if wait := l.bucket.wait(); wait > 0 {
+        return limitRate, wait
+    }
+    if src != nil {
+        src.bucket.refill(now)
+        if wait := src.bucket.wait(); wait > 0 {
+            return limitRatePerIP, wait
+        }
+    }
+
+    l.bucket.take()
+    l.active++
+    if src != nil {
+        src.bucket.take()
+        src.active++
+    }
+    return "", 0
+}
+
+// acquireSource applies the per-IP limits to a connection the global limits
+// already admitted, once a trusted proxy has named its client. On success the
+// connection is accounted to ip, so release must be called with ip.
+func (l *Limiter) acquireSource(ip string) (reason string, wait time.Duration) {
+    if l == nil {
+        return "", 0
+    }
+
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    now := l.now()
+    l.prune(now)
+
+    src := l.sources[ip]
+    if src == nil {
+        src = &source{bucket: newTokenBucket(l.ratePerIP, l.burstPerIP, now)}
+        l.sources[ip] = src
+    }
+    if l.maxConnsPerIP > 0 && src.active >= l.maxConnsPerIP {
+        return limitMaxConnectionsPerIP, 0
+    }
+    src.bucket.refill(now)
+    if wait := src.bucket.wait(); wait > 0 {
+        return limitRatePerIP, wait
+    }
+    src.bucket.take()
+    src.active++
+    return "", 0
+}
+
+// release frees the concurrency slot of a connection admitted by acquire
+func (l *Limiter) release(ip string) {
+    if l == nil {
+        return
+    }
+
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    if l.active > 0 {
+        l.active--
+    }
+    if src := l.sources[ip]; src != nil && src.active > 0 {
+        src.active--
+    }
+}
+
+// hold reserves room for a delayed or tarpitted connection
+func (l *Limiter) hold() bool {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    if l.maxHeld > 0 && l.held >= l.maxHeld {
+        return false
+    }
+    l.held++
+    return true
+}
+
+// unhold frees the room reserved by hold
+func (l *Limiter) unhold() {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    l.held--
+}
+
+// prune forgets idle sources whose buckets have refilled. Callers hold l.mu.
+func (l *Limiter) prune(now time.Time) {
+    if now.Sub(l.lastPrune) < sourceIdleTimeout {
+        return
+    }
+    l.lastPrune = now
+    for ip, src := range l.sources {
+        src.bucket.refill(now)
+        if src.active == 0 && src.bucket.full() {
+            delete(l.sources, ip)
+        }
+    }
+}
+
+// limitKey returns the per-IP accounting key of a connection. Connections from
+// trusted proxies only count against the global limits on accept, since the real
+// client address is not known until admitProxied has read the PROXY header.
+func (b *BaseHoneypot) limitKey(conn net.Conn) string {
+    addr := conn.RemoteAddr()
+    if b.proxy.enabled && b.proxy.trusts(addr) {
+        return ""
+    }
+    return addrIP(addr)
+}
+
+// admitProxied applies the per-IP limits to a session from a trusted proxy once its
+// PROXY header has named the client. A client over its limits is dropped whatever
+// the configured action, since the session already holds a global slot.
+func (b *BaseHoneypot) admitProxied(s *Session) error {
+    if b.limiter == nil || s.remote == nil {
+        return nil
+    }
+    ip := addrIP(s.remote)
+    if reason, _ := b.limiter.acquireSource(ip); reason != "" {
+        ev := b.rateLimited(s.remote, s.localAddr(), reason, LimitDrop)
+        ev.SessionID = s.ID
+        b.Emit(nil, ev)
+        return errRateLimited
+    }
+    s.setLimitKey(ip)
+    return nil
+}
+
+// addrIP returns the IP of addr without its port
+func addrIP(addr net.Addr) string {
+    if tcp, ok := addr.(*net.TCPAddr); ok {
+        return tcp.IP.String()
+    }
+    host, _, err := net.SplitHostPort(addr.String())
+    if err != nil {
+        return addr.String()
+    }
+    return host
+}
+
+// delayPollInterval is how often a delayed connection checks for a free concurrency slot
+const delayPollInterval = 100 * time.Millisecond
+
+// admit applies the rate limits to a newly accepted connection. Admitted connections
+// are handed to Accept as sessions; the rest are dropped, delayed or tarpitted.
+func (l *sessionListener) admit(conn net.Conn) {
+    b := l.owner
+    key := b.limitKey(conn)
+    reason, _ := b.limiter.acquire(key)
+    if reason == "" {
+        l.deliver(acceptResult{conn: b.track(conn, key)})
+        return
+    }
+
+    action := b.limiter.Action()
+    if action != LimitDrop && !b.limiter.hold() {
+        action = LimitDrop
+    }
+    l.reportLimited(b.rateLimited(conn.RemoteAddr(), conn.LocalAddr(), reason, action))
+
+    switch action {
+    case LimitDelay:
+        go l.delay(conn, key)
+    case LimitTarpit:
+        go l.tarpit(conn)
+    default:
+        conn.Close()
+    }
+}
+
+// delay waits up to MaxDelay for the limits to admit conn, then drops it
+func (l *sessionListener) delay(conn net.Conn, key string) {
+    limiter := l.owner.limiter
+    defer limiter.unhold()
+
+    deadline := time.Now().Add(limiter.maxDelay)
+    for {
+        reason, wait := limiter.acquire(key)
+        if reason == "" {
+            l.deliver(acceptResult{conn: l.owner.track(conn, key)})
+            return
+        }
+
+        remaining := time.Until(deadline)
+        if remaining <= 0 {
+            conn.Close()
+            return
+        }
+        if wait <= 0 {
+            wait = delayPollInterval
+        }
+        if wait > remaining {
+            wait = remaining
+        }
+
+        select {
+        case <-time.After(wait):
+        case <-l.stop:
+            conn.Close()
+            return
+        }
+    }
+}
+
+// tarpit holds conn open without reading or writing so the client's scan stalls
+func (l *sessionListener) tarpit(conn net.Conn) {
+    defer l.owner.limiter.unhold()
+    defer conn.Close()
+
+    select {
+    case <-time.After(l.owner.limiter.tarpitDuration):
+    case <-l.stop:
+    }
+}
+
+// rateLimited returns the rate_limited event of a connection from remote to local over the limits
+func (b *BaseHoneypot) rateLimited(remote, local net.Addr, reason string, action LimitAction) types.Event {
+    utils.Log.Debugf("%s rate limited connection from %s (%s, %s)", b.name, remote, reason, action)
+    return types.Event{
+        Kind:      types.EventRateLimited,
+        Src:       types.EndpointFromAddr(remote),
+        Dst:       types.EndpointFromAddr(local),
+        Timestamp: time.Now(),
+        Details:   fmt.Sprintf("%s connection from %s over the %s limit", b.name, remote, reason),
+        Fields: map[string]string{
+            "reason": reason,
+            "action": string(action),
+        },
+    }
+}
+
+// reportLimited hands a rate_limited event to the reporter without waiting, so a
+// slow event bus never stalls the accept loop during a flood
+func (l *sessionListener) reportLimited(ev types.Event) {
+    select {
+    case l.limited <- ev:
+    default:
+        atomic.AddUint64(&l.suppressed, 1)
+    }
+}
+
+// reportLoop publishes rate_limited events until the listener is closed. Events
+// that did not fit in the queue are counted in the suppressed field of the next one.
+func (l *sessionListener) reportLoop() {
+    for {
+        select {
+        case ev := <-l.limited:
+            if n := atomic.SwapUint64(&l.suppressed, 0); n > 0 {
+                ev.Fields["suppressed"] = strconv.FormatUint(n, 10)
+            }
+            l.owner.Emit(nil, ev)
+        case <-l.stop:
+            return
+        }
+    }
+}
@@ -0,0 +1,246 @@
+package honeypot
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"shadownet/config"
+	"shadownet/events"
+	"shadownet/types"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiterTokenBucket(t *testing.T) {
+    limiter, err := NewLimiter(config.RateLimitConfig{RatePerIP: 2, BurstPerIP: 2})
+    require.NoError(t, err)
+    now := time.Unix(1700000000, 0)
+    limiter.now = func() time.Time { return now }
+
+    reason, _ := limiter.acquire("203.0.113.7")
+    assert.Empty(t, reason)
+    reason, _ = limiter.acquire("203.0.113.7")
+    assert.Empty(t, reason)
+
+    reason, wait := limiter.acquire("203.0.113.7")
+    assert.Equal(t, limitRatePerIP, reason)
+    assert.Equal(t, 500*time.Millisecond, wait)
+
+    // Other sources have their own bucket
+    reason, _ = limiter.acquire("198.51.100.20")
+    assert.Empty(t, reason)
+
+    now = now.Add(500 * time.Millisecond)
+    reason, _ = limiter.acquire("203.0.113.7")
+    assert.Empty(t, reason)
+}
+
+func TestLimiterConcurrency(t *testing.T) {
+    limiter, err := NewLimiter(config.RateLimitConfig{MaxConnections: 2, MaxConnectionsPerIP: 1})
+    require.NoError(t, err)
+
+    reason, _ := limiter.acquire("203.0.113.7")
+    assert.Empty(t, reason)
+    reason, _ = limiter.acquire("203.0.113.7")
+    assert.Equal(t, limitMaxConnectionsPerIP, reason)
+    reason, _ = limiter.acquire("198.51.100.20")
+    assert.Empty(t, reason)
+    reason, _ = limiter.acquire("192.0.2.1")
+    assert.Equal(t, limitMaxConnections, reason)
+
+    limiter.release("203.0.113.7")
+    reason, _ = limiter.acquire("203.0.113.7")
+    assert.Empty(t, reason)
+}
+
+func TestNewLimiterRejectsUnknownAction(t *testing.T) {
+    _, err := NewLimiter(config.RateLimitConfig{Action: "block"})
+    assert.Error(t, err)
+}
+
+// startLimitedHoneypot runs a honeypot that greets clients and waits for them to hang up
+func startLimitedHoneypot(t *testing.T, cfg config.RateLimitConfig, bus *events.Bus) (*BaseHoneypot, context.CancelFunc) {
+    limiter, err := NewLimiter(cfg)
+    require.NoError(t, err)
+    hp := NewBaseHoneypot("Test", 0, nil)
+    hp.limiter = limiter
+    hp.Events = bus
+    hp.Handler = func(c net.Conn) {
+        c.Write([]byte("hello\n"))
+        io.Copy(io.Discard, c)
+    }
+
+    // Stopping waits for every session to finish so nothing outlives the test
+    return hp, startHoneypot(t, hp)
+}
+
+func TestRateLimitDropEmitsEvent(t *testing.T) {
+    bus := events.NewBus(16)
+    limited := make(chan types.Event, 1)
+    bus.Subscribe("test", events.SubscriberFunc(func(ev types.Event) {
+        if ev.Kind == types.EventRateLimited {
+            limited <- ev
+        }
+    }))
+    defer bus.Close()
+
+    hp, cancel := startLimitedHoneypot(t, config.RateLimitConfig{MaxConnectionsPerIP: 1, Action: "drop"}, bus)
+    defer cancel()
+
+    first, err := net.Dial("tcp", hp.Addr().String())
+    require.NoError(t, err)
+    defer first.Close()
+    line, err := bufio.NewReader(first).ReadString('\n')
+    require.NoError(t, err)
+    assert.Equal(t, "hello\n", line)
+
+    second, err := net.Dial("tcp", hp.Addr().String())
+    require.NoError(t, err)
+    defer second.Close()
+    second.SetReadDeadline(time.Now().Add(2 * time.Second))
+    _, err = second.Read(make([]byte, 1))
+    assert.Error(t, err, "the connection over the limit should be closed")
+
+    select {
+    case ev := <-limited:
+        assert.Equal(t, limitMaxConnectionsPerIP, ev.Fields["reason"])
+        assert.Equal(t, "drop", ev.Fields["action"])
+        assert.Equal(t, "test", ev.Service)
+    case <-time.After(2 * time.Second):
+        t.Fatal("no rate_limited event published")
+    }
+}
+
+func TestRateLimitingDoesNotWaitForAStalledBus(t *testing.T) {
+    bus := events.NewBus(1)
+    release := make(chan struct{})
+    bus.SubscribeBlocking("db", events.SubscriberFunc(func(ev types.Event) { <-release }))
+    defer bus.Close()
+    defer close(release)
+
+    hp, cancel := startLimitedHoneypot(t, config.RateLimitConfig{MaxConnectionsPerIP: 1, Action: "drop"}, bus)
+    defer cancel()
+
+    first, err := net.Dial("tcp", hp.Addr().String())
+    require.NoError(t, err)
+    defer first.Close()
+    _, err = bufio.NewReader(first).ReadString('\n')
+    require.NoError(t, err)
+
+    // Every connection over the limit is still closed while its event waits
+    for i := 0; i < 5; i++ {
+        conn, err := net.Dial("tcp", hp.Addr().String())
+        require.NoError(t, err)
+        conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+        _, err = conn.Read(make([]byte, 1))
+        var netErr net.Error
+        assert.False(t, errors.As(err, &netErr) && netErr.Timeout(), "connection %d was not dropped", i)
+        conn.Close()
+    }
+}
+
+func TestRateLimitAppliesPerIPLimitsBehindATrustedProxy(t *testing.T) {
+    bus := events.NewBus(16)
+    limited := make(chan types.Event, 4)
+    bus.Subscribe("test", events.SubscriberFunc(func(ev types.Event) {
+        if ev.Kind == types.EventRateLimited {
+            limited <- ev
+        }
+    }))
+    defer bus.Close()
+
+    limiter, err := NewLimiter(config.RateLimitConfig{MaxConnectionsPerIP: 1, Action: "drop"})
+    require.NoError(t, err)
+    proxy, err := newProxySettings(true, []string{"127.0.0.0/8", "::1"})
+    require.NoError(t, err)
+    hp := NewBaseHoneypot("Test", 0, nil)
+    hp.limiter = limiter
+    hp.proxy = proxy
+    hp.Events = bus
+    hp.Handler = func(c net.Conn) {
+        c.Write([]byte("hello\n"))
+        io.Copy(io.Discard, c)
+    }
+    defer startHoneypot(t, hp)()
+
+    // dial connects through the "proxy" on behalf of client and returns the first line
+    dial := func(client string) (net.Conn, string) {
+        conn, err := net.Dial("tcp", hp.Addr().String())
+        require.NoError(t, err)
+        fmt.Fprintf(conn, "PROXY TCP4 %s 10.0.0.10 51234 22\r\n", client)
+        conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+        line, _ := bufio.NewReader(conn).ReadString('\n')
+        return conn, line
+    }
+
+    first, line := dial("203.0.113.7")
+    defer first.Close()
+    assert.Equal(t, "hello\n", line)
+
+    // The same client through the same proxy is over its limit, another client is not
+    second, line := dial("203.0.113.7")
+    defer second.Close()
+    assert.Empty(t, line)
+    other, line := dial("203.0.113.8")
+    defer other.Close()
+    assert.Equal(t, "hello\n", line)
+
+    select {
+    case ev := <-limited:
+        assert.Equal(t, "203.0.113.7", ev.Src.IP)
+        assert.Equal(t, limitMaxConnectionsPerIP, ev.Fields["reason"])
+    case <-time.After(2 * time.Second):
+        t.Fatal("no rate_limited event published")
+    }
+
+    // Closing the session frees the client's slot again
+    first.Close()
+    require.Eventually(t, func() bool {
+        conn, line := dial("203.0.113.7")
+        conn.Close()
+        return line == "hello\n"
+    }, 2*time.Second, 50*time.Millisecond)
+}
+
+func TestRateLimitDelayServesOnceCapacityFrees(t *testing.T) {
+    hp, cancel := startLimitedHoneypot(t, config.RateLimitConfig{
+        MaxConnections: 1,
+        Action:         "delay",
+        MaxDelay:       5 * time.Second,
+    }, nil)
+    defer cancel()
+
+    first, err := net.Dial("tcp", hp.Addr().String())
+    require.NoError(t, err)
+    _, err = bufio.NewReader(first).ReadString('\n')
+    require.NoError(t, err)
+
+    second, err := net.Dial("tcp", hp.Addr().String())
+    require.NoError(t, err)
+    defer second.Close()
+    lines := make(chan string, 1)
+    go func() {
+        line, _ := bufio.NewReader(second).ReadString('\n')
+        lines <- line
+    }()
+
+    select {
+    case <-lines:
+        t.Fatal("delayed connection was served while the limit was reached")
+    case <-time.After(200 * time.Millisecond):
+    }
+
+    first.Close()
+    select {
+    case line := <-lines:
+        assert.Equal(t, "hello\n", line)
+    case <-time.After(2 * time.Second):
+        t.Fatal("delayed connection was not served after capacity freed up")
+    }
+}
@@ -1,34 +1,31 @@
 package honeypot
 
 import (
-	"context"
+	"database/sql"
 	"net"
-	"shadownet/db"
+	"shadownet/recording"
 	"shadownet/utils"
 )
 
 // RDPServer implements a fake RDP server
 type RDPServer struct {
-    BaseHoneypot
+    *BaseHoneypot
 }
 
-// StartRDPServer starts a fake RDP listener with proper error handling
-func StartRDPServer(port int) error {
-    rdp := &RDPServer{
-        BaseHoneypot: BaseHoneypot{
-            Name: "RDP",
-            Port: port,
-        },
-    }
+func init() {
+    Register("rdp", func(deps Deps) (Honeypot, error) {
+        return NewRDPServer(deps.DB, deps.Config.Honeypots.RDPPort), nil
+    })
+}
 
-    if err := rdp.Initialize(port); err != nil {
-        return err
+// NewRDPServer creates a new RDP honeypot
+func NewRDPServer(db *sql.DB, port int) *RDPServer {
+    rdp := &RDPServer{
+        BaseHoneypot: NewBaseHoneypot("RDP", port, db),
     }
-
-    ctx, cancel := context.WithCancel(context.Background())
-    defer cancel()
-
-    return rdp.Start(ctx, rdp.handleRDP)
+    rdp.RecordMode = recording.ModeBinary
+    rdp.Handler = rdp.handleRDP
+    return rdp
 }
 
 func (s *RDPServer) handleRDP(conn net.Conn) {
@@ -41,15 +38,12 @@ func (s *RDPServer) handleRDP(conn net.Conn) {
         return
     }
 
-    // Log the connection attempt
-    hc := s.LogConnection(conn, buf[:n])
-    
-    // Log to database
-    db.LogAttack(hc.IP, "N/A", "rdp")
+    // Log the connection attempt along with the first bytes sent
+    s.LogConnection(conn, buf[:n])
 
     // Send RDP protocol handshake
     rdpHandshake := []byte{0x03, 0x00, 0x00, 0x13} // Standard RDP protocol header
     if _, err := conn.Write(rdpHandshake); err != nil {
         utils.Log.Errorf("RDP write error: %v", err)
     }
-}
\ No newline at end of file
+}
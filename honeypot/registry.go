@@ -0,0 +1,104 @@
+package honeypot
+
+import (
+	"database/sql"
+	"fmt"
+	"shadownet/config"
+	"shadownet/events"
+	"shadownet/persona"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Deps carries the shared resources handed to every honeypot factory
+type Deps struct {
+    Config  *config.Config
+    DB      *sql.DB
+    Events  *events.Bus
+    // Limiter caps connections across every honeypot of the sensor; nil disables limits
+    Limiter *Limiter
+    // Persona is the device profile shared by every honeypot; nil uses the default profile
+    Persona *persona.Persona
+}
+
+// persona returns the persona honeypots are built with
+func (d Deps) persona() *persona.Persona {
+    if d.Persona != nil {
+        return d.Persona
+    }
+    return persona.Default()
+}
+
+// Factory builds a honeypot from the sensor configuration
+type Factory func(deps Deps) (Honeypot, error)
+
+var (
+    registryMu sync.RWMutex
+    registry   = make(map[string]Factory)
+)
+
+// Register makes a honeypot available under the given service name.
+// It panics if the name is registered twice, like database/sql drivers.
+func Register(name string, factory Factory) {
+    registryMu.Lock()
+    defer registryMu.Unlock()
+
+    name = strings.ToLower(name)
+    if factory == nil {
+        panic("honeypot: Register factory is nil for " + name)
+    }
+    if _, dup := registry[name]; dup {
+        panic("honeypot: Register called twice for " + name)
+    }
+    registry[name] = factory
+}
+
+// Registered returns the names of all registered honeypots in sorted order
+func Registered() []string {
+    registryMu.RLock()
+    defer registryMu.RUnlock()
+
+    names := make([]string, 0, len(registry))
+    for name := range registry {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+// Build constructs the honeypot registered under name
+func Build(name string, deps Deps) (Honeypot, error) {
+    registryMu.RLock()
+    factory, ok := registry[strings.ToLower(name)]
+    registryMu.RUnlock()
+
+    if !ok {
+        return nil, fmt.Errorf("unknown honeypot %q", name)
+    }
+
+    hp, err := factory(deps)
+    if err != nil {
+        return nil, err
+    }
+    if b, ok := hp.(interface{ Base() *BaseHoneypot }); ok {
+        if err := b.Base().configure(deps); err != nil {
+            return nil, err
+        }
+    }
+    return hp, nil
+}
+
+// Enabled returns the honeypot names enabled for this sensor.
+// An empty enabled list in the configuration means every registered honeypot.
+func Enabled(cfg *config.Config) []string {
+    if len(cfg.Honeypots.Enabled) == 0 {
+        return Registered()
+    }
+
+    names := make([]string, 0, len(cfg.Honeypots.Enabled))
+    for _, name := range cfg.Honeypots.Enabled {
+        names = append(names, strings.ToLower(strings.TrimSpace(name)))
+    }
+    return names
+}
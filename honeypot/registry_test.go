@@ -0,0 +1,29 @@
+package honeypot
+
+import (
+	"testing"
+
+	"shadownet/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegisteredIncludesBuiltinHoneypots(t *testing.T) {
+    names := Registered()
+    for _, name := range []string{"ssh", "http", "ftp", "rdp", "smb", "modbus", "mqtt"} {
+        assert.Contains(t, names, name)
+    }
+}
+
+func TestEnabledDefaultsToAllRegistered(t *testing.T) {
+    cfg := &config.Config{}
+    assert.Equal(t, Registered(), Enabled(cfg))
+
+    cfg.Honeypots.Enabled = []string{"SSH", " modbus "}
+    assert.Equal(t, []string{"ssh", "modbus"}, Enabled(cfg))
+}
+
+func TestBuildUnknownHoneypot(t *testing.T) {
+    _, err := Build("telnet", Deps{Config: &config.Config{}})
+    assert.Error(t, err)
+}
@@ -0,0 +1,377 @@
+package honeypot
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"net"
+	"shadownet/recording"
+	"shadownet/types"
+	"shadownet/utils"
+	"sync"
+	"time"
+)
+
+// errUntrustedProxyHeader is returned when an untrusted source sends a PROXY header
+var errUntrustedProxyHeader = errors.New("PROXY protocol header from untrusted source")
+
+// errRateLimited is returned when the client behind a trusted proxy is over its limits
+var errRateLimited = errors.New("client over the rate limits")
+
+// Session is an accepted honeypot connection tracked by BaseHoneypot.
+// Handlers receive it as a plain net.Conn; use SessionOf to get the metadata back.
+type Session struct {
+    net.Conn
+    ID      string
+    Started time.Time
+
+    owner    *BaseHoneypot
+    recorder *recording.Recorder
+    // tlsConn carries the session once it speaks TLS, from the start or after STARTTLS
+    tlsConn *tls.Conn
+    // limitKey is the source the session is accounted to in the rate limiter
+    limitKey string
+    limitMu  sync.Mutex
+    // remote and local hold the original addresses announced by a trusted PROXY header
+    remote      net.Addr
+    local       net.Addr
+    screenProxy bool
+    prepareErr  error
+    prepareOnce sync.Once
+    closeOnce   sync.Once
+    // tags are attached to every event of the session, e.g. client fingerprints
+    tagMu sync.Mutex
+    tags  map[string]string
+}
+
+// newSessionID returns a random identifier for a session
+func newSessionID() string {
+    buf := make([]byte, 8)
+    if _, err := rand.Read(buf); err != nil {
+        return time.Now().Format("20060102150405.000000000")
+    }
+    return hex.EncodeToString(buf)
+}
+
+// prepare runs once before the session is first used. It consumes the PROXY header
+// of connections from trusted proxies and starts the recording with the real client
+// address. It is deferred until first use so a slow proxy never blocks an accept loop.
+func (s *Session) prepare() error {
+    s.prepareOnce.Do(func() {
+        if s.owner == nil {
+            return
+        }
+        if s.owner.proxy.enabled {
+            if s.owner.proxy.trusts(s.Conn.RemoteAddr()) {
+                s.prepareErr = s.readProxyHeader()
+                if s.prepareErr == nil {
+                    s.prepareErr = s.owner.admitProxied(s)
+                }
+            } else {
+                // Direct connections are fine, but they may not claim to be a proxy
+                s.screenProxy = true
+            }
+        }
+        if s.prepareErr != nil {
+            // Rate limited clients were already reported
+            if s.prepareErr != errRateLimited {
+                utils.Log.Warningf("%s rejected connection from proxy %s: %v",
+                    s.owner.name, s.Conn.RemoteAddr(), s.prepareErr)
+            }
+            s.Conn.Close()
+            return
+        }
+        if s.owner.tls.implicit && s.owner.tls.config != nil {
+            s.tlsConn = tls.Server(s.helloConn(), s.owner.tls.config)
+        }
+        s.recorder = s.owner.newRecorder(s)
+    })
+    return s.prepareErr
+}
+
+// readProxyHeader reads the PROXY header a trusted proxy sends before any payload
+func (s *Session) readProxyHeader() error {
+    s.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+    src, dst, err := readProxyHeader(s.Conn)
+    s.Conn.SetReadDeadline(s.Started.Add(s.owner.Timeout))
+    if err != nil {
+        return err
+    }
+    s.remote, s.local = src, dst
+    return nil
+}
+
+// RemoteAddr returns the client address, as announced by a trusted proxy when present
+func (s *Session) RemoteAddr() net.Addr {
+    s.prepare()
+    return s.remoteAddr()
+}
+
+// LocalAddr returns the address the client connected to, as announced by a trusted proxy when present
+func (s *Session) LocalAddr() net.Addr {
+    s.prepare()
+    return s.localAddr()
+}
+
+// remoteAddr returns the client address without triggering prepare
+func (s *Session) remoteAddr() net.Addr {
+    if s.remote != nil {
+        return s.remote
+    }
+    return s.Conn.RemoteAddr()
+}
+
+// localAddr returns the local address without triggering prepare
+func (s *Session) localAddr() net.Addr {
+    if s.local != nil {
+        return s.local
+    }
+    return s.Conn.LocalAddr()
+}
+
+// Read reads from the connection, capturing the data when the session is recorded
+func (s *Session) Read(p []byte) (int, error) {
+    if err := s.prepare(); err != nil {
+        return 0, err
+    }
+
+    n, err := s.transport().Read(p)
+    if s.screenProxy && n > 0 {
+        s.screenProxy = false
+        if looksLikeProxyHeader(p[:n]) {
+            s.owner.rejectProxyHeader(s, p[:n])
+            return 0, errUntrustedProxyHeader
+        }
+    }
+    if s.recorder != nil && n > 0 && !s.owner.RecordDecoded {
+        s.recorder.Input(p[:n])
+    }
+    return n, err
+}
+
+// Write writes to the connection, capturing the data when the session is recorded
+func (s *Session) Write(p []byte) (int, error) {
+    if err := s.prepare(); err != nil {
+        return 0, err
+    }
+
+    n, err := s.transport().Write(p)
+    if s.recorder != nil && n > 0 && !s.owner.RecordDecoded {
+        s.recorder.Output(p[:n])
+    }
+    return n, err
+}
+
+// transport returns the connection that carries the session's plaintext
+func (s *Session) transport() net.Conn {
+    if s.tlsConn != nil {
+        return s.tlsConn
+    }
+    return s.Conn
+}
+
+// startTLS switches the session to TLS and completes the handshake
+func (s *Session) startTLS(config *tls.Config) error {
+    if err := s.prepare(); err != nil {
+        return err
+    }
+    if s.tlsConn != nil {
+        return errors.New("session already uses TLS")
+    }
+    s.tlsConn = tls.Server(s.helloConn(), config)
+    return s.tlsConn.Handshake()
+}
+
+// helloConn wraps the connection so the ClientHello of the TLS handshake
+// fingerprints the session
+func (s *Session) helloConn() net.Conn {
+    c := &helloConn{Conn: s.Conn}
+    c.sniffer.found = s.tagClientHello
+    return c
+}
+
+// tagClientHello attaches the JA3 and JA4 fingerprints of the client to the session
+func (s *Session) tagClientHello(hello *clientHello) {
+    fields := hello.fields()
+    if s.owner != nil {
+        if client := lookupTLSClient(s.owner.tls.clients, fields["ja4"], fields["ja3"]); client != "" {
+            fields["tls_client"] = client
+        }
+    }
+    for key, value := range fields {
+        s.Tag(key, value)
+    }
+    utils.Log.Debugf("TLS client %s: ja4=%s ja3=%s sni=%q client=%s",
+        s.remoteAddr(), fields["ja4"], fields["ja3"], fields["tls_sni"], fields["tls_client"])
+}
+
+// TLS returns the TLS connection of the session, or nil while it is in plaintext
+func (s *Session) TLS() *tls.Conn {
+    return s.tlsConn
+}
+
+// RecordInput captures decoded data received from the attacker
+func (s *Session) RecordInput(p []byte) {
+    if s.recorder != nil {
+        s.recorder.Input(p)
+    }
+}
+
+// RecordOutput captures decoded data sent to the attacker
+func (s *Session) RecordOutput(p []byte) {
+    if s.recorder != nil {
+        s.recorder.Output(p)
+    }
+}
+
+// Tag attaches a field to every event emitted for the session from now on
+func (s *Session) Tag(key, value string) {
+    s.tagMu.Lock()
+    defer s.tagMu.Unlock()
+    if s.tags == nil {
+        s.tags = make(map[string]string)
+    }
+    s.tags[key] = value
+}
+
+// Tags returns a copy of the fields attached with Tag
+func (s *Session) Tags() map[string]string {
+    s.tagMu.Lock()
+    defer s.tagMu.Unlock()
+    tags := make(map[string]string, len(s.tags))
+    for k, v := range s.tags {
+        tags[k] = v
+    }
+    return tags
+}
+
+// Recording returns the artifact path of the session recording, or "" when not recorded
+func (s *Session) Recording() string {
+    if s.recorder == nil {
+        return ""
+    }
+    return s.recorder.Path()
+}
+
+// Close closes the underlying connection and stops tracking the session
+func (s *Session) Close() error {
+    err := s.Conn.Close()
+    s.closeOnce.Do(func() {
+        if s.recorder != nil {
+            if rerr := s.recorder.Close(); rerr != nil {
+                utils.Log.Errorf("Session %s recording error: %v", s.ID, rerr)
+            }
+        }
+        if s.owner != nil {
+            s.owner.untrack(s)
+            s.limitMu.Lock()
+            key := s.limitKey
+            s.limitMu.Unlock()
+            s.owner.limiter.release(key)
+        }
+    })
+    return err
+}
+
+// setLimitKey accounts the session to another source in the rate limiter
+func (s *Session) setLimitKey(key string) {
+    s.limitMu.Lock()
+    defer s.limitMu.Unlock()
+    s.limitKey = key
+}
+
+// SessionOf returns the tracked session behind conn, or nil if conn was not accepted by a honeypot
+func SessionOf(conn net.Conn) *Session {
+    if s, ok := conn.(*Session); ok {
+        return s
+    }
+    return nil
+}
+
+// acceptResult is a connection or error handed from the accept loop to Accept
+type acceptResult struct {
+    conn net.Conn
+    err  error
+}
+
+// sessionListener wraps accepted connections in tracked, rate limited sessions.
+// It lets servers that run their own accept loop, like net/http, share the session
+// tracking. Connections are accepted in the background so that connections delayed
+// by the rate limiter can be handed out once capacity frees up.
+type sessionListener struct {
+    net.Listener
+    owner    *BaseHoneypot
+    accepted chan acceptResult
+    failed   chan struct{}
+    err      error
+    stop     chan struct{}
+    stopOnce sync.Once
+    // limited queues rate_limited events for reportLoop; suppressed counts overflow
+    limited    chan types.Event
+    suppressed uint64
+}
+
+// newSessionListener wraps l and starts accepting connections
+func newSessionListener(l net.Listener, owner *BaseHoneypot) *sessionListener {
+    sl := &sessionListener{
+        Listener: l,
+        owner:    owner,
+        accepted: make(chan acceptResult),
+        failed:   make(chan struct{}),
+        stop:     make(chan struct{}),
+        limited:  make(chan types.Event, limitReportQueue),
+    }
+    go sl.acceptLoop()
+    go sl.reportLoop()
+    return sl
+}
+
+// acceptLoop accepts connections until the underlying listener fails or is closed
+func (l *sessionListener) acceptLoop() {
+    defer close(l.failed)
+    for {
+        conn, err := l.Listener.Accept()
+        if err != nil {
+            var netErr net.Error
+            if errors.As(err, &netErr) && netErr.Timeout() {
+                if !l.deliver(acceptResult{err: err}) {
+                    return
+                }
+                continue
+            }
+            l.err = err
+            return
+        }
+        l.admit(conn)
+    }
+}
+
+// deliver hands a result to Accept, closing the connection if the listener is closed first
+func (l *sessionListener) deliver(res acceptResult) bool {
+    select {
+    case l.accepted <- res:
+        return true
+    case <-l.stop:
+        if res.conn != nil {
+            res.conn.Close()
+        }
+        return false
+    }
+}
+
+// Accept waits for the next admitted connection
+func (l *sessionListener) Accept() (net.Conn, error) {
+    select {
+    case res := <-l.accepted:
+        return res.conn, res.err
+    case <-l.failed:
+        return nil, l.err
+    }
+}
+
+// Close closes the listener and releases connections waiting to be accepted
+func (l *sessionListener) Close() error {
+    l.stopOnce.Do(func() { close(l.stop) })
+    return l.Listener.Close()
+}
@@ -1,34 +1,31 @@
 package honeypot
 
 import (
-	"context"
+	"database/sql"
 	"net"
-	"shadownet/db"
+	"shadownet/recording"
 	"shadownet/utils"
 )
 
 // SMBServer implements a fake SMB server
 type SMBServer struct {
-    BaseHoneypot
+    *BaseHoneypot
 }
 
-// StartSMBServer starts a fake SMB listener with proper error handling
-func StartSMBServer(port int) error {
-    smb := &SMBServer{
-        BaseHoneypot: BaseHoneypot{
-            Name: "SMB",
-            Port: port,
-        },
-    }
+func init() {
+    Register("smb", func(deps Deps) (Honeypot, error) {
+        return NewSMBServer(deps.DB, deps.Config.Honeypots.SMBPort), nil
+    })
+}
 
-    if err := smb.Initialize(port); err != nil {
-        return err
+// NewSMBServer creates a new SMB honeypot
+func NewSMBServer(db *sql.DB, port int) *SMBServer {
+    smb := &SMBServer{
+        BaseHoneypot: NewBaseHoneypot("SMB", port, db),
     }
-
-    ctx, cancel := context.WithCancel(context.Background())
-    defer cancel()
-
-    return smb.Start(ctx, smb.handleSMB)
+    smb.RecordMode = recording.ModeBinary
+    smb.Handler = smb.handleSMB
+    return smb
 }
 
 func (s *SMBServer) handleSMB(conn net.Conn) {
@@ -41,15 +38,12 @@ func (s *SMBServer) handleSMB(conn net.Conn) {
         return
     }
 
-    // Log the connection attempt
-    hc := s.LogConnection(conn, buf[:n])
-    
-    // Log to database
-    db.LogAttack(hc.IP, "N/A", "smb")
+    // Log the connection attempt along with the first bytes sent
+    s.LogConnection(conn, buf[:n])
 
     // Send SMB protocol signature (SMB\xFF) as response
     smbSignature := []byte{0x00, 0x53, 0x4D, 0x42, 0xFF}
     if _, err := conn.Write(smbSignature); err != nil {
         utils.Log.Errorf("SMB write error: %v", err)
     }
-}
\ No newline at end of file
+}
@@ -0,0 +1,137 @@
+package honeypot
+
+import (
+	"math/rand"
+	"shadownet/config"
+	"sync"
+	"time"
+)
+
+// authStateTTL is how long the policy remembers an IP that stopped trying
+const authStateTTL = 24 * time.Hour
+
+// authSource is what the policy remembers about one source IP
+type authSource struct {
+    failures int
+    // target is the attempt on which a random password is accepted
+    target int
+    // login is the username and password that got the IP in, once remembered
+    login    *config.SSHLogin
+    lastSeen time.Time
+}
+
+// authPolicy decides which SSH login attempts open the emulated shell, like
+// cowrie's userdb. Verdicts can depend on earlier attempts from the same IP,
+// also over earlier connections.
+type authPolicy struct {
+    rules  []config.AuthRule
+    logins []config.SSHLogin
+    // acceptAfter lets an IP in once it failed this many times, 0 disables
+    acceptAfter int
+    // randomMax accepts a random attempt up to this one per IP, 0 disables
+    randomMax int
+
+    sources   map[string]*authSource
+    lastPrune time.Time
+    now       func() time.Time
+    mu        sync.Mutex
+}
+
+// newAuthPolicy creates a policy that accepts nothing until configured
+func newAuthPolicy() *authPolicy {
+    return &authPolicy{sources: make(map[string]*authSource), now: time.Now}
+}
+
+// accept reports whether user and pass from ip get in and records the attempt
+func (p *authPolicy) accept(ip, user, pass string) bool {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    now := p.now()
+    p.prune(now)
+    src := p.sources[ip]
+    if src == nil {
+        src = &authSource{}
+        p.sources[ip] = src
+    }
+    src.lastSeen = now
+
+    accepted := p.decide(src, user, pass)
+    if !accepted {
+        src.failures++
+    }
+    return accepted
+}
+
+// decide applies the policy to one attempt. Callers hold p.mu.
+func (p *authPolicy) decide(src *authSource, user, pass string) bool {
+    for _, rule := range p.rules {
+        if matchWildcard(rule.Username, user) && matchWildcard(rule.Password, pass) {
+            return !rule.Deny
+        }
+    }
+    for _, login := range p.logins {
+        if login.Username == user && login.Password == pass {
+            return true
+        }
+    }
+
+    // An IP that got in with a random password has to keep using it
+    if src.login != nil {
+        return src.login.Username == user && src.login.Password == pass
+    }
+    if p.acceptAfter > 0 && src.failures >= p.acceptAfter {
+        return true
+    }
+    if p.randomMax > 0 {
+        if src.target == 0 {
+            src.target = 1 + rand.Intn(p.randomMax)
+        }
+        if src.failures+1 >= src.target {
+            src.login = &config.SSHLogin{Username: user, Password: pass}
+            return true
+        }
+    }
+    return false
+}
+
+// prune forgets IPs that have not tried to log in for a while. Callers hold p.mu.
+func (p *authPolicy) prune(now time.Time) {
+    if now.Sub(p.lastPrune) < time.Hour {
+        return
+    }
+    p.lastPrune = now
+    for ip, src := range p.sources {
+        if now.Sub(src.lastSeen) > authStateTTL {
+            delete(p.sources, ip)
+        }
+    }
+}
+
+// matchWildcard reports whether s matches pattern, in which * matches any run
+// of characters and ? a single character. Unlike path.Match, * also matches /.
+func matchWildcard(pattern, s string) bool {
+    pat, str := []rune(pattern), []rune(s)
+    // star is the last * seen and retry where the text it swallows ends next
+    star, retry := -1, 0
+    pi, si := 0, 0
+    for si < len(str) {
+        switch {
+        case pi < len(pat) && (pat[pi] == '?' || pat[pi] == str[si]):
+            pi++
+            si++
+        case pi < len(pat) && pat[pi] == '*':
+            star, retry = pi, si
+            pi++
+        case star >= 0:
+            retry++
+            pi, si = star+1, retry
+        default:
+            return false
+        }
+    }
+    for pi < len(pat) && pat[pi] == '*' {
+        pi++
+    }
+    return pi == len(pat)
+}
@@ -0,0 +1,100 @@
+package honeypot
+
+import (
+	"shadownet/config"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchWildcard(t *testing.T) {
+    cases := []struct {
+        pattern, s string
+        match      bool
+    }{
+        {"*", "", true},
+        {"*", "any/thing", true},
+        {"root", "root", true},
+        {"root", "roots", false},
+        {"adm?n", "admin", true},
+        {"adm?n", "admn", false},
+        {"*admin*", "superadmin123", true},
+        {"*admin*", "adm1n", false},
+        {"a*b*c", "aXXbYYbc", true},
+        {"a*b*c", "aXXbYYbd", false},
+    }
+    for _, c := range cases {
+        assert.Equal(t, c.match, matchWildcard(c.pattern, c.s), "%q ~ %q", c.pattern, c.s)
+    }
+}
+
+func TestAuthPolicyRulesAndLogins(t *testing.T) {
+    policy := newAuthPolicy()
+    policy.logins = []config.SSHLogin{{Username: "root", Password: "123456"}}
+    policy.rules = []config.AuthRule{
+        {Username: "root", Password: "root", Deny: true},
+        {Username: "*", Password: "*admin*"},
+    }
+
+    assert.True(t, policy.accept("198.51.100.1", "root", "123456"))
+    assert.True(t, policy.accept("198.51.100.1", "oracle", "admin2023"))
+    assert.False(t, policy.accept("198.51.100.1", "root", "root"))
+    assert.False(t, policy.accept("198.51.100.1", "root", "toor"))
+}
+
+func TestAuthPolicyAcceptAfterFailures(t *testing.T) {
+    policy := newAuthPolicy()
+    policy.rules = []config.AuthRule{{Username: "*", Password: "root", Deny: true}}
+    policy.acceptAfter = 3
+
+    for i := 0; i < 3; i++ {
+        assert.False(t, policy.accept("198.51.100.1", "root", "guess"))
+    }
+    // Another IP has its own count and deny rules still apply
+    assert.False(t, policy.accept("198.51.100.2", "root", "guess"))
+    assert.False(t, policy.accept("198.51.100.1", "root", "root"))
+    assert.True(t, policy.accept("198.51.100.1", "root", "guess"))
+}
+
+func TestAuthPolicyRemembersRandomPassword(t *testing.T) {
+    policy := newAuthPolicy()
+    policy.randomMax = 4
+
+    attempts := 0
+    for !policy.accept("198.51.100.1", "admin", "pass"+strings.Repeat("!", attempts)) {
+        attempts++
+        require.Less(t, attempts, 4)
+    }
+    remembered := "pass" + strings.Repeat("!", attempts)
+
+    // From then on the IP only gets in with the password that worked
+    assert.True(t, policy.accept("198.51.100.1", "admin", remembered))
+    assert.False(t, policy.accept("198.51.100.1", "admin", remembered+"?"))
+    assert.False(t, policy.accept("198.51.100.1", "root", remembered))
+
+    // The IP is forgotten after a day of silence
+    policy.now = func() time.Time { return time.Now().Add(authStateTTL + 2*time.Hour) }
+    policy.randomMax = 1
+    assert.True(t, policy.accept("198.51.100.1", "root", "other"))
+}
+
+func TestSSHUserHomeAndHostname(t *testing.T) {
+    server, stop := startShellHoneypot(t, nil)
+    defer stop()
+    server.EnableShell("srv-test", nil, []config.SSHUser{{Username: "oracle", Home: "/u01/app/oracle", Hostname: "db-prod02"}})
+    server.ConfigureAuth([]config.AuthRule{{Username: "oracle", Password: "*"}}, 0, 0)
+
+    client, err := dialSSH(server.Addr().String(), "oracle", "welcome1")
+    require.NoError(t, err)
+    defer client.Close()
+
+    out, err := runRemote(t, client, "pwd; hostname; grep oracle /etc/passwd")
+    require.NoError(t, err)
+    assert.Equal(t, "/u01/app/oracle\ndb-prod02\noracle:x:1000:1000:oracle,,,:/u01/app/oracle:/bin/bash\n", out)
+
+    _, err = dialSSH(server.Addr().String(), "root", "123456")
+    assert.Error(t, err, "EnableShell replaces the logins")
+}
@@ -0,0 +1,258 @@
+package honeypot
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"shadownet/types"
+	"shadownet/utils"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// defaultUploadLimit caps an uploaded file when no quarantine store sets a limit
+const defaultUploadLimit = 64 << 20
+
+// maxSCPRecord bounds an SCP control record such as "C0644 1234 name"
+const maxSCPRecord = 4096
+
+// errSCPProtocol is returned for SCP control records that make no sense
+var errSCPProtocol = errors.New("protocol error")
+
+// uploadLimit returns the largest file accepted over SCP or SFTP
+func (s *SSHServer) uploadLimit() int64 {
+    if s.quarantine != nil && s.quarantine.MaxBytes() > 0 {
+        return s.quarantine.MaxBytes()
+    }
+    return defaultUploadLimit
+}
+
+// runExec answers an exec request. scp transfers are served so droppers can
+// deliver their payload; anything else runs in the emulated shell.
+func (s *SSHServer) runExec(client *sshClient, ch ssh.Channel, command string) uint32 {
+    conn := client.conn
+    utils.Log.Warningf("SSH exec from %s (%s): %s", conn.RemoteAddr(), client.user, command)
+
+    if mode, target, ok := parseSCPCommand(command); ok {
+        s.emitExec(client, command, "")
+        if mode == "t" {
+            return s.scpSink(client, ch, target)
+        }
+        return s.scpSource(client, ch, target)
+    }
+
+    output, status := client.exec(command)
+    s.emitExec(client, command, output)
+    if sess := SessionOf(conn); sess != nil {
+        sess.RecordOutput([]byte(output))
+    }
+    ch.Write([]byte(output))
+    return uint32(status)
+}
+
+// emitExec publishes the command of an exec request
+func (s *SSHServer) emitExec(client *sshClient, command, output string) {
+    fields := map[string]string{"username": client.user, "channel": "exec"}
+    s.Emit(client.conn, types.Event{
+        Kind:    types.EventCommand,
+        Payload: commandOutput(output, fields),
+        Details: command,
+        Fields:  fields,
+    })
+}
+
+// parseSCPCommand recognizes the remote side of scp, e.g. "scp -r -t -- /tmp",
+// and returns "t" for uploads or "f" for downloads with the target path
+func parseSCPCommand(command string) (string, string, bool) {
+    fields := strings.Fields(command)
+    if len(fields) < 2 || path.Base(fields[0]) != "scp" {
+        return "", "", false
+    }
+
+    mode, target := "", ""
+    for _, field := range fields[1:] {
+        switch {
+        case field == "--":
+        case strings.HasPrefix(field, "-"):
+            if strings.Contains(field, "t") {
+                mode = "t"
+            } else if strings.Contains(field, "f") {
+                mode = "f"
+            }
+        default:
+            target = field
+        }
+    }
+    if mode == "" || target == "" {
+        return "", "", false
+    }
+    return mode, target, true
+}
+
+// scpSink receives files sent with "scp file host:target" into the fake
+// filesystem and quarantines each of them
+func (s *SSHServer) scpSink(client *sshClient, ch ssh.Channel, target string) uint32 {
+    r := bufio.NewReaderSize(ch, maxSCPRecord)
+    fail := func(err error) uint32 {
+        ch.Write([]byte(fmt.Sprintf("\x01scp: %v\n", err)))
+        return 1
+    }
+
+    client.mu.Lock()
+    dirs := []string{client.shell.Abs(target)}
+    client.mu.Unlock()
+
+    ch.Write([]byte{0})
+    for {
+        record, err := r.ReadSlice('\n')
+        if err == bufio.ErrBufferFull {
+            return fail(errSCPProtocol)
+        }
+        if err == io.EOF && len(record) == 0 {
+            return 0
+        }
+        if err != nil {
+            return 1
+        }
+        client.touch()
+        line := strings.TrimSuffix(string(record), "\n")
+        if line == "" {
+            return fail(errSCPProtocol)
+        }
+
+        switch line[0] {
+        case 'T':
+            // Timestamps are accepted but the fake filesystem keeps its own
+        case 'E':
+            if len(dirs) == 1 {
+                return fail(errSCPProtocol)
+            }
+            dirs = dirs[:len(dirs)-1]
+        case 'C', 'D':
+            mode, size, name, err := parseSCPRecord(line)
+            if err != nil {
+                return fail(err)
+            }
+            dest := client.destination(dirs[len(dirs)-1], name)
+
+            if line[0] == 'D' {
+                client.mu.Lock()
+                err = client.shell.FS().Mkdir(dest, client.user, true)
+                client.mu.Unlock()
+                if err != nil {
+                    return fail(fmt.Errorf("%s: %v", dest, err))
+                }
+                dirs = append(dirs, dest)
+                break
+            }
+
+            if size > s.uploadLimit() {
+                return fail(fmt.Errorf("%s: File too large", name))
+            }
+            ch.Write([]byte{0})
+            // Memory grows with the data actually sent, not with the size claimed
+            data, err := io.ReadAll(io.LimitReader(r, size))
+            if err != nil || int64(len(data)) < size {
+                return 1
+            }
+            if status, err := r.ReadByte(); err != nil || status != 0 {
+                return 1
+            }
+            // The sample is kept even when the fake filesystem refuses it
+            s.Quarantine(client.conn, dest, data)
+            if err := client.writeFile(dest, data, mode); err != nil {
+                return fail(fmt.Errorf("%s: %v", dest, err))
+            }
+        case 0x01, 0x02:
+            // The client reports its own error and carries on or gives up
+            utils.Log.Debugf("SCP client error from %s: %s", client.conn.RemoteAddr(), line[1:])
+            continue
+        default:
+            return fail(errSCPProtocol)
+        }
+        ch.Write([]byte{0})
+    }
+}
+
+// scpSource sends a file of the fake filesystem for "scp host:file ."
+func (s *SSHServer) scpSource(client *sshClient, ch ssh.Channel, target string) uint32 {
+    client.mu.Lock()
+    p := client.shell.Abs(target)
+    info, err := client.shell.FS().Stat(p)
+    var data []byte
+    if err == nil && !info.Dir {
+        data, err = client.shell.FS().ReadFile(p)
+    }
+    client.mu.Unlock()
+
+    ack := make([]byte, 1)
+    if _, err := io.ReadFull(ch, ack); err != nil {
+        return 1
+    }
+    if err == nil && info.Dir {
+        err = errors.New("not a regular file")
+    }
+    if err != nil {
+        ch.Write([]byte(fmt.Sprintf("\x01scp: %s: %v\n", target, err)))
+        return 1
+    }
+
+    fmt.Fprintf(ch, "C%04o %d %s\n", info.Mode.Perm(), len(data), path.Base(p))
+    if _, err := io.ReadFull(ch, ack); err != nil || ack[0] != 0 {
+        return 1
+    }
+    ch.Write(data)
+    ch.Write([]byte{0})
+    if _, err := io.ReadFull(ch, ack); err != nil || ack[0] != 0 {
+        return 1
+    }
+    return 0
+}
+
+// parseSCPRecord parses a "C0644 1234 name" or "D0755 0 name" record
+func parseSCPRecord(line string) (os.FileMode, int64, string, error) {
+    parts := strings.SplitN(line[1:], " ", 3)
+    if len(parts) != 3 {
+        return 0, 0, "", errSCPProtocol
+    }
+    mode, err := strconv.ParseUint(parts[0], 8, 32)
+    if err != nil {
+        return 0, 0, "", errSCPProtocol
+    }
+    size, err := strconv.ParseInt(parts[1], 10, 64)
+    if err != nil || size < 0 {
+        return 0, 0, "", errSCPProtocol
+    }
+    name := path.Base(parts[2])
+    if name == "." || name == ".." || name == "/" {
+        return 0, 0, "", errSCPProtocol
+    }
+    return os.FileMode(mode).Perm(), size, name, nil
+}
+
+// destination returns where an entry named name lands when copied to dir:
+// inside it when it is a directory, or dir itself when copying a single file
+func (c *sshClient) destination(dir, name string) string {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if info, err := c.shell.FS().Stat(dir); err == nil && info.Dir {
+        return path.Join(dir, name)
+    }
+    return dir
+}
+
+// writeFile stores an uploaded file in the fake filesystem
+func (c *sshClient) writeFile(p string, data []byte, mode os.FileMode) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    fs := c.shell.FS()
+    if err := fs.WriteFile(p, data, c.user, false); err != nil {
+        return err
+    }
+    return fs.Chmod(p, mode)
+}
@@ -0,0 +1,337 @@
+package honeypot
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+	"shadownet/events"
+	"shadownet/quarantine"
+	"shadownet/types"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+// collectEvents subscribes to bus and returns a channel with the events of kind
+func collectEvents(bus *events.Bus, kind types.EventKind) chan types.Event {
+    ch := make(chan types.Event, 16)
+    bus.Subscribe(string(kind), events.SubscriberFunc(func(ev types.Event) {
+        if ev.Kind == kind {
+            ch <- ev
+        }
+    }))
+    return ch
+}
+
+// nextEvent waits for the next event on ch
+func nextEvent(t *testing.T, ch chan types.Event) types.Event {
+    select {
+    case ev := <-ch:
+        return ev
+    case <-time.After(2 * time.Second):
+        t.Fatal("no event published")
+        return types.Event{}
+    }
+}
+
+// runRemote runs a command over a new session and returns its output
+func runRemote(t *testing.T, client *ssh.Client, command string) (string, error) {
+    session, err := client.NewSession()
+    require.NoError(t, err)
+    defer session.Close()
+    out, err := session.CombinedOutput(command)
+    return string(out), err
+}
+
+func TestParseSCPCommand(t *testing.T) {
+    mode, target, ok := parseSCPCommand("scp -r -d -t -- /tmp/.x")
+    assert.True(t, ok)
+    assert.Equal(t, "t", mode)
+    assert.Equal(t, "/tmp/.x", target)
+
+    mode, target, ok = parseSCPCommand("/usr/bin/scp -f /etc/passwd")
+    assert.True(t, ok)
+    assert.Equal(t, "f", mode)
+    assert.Equal(t, "/etc/passwd", target)
+
+    _, _, ok = parseSCPCommand("uname -a")
+    assert.False(t, ok)
+}
+
+func TestSSHExecRunsInFakeShell(t *testing.T) {
+    bus := events.NewBus(16)
+    commands := collectEvents(bus, types.EventCommand)
+    defer bus.Close()
+
+    server, stop := startShellHoneypot(t, bus)
+    defer stop()
+    client, err := dialSSH(server.Addr().String(), "root", "123456")
+    require.NoError(t, err)
+    defer client.Close()
+
+    out, err := runRemote(t, client, "uname -n; whoami")
+    require.NoError(t, err)
+    assert.Equal(t, "srv-test\nroot\n", out)
+
+    ev := nextEvent(t, commands)
+    assert.Equal(t, "uname -n; whoami", ev.Details)
+    assert.Equal(t, "exec", ev.Fields["channel"])
+
+    _, err = runRemote(t, client, "cat /nonexistent")
+    var exit *ssh.ExitError
+    require.ErrorAs(t, err, &exit)
+    assert.Equal(t, 1, exit.ExitStatus())
+}
+
+func TestSSHSCPUploadIsQuarantined(t *testing.T) {
+    bus := events.NewBus(16)
+    uploads := collectEvents(bus, types.EventUpload)
+    defer bus.Close()
+
+    server, stop := startShellHoneypot(t, bus)
+    defer stop()
+    client, err := dialSSH(server.Addr().String(), "root", "123456")
+    require.NoError(t, err)
+    defer client.Close()
+
+    session, err := client.NewSession()
+    require.NoError(t, err)
+    stdin, err := session.StdinPipe()
+    require.NoError(t, err)
+    stdout, err := session.StdoutPipe()
+    require.NoError(t, err)
+    require.NoError(t, session.Start("scp -t /tmp"))
+
+    payload := "#!/bin/sh\necho pwned\n"
+    ack := func() {
+        b := make([]byte, 1)
+        _, err := io.ReadFull(stdout, b)
+        require.NoError(t, err)
+        require.Equal(t, byte(0), b[0])
+    }
+    ack()
+    io.WriteString(stdin, "C0755 21 bot.sh\n")
+    ack()
+    io.WriteString(stdin, payload+"\x00")
+    ack()
+    stdin.Close()
+    require.NoError(t, session.Wait())
+
+    ev := nextEvent(t, uploads)
+    sum := quarantine.Sum([]byte(payload))
+    assert.Equal(t, "/tmp/bot.sh", ev.Fields["filename"])
+    assert.Equal(t, sum, ev.Fields["sha256"])
+    assert.Equal(t, "21", ev.Fields["size"])
+    stored, err := os.ReadFile(ev.Fields["path"])
+    require.NoError(t, err)
+    assert.Equal(t, payload, string(stored))
+
+    // The upload is visible to later commands on the same connection
+    out, err := runRemote(t, client, "ls -l /tmp/bot.sh")
+    require.NoError(t, err)
+    assert.Contains(t, out, "-rwxr-xr-x")
+}
+
+func TestSSHSCPQuarantinesUploadsTheFilesystemRefuses(t *testing.T) {
+    bus := events.NewBus(16)
+    uploads := collectEvents(bus, types.EventUpload)
+    defer bus.Close()
+
+    server, stop := startShellHoneypot(t, bus)
+    defer stop()
+    client, err := dialSSH(server.Addr().String(), "root", "123456")
+    require.NoError(t, err)
+    defer client.Close()
+
+    session, err := client.NewSession()
+    require.NoError(t, err)
+    stdin, err := session.StdinPipe()
+    require.NoError(t, err)
+    stdout, err := session.StdoutPipe()
+    require.NoError(t, err)
+    require.NoError(t, session.Start("scp -t /nonexistent/bot.sh"))
+
+    payload := "#!/bin/sh\necho pwned\n"
+    b := make([]byte, 1)
+    _, err = io.ReadFull(stdout, b)
+    require.NoError(t, err)
+    io.WriteString(stdin, "C0755 21 bot.sh\n")
+    _, err = io.ReadFull(stdout, b)
+    require.NoError(t, err)
+    io.WriteString(stdin, payload+"\x00")
+
+    // The client hears about the filesystem error, but the sample is kept
+    out, _ := io.ReadAll(stdout)
+    assert.Contains(t, string(out), "\x01scp: /nonexistent/bot.sh:")
+    session.Wait()
+
+    ev := nextEvent(t, uploads)
+    assert.Equal(t, quarantine.Sum([]byte(payload)), ev.Fields["sha256"])
+    stored, err := os.ReadFile(ev.Fields["path"])
+    require.NoError(t, err)
+    assert.Equal(t, payload, string(stored))
+}
+
+func TestSSHSCPRejectsOversizedRecords(t *testing.T) {
+    bus := events.NewBus(16)
+    defer bus.Close()
+
+    server, stop := startShellHoneypot(t, bus)
+    defer stop()
+    client, err := dialSSH(server.Addr().String(), "root", "123456")
+    require.NoError(t, err)
+    defer client.Close()
+
+    session, err := client.NewSession()
+    require.NoError(t, err)
+    stdin, err := session.StdinPipe()
+    require.NoError(t, err)
+    stdout, err := session.StdoutPipe()
+    require.NoError(t, err)
+    require.NoError(t, session.Start("scp -t /tmp"))
+
+    b := make([]byte, 1)
+    _, err = io.ReadFull(stdout, b)
+    require.NoError(t, err)
+
+    // A control record without an end is cut off instead of buffered
+    io.WriteString(stdin, "C0644 5 "+strings.Repeat("a", 2*maxSCPRecord))
+    out, _ := io.ReadAll(stdout)
+    assert.Equal(t, "\x01scp: protocol error\n", string(out))
+    var exit *ssh.ExitError
+    require.ErrorAs(t, session.Wait(), &exit)
+    assert.Equal(t, 1, exit.ExitStatus())
+}
+
+// sftpClient speaks just enough SFTP to upload and stat a file
+type sftpClient struct {
+    t   *testing.T
+    in  io.Writer
+    out *bufio.Reader
+}
+
+func (c *sftpClient) send(kind byte, fields ...interface{}) {
+    payload := []byte{kind}
+    for _, field := range fields {
+        switch v := field.(type) {
+        case uint32:
+            payload = binary.BigEndian.AppendUint32(payload, v)
+        case uint64:
+            payload = binary.BigEndian.AppendUint64(payload, v)
+        case string:
+            payload = appendString(payload, v)
+        }
+    }
+    _, err := c.in.Write(append(binary.BigEndian.AppendUint32(nil, uint32(len(payload))), payload...))
+    require.NoError(c.t, err)
+}
+
+func (c *sftpClient) receive() (byte, []byte) {
+    header := make([]byte, 4)
+    _, err := io.ReadFull(c.out, header)
+    require.NoError(c.t, err)
+    packet := make([]byte, binary.BigEndian.Uint32(header))
+    _, err = io.ReadFull(c.out, packet)
+    require.NoError(c.t, err)
+    return packet[0], packet[1:]
+}
+
+// status reads a STATUS response and returns its code
+func (c *sftpClient) status() uint32 {
+    kind, payload := c.receive()
+    require.Equal(c.t, byte(sftpStatus), kind)
+    return binary.BigEndian.Uint32(payload[4:])
+}
+
+func TestSSHSFTPUploadIsQuarantined(t *testing.T) {
+    bus := events.NewBus(16)
+    uploads := collectEvents(bus, types.EventUpload)
+    defer bus.Close()
+
+    server, stop := startShellHoneypot(t, bus)
+    defer stop()
+    client, err := dialSSH(server.Addr().String(), "root", "123456")
+    require.NoError(t, err)
+    defer client.Close()
+
+    session, err := client.NewSession()
+    require.NoError(t, err)
+    defer session.Close()
+    stdin, err := session.StdinPipe()
+    require.NoError(t, err)
+    stdout, err := session.StdoutPipe()
+    require.NoError(t, err)
+    require.NoError(t, session.RequestSubsystem("sftp"))
+    c := &sftpClient{t: t, in: stdin, out: bufio.NewReader(stdout)}
+
+    c.send(sftpInit, uint32(3))
+    kind, _ := c.receive()
+    require.Equal(t, byte(sftpVersion), kind)
+
+    c.send(sftpOpen, uint32(1), ".kworker", uint32(sftpFlagWrite|sftpFlagCreate|sftpFlagTrunc), uint32(0))
+    kind, payload := c.receive()
+    require.Equal(t, byte(sftpHandle), kind)
+    handle := string(payload[8:])
+
+    c.send(sftpWrite, uint32(2), handle, uint64(0), "\x7fELF")
+    assert.Equal(t, uint32(sftpOK), c.status())
+    c.send(sftpWrite, uint32(3), handle, uint64(4), "\x02\x01\x01")
+    assert.Equal(t, uint32(sftpOK), c.status())
+    c.send(sftpClose, uint32(4), handle)
+    assert.Equal(t, uint32(sftpOK), c.status())
+
+    c.send(sftpStat, uint32(5), "/root/.kworker")
+    kind, payload = c.receive()
+    require.Equal(t, byte(sftpAttrs), kind)
+    assert.Equal(t, uint64(7), binary.BigEndian.Uint64(payload[8:]))
+
+    c.send(sftpStat, uint32(6), "/nope")
+    assert.Equal(t, uint32(sftpNoSuchFile), c.status())
+
+    ev := nextEvent(t, uploads)
+    assert.Equal(t, "/root/.kworker", ev.Fields["filename"])
+    assert.Equal(t, quarantine.Sum([]byte("\x7fELF\x02\x01\x01")), ev.Fields["sha256"])
+    assert.FileExists(t, ev.Fields["path"])
+}
+
+func TestSSHSFTPRejectsWritesBeyondTheLimit(t *testing.T) {
+    bus := events.NewBus(16)
+    defer bus.Close()
+
+    server, stop := startShellHoneypot(t, bus)
+    defer stop()
+    client, err := dialSSH(server.Addr().String(), "root", "123456")
+    require.NoError(t, err)
+    defer client.Close()
+
+    session, err := client.NewSession()
+    require.NoError(t, err)
+    defer session.Close()
+    stdin, err := session.StdinPipe()
+    require.NoError(t, err)
+    stdout, err := session.StdoutPipe()
+    require.NoError(t, err)
+    require.NoError(t, session.RequestSubsystem("sftp"))
+    c := &sftpClient{t: t, in: stdin, out: bufio.NewReader(stdout)}
+
+    c.send(sftpInit, uint32(3))
+    c.receive()
+    c.send(sftpOpen, uint32(1), "x", uint32(sftpFlagWrite|sftpFlagCreate), uint32(0))
+    _, payload := c.receive()
+    handle := string(payload[8:])
+
+    // An offset that wraps around must not pass the upload limit
+    c.send(sftpWrite, uint32(2), handle, uint64(1<<64-1), "AAAA")
+    assert.Equal(t, uint32(sftpFailure), c.status())
+    c.send(sftpWrite, uint32(3), handle, uint64(defaultUploadLimit), "A")
+    assert.Equal(t, uint32(sftpFailure), c.status())
+
+    // The session survives and keeps serving
+    c.send(sftpWrite, uint32(4), handle, uint64(0), "ok")
+    assert.Equal(t, uint32(sftpOK), c.status())
+}
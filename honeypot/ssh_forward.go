@@ -0,0 +1,142 @@
+package honeypot
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"shadownet/config"
+	"shadownet/types"
+	"shadownet/utils"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// forwardPayloadTimeout is how long a forwarded connection may stay silent before
+// it is reported without payload
+const forwardPayloadTimeout = 10 * time.Second
+
+// defaultForwardCapture is how much of a forwarded payload is kept when not configured
+const defaultForwardCapture = 4096
+
+// EnableForwarding accepts port forwarding from shell logins. Nothing is ever
+// connected: forwarded connections get the canned response for their port.
+func (s *SSHServer) EnableForwarding(captureBytes int, responses []config.ForwardResponse) {
+    if captureBytes <= 0 {
+        captureBytes = defaultForwardCapture
+    }
+    s.forwardEnabled = true
+    s.forwardCapture = captureBytes
+    s.forwardResponses = make(map[int]config.ForwardResponse, len(responses))
+    for _, response := range responses {
+        s.forwardResponses[response.Port] = response
+    }
+}
+
+// serveGlobalRequests answers connection-wide requests such as tcpip-forward
+func (s *SSHServer) serveGlobalRequests(client *sshClient, reqs <-chan *ssh.Request) {
+    for req := range reqs {
+        switch {
+        case req.Type == "tcpip-forward" && s.forwardEnabled:
+            var payload struct {
+                Host string
+                Port uint32
+            }
+            if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+                req.Reply(false, nil)
+                continue
+            }
+            port := payload.Port
+            if port == 0 {
+                // Pretend the kernel picked an ephemeral port
+                port = uint32(32768 + time.Now().UnixNano()%28000)
+            }
+            s.emitProxyAbuse(client, "tcpip-forward", payload.Host, port, nil, map[string]string{})
+            req.Reply(true, ssh.Marshal(struct{ Port uint32 }{port}))
+        case req.Type == "cancel-tcpip-forward" && s.forwardEnabled:
+            req.Reply(true, nil)
+        default:
+            if req.WantReply {
+                req.Reply(false, nil)
+            }
+        }
+    }
+}
+
+// acceptDirectTCPIP accepts a direct-tcpip channel, the client side of "ssh -L" and "ssh -D"
+func (s *SSHServer) acceptDirectTCPIP(client *sshClient, newChannel ssh.NewChannel) {
+    var target struct {
+        Host       string
+        Port       uint32
+        OriginHost string
+        OriginPort uint32
+    }
+    if !s.forwardEnabled {
+        newChannel.Reject(ssh.Prohibited, "administratively prohibited")
+        return
+    }
+    if err := ssh.Unmarshal(newChannel.ExtraData(), &target); err != nil {
+        newChannel.Reject(ssh.ConnectionFailed, "malformed request")
+        return
+    }
+
+    ch, requests, err := newChannel.Accept()
+    if err != nil {
+        utils.Log.Debugf("SSH direct-tcpip accept error from %s: %v", client.conn.RemoteAddr(), err)
+        return
+    }
+    go ssh.DiscardRequests(requests)
+    go s.serveDirectTCPIP(client, ch, target.Host, target.Port, target.OriginHost, target.OriginPort)
+}
+
+// serveDirectTCPIP captures the first payload of a forwarded connection and
+// answers it with the canned response for the destination port
+func (s *SSHServer) serveDirectTCPIP(client *sshClient, ch ssh.Channel, host string, port uint32, originHost string, originPort uint32) {
+    defer ch.Close()
+
+    response := s.forwardResponses[int(port)]
+    if response.Banner != "" {
+        ch.Write([]byte(response.Banner))
+    }
+
+    // Channels have no deadlines, so the read runs aside and is abandoned on timeout
+    captured := make(chan []byte, 1)
+    go func() {
+        buf := make([]byte, s.forwardCapture)
+        n, _ := io.ReadAtLeast(ch, buf, 1)
+        captured <- buf[:n]
+    }()
+
+    var payload []byte
+    select {
+    case payload = <-captured:
+    case <-time.After(forwardPayloadTimeout):
+    }
+    client.touch()
+
+    s.emitProxyAbuse(client, "direct-tcpip", host, port, payload, map[string]string{
+        "origin_host": originHost,
+        "origin_port": strconv.Itoa(int(originPort)),
+    })
+    if len(payload) > 0 && response.Reply != "" {
+        ch.Write([]byte(response.Reply))
+    }
+}
+
+// emitProxyAbuse logs a forwarding attempt and publishes it as a proxy_abuse event
+func (s *SSHServer) emitProxyAbuse(client *sshClient, kind, host string, port uint32, payload []byte, fields map[string]string) {
+    dest := net.JoinHostPort(host, strconv.Itoa(int(port)))
+    utils.Log.Warningf("SSH %s from %s (%s) to %s", kind, client.conn.RemoteAddr(), client.user, dest)
+
+    fields["type"] = kind
+    fields["dest_host"] = host
+    fields["dest_port"] = strconv.Itoa(int(port))
+    fields["username"] = client.user
+    s.Emit(client.conn, types.Event{
+        Kind:    types.EventProxyAbuse,
+        Payload: payload,
+        Details: fmt.Sprintf("%s %s", kind, dest),
+        Fields:  fields,
+    })
+}
@@ -0,0 +1,90 @@
+package honeypot
+
+import (
+	"bufio"
+	"io"
+	"shadownet/config"
+	"shadownet/events"
+	"shadownet/types"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSSHDirectTCPIPGetsCannedResponse(t *testing.T) {
+    bus := events.NewBus(16)
+    abuse := collectEvents(bus, types.EventProxyAbuse)
+    defer bus.Close()
+
+    server, stop := startShellHoneypot(t, bus)
+    defer stop()
+    server.EnableForwarding(0, []config.ForwardResponse{{
+        Port:   25,
+        Banner: "220 mail.example.com ESMTP Postfix\r\n",
+        Reply:  "250 mail.example.com\r\n",
+    }})
+
+    client, err := dialSSH(server.Addr().String(), "root", "123456")
+    require.NoError(t, err)
+    defer client.Close()
+
+    conn, err := client.Dial("tcp", "gmail-smtp-in.l.google.com:25")
+    require.NoError(t, err)
+    defer conn.Close()
+
+    r := bufio.NewReader(conn)
+    banner, err := r.ReadString('\n')
+    require.NoError(t, err)
+    assert.Equal(t, "220 mail.example.com ESMTP Postfix\r\n", banner)
+
+    _, err = io.WriteString(conn, "EHLO spam.example\r\n")
+    require.NoError(t, err)
+    reply, err := r.ReadString('\n')
+    require.NoError(t, err)
+    assert.Equal(t, "250 mail.example.com\r\n", reply)
+
+    ev := nextEvent(t, abuse)
+    assert.Equal(t, "direct-tcpip", ev.Fields["type"])
+    assert.Equal(t, "gmail-smtp-in.l.google.com", ev.Fields["dest_host"])
+    assert.Equal(t, "25", ev.Fields["dest_port"])
+    assert.Equal(t, "root", ev.Fields["username"])
+    assert.Equal(t, "EHLO spam.example\r\n", string(ev.Payload))
+}
+
+func TestSSHTCPIPForwardIsEmulated(t *testing.T) {
+    bus := events.NewBus(16)
+    abuse := collectEvents(bus, types.EventProxyAbuse)
+    defer bus.Close()
+
+    server, stop := startShellHoneypot(t, bus)
+    defer stop()
+    server.EnableForwarding(0, nil)
+
+    client, err := dialSSH(server.Addr().String(), "root", "123456")
+    require.NoError(t, err)
+    defer client.Close()
+
+    listener, err := client.Listen("tcp", "0.0.0.0:1080")
+    require.NoError(t, err)
+    defer listener.Close()
+
+    ev := nextEvent(t, abuse)
+    assert.Equal(t, "tcpip-forward", ev.Fields["type"])
+    assert.Equal(t, "0.0.0.0", ev.Fields["dest_host"])
+    assert.Equal(t, "1080", ev.Fields["dest_port"])
+}
+
+func TestSSHForwardingDisabledRejectsChannels(t *testing.T) {
+    server, stop := startShellHoneypot(t, nil)
+    defer stop()
+
+    client, err := dialSSH(server.Addr().String(), "root", "123456")
+    require.NoError(t, err)
+    defer client.Close()
+
+    _, err = client.Dial("tcp", "10.0.0.1:22")
+    assert.Error(t, err)
+    _, err = client.Listen("tcp", "0.0.0.0:1080")
+    assert.Error(t, err)
+}
@@ -0,0 +1,145 @@
+package honeypot
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"shadownet/utils"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// HostKeyTypes are the host key algorithms generated by `ssh-keygen -A` on a stock OpenSSH server
+var HostKeyTypes = []string{"rsa", "ecdsa", "ed25519"}
+
+// hostKeyPath returns where the private host key of a type is stored, named like /etc/ssh
+func hostKeyPath(dir, keyType string) string {
+    return filepath.Join(dir, fmt.Sprintf("ssh_host_%s_key", keyType))
+}
+
+// LoadHostKeys loads the SSH host keys from dir, generating any that are missing
+func LoadHostKeys(dir string) ([]ssh.Signer, error) {
+    if err := os.MkdirAll(dir, 0700); err != nil {
+        return nil, fmt.Errorf("failed to create host key directory: %v", err)
+    }
+
+    signers := make([]ssh.Signer, 0, len(HostKeyTypes))
+    for _, keyType := range HostKeyTypes {
+        path := hostKeyPath(dir, keyType)
+        data, err := os.ReadFile(path)
+        if errors.Is(err, os.ErrNotExist) {
+            utils.Log.Infof("Generating SSH %s host key in %s", keyType, dir)
+            if err := writeHostKey(dir, keyType); err != nil {
+                return nil, err
+            }
+            data, err = os.ReadFile(path)
+        }
+        if err != nil {
+            return nil, fmt.Errorf("failed to read SSH %s host key: %v", keyType, err)
+        }
+        checkHostKeyPermissions(path)
+
+        signer, err := ssh.ParsePrivateKey(data)
+        if err != nil {
+            return nil, fmt.Errorf("failed to parse SSH %s host key: %v", keyType, err)
+        }
+        signers = append(signers, signer)
+    }
+    return signers, nil
+}
+
+// RotateHostKeys replaces every host key in dir with a freshly generated one
+func RotateHostKeys(dir string) ([]ssh.Signer, error) {
+    if err := os.MkdirAll(dir, 0700); err != nil {
+        return nil, fmt.Errorf("failed to create host key directory: %v", err)
+    }
+    for _, keyType := range HostKeyTypes {
+        if err := writeHostKey(dir, keyType); err != nil {
+            return nil, err
+        }
+    }
+    return LoadHostKeys(dir)
+}
+
+// writeHostKey generates a host key and atomically writes the private and public halves
+func writeHostKey(dir, keyType string) error {
+    key, err := generateHostKey(keyType)
+    if err != nil {
+        return fmt.Errorf("failed to generate SSH %s host key: %v", keyType, err)
+    }
+    block, err := ssh.MarshalPrivateKey(key, "")
+    if err != nil {
+        return fmt.Errorf("failed to encode SSH %s host key: %v", keyType, err)
+    }
+    signer, err := ssh.NewSignerFromKey(key)
+    if err != nil {
+        return fmt.Errorf("failed to create SSH %s signer: %v", keyType, err)
+    }
+
+    path := hostKeyPath(dir, keyType)
+    if err := writeFileAtomic(path, pem.EncodeToMemory(block), 0600); err != nil {
+        return fmt.Errorf("failed to save SSH %s host key: %v", keyType, err)
+    }
+    if err := writeFileAtomic(path+".pub", ssh.MarshalAuthorizedKey(signer.PublicKey()), 0644); err != nil {
+        return fmt.Errorf("failed to save SSH %s public key: %v", keyType, err)
+    }
+    return nil
+}
+
+// generateHostKey creates a private key with OpenSSH's default parameters
+func generateHostKey(keyType string) (crypto.PrivateKey, error) {
+    switch keyType {
+    case "rsa":
+        return rsa.GenerateKey(rand.Reader, 3072)
+    case "ecdsa":
+        return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    case "ed25519":
+        _, key, err := ed25519.GenerateKey(rand.Reader)
+        return key, err
+    default:
+        return nil, fmt.Errorf("unsupported host key type %q", keyType)
+    }
+}
+
+// writeFileAtomic writes data to a temporary file and renames it over path,
+// so a crash never leaves a truncated key behind
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+    tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(tmp.Name())
+
+    if err := tmp.Chmod(perm); err != nil {
+        tmp.Close()
+        return err
+    }
+    if _, err := tmp.Write(data); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Close(); err != nil {
+        return err
+    }
+    return os.Rename(tmp.Name(), path)
+}
+
+// checkHostKeyPermissions tightens a private key readable by other users
+func checkHostKeyPermissions(path string) {
+    info, err := os.Stat(path)
+    if err != nil || info.Mode().Perm()&0077 == 0 {
+        return
+    }
+    utils.Log.Warningf("SSH host key %s has permissions %04o, restricting to 0600", path, info.Mode().Perm())
+    if err := os.Chmod(path, 0600); err != nil {
+        utils.Log.Errorf("Failed to restrict permissions of %s: %v", path, err)
+    }
+}
@@ -0,0 +1,71 @@
+package honeypot
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+// fingerprints returns the SHA256 fingerprints of signers in order
+func fingerprints(signers []ssh.Signer) []string {
+    prints := make([]string, len(signers))
+    for i, signer := range signers {
+        prints[i] = ssh.FingerprintSHA256(signer.PublicKey())
+    }
+    return prints
+}
+
+func TestHostKeysPersistAcrossRestarts(t *testing.T) {
+    dir := t.TempDir()
+
+    first, err := LoadHostKeys(dir)
+    require.NoError(t, err)
+    require.Len(t, first, 3)
+    assert.Equal(t, "ssh-rsa", first[0].PublicKey().Type())
+    assert.Equal(t, "ecdsa-sha2-nistp256", first[1].PublicKey().Type())
+    assert.Equal(t, "ssh-ed25519", first[2].PublicKey().Type())
+
+    for _, keyType := range HostKeyTypes {
+        info, err := os.Stat(hostKeyPath(dir, keyType))
+        require.NoError(t, err)
+        assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+    }
+
+    second, err := LoadHostKeys(dir)
+    require.NoError(t, err)
+    assert.Equal(t, fingerprints(first), fingerprints(second))
+}
+
+func TestRotateHostKeys(t *testing.T) {
+    dir := t.TempDir()
+
+    before, err := LoadHostKeys(dir)
+    require.NoError(t, err)
+    rotated, err := RotateHostKeys(dir)
+    require.NoError(t, err)
+
+    for i := range before {
+        assert.NotEqual(t, fingerprints(before)[i], fingerprints(rotated)[i])
+    }
+    after, err := LoadHostKeys(dir)
+    require.NoError(t, err)
+    assert.Equal(t, fingerprints(rotated), fingerprints(after))
+}
+
+func TestHostKeyPermissionsAreRestricted(t *testing.T) {
+    dir := t.TempDir()
+
+    _, err := LoadHostKeys(dir)
+    require.NoError(t, err)
+    path := hostKeyPath(dir, "ed25519")
+    require.NoError(t, os.Chmod(path, 0644))
+
+    _, err = LoadHostKeys(dir)
+    require.NoError(t, err)
+    info, err := os.Stat(path)
+    require.NoError(t, err)
+    assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
@@ -1,15 +1,15 @@
 package honeypot
 
 import (
-	"context"
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/x509"
 	"database/sql"
-	"encoding/pem"
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
 
+	"shadownet/config"
+	"shadownet/types"
 	"shadownet/utils"
 
 	"golang.org/x/crypto/ssh"
@@ -17,69 +17,250 @@ import (
 
 // SSHServer implements a fake SSH server
 type SSHServer struct {
-    BaseHoneypot
-    config *ssh.ServerConfig
+    *BaseHoneypot
+    signers []ssh.Signer
+
+    // shellEnabled lets logins accepted by auth into the emulated shell
+    shellEnabled bool
+    hostname     string
+    users        map[string]config.SSHUser
+    auth         *authPolicy
+
+    // forwardEnabled answers port forwarding with canned responses keyed by destination port
+    forwardEnabled   bool
+    forwardCapture   int
+    forwardResponses map[int]config.ForwardResponse
+}
+
+func init() {
+    Register("ssh", func(deps Deps) (Honeypot, error) {
+        server, err := NewSSHServer(deps.DB, deps.Config.Honeypots.SSHPort, deps.Config.SSH.HostKeyDir)
+        if err != nil {
+            return nil, err
+        }
+        if shell := deps.Config.SSH.Shell; shell.Enabled {
+            hostname := shell.Hostname
+            if hostname == "" {
+                hostname = deps.persona().OS.Hostname
+            }
+            server.EnableShell(hostname, shell.Logins, shell.Users)
+        }
+        auth := deps.Config.SSH.Auth
+        randomMax := 0
+        if auth.RandomPassword.Enabled {
+            randomMax = auth.RandomPassword.MaxAttempts
+        }
+        server.ConfigureAuth(auth.Rules, auth.AcceptAfter, randomMax)
+        if forwarding := deps.Config.SSH.Forwarding; forwarding.Enabled {
+            server.EnableForwarding(forwarding.CaptureBytes, forwarding.Responses)
+        }
+        return server, nil
+    })
 }
 
-// NewSSHServer creates a new SSH honeypot
-func NewSSHServer(db *sql.DB, port int) (*SSHServer, error) {
+// NewSSHServer creates a new SSH honeypot with the host keys persisted in hostKeyDir
+func NewSSHServer(db *sql.DB, port int, hostKeyDir string) (*SSHServer, error) {
     sshServer := &SSHServer{
-        BaseHoneypot: *NewBaseHoneypot("SSH", port, db),
+        BaseHoneypot: NewBaseHoneypot("SSH", port, db),
+        auth:         newAuthPolicy(),
     }
+    sshServer.Handler = sshServer.handleSSH
+    // The socket carries ciphertext, so the shell records the decrypted channel instead
+    sshServer.RecordDecoded = true
+
+    // Reuse the same host keys across restarts so repeat visitors see a stable fingerprint
+    signers, err := LoadHostKeys(hostKeyDir)
+    if err != nil {
+        return nil, err
+    }
+    sshServer.signers = signers
+
+    return sshServer, nil
+}
 
-    // Initialize SSH server config
+// EnableShell accepts the given logins and drops them into an emulated shell on
+// hostname. users override the home directory and hostname of single accounts.
+func (s *SSHServer) EnableShell(hostname string, logins []config.SSHLogin, users []config.SSHUser) {
+    s.shellEnabled = true
+    s.hostname = hostname
+    s.auth.logins = logins
+    s.users = make(map[string]config.SSHUser, len(users))
+    for _, user := range users {
+        s.users[user.Username] = user
+    }
+}
+
+// ConfigureAuth sets which attempts get in besides the shell logins: rules are
+// checked first, then an IP gets in after acceptAfter failures or, when randomMax
+// is set, with whatever password it tries on a random attempt up to randomMax.
+// Zero disables either behaviour.
+func (s *SSHServer) ConfigureAuth(rules []config.AuthRule, acceptAfter, randomMax int) {
+    s.auth.rules = rules
+    s.auth.acceptAfter = acceptAfter
+    s.auth.randomMax = randomMax
+}
+
+// serverConfig builds the SSH server config for a single connection so
+// authentication callbacks can attribute events to its session. Password,
+// public key and keyboard-interactive are all offered so every method a
+// client tries is captured; only password-style logins can succeed.
+func (s *SSHServer) serverConfig(conn net.Conn) *ssh.ServerConfig {
+    attempts := 0
+    authenticate := func(c ssh.ConnMetadata, creds types.Credentials) (*ssh.Permissions, error) {
+        attempts++
+        accepted := creds.Method != types.AuthPublicKey && s.acceptLogin(c.RemoteAddr(), creds.Username, creds.Password)
+        s.recordAuth(conn, c, creds, attempts, accepted)
+        if !accepted {
+            return nil, fmt.Errorf("access denied")
+        }
+        return &ssh.Permissions{Extensions: map[string]string{"user": creds.Username}}, nil
+    }
+
+    profile := s.Persona().SSH
     config := &ssh.ServerConfig{
+        Config: ssh.Config{
+            KeyExchanges: serverKeyExchanges(profile.KeyExchanges),
+            Ciphers:      profile.Ciphers,
+            MACs:         profile.MACs,
+        },
+        ServerVersion: profile.Version,
         PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
-            ip := c.RemoteAddr().String()
-            user := c.User()
-            utils.Log.Warningf("Rejected SSH login attempt from %s - user:%s", ip, user)
-            return nil, fmt.Errorf("access denied")
+            return authenticate(c, types.Credentials{
+                Username: c.User(),
+                Password: string(pass),
+                Method:   types.AuthPassword,
+            })
+        },
+        PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+            return authenticate(c, types.Credentials{
+                Username:       c.User(),
+                Method:         types.AuthPublicKey,
+                KeyType:        key.Type(),
+                KeyFingerprint: ssh.FingerprintSHA256(key),
+            })
+        },
+        KeyboardInteractiveCallback: func(c ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+            answers, err := client(c.User(), "", []string{"Password: "}, []bool{false})
+            if err != nil {
+                return nil, err
+            }
+            creds := types.Credentials{Username: c.User(), Method: types.AuthKeyboardInteractive}
+            if len(answers) > 0 {
+                creds.Password = answers[0]
+            }
+            return authenticate(c, creds)
         },
     }
 
-    // Generate the RSA key
-    privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
-    if err != nil {
-        return nil, fmt.Errorf("failed to generate private key: %v", err)
+    for _, signer := range s.hostKeys(profile.HostKeys) {
+        config.AddHostKey(signer)
     }
+    return config
+}
 
-    // Generate PEM block for logging purposes
-    privateKeyPEM := pem.EncodeToMemory(&pem.Block{
-        Type:  "RSA PRIVATE KEY",
-        Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
-    })
-    utils.Log.Debugf("Generated SSH host key: %s", string(privateKeyPEM))
-
-    signer, err := ssh.NewSignerFromKey(privateKey)
-    if err != nil {
-        return nil, fmt.Errorf("failed to create signer: %v", err)
+// serverKeyExchanges drops the group exchange methods, which x/crypto/ssh only
+// implements for clients and fails the handshake on when a client picks them
+func serverKeyExchanges(kex []string) []string {
+    if kex == nil {
+        return nil
     }
+    supported := make([]string, 0, len(kex))
+    for _, name := range kex {
+        if !strings.HasPrefix(name, "diffie-hellman-group-exchange-") {
+            supported = append(supported, name)
+        }
+    }
+    return supported
+}
 
-    config.AddHostKey(signer)
-    sshServer.config = config
-
-    return sshServer, nil
+// hostKeys returns the host keys of the given types, or all of them when none match
+func (s *SSHServer) hostKeys(keyTypes []string) []ssh.Signer {
+    var signers []ssh.Signer
+    for _, signer := range s.signers {
+        for _, keyType := range keyTypes {
+            if signer.PublicKey().Type() == keyType {
+                signers = append(signers, signer)
+                break
+            }
+        }
+    }
+    if len(signers) == 0 {
+        return s.signers
+    }
+    return signers
 }
 
-// Start starts the SSH honeypot server
-func (s *SSHServer) Start() error {
-    if err := s.Initialize(s.Port); err != nil {
-        return err
+// recordAuth logs an authentication attempt and publishes it as a login event.
+// attempt is the position of the attempt within the connection, so the order
+// in which a client tries methods and keys can be compared across botnets.
+func (s *SSHServer) recordAuth(conn net.Conn, c ssh.ConnMetadata, creds types.Credentials, attempt int, accepted bool) {
+    ip := c.RemoteAddr().String()
+    result := "rejected"
+    if accepted {
+        result = "accepted"
+        utils.Log.Warningf("Accepted SSH %s login from %s - user:%s", creds.Method, ip, creds.Username)
+    } else {
+        utils.Log.Warningf("Rejected SSH %s login attempt from %s - user:%s", creds.Method, ip, creds.Username)
     }
 
-    ctx, cancel := context.WithCancel(context.Background())
-    defer cancel()
+    details := fmt.Sprintf("user:%s,pass:%s", creds.Username, creds.Password)
+    if creds.Method == types.AuthPublicKey {
+        details = fmt.Sprintf("user:%s,key:%s %s", creds.Username, creds.KeyType, creds.KeyFingerprint)
+    }
+    s.Emit(conn, types.Event{
+        Kind:        types.EventLogin,
+        Credentials: &creds,
+        Details:     details,
+        Fields: map[string]string{
+            "client_version": string(c.ClientVersion()),
+            "method":         creds.Method,
+            "attempt":        strconv.Itoa(attempt),
+            "result":         result,
+        },
+    })
+}
 
-    return s.BaseHoneypot.Start(ctx, s.handleSSH)
+// fingerprintConn wraps conn so the HASSH of the client and the HASSHServer of our
+// side are tagged on its session, and calls ready once both are known
+func (s *SSHServer) fingerprintConn(conn net.Conn, ready func()) net.Conn {
+    sess := SessionOf(conn)
+    var mu sync.Mutex
+    seen := 0
+    tag := func(key, algorithms string) {
+        fingerprint := hassh(algorithms)
+        utils.Log.Debugf("SSH %s from %s: %s (%s)", key, conn.RemoteAddr(), fingerprint, algorithms)
+        if sess != nil {
+            sess.Tag(key, fingerprint)
+            sess.Tag(key+"_algorithms", algorithms)
+        }
+        mu.Lock()
+        seen++
+        both := seen == 2
+        mu.Unlock()
+        if both {
+            ready()
+        }
+    }
+    return newHASSHConn(conn,
+        func(k *kexInit) { tag("hassh", k.ClientAlgorithms()) },
+        func(k *kexInit) { tag("hassh_server", k.ServerAlgorithms()) },
+    )
 }
 
 func (s *SSHServer) handleSSH(conn net.Conn) {
     defer conn.Close()
 
+    // The connect event waits for the key exchange so it carries the fingerprints
+    var connected sync.Once
+    logConnection := func() {
+        connected.Do(func() { s.LogConnection(conn, nil) })
+    }
+
     // Attempt SSH handshake
-    sshConn, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+    sshConn, chans, reqs, err := ssh.NewServerConn(s.fingerprintConn(conn, logConnection), s.serverConfig(conn))
+    logConnection()
     if err != nil {
-        // This is expected as we deny all auth attempts
+        // This is expected as most auth attempts are denied
         utils.Log.Debugf("SSH handshake error from %s: %v", conn.RemoteAddr(), err)
         return
     }
@@ -90,10 +271,23 @@ func (s *SSHServer) handleSSH(conn net.Conn) {
     clientVersion := string(sshConn.ClientVersion())
     utils.Log.Warningf("SSH connection attempt from %s with client version %s", remoteAddr, clientVersion)
 
-    // Even though we'll never reach here (as auth always fails), 
-    // proper handling of channels and requests
-    go ssh.DiscardRequests(reqs)
-    for ch := range chans {
-        ch.Reject(ssh.Prohibited, "Not implemented")
+    // Only logins accepted by the shell get this far
+    client := s.newSSHClient(conn, sshConn.Permissions.Extensions["user"])
+    client.touch()
+    go s.serveGlobalRequests(client, reqs)
+    for newChannel := range chans {
+        switch newChannel.ChannelType() {
+        case "session":
+            ch, requests, err := newChannel.Accept()
+            if err != nil {
+                utils.Log.Debugf("SSH channel accept error from %s: %v", remoteAddr, err)
+                continue
+            }
+            go s.serveSession(client, ch, requests)
+        case "direct-tcpip":
+            s.acceptDirectTCPIP(client, newChannel)
+        default:
+            newChannel.Reject(ssh.Prohibited, "Not implemented")
+        }
     }
 }
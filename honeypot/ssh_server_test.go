@@ -0,0 +1,80 @@
+package honeypot
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"shadownet/events"
+	"shadownet/types"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSHCapturesEveryAuthMethod(t *testing.T) {
+    bus := events.NewBus(16)
+    logins := make(chan types.Event, 8)
+    bus.Subscribe("test", events.SubscriberFunc(func(ev types.Event) {
+        if ev.Kind == types.EventLogin {
+            logins <- ev
+        }
+    }))
+    defer bus.Close()
+
+    server, stop := startShellHoneypot(t, bus)
+    defer stop()
+
+    _, private, err := ed25519.GenerateKey(rand.Reader)
+    require.NoError(t, err)
+    signer, err := ssh.NewSignerFromKey(private)
+    require.NoError(t, err)
+
+    client, err := ssh.Dial("tcp", server.Addr().String(), &ssh.ClientConfig{
+        User: "root",
+        Auth: []ssh.AuthMethod{
+            ssh.PublicKeys(signer),
+            ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+                return []string{"hunter2"}, nil
+            }),
+            ssh.Password("123456"),
+        },
+        HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+        ClientVersion:   "SSH-2.0-libssh_0.9.6",
+        Timeout:         5 * time.Second,
+    })
+    require.NoError(t, err)
+    client.Close()
+
+    var attempts []types.Event
+    for len(attempts) < 3 {
+        select {
+        case ev := <-logins:
+            attempts = append(attempts, ev)
+        case <-time.After(2 * time.Second):
+            t.Fatalf("only %d login events published", len(attempts))
+        }
+    }
+
+    key := attempts[0]
+    assert.Equal(t, types.AuthPublicKey, key.Credentials.Method)
+    assert.Equal(t, "ssh-ed25519", key.Credentials.KeyType)
+    assert.Equal(t, ssh.FingerprintSHA256(signer.PublicKey()), key.Credentials.KeyFingerprint)
+    assert.Equal(t, "1", key.Fields["attempt"])
+    assert.Equal(t, "rejected", key.Fields["result"])
+    assert.Equal(t, "SSH-2.0-libssh_0.9.6", key.Fields["client_version"])
+
+    interactive := attempts[1]
+    assert.Equal(t, types.AuthKeyboardInteractive, interactive.Credentials.Method)
+    assert.Equal(t, "hunter2", interactive.Credentials.Password)
+    assert.Equal(t, "2", interactive.Fields["attempt"])
+    assert.Equal(t, "rejected", interactive.Fields["result"])
+
+    password := attempts[2]
+    assert.Equal(t, types.AuthPassword, password.Credentials.Method)
+    assert.Equal(t, "root", password.Credentials.Username)
+    assert.Equal(t, "123456", password.Credentials.Password)
+    assert.Equal(t, "3", password.Fields["attempt"])
+    assert.Equal(t, "accepted", password.Fields["result"])
+}
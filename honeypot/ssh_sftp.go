@@ -0,0 +1,574 @@
+package honeypot
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"shadownet/shell"
+	"shadownet/types"
+	"shadownet/utils"
+	"strconv"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SFTP version 3 packet types (draft-ietf-secsh-filexfer-02)
+const (
+    sftpInit     = 1
+    sftpVersion  = 2
+    sftpOpen     = 3
+    sftpClose    = 4
+    sftpRead     = 5
+    sftpWrite    = 6
+    sftpLstat    = 7
+    sftpFstat    = 8
+    sftpSetstat  = 9
+    sftpFsetstat = 10
+    sftpOpendir  = 11
+    sftpReaddir  = 12
+    sftpRemove   = 13
+    sftpMkdir    = 14
+    sftpRmdir    = 15
+    sftpRealpath = 16
+    sftpStat     = 17
+    sftpRename   = 18
+    sftpStatus   = 101
+    sftpHandle   = 102
+    sftpData     = 103
+    sftpName     = 104
+    sftpAttrs    = 105
+)
+
+// SFTP status codes
+const (
+    sftpOK               = 0
+    sftpEOF              = 1
+    sftpNoSuchFile       = 2
+    sftpPermissionDenied = 3
+    sftpFailure          = 4
+    sftpBadMessage       = 5
+    sftpOpUnsupported    = 8
+)
+
+// SFTP open flags and attribute flags
+const (
+    sftpFlagWrite  = 0x02
+    sftpFlagAppend = 0x04
+    sftpFlagCreate = 0x08
+    sftpFlagTrunc  = 0x10
+    sftpFlagExcl   = 0x20
+
+    sftpAttrSize        = 0x01
+    sftpAttrUIDGID      = 0x02
+    sftpAttrPermissions = 0x04
+    sftpAttrACModTime   = 0x08
+    sftpAttrExtended    = 0x80000000
+)
+
+// maxSFTPPacket bounds a single request; clients write in chunks of 32-256 KiB
+const maxSFTPPacket = 1 << 20
+
+// maxSFTPHandles caps the files and directories a session keeps open
+const maxSFTPHandles = 64
+
+// sftpStatusText is the message sent with each status code
+var sftpStatusText = map[uint32]string{
+    sftpOK:               "Success",
+    sftpEOF:              "End of file",
+    sftpNoSuchFile:       "No such file",
+    sftpPermissionDenied: "Permission denied",
+    sftpFailure:          "Failure",
+    sftpBadMessage:       "Bad message",
+    sftpOpUnsupported:    "Operation unsupported",
+}
+
+// errBadPacket is returned when a request is shorter than its fields claim
+var errBadPacket = errors.New("malformed SFTP packet")
+
+// sftpFile is an open file or directory
+type sftpFile struct {
+    path  string
+    dir   bool
+    write bool
+    // data buffers the file; uploads reach the fake filesystem and the quarantine on close
+    data  []byte
+    dirty bool
+    // listed is set once a directory handle returned its entries
+    listed bool
+}
+
+// sftpServer serves the SFTP subsystem of one channel from the fake filesystem
+type sftpServer struct {
+    s       *SSHServer
+    client  *sshClient
+    ch      ssh.Channel
+    handles map[string]*sftpFile
+    next    int
+    // buffered is the size of the data held by all open handles, at most the upload limit
+    buffered int64
+}
+
+// serveSFTP runs the SFTP subsystem until the client closes the channel
+func (s *SSHServer) serveSFTP(client *sshClient, ch ssh.Channel) {
+    utils.Log.Warningf("SSH sftp session opened for %s from %s", client.user, client.conn.RemoteAddr())
+    srv := &sftpServer{s: s, client: client, ch: ch, handles: make(map[string]*sftpFile)}
+    defer srv.closeAll()
+
+    header := make([]byte, 4)
+    for {
+        if _, err := io.ReadFull(ch, header); err != nil {
+            return
+        }
+        length := binary.BigEndian.Uint32(header)
+        if length == 0 || length > maxSFTPPacket {
+            utils.Log.Debugf("SFTP packet of %d bytes from %s", length, client.conn.RemoteAddr())
+            return
+        }
+        packet := make([]byte, length)
+        if _, err := io.ReadFull(ch, packet); err != nil {
+            return
+        }
+        client.touch()
+        if err := srv.handle(packet[0], &sftpReader{data: packet[1:]}); err != nil {
+            return
+        }
+    }
+}
+
+// handle answers one request
+func (srv *sftpServer) handle(kind byte, r *sftpReader) error {
+    if kind == sftpInit {
+        return srv.send(sftpVersion, binary.BigEndian.AppendUint32(nil, 3))
+    }
+
+    id := r.uint32()
+    if r.err != nil {
+        return r.err
+    }
+    srv.client.mu.Lock()
+    status, reply, payload := srv.dispatch(kind, r)
+    srv.client.mu.Unlock()
+
+    if r.err != nil {
+        status, reply = sftpBadMessage, 0
+    }
+    if reply == 0 {
+        return srv.sendStatus(id, status)
+    }
+    return srv.send(reply, append(binary.BigEndian.AppendUint32(nil, id), payload...))
+}
+
+// dispatch performs a request on the fake filesystem. It returns either a reply
+// type and payload, or reply 0 and a status code. The caller holds client.mu.
+func (srv *sftpServer) dispatch(kind byte, r *sftpReader) (uint32, byte, []byte) {
+    fs := srv.client.shell.FS()
+
+    switch kind {
+    case sftpOpen:
+        p, flags := srv.path(r.string()), r.uint32()
+        attrs := r.attrs()
+        if r.err != nil {
+            return sftpBadMessage, 0, nil
+        }
+        return srv.open(p, flags, attrs)
+
+    case sftpClose:
+        key := r.string()
+        h := srv.lookup(key)
+        if h == nil {
+            return sftpFailure, 0, nil
+        }
+        delete(srv.handles, key)
+        srv.buffered -= int64(len(h.data))
+        return srv.flush(h), 0, nil
+
+    case sftpRead:
+        h := srv.lookup(r.string())
+        offset, length := r.uint64(), r.uint32()
+        if h == nil || h.dir {
+            return sftpFailure, 0, nil
+        }
+        if offset >= uint64(len(h.data)) {
+            return sftpEOF, 0, nil
+        }
+        end := offset + uint64(length)
+        if end > uint64(len(h.data)) {
+            end = uint64(len(h.data))
+        }
+        return 0, sftpData, appendString(nil, string(h.data[offset:end]))
+
+    case sftpWrite:
+        h := srv.lookup(r.string())
+        offset, data := r.uint64(), r.string()
+        if h == nil || !h.write {
+            return sftpFailure, 0, nil
+        }
+        limit := uint64(srv.s.uploadLimit())
+        if offset > limit || uint64(len(data)) > limit-offset {
+            return sftpFailure, 0, nil
+        }
+        if end := offset + uint64(len(data)); end > uint64(len(h.data)) {
+            grow := int64(end) - int64(len(h.data))
+            if !srv.reserve(grow) {
+                return sftpFailure, 0, nil
+            }
+            h.data = append(h.data, make([]byte, grow)...)
+        }
+        copy(h.data[offset:], data)
+        h.dirty = true
+        return sftpOK, 0, nil
+
+    case sftpLstat, sftpStat:
+        info, err := fs.Stat(srv.path(r.string()))
+        if err != nil {
+            return sftpErrorStatus(err), 0, nil
+        }
+        return 0, sftpAttrs, srv.encodeAttrs(info)
+
+    case sftpFstat:
+        h := srv.lookup(r.string())
+        if h == nil {
+            return sftpFailure, 0, nil
+        }
+        info, err := fs.Stat(h.path)
+        if err != nil {
+            return sftpErrorStatus(err), 0, nil
+        }
+        if h.write {
+            info.Size = int64(len(h.data))
+        }
+        return 0, sftpAttrs, srv.encodeAttrs(info)
+
+    case sftpSetstat, sftpFsetstat:
+        var p string
+        if kind == sftpSetstat {
+            p = srv.path(r.string())
+        } else if h := srv.lookup(r.string()); h != nil {
+            p = h.path
+        }
+        attrs := r.attrs()
+        if p == "" {
+            return sftpFailure, 0, nil
+        }
+        if attrs.flags&sftpAttrPermissions != 0 {
+            srv.emit("chmod", fmt.Sprintf("%04o %s", attrs.perm.Perm(), p))
+            if err := fs.Chmod(p, attrs.perm.Perm()); err != nil {
+                return sftpErrorStatus(err), 0, nil
+            }
+        }
+        return sftpOK, 0, nil
+
+    case sftpOpendir:
+        p := srv.path(r.string())
+        info, err := fs.Stat(p)
+        if err != nil {
+            return sftpErrorStatus(err), 0, nil
+        }
+        if !info.Dir {
+            return sftpFailure, 0, nil
+        }
+        if len(srv.handles) >= maxSFTPHandles {
+            return sftpFailure, 0, nil
+        }
+        return 0, sftpHandle, appendString(nil, srv.newHandle(&sftpFile{path: p, dir: true}))
+
+    case sftpReaddir:
+        h := srv.lookup(r.string())
+        if h == nil || !h.dir {
+            return sftpFailure, 0, nil
+        }
+        if h.listed {
+            return sftpEOF, 0, nil
+        }
+        h.listed = true
+        infos, err := fs.ReadDir(h.path)
+        if err != nil {
+            return sftpErrorStatus(err), 0, nil
+        }
+        payload := binary.BigEndian.AppendUint32(nil, uint32(len(infos)))
+        for _, info := range infos {
+            payload = appendString(payload, info.Name)
+            payload = appendString(payload, info.Long())
+            payload = append(payload, srv.encodeAttrs(info)...)
+        }
+        return 0, sftpName, payload
+
+    case sftpRemove:
+        p := srv.path(r.string())
+        srv.emit("rm", p)
+        if info, err := fs.Stat(p); err == nil && info.Dir {
+            return sftpFailure, 0, nil
+        }
+        return sftpErrorStatus(fs.Remove(p, false)), 0, nil
+
+    case sftpMkdir:
+        p := srv.path(r.string())
+        srv.emit("mkdir", p)
+        return sftpErrorStatus(fs.Mkdir(p, srv.client.user, false)), 0, nil
+
+    case sftpRmdir:
+        p := srv.path(r.string())
+        srv.emit("rmdir", p)
+        infos, err := fs.ReadDir(p)
+        if err != nil {
+            return sftpErrorStatus(err), 0, nil
+        }
+        if len(infos) > 0 {
+            return sftpFailure, 0, nil
+        }
+        return sftpErrorStatus(fs.Remove(p, true)), 0, nil
+
+    case sftpRealpath:
+        p := srv.path(r.string())
+        payload := binary.BigEndian.AppendUint32(nil, 1)
+        payload = appendString(payload, p)
+        payload = appendString(payload, p)
+        payload = binary.BigEndian.AppendUint32(payload, 0)
+        return 0, sftpName, payload
+
+    case sftpRename:
+        oldPath, newPath := srv.path(r.string()), srv.path(r.string())
+        srv.emit("rename", oldPath+" "+newPath)
+        return sftpErrorStatus(fs.Rename(oldPath, newPath)), 0, nil
+    }
+    return sftpOpUnsupported, 0, nil
+}
+
+// open opens a file for reading or writing
+func (srv *sftpServer) open(p string, flags uint32, attrs sftpFileAttrs) (uint32, byte, []byte) {
+    fs := srv.client.shell.FS()
+    info, err := fs.Stat(p)
+    exists := err == nil
+    switch {
+    case exists && info.Dir:
+        return sftpFailure, 0, nil
+    case exists && flags&sftpFlagExcl != 0:
+        return sftpFailure, 0, nil
+    case !exists && flags&sftpFlagCreate == 0:
+        return sftpNoSuchFile, 0, nil
+    case len(srv.handles) >= maxSFTPHandles:
+        return sftpFailure, 0, nil
+    }
+
+    h := &sftpFile{path: p, write: flags&(sftpFlagWrite|sftpFlagAppend) != 0}
+    if exists && flags&sftpFlagTrunc == 0 {
+        data, err := fs.ReadFile(p)
+        if err != nil {
+            return sftpErrorStatus(err), 0, nil
+        }
+        if !srv.reserve(int64(len(data))) {
+            return sftpFailure, 0, nil
+        }
+        h.data = append([]byte(nil), data...)
+    }
+    if h.write {
+        srv.emit("put", p)
+        // Create the file right away so it is visible while the upload runs
+        if err := fs.WriteFile(p, h.data, srv.client.user, false); err != nil {
+            srv.buffered -= int64(len(h.data))
+            return sftpErrorStatus(err), 0, nil
+        }
+        if attrs.flags&sftpAttrPermissions != 0 {
+            fs.Chmod(p, attrs.perm.Perm())
+        }
+    } else {
+        srv.emit("get", p)
+    }
+    return 0, sftpHandle, appendString(nil, srv.newHandle(h))
+}
+
+// flush writes an uploaded file to the fake filesystem and quarantines it once
+func (srv *sftpServer) flush(h *sftpFile) uint32 {
+    if !h.dirty {
+        return sftpOK
+    }
+    h.dirty = false
+    // The sample is kept even when the fake filesystem refuses it
+    srv.s.Quarantine(srv.client.conn, h.path, h.data)
+    if err := srv.client.shell.FS().WriteFile(h.path, h.data, srv.client.user, false); err != nil {
+        return sftpErrorStatus(err)
+    }
+    return sftpOK
+}
+
+// reserve accounts n more bytes to the open handles, refusing to go over the upload limit
+func (srv *sftpServer) reserve(n int64) bool {
+    if srv.buffered+n > srv.s.uploadLimit() {
+        return false
+    }
+    srv.buffered += n
+    return true
+}
+
+// closeAll flushes uploads the client abandoned without closing them
+func (srv *sftpServer) closeAll() {
+    srv.client.mu.Lock()
+    defer srv.client.mu.Unlock()
+    for _, h := range srv.handles {
+        srv.flush(h)
+    }
+}
+
+// newHandle registers an open file and returns its handle string
+func (srv *sftpServer) newHandle(h *sftpFile) string {
+    srv.next++
+    key := strconv.Itoa(srv.next)
+    srv.handles[key] = h
+    return key
+}
+
+// lookup returns an open handle, or nil
+func (srv *sftpServer) lookup(key string) *sftpFile {
+    return srv.handles[key]
+}
+
+// path resolves a client path against the home directory
+func (srv *sftpServer) path(p string) string {
+    if p == "" || p == "." {
+        return srv.client.shell.Abs("~")
+    }
+    if !path.IsAbs(p) {
+        p = path.Join(srv.client.shell.Abs("~"), p)
+    }
+    return path.Clean(p)
+}
+
+// emit publishes a file operation as a command event
+func (srv *sftpServer) emit(op, args string) {
+    srv.s.Emit(srv.client.conn, types.Event{
+        Kind:    types.EventCommand,
+        Details: "sftp " + op + " " + args,
+        Fields:  map[string]string{"username": srv.client.user, "channel": "sftp"},
+    })
+}
+
+// encodeAttrs renders file attributes
+func (srv *sftpServer) encodeAttrs(info shell.FileInfo) []byte {
+    perm := uint32(info.Mode.Perm()) | 0100000
+    if info.Dir {
+        perm = uint32(info.Mode.Perm()) | 0040000
+    }
+    id := uint32(0)
+    if info.Owner != "root" {
+        id = 1000
+    }
+    mtime := uint32(info.ModTime.Unix())
+
+    payload := binary.BigEndian.AppendUint32(nil, sftpAttrSize|sftpAttrUIDGID|sftpAttrPermissions|sftpAttrACModTime)
+    payload = binary.BigEndian.AppendUint64(payload, uint64(info.Size))
+    payload = binary.BigEndian.AppendUint32(payload, id)
+    payload = binary.BigEndian.AppendUint32(payload, id)
+    payload = binary.BigEndian.AppendUint32(payload, perm)
+    payload = binary.BigEndian.AppendUint32(payload, mtime)
+    return binary.BigEndian.AppendUint32(payload, mtime)
+}
+
+// send writes a response packet
+func (srv *sftpServer) send(kind byte, payload []byte) error {
+    packet := binary.BigEndian.AppendUint32(nil, uint32(len(payload)+1))
+    packet = append(packet, kind)
+    _, err := srv.ch.Write(append(packet, payload...))
+    return err
+}
+
+// sendStatus writes a status response
+func (srv *sftpServer) sendStatus(id, code uint32) error {
+    payload := binary.BigEndian.AppendUint32(nil, id)
+    payload = binary.BigEndian.AppendUint32(payload, code)
+    payload = appendString(payload, sftpStatusText[code])
+    payload = appendString(payload, "")
+    return srv.send(sftpStatus, payload)
+}
+
+// sftpErrorStatus maps a fake filesystem error to a status code
+func sftpErrorStatus(err error) uint32 {
+    switch err {
+    case nil:
+        return sftpOK
+    case shell.ErrNotFound:
+        return sftpNoSuchFile
+    case shell.ErrPermission:
+        return sftpPermissionDenied
+    }
+    return sftpFailure
+}
+
+// appendString appends an SSH string
+func appendString(buf []byte, s string) []byte {
+    buf = binary.BigEndian.AppendUint32(buf, uint32(len(s)))
+    return append(buf, s...)
+}
+
+// sftpFileAttrs holds the attributes a client sends with open, mkdir and setstat
+type sftpFileAttrs struct {
+    flags uint32
+    perm  os.FileMode
+}
+
+// sftpReader decodes the fields of a request, remembering the first error
+type sftpReader struct {
+    data []byte
+    err  error
+}
+
+func (r *sftpReader) take(n int) []byte {
+    if r.err != nil || n < 0 || len(r.data) < n {
+        r.err = errBadPacket
+        return nil
+    }
+    b := r.data[:n]
+    r.data = r.data[n:]
+    return b
+}
+
+func (r *sftpReader) uint32() uint32 {
+    if b := r.take(4); b != nil {
+        return binary.BigEndian.Uint32(b)
+    }
+    return 0
+}
+
+func (r *sftpReader) uint64() uint64 {
+    if b := r.take(8); b != nil {
+        return binary.BigEndian.Uint64(b)
+    }
+    return 0
+}
+
+func (r *sftpReader) string() string {
+    n := r.uint32()
+    if n > uint32(len(r.data)) {
+        r.err = errBadPacket
+        return ""
+    }
+    return string(r.take(int(n)))
+}
+
+// attrs decodes an ATTRS structure, keeping only the permissions
+func (r *sftpReader) attrs() sftpFileAttrs {
+    attrs := sftpFileAttrs{flags: r.uint32()}
+    if attrs.flags&sftpAttrSize != 0 {
+        r.uint64()
+    }
+    if attrs.flags&sftpAttrUIDGID != 0 {
+        r.uint32()
+        r.uint32()
+    }
+    if attrs.flags&sftpAttrPermissions != 0 {
+        attrs.perm = os.FileMode(r.uint32())
+    }
+    if attrs.flags&sftpAttrACModTime != 0 {
+        r.uint32()
+        r.uint32()
+    }
+    if attrs.flags&sftpAttrExtended != 0 {
+        for i := r.uint32(); i > 0 && r.err == nil; i-- {
+            r.string()
+            r.string()
+        }
+    }
+    return attrs
+}
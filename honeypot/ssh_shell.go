@@ -0,0 +1,268 @@
+package honeypot
+
+import (
+	"errors"
+	"io"
+	"net"
+	"shadownet/shell"
+	"shadownet/types"
+	"shadownet/utils"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// shellIdleTimeout ends an authenticated SSH session after this long without input
+const shellIdleTimeout = 5 * time.Minute
+
+// maxLineLength caps a typed command line so a flood of input cannot grow without bound
+const maxLineLength = 4096
+
+// maxCommandOutput caps the command output attached to an event
+const maxCommandOutput = 64 << 10
+
+// errInterrupt is returned by readLine when the attacker presses Ctrl-C
+var errInterrupt = errors.New("interrupted")
+
+// terminal is the pty side of an SSH shell channel. It echoes keystrokes and
+// edits lines like a tty in canonical mode, and records what the attacker sees.
+type terminal struct {
+    ch      ssh.Channel
+    sess    *Session
+    pending []byte
+    escape  int
+    lastCR  bool
+}
+
+// write sends text to the attacker, translating newlines for the pty
+func (t *terminal) write(text string) error {
+    data := []byte(strings.ReplaceAll(text, "\n", "\r\n"))
+    if t.sess != nil {
+        t.sess.RecordOutput(data)
+    }
+    _, err := t.ch.Write(data)
+    return err
+}
+
+// readLine reads a line typed by the attacker, handling backspace, Ctrl-C and Ctrl-D
+func (t *terminal) readLine() (string, error) {
+    var line []byte
+    buf := make([]byte, 256)
+    for {
+        if len(t.pending) == 0 {
+            n, err := t.ch.Read(buf)
+            if err != nil {
+                return "", err
+            }
+            t.pending = append(t.pending, buf[:n]...)
+        }
+
+        c := t.pending[0]
+        t.pending = t.pending[1:]
+
+        // Swallow cursor keys and other escape sequences
+        if t.escape > 0 {
+            if t.escape == 1 && (c == '[' || c == 'O') {
+                t.escape = 2
+            } else if t.escape == 1 || c >= 0x40 {
+                t.escape = 0
+            }
+            continue
+        }
+
+        lastCR := t.lastCR
+        t.lastCR = c == '\r'
+        switch {
+        case c == '\n' && lastCR:
+            continue
+        case c == '\r' || c == '\n':
+            t.write("\n")
+            return string(line), nil
+        case c == 0x7f || c == 0x08:
+            if len(line) > 0 {
+                line = line[:len(line)-1]
+                t.write("\b \b")
+            }
+        case c == 0x03:
+            t.write("^C\n")
+            return "", errInterrupt
+        case c == 0x04:
+            if len(line) == 0 {
+                return "", io.EOF
+            }
+        case c == 0x1b:
+            t.escape = 1
+        case c == '\t' || c >= 0x20:
+            if len(line) < maxLineLength {
+                line = append(line, c)
+                t.write(string(c))
+            }
+        }
+    }
+}
+
+// sshClient is the state shared by the channels of one authenticated SSH
+// connection, so a file uploaded over SFTP shows up in the shell
+type sshClient struct {
+    conn net.Conn
+    user string
+    // mu guards shell, which is not safe for concurrent use
+    mu    sync.Mutex
+    shell *shell.Shell
+}
+
+// newSSHClient creates the state of an authenticated connection
+func (s *SSHServer) newSSHClient(conn net.Conn, user string) *sshClient {
+    hostname, home := s.hostname, shell.HomeDir(user)
+    if account, ok := s.users[user]; ok {
+        if account.Hostname != "" {
+            hostname = account.Hostname
+        }
+        if account.Home != "" {
+            home = account.Home
+        }
+    }
+    return &sshClient{conn: conn, user: user, shell: shell.NewWithHome(s.shellSystem(), hostname, user, home)}
+}
+
+// touch extends the connection deadline after attacker activity
+func (c *sshClient) touch() {
+    c.conn.SetDeadline(time.Now().Add(shellIdleTimeout))
+}
+
+// exec runs a command line in the client's shell and returns its output and exit status
+func (c *sshClient) exec(line string) (string, int) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    output := c.shell.Exec(line)
+    return output, c.shell.Status()
+}
+
+// serveSession answers the requests of an SSH session channel. A channel runs one
+// program: an interactive shell, an exec command or the SFTP subsystem.
+func (s *SSHServer) serveSession(client *sshClient, ch ssh.Channel, reqs <-chan *ssh.Request) {
+    defer ch.Close()
+
+    started := false
+    run := func(program func() uint32) {
+        started = true
+        go func() {
+            defer ch.Close()
+            defer func() {
+                if r := recover(); r != nil {
+                    utils.Log.Errorf("SSH session panic for %s from %s: %v", client.user, client.conn.RemoteAddr(), r)
+                }
+            }()
+            status := program()
+            ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+        }()
+    }
+
+    for req := range reqs {
+        switch {
+        case req.Type == "pty-req" || req.Type == "env" || req.Type == "window-change":
+            if req.WantReply {
+                req.Reply(true, nil)
+            }
+        case req.Type == "shell" && !started:
+            req.Reply(true, nil)
+            run(func() uint32 {
+                s.runShell(client, ch)
+                return 0
+            })
+        case req.Type == "exec" && !started:
+            var payload struct{ Command string }
+            if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+                req.Reply(false, nil)
+                continue
+            }
+            req.Reply(true, nil)
+            run(func() uint32 { return s.runExec(client, ch, payload.Command) })
+        case req.Type == "subsystem" && !started:
+            var payload struct{ Name string }
+            if err := ssh.Unmarshal(req.Payload, &payload); err != nil || payload.Name != "sftp" {
+                req.Reply(false, nil)
+                continue
+            }
+            req.Reply(true, nil)
+            run(func() uint32 {
+                s.serveSFTP(client, ch)
+                return 0
+            })
+        default:
+            if req.WantReply {
+                req.Reply(false, nil)
+            }
+        }
+    }
+}
+
+// runShell drops the attacker into the emulated shell and reports every command line
+func (s *SSHServer) runShell(client *sshClient, ch ssh.Channel) {
+    conn := client.conn
+    term := &terminal{ch: ch, sess: SessionOf(conn)}
+
+    utils.Log.Warningf("SSH shell opened for %s from %s", client.user, conn.RemoteAddr())
+    if err := term.write(client.shell.Motd()); err != nil {
+        return
+    }
+
+    for {
+        client.mu.Lock()
+        prompt, exited := client.shell.Prompt(), client.shell.Exited()
+        client.mu.Unlock()
+        if exited {
+            return
+        }
+
+        if err := term.write(prompt); err != nil {
+            return
+        }
+        client.touch()
+        line, err := term.readLine()
+        if err == errInterrupt {
+            continue
+        }
+        if err != nil {
+            return
+        }
+
+        output, _ := client.exec(line)
+        if strings.TrimSpace(line) != "" {
+            fields := map[string]string{"username": client.user}
+            s.Emit(conn, types.Event{
+                Kind:    types.EventCommand,
+                Payload: commandOutput(output, fields),
+                Details: line,
+                Fields:  fields,
+            })
+        }
+        if err := term.write(output); err != nil {
+            return
+        }
+    }
+}
+
+// commandOutput returns output as an event payload, cut at maxCommandOutput
+// with output_truncated set in fields
+func commandOutput(output string, fields map[string]string) []byte {
+    if len(output) > maxCommandOutput {
+        output = output[:maxCommandOutput]
+        fields["output_truncated"] = "true"
+    }
+    return []byte(output)
+}
+
+// acceptLogin reports whether a username and password from addr open the emulated shell
+func (s *SSHServer) acceptLogin(addr net.Addr, user, pass string) bool {
+    if !s.shellEnabled {
+        return false
+    }
+    ip := addr.String()
+    if host, _, err := net.SplitHostPort(ip); err == nil {
+        ip = host
+    }
+    return s.auth.accept(ip, user, pass)
+}
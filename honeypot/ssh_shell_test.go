@@ -0,0 +1,104 @@
+package honeypot
+
+import (
+	"io"
+	"shadownet/config"
+	"shadownet/events"
+	"shadownet/quarantine"
+	"shadownet/types"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+// startShellHoneypot starts an SSH honeypot with the fake shell, a root/123456 login
+// and a quarantine in a temporary directory
+func startShellHoneypot(t *testing.T, bus *events.Bus) (*SSHServer, func()) {
+    server, err := NewSSHServer(nil, 0, t.TempDir())
+    require.NoError(t, err)
+    server.EnableShell("srv-test", []config.SSHLogin{{Username: "root", Password: "123456"}}, nil)
+    server.Events = bus
+    server.quarantine = quarantine.NewStore(t.TempDir(), 0, 0)
+
+    return server, startHoneypot(t, server)
+}
+
+// dialSSH logs in to addr with a password
+func dialSSH(addr, user, pass string) (*ssh.Client, error) {
+    return ssh.Dial("tcp", addr, &ssh.ClientConfig{
+        User:            user,
+        Auth:            []ssh.AuthMethod{ssh.Password(pass)},
+        HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+        Timeout:         5 * time.Second,
+    })
+}
+
+func TestSSHShellRunsCommands(t *testing.T) {
+    bus := events.NewBus(16)
+    commands := make(chan types.Event, 4)
+    bus.Subscribe("test", events.SubscriberFunc(func(ev types.Event) {
+        if ev.Kind == types.EventCommand {
+            commands <- ev
+        }
+    }))
+    defer bus.Close()
+
+    server, stop := startShellHoneypot(t, bus)
+    defer stop()
+
+    client, err := dialSSH(server.Addr().String(), "root", "123456")
+    require.NoError(t, err)
+    defer client.Close()
+    session, err := client.NewSession()
+    require.NoError(t, err)
+    defer session.Close()
+
+    require.NoError(t, session.RequestPty("xterm", 24, 80, ssh.TerminalModes{}))
+    stdin, err := session.StdinPipe()
+    require.NoError(t, err)
+    stdout, err := session.StdoutPipe()
+    require.NoError(t, err)
+    require.NoError(t, session.Shell())
+
+    _, err = stdin.Write([]byte("id\rhostname\rexit\r"))
+    require.NoError(t, err)
+    output, err := io.ReadAll(stdout)
+    require.NoError(t, err)
+
+    text := string(output)
+    assert.Contains(t, text, "root@srv-test:~# id\r\nuid=0(root) gid=0(root) groups=0(root)\r\n")
+    assert.Contains(t, text, "srv-test\r\n")
+    assert.True(t, strings.HasSuffix(text, "logout\r\n"))
+    assert.NoError(t, session.Wait())
+
+    select {
+    case ev := <-commands:
+        assert.Equal(t, "id", ev.Details)
+        assert.Equal(t, "root", ev.Fields["username"])
+        assert.Equal(t, "uid=0(root) gid=0(root) groups=0(root)\n", string(ev.Payload))
+    case <-time.After(2 * time.Second):
+        t.Fatal("no command event published")
+    }
+}
+
+func TestSSHShellRejectsUnknownLogins(t *testing.T) {
+    server, stop := startShellHoneypot(t, nil)
+    defer stop()
+
+    _, err := dialSSH(server.Addr().String(), "root", "toor")
+    assert.Error(t, err)
+}
+
+func TestCommandOutputIsTruncated(t *testing.T) {
+    fields := map[string]string{}
+    assert.Equal(t, []byte("uid=0(root)\n"), commandOutput("uid=0(root)\n", fields))
+    assert.Empty(t, fields)
+
+    payload := commandOutput(strings.Repeat("A", maxCommandOutput+1), fields)
+    assert.Len(t, payload, maxCommandOutput)
+    assert.Equal(t, "true", fields["output_truncated"])
+}
@@ -0,0 +1,313 @@
+package honeypot
+
+import (
+	"context"
+	"fmt"
+	"shadownet/utils"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxTransitions caps the lifecycle history kept per service
+const maxTransitions = 50
+
+// RestartPolicy controls how the supervisor restarts crashed honeypots
+type RestartPolicy struct {
+    InitialBackoff time.Duration
+    MaxBackoff     time.Duration
+    // MaxRestarts is the crash-loop limit: more crashes than this within Window stops restarts
+    MaxRestarts int
+    Window      time.Duration
+}
+
+// DefaultRestartPolicy returns the policy used when none is configured
+func DefaultRestartPolicy() RestartPolicy {
+    return RestartPolicy{
+        InitialBackoff: time.Second,
+        MaxBackoff:     time.Minute,
+        MaxRestarts:    5,
+        Window:         10 * time.Minute,
+    }
+}
+
+// Transition records a single lifecycle change of a supervised honeypot
+type Transition struct {
+    State State     `json:"state"`
+    At    time.Time `json:"at"`
+    Error string    `json:"error,omitempty"`
+}
+
+// ServiceStatus is a point-in-time view of a supervised honeypot
+type ServiceStatus struct {
+    Name        string       `json:"name"`
+    State       State        `json:"state"`
+    Since       time.Time    `json:"since"`
+    Restarts    int          `json:"restarts"`
+    LastError   string       `json:"last_error,omitempty"`
+    Transitions []Transition `json:"transitions"`
+    // ActiveSessions and CutOffSessions are reported by honeypots that track sessions
+    ActiveSessions int `json:"active_sessions"`
+    CutOffSessions int `json:"cut_off_sessions"`
+}
+
+// observable is implemented by honeypots that report their own lifecycle transitions
+type observable interface {
+    Observe(fn func(State))
+}
+
+// sessionTracker is implemented by honeypots that track and drain their sessions
+type sessionTracker interface {
+    ActiveSessions() int
+    CutOffSessions() int
+}
+
+// supervised tracks one honeypot managed by the supervisor
+type supervised struct {
+    key     string
+    hp      Honeypot
+    status  ServiceStatus
+    crashes []time.Time
+}
+
+// Supervisor runs honeypots, restarts them when they crash and keeps truthful status
+type Supervisor struct {
+    policy   RestartPolicy
+    services map[string]*supervised
+    mu       sync.RWMutex
+    wg       sync.WaitGroup
+}
+
+// NewSupervisor creates a supervisor with the given restart policy
+func NewSupervisor(policy RestartPolicy) *Supervisor {
+    defaults := DefaultRestartPolicy()
+    if policy.InitialBackoff <= 0 {
+        policy.InitialBackoff = defaults.InitialBackoff
+    }
+    if policy.MaxBackoff < policy.InitialBackoff {
+        policy.MaxBackoff = policy.InitialBackoff
+    }
+    if policy.Window <= 0 {
+        policy.Window = defaults.Window
+    }
+
+    return &Supervisor{
+        policy:   policy,
+        services: make(map[string]*supervised),
+    }
+}
+
+// Add registers a honeypot under key; it is started by Run
+func (s *Supervisor) Add(key string, hp Honeypot) {
+    svc := &supervised{
+        key:    key,
+        hp:     hp,
+        status: ServiceStatus{Name: hp.Name()},
+    }
+    s.mu.Lock()
+    s.services[key] = svc
+    s.mu.Unlock()
+
+    s.record(svc, StateStopped, nil)
+    if o, ok := hp.(observable); ok {
+        // The supervisor records starting, failed and stopped itself; the
+        // honeypot is the only one that knows when its listener is bound.
+        o.Observe(func(state State) {
+            if state == StateListening {
+                s.record(svc, state, nil)
+            }
+        })
+    }
+}
+
+// AddFailed registers a service that could not be built so it shows up in status
+func (s *Supervisor) AddFailed(key string, err error) {
+    svc := &supervised{
+        key:    key,
+        status: ServiceStatus{Name: key},
+    }
+    s.mu.Lock()
+    s.services[key] = svc
+    s.mu.Unlock()
+
+    s.record(svc, StateFailed, err)
+}
+
+// Run starts every registered honeypot and supervises it until ctx is cancelled
+func (s *Supervisor) Run(ctx context.Context) {
+    s.mu.RLock()
+    for _, svc := range s.services {
+        if svc.hp == nil {
+            continue
+        }
+        s.wg.Add(1)
+        go s.supervise(ctx, svc)
+    }
+    s.mu.RUnlock()
+}
+
+// Wait blocks until every supervised honeypot has stopped
+func (s *Supervisor) Wait() {
+    s.wg.Wait()
+}
+
+// supervise runs a single honeypot, restarting it with exponential backoff
+func (s *Supervisor) supervise(ctx context.Context, svc *supervised) {
+    defer s.wg.Done()
+
+    backoff := s.policy.InitialBackoff
+    for {
+        s.record(svc, StateStarting, nil)
+        started := time.Now()
+        err := s.run(ctx, svc.hp)
+
+        if ctx.Err() != nil || (err == nil && svc.hp.Status() == StateStopped) {
+            s.record(svc, StateStopped, nil)
+            return
+        }
+        if err == nil {
+            err = fmt.Errorf("%s honeypot exited unexpectedly", svc.hp.Name())
+        }
+        s.record(svc, StateFailed, err)
+        utils.Log.Errorf("%s honeypot failed: %v", svc.hp.Name(), err)
+
+        // A service that ran for longer than the maximum backoff was healthy,
+        // so start the next backoff sequence from the beginning.
+        if time.Since(started) > s.policy.MaxBackoff {
+            backoff = s.policy.InitialBackoff
+        }
+
+        if s.crashLooping(svc) {
+            loopErr := fmt.Errorf("crash loop detected: more than %d restarts within %s, giving up",
+                s.policy.MaxRestarts, s.policy.Window)
+            s.record(svc, StateFailed, loopErr)
+            utils.Log.Errorf("%s honeypot %v", svc.hp.Name(), loopErr)
+            return
+        }
+
+        s.record(svc, StateBackingOff, nil)
+        utils.Log.Warningf("Restarting %s honeypot in %s", svc.hp.Name(), backoff)
+        select {
+        case <-ctx.Done():
+            s.record(svc, StateStopped, nil)
+            return
+        case <-time.After(backoff):
+        }
+
+        backoff *= 2
+        if backoff > s.policy.MaxBackoff {
+            backoff = s.policy.MaxBackoff
+        }
+
+        s.mu.Lock()
+        svc.status.Restarts++
+        s.mu.Unlock()
+    }
+}
+
+// run starts the honeypot and converts handler panics into errors
+func (s *Supervisor) run(ctx context.Context, hp Honeypot) (err error) {
+    defer func() {
+        if r := recover(); r != nil {
+            err = fmt.Errorf("panic: %v", r)
+        }
+    }()
+    return hp.Start(ctx)
+}
+
+// crashLooping records a crash and reports whether the crash-loop limit was exceeded
+func (s *Supervisor) crashLooping(svc *supervised) bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    now := time.Now()
+    recent := svc.crashes[:0]
+    for _, t := range svc.crashes {
+        if now.Sub(t) <= s.policy.Window {
+            recent = append(recent, t)
+        }
+    }
+    svc.crashes = append(recent, now)
+
+    return s.policy.MaxRestarts > 0 && len(svc.crashes) > s.policy.MaxRestarts
+}
+
+// record appends a lifecycle transition, skipping repeats of the current state
+func (s *Supervisor) record(svc *supervised, state State, err error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    msg := ""
+    if err != nil {
+        msg = err.Error()
+        svc.status.LastError = msg
+    }
+    if len(svc.status.Transitions) > 0 && svc.status.State == state && msg == "" {
+        return
+    }
+
+    now := time.Now()
+    svc.status.State = state
+    svc.status.Since = now
+    svc.status.Transitions = append(svc.status.Transitions, Transition{State: state, At: now, Error: msg})
+    if len(svc.status.Transitions) > maxTransitions {
+        svc.status.Transitions = svc.status.Transitions[len(svc.status.Transitions)-maxTransitions:]
+    }
+}
+
+// Status returns a snapshot of every supervised service keyed by registry name
+func (s *Supervisor) Status() map[string]ServiceStatus {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    status := make(map[string]ServiceStatus, len(s.services))
+    for key, svc := range s.services {
+        st := svc.status
+        st.Transitions = append([]Transition(nil), svc.status.Transitions...)
+        if t, ok := svc.hp.(sessionTracker); ok {
+            st.ActiveSessions = t.ActiveSessions()
+            st.CutOffSessions = t.CutOffSessions()
+        }
+        status[key] = st
+    }
+    return status
+}
+
+// CutOffSessions returns the total number of sessions force-closed at the last shutdown
+func (s *Supervisor) CutOffSessions() int {
+    total := 0
+    for _, st := range s.Status() {
+        total += st.CutOffSessions
+    }
+    return total
+}
+
+// Honeypots returns every supervised honeypot, ordered by key
+func (s *Supervisor) Honeypots() []Honeypot {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    keys := make([]string, 0, len(s.services))
+    for key := range s.services {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    honeypots := make([]Honeypot, 0, len(keys))
+    for _, key := range keys {
+        honeypots = append(honeypots, s.services[key].hp)
+    }
+    return honeypots
+}
+
+// Names returns the keys of all supervised services in sorted order
+func (s *Supervisor) Names() []string {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    names := make([]string, 0, len(s.services))
+    for key := range s.services {
+        names = append(names, key)
+    }
+    sort.Strings(names)
+    return names
+}
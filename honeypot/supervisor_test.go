@@ -0,0 +1,75 @@
+package honeypot
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// crashingHoneypot fails every start without binding anything
+type crashingHoneypot struct {
+    starts int32
+}
+
+func (c *crashingHoneypot) Name() string   { return "Crashy" }
+func (c *crashingHoneypot) Stop() error    { return nil }
+func (c *crashingHoneypot) Addr() net.Addr { return nil }
+func (c *crashingHoneypot) Status() State  { return StateFailed }
+
+func (c *crashingHoneypot) Start(ctx context.Context) error {
+    atomic.AddInt32(&c.starts, 1)
+    return errors.New("bind: address already in use")
+}
+
+func TestSupervisorStopsAfterCrashLoop(t *testing.T) {
+    hp := &crashingHoneypot{}
+    sup := NewSupervisor(RestartPolicy{
+        InitialBackoff: time.Millisecond,
+        MaxBackoff:     4 * time.Millisecond,
+        MaxRestarts:    3,
+        Window:         time.Minute,
+    })
+    sup.Add("crashy", hp)
+    sup.Run(context.Background())
+    sup.Wait()
+
+    assert.Equal(t, int32(4), atomic.LoadInt32(&hp.starts))
+
+    status := sup.Status()["crashy"]
+    assert.Equal(t, StateFailed, status.State)
+    assert.Equal(t, 3, status.Restarts)
+    assert.Contains(t, status.LastError, "crash loop")
+
+    var states []State
+    for _, tr := range status.Transitions {
+        states = append(states, tr.State)
+    }
+    assert.Equal(t, []State{StateStopped, StateStarting, StateFailed, StateBackingOff}, states[:4])
+}
+
+func TestSupervisorReportsListeningAndStopped(t *testing.T) {
+    hp := NewBaseHoneypot("Test", 0, nil)
+    hp.Handler = func(c net.Conn) { c.Close() }
+
+    sup := NewSupervisor(DefaultRestartPolicy())
+    sup.Add("test", hp)
+
+    ctx, cancel := context.WithCancel(context.Background())
+    sup.Run(ctx)
+
+    require.Eventually(t, func() bool {
+        return sup.Status()["test"].State == StateListening
+    }, time.Second, 10*time.Millisecond)
+
+    cancel()
+    sup.Wait()
+    assert.Equal(t, StateStopped, sup.Status()["test"].State)
+    assert.Equal(t, 0, sup.Status()["test"].Restarts)
+}
@@ -0,0 +1,249 @@
+package honeypot
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"shadownet/config"
+	"shadownet/utils"
+	"sync"
+	"time"
+)
+
+// Names of the persisted certificate files in the certificate directory
+const (
+    certFile = "tls.crt"
+    keyFile  = "tls.key"
+    // personaFile holds the digest of the persona the certificate was generated for
+    personaFile = "tls.persona"
+)
+
+// errStartTLSUnavailable is returned when a listener does not offer STARTTLS
+var errStartTLSUnavailable = errors.New("STARTTLS is not enabled for this listener")
+
+var (
+    certMu    sync.Mutex
+    certCache = make(map[string]cachedCertificate)
+)
+
+// cachedCertificate is a loaded certificate with the digest of its persona
+type cachedCertificate struct {
+    cert   *tls.Certificate
+    digest string
+}
+
+// tlsSettings is the TLS configuration of a listener
+type tlsSettings struct {
+    implicit bool
+    startTLS bool
+    config   *tls.Config
+    // clients names the tools behind JA3 or JA4 fingerprints, ahead of the built-in table
+    clients map[string]string
+}
+
+// newTLSSettings loads or creates the persona certificate when the listener uses TLS
+func newTLSSettings(listener config.ListenerConfig, dir string, persona config.CertPersona) (tlsSettings, error) {
+    settings := tlsSettings{implicit: listener.TLS, startTLS: listener.StartTLS}
+    if !settings.implicit && !settings.startTLS {
+        return settings, nil
+    }
+
+    cert, err := loadOrCreateCertificate(dir, persona)
+    if err != nil {
+        return settings, err
+    }
+    settings.config = &tls.Config{
+        Certificates: []tls.Certificate{*cert},
+        // Old clients are welcome; their handshakes are part of what we observe
+        MinVersion: tls.VersionTLS10,
+    }
+    return settings, nil
+}
+
+// personaDigest identifies a persona, so any change to it, not only to the
+// common name, replaces the certificate generated for it
+func personaDigest(persona config.CertPersona) string {
+    encoded, _ := json.Marshal(persona)
+    sum := sha256.Sum256(encoded)
+    return hex.EncodeToString(sum[:])
+}
+
+// loadOrCreateCertificate returns the certificate persisted in dir, generating it on
+// first use. A certificate generated for a different persona is replaced.
+func loadOrCreateCertificate(dir string, persona config.CertPersona) (*tls.Certificate, error) {
+    certMu.Lock()
+    defer certMu.Unlock()
+
+    digest := personaDigest(persona)
+    if cached, ok := certCache[dir]; ok && cached.digest == digest {
+        return cached.cert, nil
+    }
+
+    certPath, keyPath := filepath.Join(dir, certFile), filepath.Join(dir, keyFile)
+    digestPath := filepath.Join(dir, personaFile)
+    if cert, err := tls.LoadX509KeyPair(certPath, keyPath); err == nil {
+        stored, _ := os.ReadFile(digestPath)
+        leaf, err := x509.ParseCertificate(cert.Certificate[0])
+        if err == nil && string(bytes.TrimSpace(stored)) == digest {
+            cert.Leaf = leaf
+            certCache[dir] = cachedCertificate{cert: &cert, digest: digest}
+            return &cert, nil
+        }
+        utils.Log.Infof("TLS persona changed, replacing certificate in %s", dir)
+    } else if !errors.Is(err, os.ErrNotExist) {
+        return nil, fmt.Errorf("failed to load TLS certificate: %v", err)
+    }
+
+    certPEM, keyPEM, err := generateCertificate(persona)
+    if err != nil {
+        return nil, err
+    }
+    if err := os.MkdirAll(dir, 0700); err != nil {
+        return nil, fmt.Errorf("failed to create certificate directory: %v", err)
+    }
+    if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+        return nil, fmt.Errorf("failed to save TLS key: %v", err)
+    }
+    if err := os.WriteFile(certPath, certPEM, 0644); err != nil {
+        return nil, fmt.Errorf("failed to save TLS certificate: %v", err)
+    }
+    if err := os.WriteFile(digestPath, []byte(digest+"\n"), 0644); err != nil {
+        return nil, fmt.Errorf("failed to save TLS persona digest: %v", err)
+    }
+
+    cert, err := tls.X509KeyPair(certPEM, keyPEM)
+    if err != nil {
+        return nil, fmt.Errorf("failed to load generated TLS certificate: %v", err)
+    }
+    if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+        return nil, fmt.Errorf("failed to parse generated TLS certificate: %v", err)
+    }
+    utils.Log.Infof("Generated TLS certificate for %s in %s", persona.CommonName, dir)
+    certCache[dir] = cachedCertificate{cert: &cert, digest: digest}
+    return &cert, nil
+}
+
+// generateCertificate creates a certificate for the persona signed by a throwaway CA
+// named after the persona's issuer. It returns the PEM encoded chain and leaf key.
+func generateCertificate(persona config.CertPersona) (certPEM, keyPEM []byte, err error) {
+    validDays := persona.ValidDays
+    if validDays <= 0 {
+        validDays = 3650
+    }
+    notBefore := time.Now().AddDate(0, 0, -persona.AgeDays).Truncate(time.Hour)
+    notAfter := notBefore.AddDate(0, 0, validDays)
+
+    subject := pkix.Name{CommonName: persona.CommonName}
+    if persona.Organization != "" {
+        subject.Organization = []string{persona.Organization}
+    }
+    if persona.OrganizationalUnit != "" {
+        subject.OrganizationalUnit = []string{persona.OrganizationalUnit}
+    }
+    if persona.Country != "" {
+        subject.Country = []string{persona.Country}
+    }
+    if persona.Province != "" {
+        subject.Province = []string{persona.Province}
+    }
+    if persona.Locality != "" {
+        subject.Locality = []string{persona.Locality}
+    }
+
+    leafKey, err := rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil {
+        return nil, nil, fmt.Errorf("failed to generate TLS key: %v", err)
+    }
+    leaf := &x509.Certificate{
+        SerialNumber: randomSerial(),
+        Subject:      subject,
+        NotBefore:    notBefore,
+        NotAfter:     notAfter,
+        KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+        ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+        DNSNames:     persona.DNSNames,
+    }
+    if ip := net.ParseIP(persona.CommonName); ip != nil {
+        leaf.IPAddresses = []net.IP{ip}
+    }
+
+    // Without an issuer the certificate is self-signed, as on many appliances
+    parent, signer := leaf, leafKey
+    var chain [][]byte
+    if persona.IssuerCommonName != "" {
+        caKey, err := rsa.GenerateKey(rand.Reader, 2048)
+        if err != nil {
+            return nil, nil, fmt.Errorf("failed to generate TLS issuer key: %v", err)
+        }
+        issuer := pkix.Name{CommonName: persona.IssuerCommonName, Country: subject.Country}
+        if persona.IssuerOrganization != "" {
+            issuer.Organization = []string{persona.IssuerOrganization}
+        }
+        ca := &x509.Certificate{
+            SerialNumber:          randomSerial(),
+            Subject:               issuer,
+            NotBefore:             notBefore.AddDate(-1, 0, 0),
+            NotAfter:              notAfter.AddDate(1, 0, 0),
+            KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+            BasicConstraintsValid: true,
+            IsCA:                  true,
+        }
+        caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+        if err != nil {
+            return nil, nil, fmt.Errorf("failed to create TLS issuer certificate: %v", err)
+        }
+        parent, signer = ca, caKey
+        chain = append(chain, caDER)
+    }
+
+    leafDER, err := x509.CreateCertificate(rand.Reader, leaf, parent, &leafKey.PublicKey, signer)
+    if err != nil {
+        return nil, nil, fmt.Errorf("failed to create TLS certificate: %v", err)
+    }
+
+    for _, der := range append([][]byte{leafDER}, chain...) {
+        certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+    }
+    keyPEM = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(leafKey)})
+    return certPEM, keyPEM, nil
+}
+
+// randomSerial returns a random positive certificate serial number
+func randomSerial() *big.Int {
+    serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+    if err != nil {
+        return big.NewInt(time.Now().UnixNano())
+    }
+    return serial
+}
+
+// OffersStartTLS reports whether line protocols should advertise a TLS upgrade
+func (b *BaseHoneypot) OffersStartTLS() bool {
+    return b.tls.startTLS && b.tls.config != nil
+}
+
+// StartTLS upgrades a session to TLS after the protocol's STARTTLS exchange. Any
+// buffered reader or writer wrapping conn must be discarded afterwards.
+func (b *BaseHoneypot) StartTLS(conn net.Conn) error {
+    if !b.OffersStartTLS() {
+        return errStartTLSUnavailable
+    }
+    sess := SessionOf(conn)
+    if sess == nil {
+        return errors.New("STARTTLS requires a honeypot session")
+    }
+    return sess.startTLS(b.tls.config)
+}
@@ -0,0 +1,498 @@
+package honeypot
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// TLS record and handshake types of a ClientHello
+const (
+    recordTypeHandshake = 22
+    handshakeClientHello = 1
+)
+
+// TLS extensions read from a ClientHello
+const (
+    extServerName          = 0x0000
+    extSupportedGroups     = 0x000a
+    extECPointFormats      = 0x000b
+    extSignatureAlgorithms = 0x000d
+    extALPN                = 0x0010
+    extSupportedVersions   = 0x002b
+)
+
+// maxClientHello bounds how much of the handshake is buffered while looking for the ClientHello
+const maxClientHello = 64 << 10
+
+// errNotClientHello is returned when a client does not open with a ClientHello
+var errNotClientHello = errors.New("first TLS message is not a ClientHello")
+
+// knownTLSClients maps fingerprints to the tool that sends them. Keys are a full
+// JA4, a JA3 hash, or the last two JA4 sections, which leave out the server name,
+// ALPN and counts so one entry covers a library whatever it connects to. JA4
+// sorts the lists, so it survives the extension shuffling of recent clients.
+var knownTLSClients = map[string]string{
+    // Go crypto/tls, as used by net/http and Go scanners built on it
+    "f57a46bbacb6_a089bac06eae": "go",
+    // curl with OpenSSL 3
+    "e8f1e7e78f70_b26ce05bbdd6":        "curl",
+    "0149f47eabf9a20d0893e2a44e5a6323": "curl",
+    // openssl s_client, a favourite for poking at TLS services by hand
+    "e8f1e7e78f70_1f22a2ca17c4": "openssl",
+    // Not covered yet, although the request names them:
+    //  - masscan sends one fixed ClientHello from its source, but no copy of it is
+    //    checked in here to derive and test the entry from
+    //  - zgrab2 handshakes with zcrypto, a crypto/tls fork, so it matches the go
+    //    entry above and is reported as "go"
+    // Name either under tls.clients once its ClientHello is in hand
+}
+
+// clientHello holds the parts of a ClientHello that JA3 and JA4 are computed from
+type clientHello struct {
+    version           uint16
+    ciphers           []uint16
+    extensions        []uint16
+    groups            []uint16
+    pointFormats      []uint8
+    signatures        []uint16
+    supportedVersions []uint16
+    serverName        string
+    alpn              []string
+}
+
+// isGREASE reports whether v is one of the reserved values of RFC 8701 clients
+// send to keep servers tolerant of unknown values
+func isGREASE(v uint16) bool {
+    return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// withoutGREASE returns values without the GREASE ones
+func withoutGREASE(values []uint16) []uint16 {
+    out := make([]uint16, 0, len(values))
+    for _, v := range values {
+        if !isGREASE(v) {
+            out = append(out, v)
+        }
+    }
+    return out
+}
+
+// helloReader is a TLS reader over a byte slice
+type helloReader []byte
+
+// u8 reads a byte
+func (r *helloReader) u8() (uint8, bool) {
+    if len(*r) < 1 {
+        return 0, false
+    }
+    v := (*r)[0]
+    *r = (*r)[1:]
+    return v, true
+}
+
+// u16 reads a big-endian uint16
+func (r *helloReader) u16() (uint16, bool) {
+    if len(*r) < 2 {
+        return 0, false
+    }
+    v := binary.BigEndian.Uint16(*r)
+    *r = (*r)[2:]
+    return v, true
+}
+
+// bytes reads n bytes
+func (r *helloReader) bytes(n int) (helloReader, bool) {
+    if len(*r) < n {
+        return nil, false
+    }
+    v := (*r)[:n]
+    *r = (*r)[n:]
+    return v, true
+}
+
+// vector reads a vector with a length prefix of lenSize bytes
+func (r *helloReader) vector(lenSize int) (helloReader, bool) {
+    var n int
+    if lenSize == 1 {
+        v, ok := r.u8()
+        if !ok {
+            return nil, false
+        }
+        n = int(v)
+    } else {
+        v, ok := r.u16()
+        if !ok {
+            return nil, false
+        }
+        n = int(v)
+    }
+    return r.bytes(n)
+}
+
+// u16s reads a vector of uint16 values
+func (r *helloReader) u16s(lenSize int) ([]uint16, bool) {
+    data, ok := r.vector(lenSize)
+    if !ok || len(data)%2 != 0 {
+        return nil, false
+    }
+    values := make([]uint16, 0, len(data)/2)
+    for len(data) > 0 {
+        v, _ := data.u16()
+        values = append(values, v)
+    }
+    return values, true
+}
+
+// parseClientHello decodes a ClientHello handshake message, header included
+func parseClientHello(msg []byte) (*clientHello, error) {
+    truncated := errors.New("truncated ClientHello")
+    r := helloReader(msg)
+    if typ, ok := r.u8(); !ok || typ != handshakeClientHello {
+        return nil, errNotClientHello
+    }
+    if _, ok := r.bytes(3); !ok {
+        return nil, truncated
+    }
+
+    hello := &clientHello{}
+    var ok bool
+    if hello.version, ok = r.u16(); !ok {
+        return nil, truncated
+    }
+    if _, ok = r.bytes(32); !ok {
+        return nil, truncated
+    }
+    if _, ok = r.vector(1); !ok {
+        return nil, truncated
+    }
+    if hello.ciphers, ok = r.u16s(2); !ok {
+        return nil, truncated
+    }
+    if _, ok = r.vector(1); !ok {
+        return nil, truncated
+    }
+    if len(r) == 0 {
+        // Extensions are optional, as in SSLv3 era hellos
+        return hello, nil
+    }
+    extensions, ok := r.vector(2)
+    if !ok {
+        return nil, truncated
+    }
+
+    for len(extensions) > 0 {
+        typ, ok := extensions.u16()
+        if !ok {
+            return nil, truncated
+        }
+        data, ok := extensions.vector(2)
+        if !ok {
+            return nil, truncated
+        }
+        hello.extensions = append(hello.extensions, typ)
+
+        switch typ {
+        case extServerName:
+            list, _ := data.vector(2)
+            for len(list) > 0 {
+                nameType, _ := list.u8()
+                name, ok := list.vector(2)
+                if !ok {
+                    break
+                }
+                if nameType == 0 && hello.serverName == "" {
+                    hello.serverName = string(name)
+                }
+            }
+        case extSupportedGroups:
+            hello.groups, _ = data.u16s(2)
+        case extECPointFormats:
+            formats, _ := data.vector(1)
+            hello.pointFormats = append([]uint8(nil), formats...)
+        case extSignatureAlgorithms:
+            hello.signatures, _ = data.u16s(2)
+        case extALPN:
+            list, _ := data.vector(2)
+            for len(list) > 0 {
+                proto, ok := list.vector(1)
+                if !ok {
+                    break
+                }
+                hello.alpn = append(hello.alpn, string(proto))
+            }
+        case extSupportedVersions:
+            hello.supportedVersions, _ = data.u16s(1)
+        }
+    }
+    return hello, nil
+}
+
+// joinDecimal renders values as JA3 does, dash separated in decimal
+func joinDecimal(values []uint16) string {
+    parts := make([]string, len(values))
+    for i, v := range values {
+        parts[i] = strconv.Itoa(int(v))
+    }
+    return strings.Join(parts, "-")
+}
+
+// JA3String returns the JA3 fields: version, ciphers, extensions, groups and
+// point formats, without GREASE values
+func (h *clientHello) JA3String() string {
+    formats := make([]uint16, len(h.pointFormats))
+    for i, f := range h.pointFormats {
+        formats[i] = uint16(f)
+    }
+    return strings.Join([]string{
+        strconv.Itoa(int(h.version)),
+        joinDecimal(withoutGREASE(h.ciphers)),
+        joinDecimal(withoutGREASE(h.extensions)),
+        joinDecimal(withoutGREASE(h.groups)),
+        joinDecimal(formats),
+    }, ",")
+}
+
+// JA3 hashes the JA3 string
+func (h *clientHello) JA3() string {
+    sum := md5.Sum([]byte(h.JA3String()))
+    return hex.EncodeToString(sum[:])
+}
+
+// maxVersion returns the highest version offered, from supported_versions when present
+func (h *clientHello) maxVersion() uint16 {
+    version := h.version
+    if versions := withoutGREASE(h.supportedVersions); len(versions) > 0 {
+        version = 0
+        for _, v := range versions {
+            if v > version {
+                version = v
+            }
+        }
+    }
+    return version
+}
+
+// Versions returns the names of the offered protocol versions, highest first
+func (h *clientHello) Versions() []string {
+    versions := withoutGREASE(h.supportedVersions)
+    if len(versions) == 0 {
+        versions = []uint16{h.version}
+    }
+    names := make([]string, len(versions))
+    for i, v := range versions {
+        names[i] = versionName(v)
+    }
+    return names
+}
+
+// versionName names a TLS protocol version
+func versionName(v uint16) string {
+    switch v {
+    case 0x0304:
+        return "TLS1.3"
+    case 0x0303:
+        return "TLS1.2"
+    case 0x0302:
+        return "TLS1.1"
+    case 0x0301:
+        return "TLS1.0"
+    case 0x0300:
+        return "SSL3.0"
+    }
+    return fmt.Sprintf("0x%04x", v)
+}
+
+// ja4Version is the two character version code of JA4
+func ja4Version(v uint16) string {
+    switch v {
+    case 0x0304:
+        return "13"
+    case 0x0303:
+        return "12"
+    case 0x0302:
+        return "11"
+    case 0x0301:
+        return "10"
+    case 0x0300:
+        return "s3"
+    case 0x0002:
+        return "s2"
+    }
+    return "00"
+}
+
+// capCount limits a JA4 count to its two digits
+func capCount(n int) int {
+    if n > 99 {
+        return 99
+    }
+    return n
+}
+
+// ja4Hash is the truncated SHA-256 JA4 uses for its sorted lists
+func ja4Hash(s string) string {
+    if s == "" {
+        return "000000000000"
+    }
+    sum := sha256.Sum256([]byte(s))
+    return hex.EncodeToString(sum[:])[:12]
+}
+
+// joinHex renders values as JA4 does, comma separated four digit hex
+func joinHex(values []uint16) string {
+    parts := make([]string, len(values))
+    for i, v := range values {
+        parts[i] = fmt.Sprintf("%04x", v)
+    }
+    return strings.Join(parts, ",")
+}
+
+// isAlnum reports whether b is an ASCII letter or digit
+func isAlnum(b byte) bool {
+    return b >= '0' && b <= '9' || b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z'
+}
+
+// JA4 returns the JA4 fingerprint of the ClientHello, as sent over TCP
+func (h *clientHello) JA4() string {
+    ciphers := withoutGREASE(h.ciphers)
+    extensions := withoutGREASE(h.extensions)
+
+    sni := "i"
+    if h.serverName != "" {
+        sni = "d"
+    }
+    alpn := "00"
+    if len(h.alpn) > 0 && h.alpn[0] != "" {
+        first := h.alpn[0]
+        if isAlnum(first[0]) && isAlnum(first[len(first)-1]) {
+            alpn = first[:1] + first[len(first)-1:]
+        } else {
+            encoded := hex.EncodeToString([]byte(first))
+            alpn = encoded[:1] + encoded[len(encoded)-1:]
+        }
+    }
+    a := fmt.Sprintf("t%s%s%02d%02d%s", ja4Version(h.maxVersion()), sni,
+        capCount(len(ciphers)), capCount(len(extensions)), alpn)
+
+    sortedCiphers := append([]uint16(nil), ciphers...)
+    sort.Slice(sortedCiphers, func(i, j int) bool { return sortedCiphers[i] < sortedCiphers[j] })
+
+    // The server name and ALPN are left out, so the hash does not depend on the target
+    var sortedExtensions []uint16
+    for _, ext := range extensions {
+        if ext != extServerName && ext != extALPN {
+            sortedExtensions = append(sortedExtensions, ext)
+        }
+    }
+    sort.Slice(sortedExtensions, func(i, j int) bool { return sortedExtensions[i] < sortedExtensions[j] })
+    c := joinHex(sortedExtensions)
+    if signatures := withoutGREASE(h.signatures); len(signatures) > 0 && c != "" {
+        c += "_" + joinHex(signatures)
+    }
+    return a + "_" + ja4Hash(joinHex(sortedCiphers)) + "_" + ja4Hash(c)
+}
+
+// fields describes the ClientHello as session tags
+func (h *clientHello) fields() map[string]string {
+    fields := map[string]string{
+        "ja3":          h.JA3(),
+        "ja3_string":   h.JA3String(),
+        "ja4":          h.JA4(),
+        "tls_versions": strings.Join(h.Versions(), ","),
+    }
+    if h.serverName != "" {
+        fields["tls_sni"] = h.serverName
+    }
+    if len(h.alpn) > 0 {
+        fields["tls_alpn"] = strings.Join(h.alpn, ",")
+    }
+    return fields
+}
+
+// lookupTLSClient names the tool behind a fingerprint, preferring the configured table
+func lookupTLSClient(configured map[string]string, ja4, ja3 string) string {
+    keys := []string{ja4, ja3}
+    if i := strings.IndexByte(ja4, '_'); i >= 0 {
+        keys = append(keys, ja4[i+1:])
+    }
+    for _, table := range []map[string]string{configured, knownTLSClients} {
+        for _, key := range keys {
+            if name, ok := table[key]; ok {
+                return name
+            }
+        }
+    }
+    return ""
+}
+
+// helloSniffer follows the records a client sends until its ClientHello is complete
+type helloSniffer struct {
+    buf       []byte
+    handshake []byte
+    done      bool
+    found     func(*clientHello)
+}
+
+// feed inspects the next bytes received from the client
+func (h *helloSniffer) feed(data []byte) {
+    if h.done || len(data) == 0 {
+        return
+    }
+    h.buf = append(h.buf, data...)
+
+    // A ClientHello may be split over several records
+    for len(h.buf) >= 5 {
+        length := int(binary.BigEndian.Uint16(h.buf[3:5]))
+        if h.buf[0] != recordTypeHandshake || len(h.handshake)+length > maxClientHello {
+            h.stop()
+            return
+        }
+        if len(h.buf) < 5+length {
+            return
+        }
+        h.handshake = append(h.handshake, h.buf[5:5+length]...)
+        h.buf = h.buf[5+length:]
+
+        if len(h.handshake) < 4 {
+            continue
+        }
+        size := int(h.handshake[1])<<16 | int(h.handshake[2])<<8 | int(h.handshake[3])
+        if len(h.handshake) < 4+size {
+            continue
+        }
+        msg := h.handshake[:4+size]
+        h.stop()
+        if hello, err := parseClientHello(msg); err == nil {
+            h.found(hello)
+        }
+        return
+    }
+}
+
+// stop ends sniffing and releases the buffers
+func (h *helloSniffer) stop() {
+    h.done = true
+    h.buf, h.handshake = nil, nil
+}
+
+// helloConn passes a connection to crypto/tls while capturing the ClientHello,
+// which crypto/tls only exposes after parsing away the order of its lists
+type helloConn struct {
+    net.Conn
+    sniffer helloSniffer
+}
+
+// Read reads from the client, watching for its ClientHello
+func (c *helloConn) Read(p []byte) (int, error) {
+    n, err := c.Conn.Read(p)
+    c.sniffer.feed(p[:n])
+    return n, err
+}
@@ -0,0 +1,172 @@
+package honeypot
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"net"
+	"shadownet/config"
+	"shadownet/events"
+	"shadownet/types"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// helloExtension is one extension of a test ClientHello
+type helloExtension struct {
+    typ  uint16
+    data []byte
+}
+
+// u16List encodes values as a TLS vector with a lenSize byte length
+func u16List(lenSize int, values ...uint16) []byte {
+    var body []byte
+    for _, v := range values {
+        body = binary.BigEndian.AppendUint16(body, v)
+    }
+    if lenSize == 1 {
+        return append([]byte{byte(len(body))}, body...)
+    }
+    return append(binary.BigEndian.AppendUint16(nil, uint16(len(body))), body...)
+}
+
+// clientHelloRecords builds a ClientHello and frames it in records of at most recordSize bytes
+func clientHelloRecords(recordSize int, version uint16, ciphers []uint16, extensions []helloExtension) []byte {
+    body := binary.BigEndian.AppendUint16(nil, version)
+    body = append(body, make([]byte, 32)...)
+    body = append(body, 0)
+    body = append(body, u16List(2, ciphers...)...)
+    body = append(body, 1, 0)
+    var exts []byte
+    for _, ext := range extensions {
+        exts = binary.BigEndian.AppendUint16(exts, ext.typ)
+        exts = binary.BigEndian.AppendUint16(exts, uint16(len(ext.data)))
+        exts = append(exts, ext.data...)
+    }
+    body = binary.BigEndian.AppendUint16(body, uint16(len(exts)))
+    body = append(body, exts...)
+
+    msg := append([]byte{handshakeClientHello, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}, body...)
+    var records []byte
+    for len(msg) > 0 {
+        n := recordSize
+        if n > len(msg) {
+            n = len(msg)
+        }
+        records = append(records, recordTypeHandshake, 0x03, 0x01, byte(n>>8), byte(n))
+        records = append(records, msg[:n]...)
+        msg = msg[n:]
+    }
+    return records
+}
+
+// chromeLikeHello mirrors the ClientHello of the JA4 reference fingerprint, with GREASE
+func chromeLikeHello(recordSize int) []byte {
+    sni := []byte("shop.example.com")
+    serverName := binary.BigEndian.AppendUint16(nil, uint16(len(sni)+3))
+    serverName = append(serverName, 0)
+    serverName = binary.BigEndian.AppendUint16(serverName, uint16(len(sni)))
+    serverName = append(serverName, sni...)
+    alpn := []byte{0, 12, 2, 'h', '2', 8, 'h', 't', 't', 'p', '/', '1', '.', '1'}
+
+    extensions := []helloExtension{{typ: 0x1a1a}, {typ: extServerName, data: serverName}}
+    for _, typ := range []uint16{0x0005, 0x000b, 0x0012, 0x0017, 0x001b, 0x0023, 0x0029, 0x002d, 0x0033, 0x4469, 0xfe0d, 0xff01} {
+        extensions = append(extensions, helloExtension{typ: typ})
+    }
+    extensions = append(extensions,
+        helloExtension{typ: extSupportedGroups, data: u16List(2, 0x2a2a, 0x001d, 0x0017, 0x0018)},
+        helloExtension{typ: extSignatureAlgorithms, data: u16List(2, 0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601)},
+        helloExtension{typ: extALPN, data: alpn},
+        helloExtension{typ: extSupportedVersions, data: u16List(1, 0x3a3a, 0x0304, 0x0303)},
+    )
+    ciphers := []uint16{0x4a4a, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030, 0xcca9, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035}
+    return clientHelloRecords(recordSize, 0x0303, ciphers, extensions)
+}
+
+func TestClientHelloFingerprints(t *testing.T) {
+    var found *clientHello
+    sniffer := helloSniffer{found: func(h *clientHello) { found = h }}
+
+    // The hello arrives split over records and byte by byte
+    for _, b := range chromeLikeHello(100) {
+        sniffer.feed([]byte{b})
+    }
+    require.NotNil(t, found)
+    assert.True(t, sniffer.done)
+
+    // Chrome resuming a session: pre_shared_key (0x0029) is the 17th extension. A fresh
+    // Chrome hello leaves it out and fingerprints as t13d1516h2_8daaf6152771_02713d6af862
+    assert.Equal(t, "t13d1517h2_8daaf6152771_b0da82dd1658", found.JA4())
+    assert.Equal(t, "771,4865-4866-4867-49195-49199-49196-49200-52393-52392-49171-49172-156-157-47-53,"+
+        "0-5-11-18-23-27-35-41-45-51-17513-65037-65281-10-13-16-43,29-23-24,", found.JA3String())
+    assert.Len(t, found.JA3(), 32)
+
+    fields := found.fields()
+    assert.Equal(t, "shop.example.com", fields["tls_sni"])
+    assert.Equal(t, "h2,http/1.1", fields["tls_alpn"])
+    assert.Equal(t, "TLS1.3,TLS1.2", fields["tls_versions"])
+}
+
+func TestHelloSnifferIgnoresOtherProtocols(t *testing.T) {
+    called := false
+    sniffer := helloSniffer{found: func(*clientHello) { called = true }}
+
+    sniffer.feed([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+    assert.True(t, sniffer.done)
+    assert.False(t, called)
+}
+
+func TestLookupTLSClient(t *testing.T) {
+    goJA4 := "t13i131000_f57a46bbacb6_a089bac06eae"
+    assert.Equal(t, "go", lookupTLSClient(nil, goJA4, ""))
+    assert.Equal(t, "curl", lookupTLSClient(nil, "", "0149f47eabf9a20d0893e2a44e5a6323"))
+    assert.Equal(t, "", lookupTLSClient(nil, "t13d1516h2_8daaf6152771_b0da82dd1658", ""))
+
+    // The configured table wins over the built-in one
+    configured := map[string]string{goJA4: "zgrab2"}
+    assert.Equal(t, "zgrab2", lookupTLSClient(configured, goJA4, ""))
+}
+
+func TestTLSSessionEventsCarryFingerprints(t *testing.T) {
+    bus := events.NewBus(16)
+    published := make(chan types.Event, 4)
+    bus.Subscribe("test", events.SubscriberFunc(func(ev types.Event) {
+        published <- ev
+    }))
+    defer bus.Close()
+
+    hp := NewBaseHoneypot("Test", 0, nil)
+    hp.Events = bus
+    hp.Handler = func(c net.Conn) {
+        line, _ := bufio.NewReader(c).ReadString('\n')
+        hp.Emit(c, types.Event{Kind: types.EventPayload, Payload: []byte(line)})
+    }
+    stop := startTLSHoneypot(t, hp, config.ListenerConfig{TLS: true})
+    defer stop()
+
+    conn, err := tls.Dial("tcp", hp.Addr().String(), &tls.Config{
+        InsecureSkipVerify: true,
+        ServerName:         "cam-02.plant.local",
+        NextProtos:         []string{"h2", "http/1.1"},
+    })
+    require.NoError(t, err)
+    defer conn.Close()
+    conn.Write([]byte("ping\n"))
+
+    select {
+    case ev := <-published:
+        assert.True(t, strings.HasPrefix(ev.Fields["ja4"], "t13d"), ev.Fields["ja4"])
+        assert.Len(t, ev.Fields["ja3"], 32)
+        assert.True(t, strings.HasPrefix(ev.Fields["ja3_string"], "771,"))
+        assert.Equal(t, "cam-02.plant.local", ev.Fields["tls_sni"])
+        assert.Equal(t, "h2,http/1.1", ev.Fields["tls_alpn"])
+        assert.Contains(t, ev.Fields["tls_versions"], "TLS1.3")
+        assert.Equal(t, lookupTLSClient(nil, ev.Fields["ja4"], ev.Fields["ja3"]), ev.Fields["tls_client"])
+    case <-time.After(5 * time.Second):
+        t.Fatal("no event published")
+    }
+}
@@ -0,0 +1,129 @@
+package honeypot
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"shadownet/config"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testPersona = config.CertPersona{
+    CommonName:       "cam-02.plant.local",
+    Organization:     "Acme Automation",
+    Country:          "DE",
+    IssuerCommonName: "Acme Device CA",
+    ValidDays:        3650,
+    AgeDays:          100,
+}
+
+// resetCertCache forgets loaded certificates so the next load reads from disk
+func resetCertCache() {
+    certMu.Lock()
+    certCache = make(map[string]cachedCertificate)
+    certMu.Unlock()
+}
+
+func TestPersonaCertificatePersists(t *testing.T) {
+    dir := t.TempDir()
+    resetCertCache()
+
+    cert, err := loadOrCreateCertificate(dir, testPersona)
+    require.NoError(t, err)
+    leaf := cert.Leaf
+    assert.Equal(t, "cam-02.plant.local", leaf.Subject.CommonName)
+    assert.Equal(t, []string{"Acme Automation"}, leaf.Subject.Organization)
+    assert.Equal(t, "Acme Device CA", leaf.Issuer.CommonName)
+    assert.WithinDuration(t, time.Now().AddDate(0, 0, -100), leaf.NotBefore, 2*time.Hour)
+    assert.WithinDuration(t, leaf.NotBefore.AddDate(0, 0, 3650), leaf.NotAfter, time.Second)
+
+    // A restart loads the same certificate instead of minting a new one
+    resetCertCache()
+    again, err := loadOrCreateCertificate(dir, testPersona)
+    require.NoError(t, err)
+    assert.Equal(t, leaf.SerialNumber, again.Leaf.SerialNumber)
+
+    // Changing the persona replaces it
+    resetCertCache()
+    other := testPersona
+    other.CommonName = "nas.plant.local"
+    replaced, err := loadOrCreateCertificate(dir, other)
+    require.NoError(t, err)
+    assert.Equal(t, "nas.plant.local", replaced.Leaf.Subject.CommonName)
+
+    // So does a change that keeps the common name, with or without a restart
+    reissued := other
+    reissued.IssuerCommonName = "Plant Root CA"
+    reissued.Organization = "Plant Ops"
+    cert, err = loadOrCreateCertificate(dir, reissued)
+    require.NoError(t, err)
+    assert.Equal(t, "Plant Root CA", cert.Leaf.Issuer.CommonName)
+    assert.Equal(t, []string{"Plant Ops"}, cert.Leaf.Subject.Organization)
+
+    resetCertCache()
+    aged := reissued
+    aged.AgeDays = 400
+    cert, err = loadOrCreateCertificate(dir, aged)
+    require.NoError(t, err)
+    assert.WithinDuration(t, time.Now().AddDate(0, 0, -400), cert.Leaf.NotBefore, 2*time.Hour)
+}
+
+// startTLSHoneypot runs hp with the given listener TLS options until the returned stop is called
+func startTLSHoneypot(t *testing.T, hp *BaseHoneypot, listener config.ListenerConfig) func() {
+    resetCertCache()
+
+    settings, err := newTLSSettings(listener, t.TempDir(), testPersona)
+    require.NoError(t, err)
+    hp.tls = settings
+
+    return startHoneypot(t, hp)
+}
+
+func TestImplicitTLS(t *testing.T) {
+    hp := NewBaseHoneypot("Test", 0, nil)
+    hp.Handler = func(c net.Conn) {
+        c.Write([]byte("hello\n"))
+    }
+    stop := startTLSHoneypot(t, hp, config.ListenerConfig{TLS: true})
+    defer stop()
+
+    conn, err := tls.Dial("tcp", hp.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+    require.NoError(t, err)
+    defer conn.Close()
+
+    line, err := bufio.NewReader(conn).ReadString('\n')
+    require.NoError(t, err)
+    assert.Equal(t, "hello\n", line)
+    assert.Equal(t, "cam-02.plant.local", conn.ConnectionState().PeerCertificates[0].Subject.CommonName)
+}
+
+func TestFTPAuthTLS(t *testing.T) {
+    ftp := NewFTPServer(nil, 0)
+    stop := startTLSHoneypot(t, ftp.BaseHoneypot, config.ListenerConfig{StartTLS: true})
+    defer stop()
+
+    conn, err := net.Dial("tcp", ftp.Addr().String())
+    require.NoError(t, err)
+    defer conn.Close()
+    reader := bufio.NewReader(conn)
+
+    line, err := reader.ReadString('\n')
+    require.NoError(t, err)
+    assert.Contains(t, line, "220")
+
+    conn.Write([]byte("AUTH TLS\r\n"))
+    line, err = reader.ReadString('\n')
+    require.NoError(t, err)
+    assert.Contains(t, line, "234")
+
+    secure := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+    require.NoError(t, secure.Handshake())
+    secure.Write([]byte("QUIT\r\n"))
+    line, err = bufio.NewReader(secure).ReadString('\n')
+    require.NoError(t, err)
+    assert.Contains(t, line, "221")
+}
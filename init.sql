@@ -11,7 +11,32 @@ CREATE TABLE IF NOT EXISTS attacks (
     attack_vector TEXT,
     payload BYTEA,
     session_duration INTEGER,
-    severity INT DEFAULT 1 -- 1=ต่ำ, 2=กลาง, 3=สูง
+    severity INT DEFAULT 1 -- 0=ข้อมูล, 1=ต่ำ, 2=กลาง, 3=สูง, 4=วิกฤต
+);
+
+-- สร้างตารางเก็บเหตุการณ์แบบมีโครงสร้างจาก honeypot
+CREATE TABLE IF NOT EXISTS events (
+    id SERIAL PRIMARY KEY,
+    session_id TEXT,
+    service TEXT NOT NULL,
+    event_kind TEXT NOT NULL,
+    src_ip TEXT NOT NULL,
+    src_port INTEGER,
+    dst_ip TEXT,
+    dst_port INTEGER,
+    username TEXT,
+    password TEXT,
+    auth_method TEXT,
+    key_type TEXT,
+    key_fingerprint TEXT,
+    hassh TEXT,
+    hassh_server TEXT,
+    ja3 TEXT,
+    ja4 TEXT,
+    payload BYTEA,
+    details TEXT,
+    fields TEXT,
+    timestamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
 -- สร้างตารางเก็บข้อมูลภัยคุกคาม
@@ -47,6 +72,12 @@ CREATE INDEX IF NOT EXISTS idx_attacks_ip ON attacks(ip_address);
 CREATE INDEX IF NOT EXISTS idx_attacks_timestamp ON attacks(timestamp);
 CREATE INDEX IF NOT EXISTS idx_attacks_service ON attacks(service);
 CREATE INDEX IF NOT EXISTS idx_threat_intel_ip ON threat_intel(ip_address);
+CREATE INDEX IF NOT EXISTS idx_events_session ON events(session_id);
+CREATE INDEX IF NOT EXISTS idx_events_src_ip ON events(src_ip);
+CREATE INDEX IF NOT EXISTS idx_events_hassh ON events(hassh);
+CREATE INDEX IF NOT EXISTS idx_events_hassh_server ON events(hassh_server);
+CREATE INDEX IF NOT EXISTS idx_events_ja3 ON events(ja3);
+CREATE INDEX IF NOT EXISTS idx_events_ja4 ON events(ja4);
 
 -- สร้าง view สำหรับการดูข้อมูลที่สำคัญ
 CREATE OR REPLACE VIEW attack_summary AS
@@ -0,0 +1,201 @@
+package persona
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+	"shadownet/config"
+	"sort"
+	"strings"
+	texttemplate "text/template"
+
+	"gopkg.in/yaml.v2"
+)
+
+// DefaultName is the profile used when the configuration does not pick one
+const DefaultName = "ubuntu-web"
+
+//go:embed profiles/*.yaml
+var builtinProfiles embed.FS
+
+// Persona describes the device a sensor pretends to be. Every honeypot takes its
+// banners, version strings and protocol fingerprints from the same persona, so a
+// scan of the sensor finds one coherent machine instead of a mix of defaults.
+type Persona struct {
+    Name        string `yaml:"name"`
+    Description string `yaml:"description"`
+    OS          OS     `yaml:"os"`
+    SSH         SSH    `yaml:"ssh"`
+    HTTP        HTTP   `yaml:"http"`
+    FTP         FTP    `yaml:"ftp"`
+    Modbus      Modbus `yaml:"modbus"`
+    // TLS is the certificate presented by TLS listeners; it replaces tls.persona when set
+    TLS *config.CertPersona `yaml:"tls"`
+}
+
+// OS holds hints about the operating system the persona runs
+type OS struct {
+    // Family is e.g. "linux", "windows" or "embedded"
+    Family string `yaml:"family"`
+    // Name is the product as a scanner would report it, e.g. "Ubuntu 20.04.6 LTS"
+    Name string `yaml:"name"`
+    // Hostname is used by the SSH shell unless ssh.shell.hostname is configured
+    Hostname string `yaml:"hostname"`
+    // Kernel, KernelVersion and Machine are what uname -r, -v and -m report
+    Kernel        string `yaml:"kernel"`
+    KernelVersion string `yaml:"kernel_version"`
+    Machine       string `yaml:"machine"`
+    // KernelBuild is the builder and compiler /proc/version shows
+    KernelBuild string `yaml:"kernel_build"`
+    // Release is /etc/os-release
+    Release string `yaml:"release"`
+    // Issue is /etc/issue; empty derives it from Name
+    Issue string `yaml:"issue"`
+    // CPUInfo is /proc/cpuinfo
+    CPUInfo string `yaml:"cpuinfo"`
+    // Motd is the shell's login banner, a text/template with the fields above
+    // and the Now and LastLogin times
+    Motd string `yaml:"motd"`
+}
+
+// SSH describes the SSH server. Algorithms x/crypto/ssh does not implement are
+// dropped from the lists, so the HASSHServer can only approximate the real daemon.
+type SSH struct {
+    // Version is the identification string, e.g. "SSH-2.0-OpenSSH_8.2p1 Ubuntu-4ubuntu0.11"
+    Version      string   `yaml:"version"`
+    KeyExchanges []string `yaml:"key_exchanges"`
+    Ciphers      []string `yaml:"ciphers"`
+    MACs         []string `yaml:"macs"`
+    // HostKeys limits the offered host key types, e.g. ["ssh-rsa", "ssh-ed25519"]; empty offers all
+    HostKeys []string `yaml:"host_keys"`
+}
+
+// HTTP describes the web server
+type HTTP struct {
+    // Server is the Server response header
+    Server string `yaml:"server"`
+    // Headers are extra headers sent with every response
+    Headers map[string]string `yaml:"headers"`
+    // Index is the page served for / when no app pack routes it
+    Index string `yaml:"index"`
+    // NotFound is the template of the 404 page, executed with webapp.Data
+    NotFound string `yaml:"not_found"`
+    // Apps are the webapp packs the persona runs unless http.apps is configured
+    Apps []string `yaml:"apps"`
+}
+
+// FTP holds the replies of the FTP server, including their status codes
+type FTP struct {
+    Banner           string `yaml:"banner"`
+    PasswordRequired string `yaml:"password_required"`
+    LoginIncorrect   string `yaml:"login_incorrect"`
+    NotLoggedIn      string `yaml:"not_logged_in"`
+    Goodbye          string `yaml:"goodbye"`
+    LoginSuccessful  string `yaml:"login_successful"`
+    // Syst is the reply to SYST, which clients use to pick a listing parser
+    Syst string `yaml:"syst"`
+}
+
+// Modbus picks the PLC the Modbus server emulates
+type Modbus struct {
+    // Profile names the PLC profile with the register map and device identification
+    Profile string `yaml:"profile"`
+}
+
+// Default returns the built-in default profile
+func Default() *Persona {
+    p, err := builtin(DefaultName)
+    if err != nil {
+        panic("persona: broken built-in profile: " + err.Error())
+    }
+    return p
+}
+
+// Builtin returns the names of the profiles compiled into the binary
+func Builtin() []string {
+    entries, _ := builtinProfiles.ReadDir("profiles")
+    names := make([]string, 0, len(entries))
+    for _, entry := range entries {
+        names = append(names, strings.TrimSuffix(entry.Name(), ".yaml"))
+    }
+    sort.Strings(names)
+    return names
+}
+
+// Load returns the profile called name. A <name>.yaml file in dir takes
+// precedence over the built-in profile of the same name. Fields a profile
+// leaves out keep the values of the default profile, except the certificate.
+func Load(name, dir string) (*Persona, error) {
+    if name == "" {
+        name = DefaultName
+    }
+    if strings.ContainsAny(name, `/\`) {
+        return nil, fmt.Errorf("invalid persona name %q", name)
+    }
+
+    if dir != "" {
+        data, err := os.ReadFile(filepath.Join(dir, name+".yaml"))
+        if err == nil {
+            p, err := parse(data, Default())
+            if err != nil {
+                return nil, fmt.Errorf("persona %s: %v", name, err)
+            }
+            return p, nil
+        }
+        if !errors.Is(err, os.ErrNotExist) {
+            return nil, err
+        }
+    }
+
+    p, err := builtin(name)
+    if errors.Is(err, os.ErrNotExist) {
+        return nil, fmt.Errorf("unknown persona %q (built-in: %s)", name, strings.Join(Builtin(), ", "))
+    }
+    return p, err
+}
+
+// builtin parses a profile compiled into the binary
+func builtin(name string) (*Persona, error) {
+    data, err := builtinProfiles.ReadFile("profiles/" + name + ".yaml")
+    if err != nil {
+        return nil, err
+    }
+    base := &Persona{}
+    if name != DefaultName {
+        base = Default()
+    }
+    return parse(data, base)
+}
+
+// parse decodes a profile on top of a copy of base
+func parse(data []byte, base *Persona) (*Persona, error) {
+    // A certificate is specific to its device, so it is never inherited
+    p := *base
+    p.Name, p.Description, p.TLS = "", "", nil
+    // Copy what the decoder would otherwise write through to base
+    if base.HTTP.Headers != nil {
+        p.HTTP.Headers = make(map[string]string, len(base.HTTP.Headers))
+        for key, value := range base.HTTP.Headers {
+            p.HTTP.Headers[key] = value
+        }
+    }
+    if err := yaml.Unmarshal(data, &p); err != nil {
+        return nil, err
+    }
+    if p.Name == "" {
+        return nil, errors.New("profile has no name")
+    }
+    if !strings.HasPrefix(p.SSH.Version, "SSH-2.0-") {
+        return nil, fmt.Errorf("SSH version %q must start with SSH-2.0-", p.SSH.Version)
+    }
+    if _, err := template.New("not_found").Parse(p.HTTP.NotFound); err != nil {
+        return nil, fmt.Errorf("HTTP not_found: %v", err)
+    }
+    if _, err := texttemplate.New("motd").Parse(p.OS.Motd); err != nil {
+        return nil, fmt.Errorf("OS motd: %v", err)
+    }
+    return &p, nil
+}
@@ -0,0 +1,71 @@
+package persona
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuiltinProfilesLoad(t *testing.T) {
+    names := Builtin()
+    assert.Equal(t, []string{"hikvision-camera", "siemens-plc", "ubuntu-web"}, names)
+
+    for _, name := range names {
+        p, err := Load(name, "")
+        require.NoError(t, err, name)
+        assert.Equal(t, name, p.Name)
+        assert.NotEmpty(t, p.Description, name)
+        assert.NotEmpty(t, p.OS.Hostname, name)
+        assert.NotEmpty(t, p.HTTP.Server, name)
+        assert.NotEmpty(t, p.FTP.Banner, name)
+        require.NotNil(t, p.TLS, name)
+        assert.NotEmpty(t, p.FTP.Syst, name)
+        if name != DefaultName {
+            // Other devices describe their own system rather than inheriting Ubuntu's
+            assert.NotEmpty(t, p.OS.Kernel, name)
+            assert.NotEmpty(t, p.OS.Release, name)
+            assert.NotEmpty(t, p.OS.Motd, name)
+            assert.NotContains(t, p.OS.CPUInfo, "Intel", name)
+        }
+    }
+
+    camera, err := Load("hikvision-camera", "")
+    require.NoError(t, err)
+    assert.Equal(t, "SSH-2.0-dropbear_2019.78", camera.SSH.Version)
+    assert.Equal(t, "Hikvision", camera.TLS.Organization)
+}
+
+func TestCustomProfileOverridesAndInherits(t *testing.T) {
+    dir := t.TempDir()
+    profile := []byte("name: ubuntu-web\ndescription: tuned\nssh:\n  version: \"SSH-2.0-OpenSSH_7.4\"\nhttp:\n  headers:\n    X-Powered-By: PHP/7.4.3\n")
+    require.NoError(t, os.WriteFile(filepath.Join(dir, "ubuntu-web.yaml"), profile, 0644))
+
+    p, err := Load("", dir)
+    require.NoError(t, err)
+    assert.Equal(t, "tuned", p.Description)
+    assert.Equal(t, "SSH-2.0-OpenSSH_7.4", p.SSH.Version)
+    assert.Equal(t, "PHP/7.4.3", p.HTTP.Headers["X-Powered-By"])
+    // Left out fields come from the default profile, but not its certificate
+    assert.Equal(t, "Apache/2.4.41 (Ubuntu)", p.HTTP.Server)
+    assert.Nil(t, p.TLS)
+    assert.Empty(t, Default().HTTP.Headers)
+}
+
+func TestLoadRejectsBadProfiles(t *testing.T) {
+    _, err := Load("cisco-router", "")
+    assert.ErrorContains(t, err, "unknown persona")
+    _, err = Load("../etc/passwd", "")
+    assert.Error(t, err)
+
+    dir := t.TempDir()
+    require.NoError(t, os.WriteFile(filepath.Join(dir, "broken.yaml"), []byte("name: broken\nssh:\n  version: OpenSSH\n"), 0644))
+    _, err = Load("broken", dir)
+    assert.ErrorContains(t, err, "SSH-2.0-")
+
+    require.NoError(t, os.WriteFile(filepath.Join(dir, "motd.yaml"), []byte("name: motd\nos:\n  motd: \"{{.Kernel\"\n"), 0644))
+    _, err = Load("motd", dir)
+    assert.ErrorContains(t, err, "motd")
+}
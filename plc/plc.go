@@ -0,0 +1,350 @@
+package plc
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v2"
+)
+
+// DefaultName is the profile used when neither the configuration nor the persona picks one
+const DefaultName = "schneider-m340"
+
+//go:embed profiles/*.yaml
+var builtinProfiles embed.FS
+
+// ErrIllegalAddress is returned for a range outside a table, Modbus exception 02
+var ErrIllegalAddress = errors.New("illegal data address")
+
+// Table is one of the four Modbus data tables
+type Table int
+
+// Modbus data tables
+const (
+    Coils Table = iota
+    DiscreteInputs
+    InputRegisters
+    HoldingRegisters
+)
+
+// String returns the name of the table as used in profiles and events
+func (t Table) String() string {
+    switch t {
+    case Coils:
+        return "coils"
+    case DiscreteInputs:
+        return "discrete_inputs"
+    case InputRegisters:
+        return "input_registers"
+    case HoldingRegisters:
+        return "holding_registers"
+    }
+    return fmt.Sprintf("table(%d)", int(t))
+}
+
+// Profile describes a PLC: what it reports about itself and its register map
+type Profile struct {
+    Name        string `yaml:"name"`
+    Description string `yaml:"description"`
+    // UnitID is the unit the PLC answers as; 0 answers any unit
+    UnitID   uint8    `yaml:"unit_id"`
+    Identity Identity `yaml:"identity"`
+
+    Coils            Map `yaml:"coils"`
+    DiscreteInputs   Map `yaml:"discrete_inputs"`
+    InputRegisters   Map `yaml:"input_registers"`
+    HoldingRegisters Map `yaml:"holding_registers"`
+
+    // Process optionally drives the points over time; see Signal
+    Process *Process `yaml:"process"`
+}
+
+// Identity holds the device identification objects of function 43/14
+type Identity struct {
+    Vendor          string `yaml:"vendor"`
+    ProductCode     string `yaml:"product_code"`
+    Revision        string `yaml:"revision"`
+    VendorURL       string `yaml:"vendor_url"`
+    ProductName     string `yaml:"product_name"`
+    ModelName       string `yaml:"model_name"`
+    ApplicationName string `yaml:"application_name"`
+}
+
+// Objects returns the identification objects by object id, basic ones first
+func (id Identity) Objects() []string {
+    return []string{id.Vendor, id.ProductCode, id.Revision, id.VendorURL, id.ProductName, id.ModelName, id.ApplicationName}
+}
+
+// Map is one data table: Size addresses starting at 0, of which Points are named.
+// Addresses without a point read as 0.
+type Map struct {
+    // Size is the number of addresses; 0 ends the table after the last point
+    Size   int     `yaml:"size"`
+    Points []Point `yaml:"points"`
+}
+
+// Point is a named coil, input or register. Coils and discrete inputs are on when Value is not 0.
+type Point struct {
+    Address uint16 `yaml:"address"`
+    Name    string `yaml:"name"`
+    Value   uint16 `yaml:"value"`
+    // Critical marks a point every write to which raises an alert, such as a safety limit
+    Critical bool `yaml:"critical"`
+    // Safe is the range the process tolerates; a write outside it raises an alert
+    Safe *Range `yaml:"safe"`
+}
+
+// Range is an inclusive range of values
+type Range struct {
+    Min uint16 `yaml:"min"`
+    Max uint16 `yaml:"max"`
+}
+
+// Contains reports whether v lies in the range
+func (r Range) Contains(v uint16) bool {
+    return v >= r.Min && v <= r.Max
+}
+
+// Alert reasons
+const (
+    // AlertCritical is a write to a point marked critical
+    AlertCritical = "critical"
+    // AlertUnsafe is a write that leaves the safe range of a point
+    AlertUnsafe = "unsafe"
+)
+
+// Alert describes a write that touched a critical point or left a safe range
+type Alert struct {
+    Reason   string
+    Table    Table
+    Point    Point
+    Previous uint16
+    Value    uint16
+}
+
+// table returns the map of t
+func (p *Profile) table(t Table) *Map {
+    switch t {
+    case Coils:
+        return &p.Coils
+    case DiscreteInputs:
+        return &p.DiscreteInputs
+    case InputRegisters:
+        return &p.InputRegisters
+    }
+    return &p.HoldingRegisters
+}
+
+// Builtin returns the names of the profiles compiled into the binary
+func Builtin() []string {
+    entries, _ := builtinProfiles.ReadDir("profiles")
+    names := make([]string, 0, len(entries))
+    for _, entry := range entries {
+        names = append(names, strings.TrimSuffix(entry.Name(), ".yaml"))
+    }
+    sort.Strings(names)
+    return names
+}
+
+// Default returns the built-in default profile
+func Default() *Profile {
+    p, err := Load(DefaultName, "")
+    if err != nil {
+        panic("plc: broken built-in profile: " + err.Error())
+    }
+    return p
+}
+
+// Load returns the profile called name. A <name>.yaml file in dir takes
+// precedence over the built-in profile of the same name.
+func Load(name, dir string) (*Profile, error) {
+    if name == "" {
+        name = DefaultName
+    }
+    if strings.ContainsAny(name, `/\`) {
+        return nil, fmt.Errorf("invalid PLC profile name %q", name)
+    }
+
+    var data []byte
+    var err error
+    if dir != "" {
+        data, err = os.ReadFile(filepath.Join(dir, name+".yaml"))
+    }
+    if dir == "" || errors.Is(err, os.ErrNotExist) {
+        data, err = builtinProfiles.ReadFile("profiles/" + name + ".yaml")
+        if errors.Is(err, os.ErrNotExist) {
+            return nil, fmt.Errorf("unknown PLC profile %q (built-in: %s)", name, strings.Join(Builtin(), ", "))
+        }
+    }
+    if err != nil {
+        return nil, err
+    }
+    p, err := Parse(data)
+    if err != nil {
+        return nil, fmt.Errorf("PLC profile %s: %v", name, err)
+    }
+    return p, nil
+}
+
+// Parse decodes a profile and checks its register map
+func Parse(data []byte) (*Profile, error) {
+    var p Profile
+    if err := yaml.Unmarshal(data, &p); err != nil {
+        return nil, err
+    }
+    if p.Name == "" {
+        return nil, errors.New("profile has no name")
+    }
+    // Names are unique across tables so the process can refer to points by name
+    names := make(map[string]bool)
+    for t := Coils; t <= HoldingRegisters; t++ {
+        m := p.table(t)
+        if m.Size < 0 || m.Size > 65536 {
+            return nil, fmt.Errorf("%s: size %d is outside the address space", t, m.Size)
+        }
+        size := m.Size
+        for _, point := range m.Points {
+            if m.Size != 0 && int(point.Address) >= m.Size {
+                return nil, fmt.Errorf("%s: %s at %d is beyond size %d", t, point.Name, point.Address, m.Size)
+            }
+            if point.Name != "" && names[point.Name] {
+                return nil, fmt.Errorf("%s: duplicate point %s", t, point.Name)
+            }
+            if point.Safe != nil && point.Safe.Min > point.Safe.Max {
+                return nil, fmt.Errorf("%s: %s has an empty safe range", t, point.Name)
+            }
+            names[point.Name] = true
+            if int(point.Address) >= size {
+                size = int(point.Address) + 1
+            }
+        }
+        m.Size = size
+    }
+    if p.Process != nil {
+        if err := p.Process.check(&p); err != nil {
+            return nil, fmt.Errorf("process: %v", err)
+        }
+    }
+    return &p, nil
+}
+
+// lookup finds a point by name
+func (p *Profile) lookup(name string) (ref, bool) {
+    for t := Coils; t <= HoldingRegisters; t++ {
+        for _, point := range p.table(t).Points {
+            if point.Name == name {
+                return ref{table: t, address: point.Address}, true
+            }
+        }
+    }
+    return ref{}, false
+}
+
+// Device is the live memory of a PLC, shared by every connection to it
+type Device struct {
+    profile *Profile
+    values  [4][]uint16
+    points  [4]map[uint16]Point
+    // signals are the compiled process of the profile, stepped by Simulate
+    signals []*signal
+    mu      sync.RWMutex
+}
+
+// NewDevice loads the register map of a profile into memory
+func NewDevice(p *Profile) *Device {
+    d := &Device{profile: p}
+    for t := Coils; t <= HoldingRegisters; t++ {
+        m := p.table(t)
+        d.values[t] = make([]uint16, m.Size)
+        d.points[t] = make(map[uint16]Point, len(m.Points))
+        for _, point := range m.Points {
+            d.values[t][point.Address] = normalize(t, point.Value)
+            d.points[t][point.Address] = point
+        }
+    }
+    if p.Process != nil {
+        d.signals = p.Process.compile(p)
+    }
+    return d
+}
+
+// Profile returns the profile the device was built from
+func (d *Device) Profile() *Profile {
+    return d.profile
+}
+
+// Read returns count values of table t starting at addr
+func (d *Device) Read(t Table, addr, count uint16) ([]uint16, error) {
+    d.mu.RLock()
+    defer d.mu.RUnlock()
+    if !d.contains(t, addr, int(count)) {
+        return nil, ErrIllegalAddress
+    }
+    return append([]uint16(nil), d.values[t][addr:int(addr)+int(count)]...), nil
+}
+
+// Write stores values in table t starting at addr. It returns an alert for
+// every critical point written and every value outside its safe range.
+func (d *Device) Write(t Table, addr uint16, values []uint16) ([]Alert, error) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    if !d.contains(t, addr, len(values)) {
+        return nil, ErrIllegalAddress
+    }
+    var alerts []Alert
+    for i, v := range values {
+        address := uint16(int(addr) + i)
+        v = normalize(t, v)
+        previous := d.values[t][address]
+        d.values[t][address] = v
+
+        point, ok := d.points[t][address]
+        if !ok {
+            continue
+        }
+        switch {
+        case point.Safe != nil && !point.Safe.Contains(v):
+            alerts = append(alerts, Alert{Reason: AlertUnsafe, Table: t, Point: point, Previous: previous, Value: v})
+        case point.Critical:
+            alerts = append(alerts, Alert{Reason: AlertCritical, Table: t, Point: point, Previous: previous, Value: v})
+        }
+    }
+    return alerts, nil
+}
+
+// Names returns the names of the points in a range, skipping unnamed addresses
+func (d *Device) Names(t Table, addr uint16, count int) []string {
+    var names []string
+    for i := 0; i < count && int(addr)+i < 65536; i++ {
+        if point, ok := d.points[t][uint16(int(addr)+i)]; ok && point.Name != "" {
+            names = append(names, point.Name)
+        }
+    }
+    return names
+}
+
+// Contains reports whether count addresses from addr exist in table t
+func (d *Device) Contains(t Table, addr uint16, count int) bool {
+    d.mu.RLock()
+    defer d.mu.RUnlock()
+    return d.contains(t, addr, count)
+}
+
+// contains is Contains with the lock held
+func (d *Device) contains(t Table, addr uint16, count int) bool {
+    return count > 0 && int(addr)+count <= len(d.values[t])
+}
+
+// normalize stores coils and discrete inputs as 0 or 1
+func normalize(t Table, v uint16) uint16 {
+    if (t == Coils || t == DiscreteInputs) && v != 0 {
+        return 1
+    }
+    return v
+}
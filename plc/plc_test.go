@@ -0,0 +1,83 @@
+package plc
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuiltinProfilesLoad(t *testing.T) {
+    names := Builtin()
+    assert.Equal(t, []string{"schneider-m340", "siemens-s7-1200"}, names)
+
+    for _, name := range names {
+        p, err := Load(name, "")
+        require.NoError(t, err, name)
+        assert.Equal(t, name, p.Name)
+        assert.NotEmpty(t, p.Identity.Vendor, name)
+        assert.NotEmpty(t, p.Identity.ProductCode, name)
+        assert.NotEmpty(t, p.Identity.Revision, name)
+        assert.NotEmpty(t, p.HoldingRegisters.Points, name)
+    }
+    assert.Equal(t, DefaultName, Default().Name)
+
+    _, err := Load("modicon-unknown", "")
+    assert.ErrorContains(t, err, "built-in: schneider-m340, siemens-s7-1200")
+}
+
+func TestCustomProfileOverridesBuiltin(t *testing.T) {
+    dir := t.TempDir()
+    profile := []byte("name: schneider-m340\nidentity: {vendor: Acme}\nholding_registers:\n  points:\n    - {address: 9, name: speed, value: 1500}\n")
+    require.NoError(t, os.WriteFile(filepath.Join(dir, "schneider-m340.yaml"), profile, 0644))
+
+    p, err := Load("", dir)
+    require.NoError(t, err)
+    assert.Equal(t, "Acme", p.Identity.Vendor)
+    // Without a size the table ends after the last point
+    assert.Equal(t, 10, p.HoldingRegisters.Size)
+    assert.Equal(t, 0, p.Coils.Size)
+
+    other, err := Load("siemens-s7-1200", dir)
+    require.NoError(t, err)
+    assert.Equal(t, "Siemens", other.Identity.Vendor)
+}
+
+func TestInvalidProfilesAreRejected(t *testing.T) {
+    for _, data := range []string{
+        "description: nameless",
+        "name: x\ncoils:\n  size: 4\n  points:\n    - {address: 4, name: beyond}",
+        "name: x\ninput_registers:\n  points:\n    - {address: 0, name: a}\n    - {address: 1, name: a}",
+        "name: x\nholding_registers:\n  size: 70000",
+    } {
+        _, err := Parse([]byte(data))
+        assert.Error(t, err, data)
+    }
+}
+
+func TestDeviceReadsAndWrites(t *testing.T) {
+    p, err := Parse([]byte("name: x\ncoils:\n  size: 8\n  points:\n    - {address: 1, name: run, value: 5}\nholding_registers:\n  size: 4\n  points:\n    - {address: 2, name: setpoint, value: 450}\n"))
+    require.NoError(t, err)
+    d := NewDevice(p)
+
+    values, err := d.Read(Coils, 0, 3)
+    require.NoError(t, err)
+    assert.Equal(t, []uint16{0, 1, 0}, values, "coils are 0 or 1")
+
+    alerts, err := d.Write(HoldingRegisters, 1, []uint16{7, 8, 9})
+    require.NoError(t, err)
+    assert.Empty(t, alerts)
+    values, err = d.Read(HoldingRegisters, 0, 4)
+    require.NoError(t, err)
+    assert.Equal(t, []uint16{0, 7, 8, 9}, values)
+    assert.Equal(t, []string{"setpoint"}, d.Names(HoldingRegisters, 0, 4))
+
+    _, err = d.Write(HoldingRegisters, 3, []uint16{1, 2})
+    assert.ErrorIs(t, err, ErrIllegalAddress)
+    _, err = d.Read(InputRegisters, 0, 1)
+    assert.ErrorIs(t, err, ErrIllegalAddress)
+    assert.False(t, d.Contains(Coils, 7, 2))
+    assert.True(t, d.Contains(Coils, 7, 1))
+}
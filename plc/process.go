@@ -0,0 +1,289 @@
+package plc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// defaultInterval is how often the process is stepped when the profile does not say
+const defaultInterval = time.Second
+
+// Process is a simple model of the plant a PLC controls. Every interval the
+// signals are applied in order, each computing one point from the others, so
+// values drift like real measurements and writes have visible consequences.
+type Process struct {
+    Interval time.Duration `yaml:"interval"`
+    Signals  []Signal      `yaml:"signals"`
+}
+
+// Signal drives one point. Kinds:
+//
+//   - noise: the point wanders randomly within Noise of its value
+//   - mirror: the point copies Source, e.g. a running feedback from its run coil
+//   - follow: the point approaches Offset + Source*Scale by Rate of the gap per step
+//   - integrate: every step the point changes by the sum of its Terms, within Min and Max
+//   - threshold: the point is on while Source is at or above the limit, at or below with Reverse
+//   - control: the point is switched on when Source falls Band below the limit and
+//     off when it rises Band above it, the other way round with Reverse
+//
+// The limit is the value of the Setpoint point, or Limit without one. While
+// Enable is off the point is off, or at Offset for follow.
+type Signal struct {
+    Kind     string  `yaml:"kind"`
+    Point    string  `yaml:"point"`
+    Source   string  `yaml:"source"`
+    Enable   string  `yaml:"enable"`
+    Scale    float64 `yaml:"scale"`
+    Offset   float64 `yaml:"offset"`
+    Rate     float64 `yaml:"rate"`
+    Noise    float64 `yaml:"noise"`
+    Terms    []Term  `yaml:"terms"`
+    Min      float64 `yaml:"min"`
+    Max      float64 `yaml:"max"`
+    Setpoint string  `yaml:"setpoint"`
+    Limit    float64 `yaml:"limit"`
+    Band     float64 `yaml:"band"`
+    Reverse  bool    `yaml:"reverse"`
+}
+
+// Term is one contribution to an integrate signal: Rate plus Source*Scale per step while Enable is on
+type Term struct {
+    Enable string  `yaml:"enable"`
+    Source string  `yaml:"source"`
+    Scale  float64 `yaml:"scale"`
+    Rate   float64 `yaml:"rate"`
+}
+
+// ref addresses one point of a device
+type ref struct {
+    table   Table
+    address uint16
+}
+
+// check validates the signals against the points of p
+func (proc *Process) check(p *Profile) error {
+    if proc.Interval < 0 {
+        return errors.New("negative interval")
+    }
+    known := func(name string) bool {
+        _, ok := p.lookup(name)
+        return name == "" || ok
+    }
+    for i, sig := range proc.Signals {
+        target, ok := p.lookup(sig.Point)
+        if !ok {
+            return fmt.Errorf("signal %d: unknown point %q", i, sig.Point)
+        }
+        for _, name := range []string{sig.Source, sig.Enable, sig.Setpoint} {
+            if !known(name) {
+                return fmt.Errorf("signal %s: unknown point %q", sig.Point, name)
+            }
+        }
+        for _, term := range sig.Terms {
+            if !known(term.Source) || !known(term.Enable) {
+                return fmt.Errorf("signal %s: unknown point in terms", sig.Point)
+            }
+        }
+        switch sig.Kind {
+        case "noise", "follow", "integrate":
+            if target.table == Coils || target.table == DiscreteInputs {
+                return fmt.Errorf("signal %s: %s needs a register", sig.Point, sig.Kind)
+            }
+        case "mirror", "threshold", "control":
+            if sig.Source == "" {
+                return fmt.Errorf("signal %s: %s needs a source", sig.Point, sig.Kind)
+            }
+        default:
+            return fmt.Errorf("signal %s: unknown kind %q", sig.Point, sig.Kind)
+        }
+        if sig.Max != 0 && sig.Min > sig.Max {
+            return fmt.Errorf("signal %s: min above max", sig.Point)
+        }
+    }
+    return nil
+}
+
+// signal is a Signal resolved against a device, with its running state
+type signal struct {
+    Signal
+    point    ref
+    source   *ref
+    enable   *ref
+    setpoint *ref
+    terms    []term
+    // value is the unrounded value of the point, base the centre of a noise signal
+    value   float64
+    base    float64
+    last    uint16
+    started bool
+}
+
+// term is a resolved Term
+type term struct {
+    Term
+    source *ref
+    enable *ref
+}
+
+// compile resolves the signals of a checked process against p
+func (proc *Process) compile(p *Profile) []*signal {
+    resolve := func(name string) *ref {
+        if r, ok := p.lookup(name); ok {
+            return &r
+        }
+        return nil
+    }
+    signals := make([]*signal, 0, len(proc.Signals))
+    for _, sig := range proc.Signals {
+        s := &signal{Signal: sig, source: resolve(sig.Source), enable: resolve(sig.Enable), setpoint: resolve(sig.Setpoint)}
+        s.point = *resolve(sig.Point)
+        if s.Scale == 0 {
+            s.Scale = 1
+        }
+        if s.Rate == 0 {
+            s.Rate = 1
+        }
+        if s.Max == 0 {
+            s.Max = math.MaxUint16
+        }
+        for _, t := range sig.Terms {
+            if t.Scale == 0 {
+                t.Scale = 1
+            }
+            s.terms = append(s.terms, term{Term: t, source: resolve(t.Source), enable: resolve(t.Enable)})
+        }
+        signals = append(signals, s)
+    }
+    return signals
+}
+
+// Simulate steps the process every interval until ctx is done
+func (d *Device) Simulate(ctx context.Context) {
+    if len(d.signals) == 0 {
+        return
+    }
+    interval := d.profile.Process.Interval
+    if interval == 0 {
+        interval = defaultInterval
+    }
+    rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+            d.Step(rng)
+        }
+    }
+}
+
+// Step applies every signal once
+func (d *Device) Step(rng *rand.Rand) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    for _, s := range d.signals {
+        s.step(d, rng)
+    }
+}
+
+// get reads a point, with the lock held; an absent point reads as 0
+func (d *Device) get(r *ref) float64 {
+    if r == nil {
+        return 0
+    }
+    return float64(d.values[r.table][r.address])
+}
+
+// on reports whether an optional gate is on
+func (d *Device) on(r *ref) bool {
+    return r == nil || d.get(r) != 0
+}
+
+// step computes the point of s from the current values
+func (s *signal) step(d *Device, rng *rand.Rand) {
+    current := d.values[s.point.table][s.point.address]
+    // A write from outside moves the simulated value with it
+    if !s.started || current != s.last {
+        s.value, s.base, s.started = float64(current), float64(current), true
+    }
+    enabled := d.on(s.enable)
+    jitter := (rng.Float64()*2 - 1) * s.Noise
+
+    var next float64
+    switch s.Kind {
+    case "noise":
+        s.value += jitter / 2
+        s.value = math.Max(s.base-s.Noise, math.Min(s.base+s.Noise, s.value))
+        next = s.value
+    case "mirror":
+        next = d.get(s.source)
+        if !enabled {
+            next = 0
+        }
+    case "follow":
+        target := s.Offset
+        if enabled && s.source != nil {
+            target += d.get(s.source) * s.Scale
+        }
+        s.value += (target - s.value) * s.Rate
+        next = s.value + jitter
+    case "integrate":
+        for _, t := range s.terms {
+            if d.on(t.enable) {
+                s.value += t.Rate
+                if t.source != nil {
+                    s.value += d.get(t.source) * t.Scale
+                }
+            }
+        }
+        s.value = math.Max(s.Min, math.Min(s.Max, s.value))
+        next = s.value + jitter
+    case "threshold":
+        source, limit := d.get(s.source), s.limit(d)
+        on := source >= limit
+        if s.Reverse {
+            on = source <= limit
+        }
+        next = boolValue(on && enabled)
+    case "control":
+        source, limit := d.get(s.source), s.limit(d)
+        low, high := source < limit-s.Band, source > limit+s.Band
+        if s.Reverse {
+            low, high = high, low
+        }
+        next = float64(current)
+        switch {
+        case !enabled || high:
+            next = 0
+        case low:
+            next = 1
+        }
+    }
+
+    v := uint16(math.Round(math.Max(0, math.Min(math.MaxUint16, next))))
+    v = normalize(s.point.table, v)
+    d.values[s.point.table][s.point.address] = v
+    s.last = v
+}
+
+// limit returns the threshold of a threshold or control signal
+func (s *signal) limit(d *Device) float64 {
+    if s.setpoint != nil {
+        return d.get(s.setpoint)
+    }
+    return s.Limit
+}
+
+// boolValue converts a condition to a coil value
+func boolValue(on bool) float64 {
+    if on {
+        return 1
+    }
+    return 0
+}
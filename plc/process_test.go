@@ -0,0 +1,106 @@
+package plc
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// value reads one point by name
+func value(t *testing.T, d *Device, name string) uint16 {
+    r, ok := d.profile.lookup(name)
+    require.True(t, ok, name)
+    values, err := d.Read(r.table, r.address, 1)
+    require.NoError(t, err)
+    return values[0]
+}
+
+// write sets one point by name
+func write(t *testing.T, d *Device, name string, v uint16) []Alert {
+    r, ok := d.profile.lookup(name)
+    require.True(t, ok, name)
+    alerts, err := d.Write(r.table, r.address, []uint16{v})
+    require.NoError(t, err)
+    return alerts
+}
+
+func TestProcessReactsToWrites(t *testing.T) {
+    p, err := Load("schneider-m340", "")
+    require.NoError(t, err)
+    d := NewDevice(p)
+    rng := rand.New(rand.NewSource(1))
+    steps := func(n int) {
+        for i := 0; i < n; i++ {
+            d.Step(rng)
+        }
+    }
+
+    // The tank fills to the setpoint band and the PLC closes the inlet
+    steps(120)
+    assert.InDelta(t, 450, float64(value(t, d, "tank_level_cm")), 20)
+    assert.InDelta(t, 143, float64(value(t, d, "water_temp_c_x10")), 4)
+    assert.InDelta(t, 186, float64(value(t, d, "pump_1_current_a_x10")), 6)
+
+    // Stopping the pump stops its feedback and current; a raised setpoint overfills the tank
+    write(t, d, "pump_1_run", 0)
+    write(t, d, "tank_level_setpoint_cm", 580)
+    steps(400)
+    assert.Equal(t, uint16(0), value(t, d, "pump_1_running"))
+    assert.LessOrEqual(t, value(t, d, "pump_1_current_a_x10"), uint16(2))
+    assert.InDelta(t, 580, float64(value(t, d, "tank_level_cm")), 20)
+    assert.Equal(t, uint16(1), value(t, d, "tank_high_switch"))
+
+    // A level written from outside is where the simulation carries on
+    write(t, d, "pump_1_run", 1)
+    write(t, d, "tank_level_setpoint_cm", 450)
+    level, ok := p.lookup("tank_level_cm")
+    require.True(t, ok)
+    d.mu.Lock()
+    d.values[level.table][level.address] = 100
+    d.mu.Unlock()
+    steps(1)
+    assert.InDelta(t, 101, float64(value(t, d, "tank_level_cm")), 2)
+    assert.Equal(t, uint16(1), value(t, d, "tank_low_switch"))
+}
+
+func TestWriteAlerts(t *testing.T) {
+    d := NewDevice(Default())
+
+    assert.Empty(t, write(t, d, "pump_1_speed_pct", 95))
+
+    alerts := write(t, d, "pump_1_speed_pct", 150)
+    require.Len(t, alerts, 1)
+    assert.Equal(t, AlertUnsafe, alerts[0].Reason)
+    assert.Equal(t, "pump_1_speed_pct", alerts[0].Point.Name)
+    assert.Equal(t, uint16(95), alerts[0].Previous)
+    assert.Equal(t, uint16(150), alerts[0].Value)
+
+    // A critical point alerts on every write; leaving its safe range is the graver reason
+    alerts = write(t, d, "tank_high_alarm_cm", 500)
+    require.Len(t, alerts, 1)
+    assert.Equal(t, AlertCritical, alerts[0].Reason)
+    alerts = write(t, d, "tank_high_alarm_cm", 900)
+    require.Len(t, alerts, 1)
+    assert.Equal(t, AlertUnsafe, alerts[0].Reason)
+    assert.Equal(t, AlertCritical, write(t, d, "remote_control", 0)[0].Reason)
+}
+
+func TestInvalidProcessesAreRejected(t *testing.T) {
+    points := "name: x\ncoils:\n  points:\n    - {address: 0, name: run}\ninput_registers:\n  points:\n    - {address: 0, name: level}\nprocess:\n  signals:\n"
+    for _, signal := range []string{
+        "    - {kind: noise, point: missing}",
+        "    - {kind: noise, point: run, noise: 2}",
+        "    - {kind: mirror, point: run}",
+        "    - {kind: wobble, point: level}",
+        "    - {kind: follow, point: level, source: nowhere}",
+        "    - {kind: integrate, point: level, terms: [{enable: nowhere}]}",
+        "    - {kind: integrate, point: level, min: 10, max: 5}",
+    } {
+        _, err := Parse([]byte(points + signal))
+        assert.Error(t, err, signal)
+    }
+    _, err := Parse([]byte(points + "    - {kind: threshold, point: run, source: level, limit: 10}"))
+    assert.NoError(t, err)
+}
@@ -0,0 +1,261 @@
+package quarantine
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Upload records one time a sample was delivered to a honeypot
+type Upload struct {
+    // Filename is the name the attacker gave the file, e.g. the SCP or SFTP target path
+    Filename  string    `json:"filename"`
+    SessionID string    `json:"session_id"`
+    Service   string    `json:"service"`
+    Src       string    `json:"src"`
+    Timestamp time.Time `json:"timestamp"`
+    // Truncated is set when the delivered file exceeded the size cap
+    Truncated bool `json:"truncated,omitempty"`
+}
+
+// maxUploads is how many of the most recent deliveries a sample lists
+const maxUploads = 100
+
+// Sample is the metadata kept next to a quarantined file
+type Sample struct {
+    SHA256    string    `json:"sha256"`
+    Size      int64     `json:"size"`
+    FirstSeen time.Time `json:"first_seen"`
+    LastSeen  time.Time `json:"last_seen"`
+    // UploadCount counts every delivery; Uploads lists the most recent ones
+    UploadCount int      `json:"upload_count"`
+    Uploads     []Upload `json:"uploads"`
+}
+
+// Store keeps uploaded files in a content-addressed directory. Files are named by
+// their SHA-256 so the same sample delivered by a thousand bots is stored once,
+// with a metadata sidecar listing every delivery.
+type Store struct {
+    dir      string
+    maxBytes int64
+    maxTotal int64
+    mu       sync.Mutex
+
+    // index tracks the stored samples for the store-wide cap; nil until first needed
+    index map[string]indexEntry
+    total int64
+}
+
+// indexEntry is what eviction needs to know about a stored sample
+type indexEntry struct {
+    size     int64
+    lastSeen time.Time
+}
+
+// NewStore creates a store in dir; maxBytes caps the stored size of a file and
+// maxTotal that of all files, evicting the least recently seen samples (0 means unlimited)
+func NewStore(dir string, maxBytes, maxTotal int64) *Store {
+    return &Store{dir: dir, maxBytes: maxBytes, maxTotal: maxTotal}
+}
+
+// Dir returns the directory the store writes to
+func (s *Store) Dir() string {
+    return s.dir
+}
+
+// MaxBytes returns the size cap for a single file, 0 when unlimited
+func (s *Store) MaxBytes() int64 {
+    return s.maxBytes
+}
+
+// Path returns where the sample with the given SHA-256 is stored
+func (s *Store) Path(sum string) string {
+    return filepath.Join(s.dir, sum[:2], sum)
+}
+
+// metadataPath returns where the metadata of a sample is stored
+func (s *Store) metadataPath(sum string) string {
+    return s.Path(sum) + ".json"
+}
+
+// Sum returns the hex SHA-256 of data
+func Sum(data []byte) string {
+    sum := sha256.Sum256(data)
+    return hex.EncodeToString(sum[:])
+}
+
+// Save stores data unless the same content is already quarantined and records the upload
+func (s *Store) Save(data []byte, upload Upload) (*Sample, error) {
+    if s.maxBytes > 0 && int64(len(data)) > s.maxBytes {
+        data = data[:s.maxBytes]
+        upload.Truncated = true
+    }
+    if upload.Timestamp.IsZero() {
+        upload.Timestamp = time.Now()
+    }
+    sum := Sum(data)
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if err := os.MkdirAll(filepath.Dir(s.Path(sum)), 0700); err != nil {
+        return nil, fmt.Errorf("failed to create quarantine directory: %v", err)
+    }
+
+    sample, err := s.lookup(sum)
+    if os.IsNotExist(err) {
+        if err := s.makeRoom(int64(len(data))); err != nil {
+            return nil, err
+        }
+        // Samples are never executable and only readable by the sensor
+        if err := writeFile(s.Path(sum), data, 0400); err != nil {
+            return nil, fmt.Errorf("failed to quarantine %s: %v", sum, err)
+        }
+        sample = &Sample{SHA256: sum, Size: int64(len(data)), FirstSeen: upload.Timestamp}
+        if s.index != nil {
+            s.index[sum] = indexEntry{size: sample.Size}
+            s.total += sample.Size
+        }
+    } else if err != nil {
+        return nil, err
+    }
+
+    sample.LastSeen = upload.Timestamp
+    sample.UploadCount++
+    sample.Uploads = append(sample.Uploads, upload)
+    if len(sample.Uploads) > maxUploads {
+        sample.Uploads = append([]Upload(nil), sample.Uploads[len(sample.Uploads)-maxUploads:]...)
+    }
+    encoded, err := json.MarshalIndent(sample, "", "  ")
+    if err != nil {
+        return nil, fmt.Errorf("failed to encode sample metadata: %v", err)
+    }
+    if err := writeFile(s.metadataPath(sum), encoded, 0600); err != nil {
+        return nil, fmt.Errorf("failed to write sample metadata: %v", err)
+    }
+    if entry, ok := s.index[sum]; ok {
+        entry.lastSeen = sample.LastSeen
+        s.index[sum] = entry
+    }
+    return sample, nil
+}
+
+// makeRoom evicts the least recently seen samples until size more bytes fit under
+// the store-wide cap; the caller holds s.mu
+func (s *Store) makeRoom(size int64) error {
+    if s.maxTotal <= 0 {
+        return nil
+    }
+    if size > s.maxTotal {
+        return fmt.Errorf("sample of %d bytes exceeds the quarantine size of %d bytes", size, s.maxTotal)
+    }
+    if s.index == nil {
+        if err := s.loadIndex(); err != nil {
+            return err
+        }
+    }
+    if s.total+size <= s.maxTotal {
+        return nil
+    }
+
+    sums := make([]string, 0, len(s.index))
+    for sum := range s.index {
+        sums = append(sums, sum)
+    }
+    sort.Slice(sums, func(i, j int) bool {
+        return s.index[sums[i]].lastSeen.Before(s.index[sums[j]].lastSeen)
+    })
+    for _, sum := range sums {
+        if s.total+size <= s.maxTotal {
+            break
+        }
+        if err := os.Remove(s.Path(sum)); err != nil && !os.IsNotExist(err) {
+            return fmt.Errorf("failed to evict %s: %v", sum, err)
+        }
+        os.Remove(s.metadataPath(sum))
+        s.total -= s.index[sum].size
+        delete(s.index, sum)
+    }
+    return nil
+}
+
+// loadIndex reads the samples already in the directory; the caller holds s.mu
+func (s *Store) loadIndex() error {
+    s.index = make(map[string]indexEntry)
+    s.total = 0
+    paths, err := filepath.Glob(filepath.Join(s.dir, "*", "*"))
+    if err != nil {
+        return err
+    }
+    for _, p := range paths {
+        sum := filepath.Base(p)
+        if len(sum) != sha256.Size*2 || filepath.Ext(sum) != "" {
+            continue
+        }
+        info, err := os.Stat(p)
+        if err != nil {
+            continue
+        }
+        entry := indexEntry{size: info.Size(), lastSeen: info.ModTime()}
+        if sample, err := s.lookup(sum); err == nil {
+            entry.lastSeen = sample.LastSeen
+        }
+        s.index[sum] = entry
+        s.total += entry.size
+    }
+    return nil
+}
+
+// Lookup returns the metadata of a quarantined sample
+func (s *Store) Lookup(sum string) (*Sample, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.lookup(sum)
+}
+
+// lookup reads sample metadata; the caller holds s.mu
+func (s *Store) lookup(sum string) (*Sample, error) {
+    if len(sum) != sha256.Size*2 {
+        return nil, fmt.Errorf("invalid SHA-256 %q", sum)
+    }
+    data, err := os.ReadFile(s.metadataPath(sum))
+    if err != nil {
+        return nil, err
+    }
+    var sample Sample
+    if err := json.Unmarshal(data, &sample); err != nil {
+        return nil, fmt.Errorf("corrupt metadata for %s: %v", sum, err)
+    }
+    // Metadata written before the count was kept lists every upload
+    if sample.UploadCount < len(sample.Uploads) {
+        sample.UploadCount = len(sample.Uploads)
+    }
+    return &sample, nil
+}
+
+// writeFile replaces path atomically so readers never see a partial file
+func writeFile(path string, data []byte, perm os.FileMode) error {
+    tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(tmp.Name())
+
+    if _, err := tmp.Write(data); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Close(); err != nil {
+        return err
+    }
+    if err := os.Chmod(tmp.Name(), perm); err != nil {
+        return err
+    }
+    return os.Rename(tmp.Name(), path)
+}
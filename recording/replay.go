@@ -0,0 +1,61 @@
+package recording
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Replay writes a recording to w.
+// Terminal recordings are played back with their original timing scaled by speed,
+// like asciinema; a speed of 0 or less prints everything immediately.
+// Binary recordings are printed as annotated hex/ASCII dumps.
+func Replay(w io.Writer, header *Header, frames []Frame, speed float64) error {
+    fmt.Fprintf(w, "Session %s (%s) %s -> %s, started %s\n\n",
+        header.SessionID, header.Service, header.Src, header.Dst,
+        header.Started.Format(time.RFC3339))
+
+    if header.Mode == ModeBinary {
+        return replayBinary(w, frames)
+    }
+    return replayTerminal(w, frames, speed)
+}
+
+// replayTerminal streams frames as text, sleeping between them
+func replayTerminal(w io.Writer, frames []Frame, speed float64) error {
+    last := 0.0
+    for _, frame := range frames {
+        if speed > 0 && frame.Offset > last {
+            time.Sleep(time.Duration((frame.Offset - last) / speed * float64(time.Second)))
+        }
+        last = frame.Offset
+
+        if _, err := w.Write(frame.Data); err != nil {
+            return err
+        }
+        if frame.Truncated {
+            fmt.Fprint(w, "\n[recording truncated]\n")
+        }
+    }
+    return nil
+}
+
+// replayBinary prints every frame with its direction, offset and a hex dump
+func replayBinary(w io.Writer, frames []Frame) error {
+    for _, frame := range frames {
+        direction := "attacker -> honeypot"
+        if frame.Dir == DirOutput {
+            direction = "honeypot -> attacker"
+        }
+        fmt.Fprintf(w, "[+%.3fs] %s, %d bytes\n", frame.Offset, direction, len(frame.Data))
+        if _, err := io.WriteString(w, hex.Dump(frame.Data)); err != nil {
+            return err
+        }
+        if frame.Truncated {
+            fmt.Fprintln(w, "[recording truncated]")
+        }
+        fmt.Fprintln(w)
+    }
+    return nil
+}
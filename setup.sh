@@ -47,7 +47,7 @@ go mod tidy
 
 # สร้าง binary
 echo "คอมไพล์โปรแกรม..."
-go build -o shadownet cmd/main.go
+go build -o shadownet ./cmd
 
 # ตั้งค่าสิทธิ์การเข้าถึงพอร์ต
 echo "ตั้งค่าสิทธิ์การใช้งานพอร์ต..."
@@ -0,0 +1,612 @@
+package shell
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// builtin emulates a command; args[0] is the command name
+type builtin func(s *Shell, args []string, stdin string) result
+
+// builtins maps command names to their emulation. It is filled in init because
+// commands like sudo and sh run other commands through it.
+var builtins map[string]builtin
+
+func init() {
+    builtins = map[string]builtin{
+        "bash":     cmdSh,
+        "cat":      cmdCat,
+        "cd":       cmdCd,
+        "chmod":    cmdChmod,
+        "clear":    func(s *Shell, args []string, stdin string) result { return ok("\x1b[H\x1b[2J") },
+        "curl":     cmdCurl,
+        "df":       cmdDf,
+        "echo":     cmdEcho,
+        "env":      cmdEnv,
+        "exit":     cmdExit,
+        "export":   cmdExport,
+        "free":     cmdFree,
+        "grep":     cmdGrep,
+        "head":     cmdHead,
+        "history":  cmdHistory,
+        "hostname": func(s *Shell, args []string, stdin string) result { return ok(s.hostname + "\n") },
+        "id":       cmdID,
+        "logout":   cmdExit,
+        "ls":       cmdLs,
+        "mkdir":    cmdMkdir,
+        "nproc":    func(s *Shell, args []string, stdin string) result { return ok("2\n") },
+        "ps":       cmdPs,
+        "pwd":      func(s *Shell, args []string, stdin string) result { return ok(s.cwd + "\n") },
+        "rm":       cmdRm,
+        "sh":       cmdSh,
+        "sudo":     cmdSudo,
+        "touch":    cmdTouch,
+        "true":     func(s *Shell, args []string, stdin string) result { return result{} },
+        "false":    func(s *Shell, args []string, stdin string) result { return result{status: 1} },
+        "uname":    cmdUname,
+        "uptime":   cmdUptime,
+        "w":        cmdW,
+        "wc":       cmdWc,
+        "wget":     cmdWget,
+        "which":    cmdWhich,
+        "whoami":   func(s *Shell, args []string, stdin string) result { return ok(s.user + "\n") },
+    }
+}
+
+// splitFlags separates single-dash flags from operands, e.g. "-la" gives "la"
+func splitFlags(args []string) (flags string, operands []string) {
+    for _, arg := range args {
+        if len(arg) > 1 && arg[0] == '-' && !strings.HasPrefix(arg, "--") {
+            flags += arg[1:]
+        } else if !strings.HasPrefix(arg, "--") {
+            operands = append(operands, arg)
+        }
+    }
+    return flags, operands
+}
+
+func cmdCd(s *Shell, args []string, stdin string) result {
+    target := s.env["HOME"]
+    if len(args) > 1 {
+        target = args[1]
+    }
+    if target == "-" {
+        target = s.env["OLDPWD"]
+    }
+    dir := s.abs(target)
+    n := s.fs.lookupNode(dir)
+    switch {
+    case n == nil:
+        return fail(1, "-bash: cd: %s: %v", target, ErrNotFound)
+    case !n.dir:
+        return fail(1, "-bash: cd: %s: %v", target, ErrNotDir)
+    case dir == "/root" && s.user != "root":
+        return fail(1, "-bash: cd: %s: %v", target, ErrPermission)
+    }
+    s.env["OLDPWD"] = s.cwd
+    s.cwd = dir
+    return result{}
+}
+
+func cmdLs(s *Shell, args []string, stdin string) result {
+    flags, operands := splitFlags(args[1:])
+    long := strings.ContainsAny(flags, "l")
+    all := strings.ContainsAny(flags, "aA")
+    if len(operands) == 0 {
+        operands = []string{"."}
+    }
+
+    var res result
+    var out strings.Builder
+    for i, operand := range operands {
+        n := s.fs.lookupNode(s.abs(operand))
+        if n == nil {
+            res.stderr += fmt.Sprintf("ls: cannot access '%s': %v\n", operand, ErrNotFound)
+            res.status = 2
+            continue
+        }
+        if !n.dir {
+            out.WriteString(lsEntry(n, operand, long))
+            continue
+        }
+        if len(operands) > 1 {
+            if i > 0 {
+                out.WriteString("\n")
+            }
+            fmt.Fprintf(&out, "%s:\n", operand)
+        }
+        if long {
+            fmt.Fprintf(&out, "total %d\n", 4*(len(n.children)+2))
+        }
+        var names []string
+        if all && long {
+            parent := s.fs.lookupNode(path.Dir(s.abs(operand)))
+            out.WriteString(lsEntry(n, ".", true))
+            out.WriteString(lsEntry(parent, "..", true))
+        } else if all {
+            names = append(names, ".", "..")
+        }
+        for _, child := range n.list() {
+            if strings.HasPrefix(child.name, ".") && !all {
+                continue
+            }
+            if long {
+                out.WriteString(lsEntry(child, child.name, true))
+            } else {
+                names = append(names, child.name)
+            }
+        }
+        if len(names) > 0 {
+            out.WriteString(strings.Join(names, "  ") + "\n")
+        }
+    }
+    res.stdout = out.String()
+    return res
+}
+
+// lsEntry renders one node like ls
+func lsEntry(n *node, name string, long bool) string {
+    if !long {
+        return name + "\n"
+    }
+    links := 1
+    if n.dir {
+        links = 2
+    }
+    return fmt.Sprintf("%s %d %-4s %-4s %5d %s %s\n", n.modeString(), links, n.owner, n.owner, n.size(), n.modTime.Format("Jan _2 15:04"), name)
+}
+
+func cmdCat(s *Shell, args []string, stdin string) result {
+    _, operands := splitFlags(args[1:])
+    if len(operands) == 0 {
+        return ok(stdin)
+    }
+
+    var res result
+    for _, operand := range operands {
+        p := s.abs(operand)
+        if s.user != "root" && (p == "/etc/shadow" || strings.HasPrefix(p, "/root/")) {
+            res.stderr += fmt.Sprintf("cat: %s: %v\n", operand, ErrPermission)
+            res.status = 1
+            continue
+        }
+        data, err := s.fs.ReadFile(p)
+        if err != nil {
+            res.stderr += fmt.Sprintf("cat: %s: %v\n", operand, err)
+            res.status = 1
+            continue
+        }
+        // Repeating a large file must not build unbounded output
+        if int64(len(res.stdout)+len(data)) > s.fs.maxFile {
+            res.stderr += fmt.Sprintf("cat: write error: %v\n", ErrNoSpace)
+            res.status = 1
+            break
+        }
+        res.stdout += string(data)
+    }
+    return res
+}
+
+func cmdEcho(s *Shell, args []string, stdin string) result {
+    words := args[1:]
+    newline := true
+    if len(words) > 0 && words[0] == "-n" {
+        newline = false
+        words = words[1:]
+    } else if len(words) > 0 && words[0] == "-e" {
+        words = words[1:]
+    }
+    out := strings.Join(words, " ")
+    if newline {
+        out += "\n"
+    }
+    return ok(out)
+}
+
+func cmdUname(s *Shell, args []string, stdin string) result {
+    flags, _ := splitFlags(args[1:])
+    // GNU uname leaves out the processor and platform where it cannot tell them
+    processor := "unknown"
+    if s.sys.Machine == "x86_64" {
+        processor = s.sys.Machine
+    }
+    if strings.Contains(flags, "a") {
+        if processor == "unknown" {
+            return ok(fmt.Sprintf("Linux %s %s %s %s GNU/Linux\n", s.hostname, s.sys.Kernel, s.sys.KernelVersion, s.sys.Machine))
+        }
+        return ok(fmt.Sprintf("Linux %s %s %s %s %s %s GNU/Linux\n", s.hostname, s.sys.Kernel, s.sys.KernelVersion, s.sys.Machine, processor, processor))
+    }
+    if flags == "" {
+        flags = "s"
+    }
+
+    var parts []string
+    for _, flag := range flags {
+        switch flag {
+        case 's':
+            parts = append(parts, "Linux")
+        case 'n':
+            parts = append(parts, s.hostname)
+        case 'r':
+            parts = append(parts, s.sys.Kernel)
+        case 'v':
+            parts = append(parts, s.sys.KernelVersion)
+        case 'm':
+            parts = append(parts, s.sys.Machine)
+        case 'p', 'i':
+            parts = append(parts, processor)
+        case 'o':
+            parts = append(parts, "GNU/Linux")
+        default:
+            return fail(1, "uname: invalid option -- '%c'\nTry 'uname --help' for more information.", flag)
+        }
+    }
+    return ok(strings.Join(parts, " ") + "\n")
+}
+
+func cmdID(s *Shell, args []string, stdin string) result {
+    if s.user == "root" {
+        return ok("uid=0(root) gid=0(root) groups=0(root)\n")
+    }
+    return ok(fmt.Sprintf("uid=1000(%[1]s) gid=1000(%[1]s) groups=1000(%[1]s),4(adm),27(sudo)\n", s.user))
+}
+
+func cmdPs(s *Shell, args []string, stdin string) result {
+    flags, operands := splitFlags(args[1:])
+    if strings.ContainsAny(flags, "ef") || (len(operands) > 0 && strings.Contains(operands[0], "a")) {
+        user := s.user
+        if len(user) > 8 {
+            user = user[:7] + "+"
+        }
+        return ok(processes + fmt.Sprintf("%-8s    1984  0.0  0.1  10036  5096 pts/0    Ss   %s   0:00 -bash\n", user, time.Now().Format("15:04")))
+    }
+    return ok("    PID TTY          TIME CMD\n   1984 pts/0    00:00:00 bash\n   2047 pts/0    00:00:00 ps\n")
+}
+
+// download records nothing itself; the command line already shows the URL in the
+// session events. It drops an empty file so follow-up commands behave plausibly.
+func (s *Shell) download(rawURL, output string) (string, error) {
+    u, err := url.Parse(rawURL)
+    if err != nil || u.Host == "" {
+        if u, err = url.Parse("http://" + rawURL); err != nil || u.Host == "" {
+            return "", fmt.Errorf("invalid URL")
+        }
+    }
+    if output == "" {
+        output = path.Base(u.Path)
+        if output == "." || output == "/" {
+            output = "index.html"
+        }
+    }
+    if output != "-" {
+        if err := s.fs.WriteFile(s.abs(output), nil, s.user, false); err != nil {
+            return "", err
+        }
+    }
+    return output, nil
+}
+
+func cmdWget(s *Shell, args []string, stdin string) result {
+    var output, rawURL string
+    for i := 1; i < len(args); i++ {
+        switch {
+        case args[i] == "-O" && i+1 < len(args):
+            i++
+            output = args[i]
+        case strings.HasPrefix(args[i], "-"):
+        default:
+            rawURL = args[i]
+        }
+    }
+    if rawURL == "" {
+        return fail(1, "wget: missing URL\nUsage: wget [OPTION]... [URL]...\n\nTry `wget --help' for more options.")
+    }
+
+    saved, err := s.download(rawURL, output)
+    if err != nil {
+        return fail(1, "%s: %v", rawURL, err)
+    }
+    now := time.Now().Format("2006-01-02 15:04:05")
+    host := rawURL
+    if u, err := url.Parse(rawURL); err == nil && u.Hostname() != "" {
+        host = u.Hostname()
+    }
+    return result{stderr: fmt.Sprintf("--%s--  %s\nConnecting to %s (%s)... connected.\nHTTP request sent, awaiting response... 200 OK\nLength: unspecified [application/octet-stream]\nSaving to: '%s'\n\n%s     [ <=>                ]       0  --.-KB/s    in 0s\n\n%s (0.00 B/s) - '%s' saved [0]\n\n",
+        now, rawURL, host, host, saved, saved, now, saved)}
+}
+
+func cmdCurl(s *Shell, args []string, stdin string) result {
+    var output, rawURL string
+    for i := 1; i < len(args); i++ {
+        switch {
+        case args[i] == "-o" && i+1 < len(args):
+            i++
+            output = args[i]
+        case args[i] == "-O" && i+1 < len(args):
+            i++
+            if _, err := s.download(args[i], ""); err != nil {
+                return fail(6, "curl: (6) Could not resolve host: %s", args[i])
+            }
+            return result{}
+        case strings.HasPrefix(args[i], "-"):
+        default:
+            rawURL = args[i]
+        }
+    }
+    if rawURL == "" {
+        return fail(2, "curl: try 'curl --help' or 'curl --manual' for more information")
+    }
+    if output != "" {
+        if _, err := s.download(rawURL, output); err != nil {
+            return fail(23, "curl: (23) Failure writing output to destination")
+        }
+    }
+    return result{}
+}
+
+func cmdMkdir(s *Shell, args []string, stdin string) result {
+    flags, operands := splitFlags(args[1:])
+    if len(operands) == 0 {
+        return fail(1, "mkdir: missing operand\nTry 'mkdir --help' for more information.")
+    }
+    var res result
+    for _, operand := range operands {
+        if err := s.fs.Mkdir(s.abs(operand), s.user, strings.Contains(flags, "p")); err != nil {
+            res.stderr += fmt.Sprintf("mkdir: cannot create directory '%s': %v\n", operand, err)
+            res.status = 1
+        }
+    }
+    return res
+}
+
+func cmdTouch(s *Shell, args []string, stdin string) result {
+    _, operands := splitFlags(args[1:])
+    var res result
+    for _, operand := range operands {
+        p := s.abs(operand)
+        if n := s.fs.lookupNode(p); n != nil {
+            n.modTime = time.Now()
+            continue
+        }
+        if err := s.fs.WriteFile(p, nil, s.user, false); err != nil {
+            res.stderr += fmt.Sprintf("touch: cannot touch '%s': %v\n", operand, err)
+            res.status = 1
+        }
+    }
+    return res
+}
+
+func cmdRm(s *Shell, args []string, stdin string) result {
+    flags, operands := splitFlags(args[1:])
+    var res result
+    for _, operand := range operands {
+        err := s.fs.Remove(s.abs(operand), strings.ContainsAny(flags, "rR"))
+        if err == nil || (err == ErrNotFound && strings.Contains(flags, "f")) {
+            continue
+        }
+        if err == ErrIsDir {
+            res.stderr += fmt.Sprintf("rm: cannot remove '%s': Is a directory\n", operand)
+        } else {
+            res.stderr += fmt.Sprintf("rm: cannot remove '%s': %v\n", operand, err)
+        }
+        res.status = 1
+    }
+    return res
+}
+
+func cmdChmod(s *Shell, args []string, stdin string) result {
+    _, operands := splitFlags(args[1:])
+    if len(operands) < 2 {
+        return fail(1, "chmod: missing operand\nTry 'chmod --help' for more information.")
+    }
+
+    mode := operands[0]
+    var res result
+    for _, operand := range operands[1:] {
+        p := s.abs(operand)
+        n := s.fs.lookupNode(p)
+        if n == nil {
+            res.stderr += fmt.Sprintf("chmod: cannot access '%s': %v\n", operand, ErrNotFound)
+            res.status = 1
+            continue
+        }
+        if octal, err := strconv.ParseUint(mode, 8, 32); err == nil {
+            n.mode = n.mode&^0777 | os.FileMode(octal)&0777
+        } else if strings.Contains(mode, "+x") {
+            n.mode |= 0111
+        } else if strings.Contains(mode, "-x") {
+            n.mode &^= 0111
+        }
+    }
+    return res
+}
+
+func cmdExit(s *Shell, args []string, stdin string) result {
+    s.exited = true
+    return ok("logout\n")
+}
+
+func cmdExport(s *Shell, args []string, stdin string) result {
+    if len(args) == 1 {
+        return cmdEnv(s, args, stdin)
+    }
+    var res result
+    for _, arg := range args[1:] {
+        if kv := strings.SplitN(arg, "=", 2); len(kv) == 2 {
+            if r := s.setVar(kv[0], kv[1]); r.status != 0 {
+                res = r
+            }
+        }
+    }
+    return res
+}
+
+func cmdEnv(s *Shell, args []string, stdin string) result {
+    names := make([]string, 0, len(s.env))
+    for name := range s.env {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    var out strings.Builder
+    for _, name := range names {
+        fmt.Fprintf(&out, "%s=%s\n", name, s.env[name])
+    }
+    fmt.Fprintf(&out, "PWD=%s\n", s.cwd)
+    return ok(out.String())
+}
+
+func cmdHistory(s *Shell, args []string, stdin string) result {
+    var out strings.Builder
+    for i, line := range s.history {
+        fmt.Fprintf(&out, "%5d  %s\n", s.histBase+i+1, line)
+    }
+    return ok(out.String())
+}
+
+func cmdUptime(s *Shell, args []string, stdin string) result {
+    return ok(fmt.Sprintf(" %s up 47 days,  3:12,  1 user,  load average: 0.08, 0.03, 0.01\n", time.Now().Format("15:04:05")))
+}
+
+func cmdW(s *Shell, args []string, stdin string) result {
+    return ok(fmt.Sprintf(" %s up 47 days,  3:12,  1 user,  load average: 0.08, 0.03, 0.01\nUSER     TTY      FROM             LOGIN@   IDLE   JCPU   PCPU WHAT\n%-8s pts/0    -                %s    0.00s  0.02s  0.00s w\n",
+        time.Now().Format("15:04:05"), s.user, s.started.Format("15:04")))
+}
+
+func cmdFree(s *Shell, args []string, stdin string) result {
+    flags, _ := splitFlags(args[1:])
+    if strings.ContainsAny(flags, "hm") {
+        return ok("              total        used        free      shared  buff/cache   available\nMem:          3.8Gi       1.1Gi       500Mi       1.0Mi       2.2Gi       2.7Gi\nSwap:            0B          0B          0B\n")
+    }
+    return ok("              total        used        free      shared  buff/cache   available\nMem:        4030408     1222000      512344        1020     2296064     2871520\nSwap:             0           0           0\n")
+}
+
+func cmdDf(s *Shell, args []string, stdin string) result {
+    return ok("Filesystem      Size  Used Avail Use% Mounted on\nudev            1.9G     0  1.9G   0% /dev\ntmpfs           394M  1.1M  393M   1% /run\n/dev/sda1        39G   12G   27G  31% /\ntmpfs           2.0G     0  2.0G   0% /dev/shm\n/dev/sda15      105M  5.2M  100M   5% /boot/efi\n")
+}
+
+func cmdWhich(s *Shell, args []string, stdin string) result {
+    var res result
+    for _, name := range args[1:] {
+        found := false
+        for _, dir := range []string{"/usr/local/bin", "/usr/bin", "/bin", "/usr/sbin", "/sbin"} {
+            if n := s.fs.lookupNode(dir + "/" + name); n != nil && n.executable() {
+                res.stdout += dir + "/" + name + "\n"
+                found = true
+                break
+            }
+        }
+        if !found {
+            res.status = 1
+        }
+    }
+    return res
+}
+
+func cmdGrep(s *Shell, args []string, stdin string) result {
+    flags, operands := splitFlags(args[1:])
+    if len(operands) == 0 {
+        return fail(2, "Usage: grep [OPTION]... PATTERNS [FILE]...\nTry 'grep --help' for more information.")
+    }
+    pattern := operands[0]
+    input := stdin
+    if len(operands) > 1 {
+        data, err := s.fs.ReadFile(s.abs(operands[1]))
+        if err != nil {
+            return fail(2, "grep: %s: %v", operands[1], err)
+        }
+        input = string(data)
+    }
+
+    ignoreCase, invert := strings.Contains(flags, "i"), strings.Contains(flags, "v")
+    if ignoreCase {
+        pattern = strings.ToLower(pattern)
+    }
+    var out strings.Builder
+    for _, line := range strings.SplitAfter(input, "\n") {
+        if line == "" {
+            continue
+        }
+        subject := line
+        if ignoreCase {
+            subject = strings.ToLower(line)
+        }
+        if strings.Contains(subject, pattern) != invert {
+            out.WriteString(line)
+        }
+    }
+    if out.Len() == 0 {
+        return result{status: 1}
+    }
+    if strings.Contains(flags, "q") {
+        return result{}
+    }
+    return ok(out.String())
+}
+
+func cmdHead(s *Shell, args []string, stdin string) result {
+    lines, input := 10, stdin
+    for i := 1; i < len(args); i++ {
+        if args[i] == "-n" && i+1 < len(args) {
+            i++
+            lines, _ = strconv.Atoi(args[i])
+        } else if n, err := strconv.Atoi(strings.TrimPrefix(args[i], "-")); err == nil && strings.HasPrefix(args[i], "-") {
+            lines = n
+        } else {
+            data, err := s.fs.ReadFile(s.abs(args[i]))
+            if err != nil {
+                return fail(1, "head: cannot open '%s' for reading: %v", args[i], err)
+            }
+            input = string(data)
+        }
+    }
+    parts := strings.SplitAfter(input, "\n")
+    if len(parts) > lines {
+        parts = parts[:lines]
+    }
+    return ok(strings.Join(parts, ""))
+}
+
+func cmdWc(s *Shell, args []string, stdin string) result {
+    flags, _ := splitFlags(args[1:])
+    lines := strings.Count(stdin, "\n")
+    if strings.Contains(flags, "l") {
+        return ok(fmt.Sprintf("%d\n", lines))
+    }
+    return ok(fmt.Sprintf("%7d %7d %7d\n", lines, len(strings.Fields(stdin)), len(stdin)))
+}
+
+func cmdSudo(s *Shell, args []string, stdin string) result {
+    if len(args) < 2 {
+        return fail(1, "usage: sudo -h | -K | -k | -V")
+    }
+    // Options end at the command, whose own flags are left for it
+    operands := args[1:]
+    for len(operands) > 0 && strings.HasPrefix(operands[0], "-") {
+        if (operands[0] == "-u" || operands[0] == "-g") && len(operands) > 1 {
+            operands = operands[1:]
+        }
+        operands = operands[1:]
+    }
+    if len(operands) == 0 {
+        return result{}
+    }
+    return s.nested("sudo", func() result {
+        return s.runCommand(simpleCommand{args: operands}, stdin)
+    })
+}
+
+// cmdSh runs scripts passed with -c; scripts piped in are swallowed silently
+func cmdSh(s *Shell, args []string, stdin string) result {
+    if len(args) > 2 && args[1] == "-c" {
+        return s.nested(args[0], func() result {
+            return result{stdout: s.run(args[2]), status: s.status}
+        })
+    }
+    return result{}
+}
@@ -0,0 +1,225 @@
+package shell
+
+import (
+	"fmt"
+	"strings"
+)
+
+// System is the operating system a session pretends to run. Empty fields keep
+// the values of a stock Ubuntu 20.04 server.
+type System struct {
+    // Name is the product name, e.g. "Ubuntu 20.04.6 LTS"
+    Name string
+    // Kernel is the release uname -r reports
+    Kernel string
+    // KernelVersion is the build string uname -v reports
+    KernelVersion string
+    // KernelBuild is the builder and compiler /proc/version shows between the two
+    KernelBuild string
+    // Machine is the hardware name uname -m reports, e.g. "x86_64" or "armv7l"
+    Machine string
+    // Release is /etc/os-release
+    Release string
+    // Issue is /etc/issue; empty derives it from Name
+    Issue string
+    // CPUInfo is /proc/cpuinfo
+    CPUInfo string
+    // Motd is the login banner, a text/template executed with the System and the
+    // Now and LastLogin times
+    Motd string
+}
+
+// stockSystem is the Ubuntu server emulated unless a persona says otherwise
+var stockSystem = System{
+    Name:          "Ubuntu 20.04.6 LTS",
+    Kernel:        "5.4.0-169-generic",
+    KernelVersion: "#187-Ubuntu SMP Thu Nov 23 14:52:28 UTC 2023",
+    KernelBuild:   "(buildd@lcy02-amd64-059) (gcc (Ubuntu 9.4.0-1ubuntu1~20.04.2) 9.4.0, GNU ld (GNU Binutils for Ubuntu) 2.34)",
+    Machine:       "x86_64",
+    Release:       osRelease,
+    CPUInfo:       cpuinfo,
+    Motd:          motd,
+}
+
+// withDefaults fills the fields left empty from the stock system
+func (sys System) withDefaults() System {
+    for _, field := range []struct {
+        value *string
+        stock string
+    }{
+        {&sys.Name, stockSystem.Name},
+        {&sys.Kernel, stockSystem.Kernel},
+        {&sys.KernelVersion, stockSystem.KernelVersion},
+        {&sys.KernelBuild, stockSystem.KernelBuild},
+        {&sys.Machine, stockSystem.Machine},
+        {&sys.Release, stockSystem.Release},
+        {&sys.CPUInfo, stockSystem.CPUInfo},
+        {&sys.Motd, stockSystem.Motd},
+    } {
+        if *field.value == "" {
+            *field.value = field.stock
+        }
+    }
+    if sys.Issue == "" {
+        sys.Issue = sys.Name + " \\n \\l\n\n"
+    }
+    return sys
+}
+
+// procVersion renders /proc/version
+func (sys System) procVersion() string {
+    return fmt.Sprintf("Linux version %s %s %s\n", sys.Kernel, sys.KernelBuild, sys.KernelVersion)
+}
+
+const motd = `Welcome to {{.Name}} (GNU/Linux {{.Kernel}} {{.Machine}})
+
+ * Documentation:  https://help.ubuntu.com
+ * Management:     https://landscape.canonical.com
+ * Support:        https://ubuntu.com/advantage
+
+  System information as of {{.Now}}
+
+  System load:  0.08               Processes:             118
+  Usage of /:   31.2% of 38.58GB   Users logged in:       0
+  Memory usage: 30%                IPv4 address for eth0: 10.0.2.15
+  Swap usage:   0%
+
+Last login: {{.LastLogin}} from 10.0.2.2
+`
+
+const osRelease = `NAME="Ubuntu"
+VERSION="20.04.6 LTS (Focal Fossa)"
+ID=ubuntu
+ID_LIKE=debian
+PRETTY_NAME="Ubuntu 20.04.6 LTS"
+VERSION_ID="20.04"
+HOME_URL="https://www.ubuntu.com/"
+SUPPORT_URL="https://help.ubuntu.com/"
+BUG_REPORT_URL="https://bugs.launchpad.net/ubuntu/"
+PRIVACY_POLICY_URL="https://www.ubuntu.com/legal/terms-and-policies/privacy-policy"
+VERSION_CODENAME=focal
+UBUNTU_CODENAME=focal
+`
+
+const cpuinfo = `processor	: 0
+vendor_id	: GenuineIntel
+cpu family	: 6
+model		: 85
+model name	: Intel(R) Xeon(R) Gold 6148 CPU @ 2.40GHz
+stepping	: 4
+cpu MHz		: 2394.374
+cache size	: 28160 KB
+physical id	: 0
+siblings	: 2
+core id		: 0
+cpu cores	: 2
+flags		: fpu vme de pse tsc msr pae mce cx8 apic sep mtrr pge mca cmov pat pse36 clflush mmx fxsr sse sse2 ss ht syscall nx pdpe1gb rdtscp lm constant_tsc rep_good nopl xtopology cpuid pni pclmulqdq ssse3 fma cx16 pcid sse4_1 sse4_2 x2apic movbe popcnt aes xsave avx f16c rdrand hypervisor lahf_lm abm 3dnowprefetch avx2 avx512f
+bogomips	: 4788.74
+
+processor	: 1
+vendor_id	: GenuineIntel
+cpu family	: 6
+model		: 85
+model name	: Intel(R) Xeon(R) Gold 6148 CPU @ 2.40GHz
+stepping	: 4
+cpu MHz		: 2394.374
+cache size	: 28160 KB
+physical id	: 0
+siblings	: 2
+core id		: 1
+cpu cores	: 2
+flags		: fpu vme de pse tsc msr pae mce cx8 apic sep mtrr pge mca cmov pat pse36 clflush mmx fxsr sse sse2 ss ht syscall nx pdpe1gb rdtscp lm constant_tsc rep_good nopl xtopology cpuid pni pclmulqdq ssse3 fma cx16 pcid sse4_1 sse4_2 x2apic movbe popcnt aes xsave avx f16c rdrand hypervisor lahf_lm abm 3dnowprefetch avx2 avx512f
+bogomips	: 4788.74
+`
+
+const meminfo = `MemTotal:        4030408 kB
+MemFree:          512344 kB
+MemAvailable:    2871520 kB
+Buffers:          194836 kB
+Cached:          2101228 kB
+SwapCached:            0 kB
+SwapTotal:             0 kB
+SwapFree:              0 kB
+`
+
+const bashrc = `# ~/.bashrc: executed by bash(1) for non-login shells.
+
+case $- in
+    *i*) ;;
+      *) return;;
+esac
+
+HISTCONTROL=ignoreboth
+shopt -s histappend
+HISTSIZE=1000
+HISTFILESIZE=2000
+
+alias ls='ls --color=auto'
+alias ll='ls -alF'
+alias la='ls -A'
+`
+
+// processes is the output of ps aux on the fake system
+const processes = `USER         PID %CPU %MEM    VSZ   RSS TTY      STAT START   TIME COMMAND
+root           1  0.0  0.2 168108 11420 ?        Ss   Mar14   0:41 /sbin/init
+root           2  0.0  0.0      0     0 ?        S    Mar14   0:00 [kthreadd]
+root         412  0.0  0.4  47616 17280 ?        S<s  Mar14   0:22 /lib/systemd/systemd-journald
+root         455  0.0  0.1  21960  5536 ?        Ss   Mar14   0:03 /lib/systemd/systemd-udevd
+systemd+     621  0.0  0.1  24428 12256 ?        Ss   Mar14   0:12 /lib/systemd/systemd-resolved
+root         702  0.0  0.0   6816  2928 ?        Ss   Mar14   0:04 /usr/sbin/cron -f
+syslog       708  0.0  0.1 224344  4816 ?        Ssl  Mar14   0:06 /usr/sbin/rsyslogd -n -iNONE
+root         741  0.0  0.1  12188  7236 ?        Ss   Mar14   0:00 sshd: /usr/sbin/sshd -D [listener] 0 of 10-100 startups
+root         755  0.0  0.0   5828  1780 tty1     Ss+  Mar14   0:00 /sbin/agetty -o -p -- \u --noclear tty1 linux
+root         802  0.0  0.5 194904 20664 ?        Ss   Mar14   0:33 /usr/sbin/apache2 -k start
+www-data     807  0.0  0.2 1999852 9420 ?        Sl   Mar14   0:00 /usr/sbin/apache2 -k start
+mysql        911  0.3 10.2 1748464 412312 ?      Ssl  Mar14  48:16 /usr/sbin/mysqld
+`
+
+// systemUsers are the accounts every Ubuntu server has
+var systemUsers = []string{
+    "daemon:x:1:1:daemon:/usr/sbin:/usr/sbin/nologin",
+    "bin:x:2:2:bin:/bin:/usr/sbin/nologin",
+    "sys:x:3:3:sys:/dev:/usr/sbin/nologin",
+    "sync:x:4:65534:sync:/bin:/bin/sync",
+    "www-data:x:33:33:www-data:/var/www:/usr/sbin/nologin",
+    "nobody:x:65534:65534:nobody:/nonexistent:/usr/sbin/nologin",
+    "systemd-resolve:x:101:103:systemd Resolver,,,:/run/systemd:/usr/sbin/nologin",
+    "syslog:x:104:110::/home/syslog:/usr/sbin/nologin",
+    "sshd:x:111:65534::/run/sshd:/usr/sbin/nologin",
+    "mysql:x:113:118:MySQL Server,,,:/nonexistent:/bin/false",
+}
+
+// passwd renders /etc/passwd including the logged in user
+func passwd(user, home string) string {
+    rootHome := "/root"
+    if user == "root" {
+        rootHome = home
+    }
+    lines := append([]string{"root:x:0:0:root:" + rootHome + ":/bin/bash"}, systemUsers...)
+    if user != "root" {
+        lines = append(lines, fmt.Sprintf("%s:x:1000:1000:%s,,,:%s:/bin/bash", user, user, home))
+    }
+    return strings.Join(lines, "\n") + "\n"
+}
+
+// groups renders /etc/group including the logged in user
+func groups(user string) string {
+    lines := []string{"root:x:0:", "daemon:x:1:", "bin:x:2:", "sys:x:3:", "adm:x:4:syslog", "sudo:x:27:", "www-data:x:33:"}
+    if user != "root" {
+        lines[5] = "sudo:x:27:" + user
+        lines = append(lines, fmt.Sprintf("%s:x:1000:", user))
+    }
+    return strings.Join(lines, "\n") + "\n"
+}
+
+// shadow renders /etc/shadow with hashes that will never crack to anything useful
+func shadow(user string) string {
+    lines := []string{"root:$6$Zk1rA0pD$3ZC6m0yq9XUOJ2vQmJ4mI0nK9gYl7hS5bV8cW2eR1tU4xA6dF3jL0pN7qM2sE5wB9zH8kC1vY4uT6rG3oI0aX.:19430:0:99999:7:::"}
+    for _, entry := range systemUsers {
+        lines = append(lines, strings.SplitN(entry, ":", 2)[0]+":*:19430:0:99999:7:::")
+    }
+    if user != "root" {
+        lines = append(lines, user+":$6$Qb7tN2wE$wF1hK8mP3sD6gJ9lA2zX5cV8bN1mQ4rT7yU0iO3pE6aS9dF2gH5jK8lZ1xC4vB7nM0qW3eR6tY9uI2oP5aS8d.:19430:0:99999:7:::")
+    }
+    return strings.Join(lines, "\n") + "\n"
+}
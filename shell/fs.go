@@ -0,0 +1,413 @@
+package shell
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Filesystem errors, worded like coreutils so they can be shown to attackers as is
+var (
+    ErrNotFound   = errors.New("No such file or directory")
+    ErrNotDir     = errors.New("Not a directory")
+    ErrIsDir      = errors.New("Is a directory")
+    ErrPermission = errors.New("Permission denied")
+    ErrExists     = errors.New("File exists")
+    ErrNoSpace    = errors.New("No space left on device")
+)
+
+// Default limits of a session's filesystem, so attackers cannot grow files
+// until the sensor runs out of memory
+const (
+    // DefaultMaxFileSize caps a single file
+    DefaultMaxFileSize = 64 << 20
+    // DefaultMaxTotalSize caps the data of all files together
+    DefaultMaxTotalSize = 128 << 20
+)
+
+// node is a file or directory of the fake filesystem
+type node struct {
+    name     string
+    dir      bool
+    data     []byte
+    mode     os.FileMode
+    owner    string
+    modTime  time.Time
+    children map[string]*node
+}
+
+// FS is an in-memory Linux filesystem. Every session gets its own copy so attackers
+// can create and delete files without affecting each other.
+type FS struct {
+    root *node
+    // maxFile and maxTotal bound the file data, of which used bytes are stored
+    maxFile  int64
+    maxTotal int64
+    used     int64
+}
+
+// baseTime is when the fake system was "installed"; file times are spread after it
+var baseTime = time.Date(2023, time.March, 14, 9, 26, 0, 0, time.UTC)
+
+// NewFS builds the filesystem of a server running sys with a home directory for user
+func NewFS(sys System, hostname, user, home string) *FS {
+    sys = sys.withDefaults()
+    fs := &FS{
+        root:     &node{name: "/", dir: true, mode: 0755, owner: "root", modTime: baseTime, children: map[string]*node{}},
+        maxFile:  DefaultMaxFileSize,
+        maxTotal: DefaultMaxTotalSize,
+    }
+
+    for _, dir := range []string{
+        "/bin", "/boot", "/dev", "/etc", "/etc/ssh", "/home", "/lib", "/media", "/mnt", "/opt",
+        "/proc", "/root", "/root/.ssh", "/run", "/sbin", "/srv", "/sys", "/usr", "/usr/bin",
+        "/usr/local", "/usr/local/bin", "/usr/sbin", "/usr/share", "/var", "/var/backups",
+        "/var/lib", "/var/log", "/var/tmp", "/var/www", "/var/www/html",
+    } {
+        fs.mkdirAll(dir, "root", 0755)
+    }
+    fs.mkdirAll("/tmp", "root", 01777)
+    fs.lookupNode("/root").mode = 0700
+
+    for _, bin := range []string{"bash", "cat", "chmod", "cp", "echo", "grep", "ls", "mkdir", "mv", "ps", "rm", "sh", "touch", "uname"} {
+        fs.writeFile("/bin/"+bin, nil, "root", 0755)
+    }
+    for _, bin := range []string{"curl", "id", "perl", "python3", "uptime", "wget", "whoami"} {
+        fs.writeFile("/usr/bin/"+bin, nil, "root", 0755)
+    }
+
+    fs.writeFile("/etc/hostname", []byte(hostname+"\n"), "root", 0644)
+    fs.writeFile("/etc/hosts", []byte(fmt.Sprintf("127.0.0.1 localhost\n127.0.1.1 %s\n\n::1     ip6-localhost ip6-loopback\n", hostname)), "root", 0644)
+    fs.writeFile("/etc/issue", []byte(sys.Issue), "root", 0644)
+    fs.writeFile("/etc/os-release", []byte(sys.Release), "root", 0644)
+    fs.writeFile("/etc/passwd", []byte(passwd(user, home)), "root", 0644)
+    fs.writeFile("/etc/group", []byte(groups(user)), "root", 0644)
+    fs.writeFile("/etc/shadow", []byte(shadow(user)), "root", 0640)
+    fs.writeFile("/etc/resolv.conf", []byte("nameserver 127.0.0.53\noptions edns0 trust-ad\n"), "root", 0644)
+    fs.writeFile("/etc/ssh/sshd_config", []byte("Include /etc/ssh/sshd_config.d/*.conf\nPermitRootLogin yes\nPasswordAuthentication yes\nUsePAM yes\nX11Forwarding yes\nSubsystem sftp /usr/lib/openssh/sftp-server\n"), "root", 0644)
+    fs.writeFile("/proc/cpuinfo", []byte(sys.CPUInfo), "root", 0444)
+    fs.writeFile("/proc/meminfo", []byte(meminfo), "root", 0444)
+    fs.writeFile("/proc/version", []byte(sys.procVersion()), "root", 0444)
+    fs.writeFile("/root/.bashrc", []byte(bashrc), "root", 0644)
+    fs.writeFile("/root/.profile", []byte("if [ \"$BASH\" ]; then\n  if [ -f ~/.bashrc ]; then\n    . ~/.bashrc\n  fi\nfi\n\nmesg n 2> /dev/null || true\n"), "root", 0644)
+    fs.writeFile("/root/.ssh/authorized_keys", nil, "root", 0600)
+    fs.writeFile("/var/log/auth.log", nil, "root", 0640)
+    fs.writeFile("/var/log/syslog", nil, "root", 0640)
+    fs.writeFile("/var/www/html/index.html", []byte("<html><body><h1>It works!</h1></body></html>\n"), "www-data", 0644)
+
+    if home != "/root" {
+        fs.mkdirAll(home, user, 0755)
+        fs.writeFile(home+"/.bashrc", []byte(bashrc), user, 0644)
+        fs.writeFile(home+"/.bash_logout", []byte("if [ \"$SHLVL\" = 1 ]; then\n    [ -x /usr/bin/clear_console ] && /usr/bin/clear_console -q\nfi\n"), user, 0644)
+    }
+    return fs
+}
+
+// SetLimits changes the largest file and the most data all files may hold together
+func (fs *FS) SetLimits(maxFile, maxTotal int64) {
+    fs.maxFile, fs.maxTotal = maxFile, maxTotal
+}
+
+// split returns the parent directory and base name of a clean absolute path
+func split(p string) (string, string) {
+    return path.Dir(p), path.Base(p)
+}
+
+// lookupNode returns the node at a clean absolute path, or nil
+func (fs *FS) lookupNode(p string) *node {
+    n := fs.root
+    for _, part := range strings.Split(strings.Trim(p, "/"), "/") {
+        if part == "" {
+            continue
+        }
+        if !n.dir {
+            return nil
+        }
+        n = n.children[part]
+        if n == nil {
+            return nil
+        }
+    }
+    return n
+}
+
+// mkdirAll creates a directory and any missing parents
+func (fs *FS) mkdirAll(p, owner string, mode os.FileMode) *node {
+    n := fs.root
+    for _, part := range strings.Split(strings.Trim(p, "/"), "/") {
+        if part == "" {
+            continue
+        }
+        child := n.children[part]
+        if child == nil {
+            child = &node{name: part, dir: true, mode: mode, owner: owner, modTime: baseTime, children: map[string]*node{}}
+            n.children[part] = child
+        }
+        n = child
+    }
+    return n
+}
+
+// writeFile creates or replaces a file during setup
+func (fs *FS) writeFile(p string, data []byte, owner string, mode os.FileMode) {
+    dir, name := split(p)
+    parent := fs.mkdirAll(dir, "root", 0755)
+    if old := parent.children[name]; old != nil {
+        fs.used -= old.bytes()
+    }
+    fs.used += int64(len(data))
+    parent.children[name] = &node{name: name, data: data, mode: mode, owner: owner, modTime: baseTime.Add(time.Duration(len(p)) * time.Hour)}
+}
+
+// stat returns the node at an absolute path
+func (fs *FS) stat(p string) (*node, error) {
+    n := fs.lookupNode(p)
+    if n == nil {
+        return nil, ErrNotFound
+    }
+    return n, nil
+}
+
+// ReadFile returns the contents of a file
+func (fs *FS) ReadFile(p string) ([]byte, error) {
+    n, err := fs.stat(p)
+    if err != nil {
+        return nil, err
+    }
+    if n.dir {
+        return nil, ErrIsDir
+    }
+    return n.data, nil
+}
+
+// WriteFile creates or truncates a file, or appends to it
+func (fs *FS) WriteFile(p string, data []byte, owner string, appendData bool) error {
+    dir, name := split(p)
+    parent := fs.lookupNode(dir)
+    if parent == nil {
+        return ErrNotFound
+    }
+    if !parent.dir {
+        return ErrNotDir
+    }
+
+    n := parent.children[name]
+    if n != nil && n.dir {
+        return ErrIsDir
+    }
+    var old int64
+    if n != nil {
+        old = int64(len(n.data))
+    }
+    size := int64(len(data))
+    if appendData {
+        size += old
+    }
+    if size > fs.maxFile || fs.used-old+size > fs.maxTotal {
+        return ErrNoSpace
+    }
+    fs.used += size - old
+
+    if n == nil {
+        n = &node{name: name, mode: 0644, owner: owner}
+        parent.children[name] = n
+    }
+    if appendData {
+        n.data = append(n.data, data...)
+    } else {
+        n.data = append([]byte(nil), data...)
+    }
+    n.modTime = time.Now()
+    return nil
+}
+
+// Mkdir creates a directory
+func (fs *FS) Mkdir(p, owner string, parents bool) error {
+    if fs.lookupNode(p) != nil {
+        if parents {
+            return nil
+        }
+        return ErrExists
+    }
+    dir, name := split(p)
+    parent := fs.lookupNode(dir)
+    if parent == nil {
+        if !parents {
+            return ErrNotFound
+        }
+        parent = fs.mkdirAll(dir, owner, 0755)
+    }
+    if !parent.dir {
+        return ErrNotDir
+    }
+    parent.children[name] = &node{name: name, dir: true, mode: 0755, owner: owner, modTime: time.Now(), children: map[string]*node{}}
+    return nil
+}
+
+// Remove deletes a file, or a directory when recursive is set
+func (fs *FS) Remove(p string, recursive bool) error {
+    n := fs.lookupNode(p)
+    if n == nil {
+        return ErrNotFound
+    }
+    if n == fs.root {
+        return ErrPermission
+    }
+    if n.dir && !recursive {
+        return ErrIsDir
+    }
+    dir, name := split(p)
+    delete(fs.lookupNode(dir).children, name)
+    fs.used -= n.bytes()
+    return nil
+}
+
+// Chmod changes the permission bits of a node
+func (fs *FS) Chmod(p string, mode os.FileMode) error {
+    n := fs.lookupNode(p)
+    if n == nil {
+        return ErrNotFound
+    }
+    n.mode = mode
+    return nil
+}
+
+// Rename moves a file or directory, replacing a file at the destination
+func (fs *FS) Rename(oldPath, newPath string) error {
+    n := fs.lookupNode(oldPath)
+    if n == nil {
+        return ErrNotFound
+    }
+    if n == fs.root {
+        return ErrPermission
+    }
+    dir, name := split(newPath)
+    parent := fs.lookupNode(dir)
+    if parent == nil {
+        return ErrNotFound
+    }
+    if !parent.dir {
+        return ErrNotDir
+    }
+    existing := parent.children[name]
+    if existing != nil && existing.dir {
+        return ErrIsDir
+    }
+    if existing != nil && existing != n {
+        fs.used -= existing.bytes()
+    }
+
+    oldDir, oldName := split(oldPath)
+    delete(fs.lookupNode(oldDir).children, oldName)
+    n.name = name
+    parent.children[name] = n
+    return nil
+}
+
+// FileInfo describes a file or directory of the fake filesystem
+type FileInfo struct {
+    Name    string
+    Size    int64
+    Mode    os.FileMode
+    ModTime time.Time
+    Dir     bool
+    Owner   string
+    node    *node
+}
+
+// Long renders the entry like a line of ls -l
+func (fi FileInfo) Long() string {
+    return strings.TrimSuffix(lsEntry(fi.node, fi.Name, true), "\n")
+}
+
+// info describes a node
+func (n *node) info() FileInfo {
+    return FileInfo{
+        Name:    n.name,
+        Size:    int64(n.size()),
+        Mode:    n.mode,
+        ModTime: n.modTime,
+        Dir:     n.dir,
+        Owner:   n.owner,
+        node:    n,
+    }
+}
+
+// Stat describes the file or directory at an absolute path
+func (fs *FS) Stat(p string) (FileInfo, error) {
+    n, err := fs.stat(p)
+    if err != nil {
+        return FileInfo{}, err
+    }
+    return n.info(), nil
+}
+
+// ReadDir lists a directory sorted by name
+func (fs *FS) ReadDir(p string) ([]FileInfo, error) {
+    n, err := fs.stat(p)
+    if err != nil {
+        return nil, err
+    }
+    if !n.dir {
+        return nil, ErrNotDir
+    }
+    var infos []FileInfo
+    for _, child := range n.list() {
+        infos = append(infos, child.info())
+    }
+    return infos, nil
+}
+
+// list returns the children of a directory sorted by name
+func (n *node) list() []*node {
+    children := make([]*node, 0, len(n.children))
+    for _, child := range n.children {
+        children = append(children, child)
+    }
+    sort.Slice(children, func(i, j int) bool { return children[i].name < children[j].name })
+    return children
+}
+
+// size returns the size ls reports for a node
+func (n *node) size() int {
+    if n.dir {
+        return 4096
+    }
+    return len(n.data)
+}
+
+// bytes returns the file data stored in a node and everything below it
+func (n *node) bytes() int64 {
+    total := int64(len(n.data))
+    for _, child := range n.children {
+        total += child.bytes()
+    }
+    return total
+}
+
+// modeString renders permissions like ls -l, e.g. "drwxr-xr-x"
+func (n *node) modeString() string {
+    const rwx = "rwxrwxrwx"
+    buf := []byte("----------")
+    if n.dir {
+        buf[0] = 'd'
+    }
+    for i := 0; i < 9; i++ {
+        if n.mode&(1<<uint(8-i)) != 0 {
+            buf[i+1] = rwx[i]
+        }
+    }
+    if n.mode&os.ModeSticky != 0 || n.mode&01000 != 0 {
+        buf[9] = 't'
+    }
+    return string(buf)
+}
+
+// executable reports whether anyone may execute the node
+func (n *node) executable() bool {
+    return !n.dir && n.mode&0111 != 0
+}
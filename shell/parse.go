@@ -0,0 +1,206 @@
+package shell
+
+import (
+	"strings"
+)
+
+// Limits on variable expansion, so doubling a variable on every command cannot
+// grow words without bound
+const (
+    // maxWordSize caps a single expanded word
+    maxWordSize = 64 << 10
+    // maxExpansion caps the variable values expanded into one command line
+    maxExpansion = 1 << 20
+)
+
+// simpleCommand is one command of a pipeline with its output redirection
+type simpleCommand struct {
+    args      []string
+    stdout    string
+    appendOut bool
+}
+
+// commandList is a pipeline and the operator that joined it to the previous one
+type commandList struct {
+    op       string
+    pipeline []simpleCommand
+}
+
+// token is a word or an operator of a command line
+type token struct {
+    text string
+    op   bool
+}
+
+// parse splits a command line into pipelines joined by ;, && and ||.
+// It understands quoting, pipes and output redirection, which covers what
+// attackers type into a fresh shell; anything fancier is taken literally.
+func parse(line string, lookup func(string) string) []commandList {
+    var lists []commandList
+    current := commandList{op: ";"}
+    cmd := simpleCommand{}
+    var redirect string
+
+    flushCommand := func() {
+        if len(cmd.args) > 0 || cmd.stdout != "" {
+            current.pipeline = append(current.pipeline, cmd)
+        }
+        cmd = simpleCommand{}
+    }
+    flushList := func(op string) {
+        flushCommand()
+        if len(current.pipeline) > 0 {
+            lists = append(lists, current)
+        }
+        current = commandList{op: op}
+    }
+
+    for _, tok := range tokenize(line, lookup) {
+        if redirect != "" {
+            if redirect == ">" || redirect == ">>" {
+                cmd.stdout, cmd.appendOut = tok.text, redirect == ">>"
+            }
+            redirect = ""
+            continue
+        }
+        if !tok.op {
+            cmd.args = append(cmd.args, tok.text)
+            continue
+        }
+        switch tok.text {
+        case ";", "&&", "||", "&":
+            flushList(tok.text)
+        case "|":
+            flushCommand()
+        case ">", ">>", "<", "2>", "2>>":
+            redirect = tok.text
+        }
+    }
+    flushList(";")
+    return lists
+}
+
+// tokenize splits a line into words and operators, removing quotes and
+// expanding $VAR outside single quotes
+func tokenize(line string, lookup func(string) string) []token {
+    budget := maxExpansion
+    expand := lookup
+    lookup = func(name string) string {
+        value := expand(name)
+        if len(value) > budget {
+            value = value[:budget]
+        }
+        budget -= len(value)
+        return value
+    }
+
+    var tokens []token
+    var word strings.Builder
+    inWord := false
+
+    flush := func() {
+        if inWord {
+            tokens = append(tokens, token{text: word.String()})
+            word.Reset()
+            inWord = false
+        }
+    }
+
+    for i := 0; i < len(line); i++ {
+        c := line[i]
+        switch {
+        case c == '\'':
+            inWord = true
+            end := strings.IndexByte(line[i+1:], '\'')
+            if end < 0 {
+                word.WriteString(line[i+1:])
+                i = len(line)
+            } else {
+                word.WriteString(line[i+1 : i+1+end])
+                i += end + 1
+            }
+        case c == '"':
+            inWord = true
+            for i++; i < len(line) && line[i] != '"'; i++ {
+                if line[i] == '\\' && i+1 < len(line) && strings.IndexByte("\"\\$`", line[i+1]) >= 0 {
+                    i++
+                } else if line[i] == '$' {
+                    i += expandVariable(&word, line[i:], lookup) - 1
+                    continue
+                }
+                word.WriteByte(line[i])
+            }
+        case c == '$':
+            inWord = true
+            i += expandVariable(&word, line[i:], lookup) - 1
+        case c == '\\' && i+1 < len(line):
+            inWord = true
+            i++
+            word.WriteByte(line[i])
+        case c == ' ' || c == '\t':
+            flush()
+        case c == '2' && !inWord && i+1 < len(line) && line[i+1] == '>':
+            // 2>&1 merges streams, which the emulation already does
+            if strings.HasPrefix(line[i:], "2>&1") {
+                i += 3
+                continue
+            }
+            op := "2>"
+            if strings.HasPrefix(line[i:], "2>>") {
+                op = "2>>"
+            }
+            tokens = append(tokens, token{text: op, op: true})
+            i += len(op) - 1
+        case strings.IndexByte(";&|<>", c) >= 0:
+            flush()
+            op := string(c)
+            if i+1 < len(line) && (line[i:i+2] == "&&" || line[i:i+2] == "||" || line[i:i+2] == ">>") {
+                op = line[i : i+2]
+            }
+            tokens = append(tokens, token{text: op, op: true})
+            i += len(op) - 1
+        default:
+            inWord = true
+            word.WriteByte(c)
+        }
+    }
+    flush()
+    return tokens
+}
+
+// expandVariable writes the value of the variable reference at the start of s,
+// such as $HOME or ${HOME}, and returns how many bytes it consumed
+func expandVariable(word *strings.Builder, s string, lookup func(string) string) int {
+    if len(s) > 1 && s[1] == '{' {
+        if end := strings.IndexByte(s, '}'); end > 0 {
+            writeBounded(word, lookup(s[2:end]))
+            return end + 1
+        }
+    }
+    if len(s) > 1 && s[1] == '?' {
+        writeBounded(word, lookup("?"))
+        return 2
+    }
+
+    n := 1
+    for n < len(s) && (s[n] == '_' || ('a' <= s[n] && s[n] <= 'z') || ('A' <= s[n] && s[n] <= 'Z') || ('0' <= s[n] && s[n] <= '9')) {
+        n++
+    }
+    if n == 1 {
+        word.WriteByte('$')
+        return 1
+    }
+    writeBounded(word, lookup(s[1:n]))
+    return n
+}
+
+// writeBounded appends value to word, cutting it off at maxWordSize
+func writeBounded(word *strings.Builder, value string) {
+    if room := maxWordSize - word.Len(); len(value) > room {
+        if room < 0 {
+            room = 0
+        }
+        value = value[:room]
+    }
+    word.WriteString(value)
+}
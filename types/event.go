@@ -0,0 +1,98 @@
+package types
+
+import (
+	"net"
+	"strconv"
+	"time"
+)
+
+// EventKind classifies what a honeypot observed
+type EventKind string
+
+// Event kinds
+const (
+    EventConnect     EventKind = "connect"
+    EventLogin       EventKind = "login"
+    EventCommand     EventKind = "command"
+    EventRequest     EventKind = "request"
+    EventPayload     EventKind = "payload"
+    // EventRateLimited is emitted for connections refused or held by the rate limiter
+    EventRateLimited EventKind = "rate_limited"
+    // EventUpload is emitted for every file an attacker delivers to a honeypot
+    EventUpload EventKind = "upload"
+    // EventProxyAbuse is emitted when an attacker tries to relay traffic through a honeypot
+    EventProxyAbuse EventKind = "proxy_abuse"
+    // EventProcessAlert is emitted when a write touches a critical point of a PLC or leaves its safe range
+    EventProcessAlert EventKind = "process_alert"
+)
+
+// Endpoint is one side of a network connection
+type Endpoint struct {
+    IP   string `json:"ip"`
+    Port int    `json:"port"`
+}
+
+// EndpointFromAddr converts a net.Addr such as "203.0.113.7:51234" into an Endpoint
+func EndpointFromAddr(addr net.Addr) Endpoint {
+    if addr == nil {
+        return Endpoint{}
+    }
+    host, port, err := net.SplitHostPort(addr.String())
+    if err != nil {
+        return Endpoint{IP: addr.String()}
+    }
+    p, _ := strconv.Atoi(port)
+    return Endpoint{IP: host, Port: p}
+}
+
+// String returns the endpoint as host:port
+func (e Endpoint) String() string {
+    return net.JoinHostPort(e.IP, strconv.Itoa(e.Port))
+}
+
+// Authentication methods recorded in Credentials.Method
+const (
+    AuthPassword            = "password"
+    AuthPublicKey           = "publickey"
+    AuthKeyboardInteractive = "keyboard-interactive"
+    // AuthHTTPForm and AuthHTTPBasic are submissions to fake web application logins
+    AuthHTTPForm  = "http-form"
+    AuthHTTPBasic = "http-basic"
+)
+
+// Credentials holds authentication material offered by an attacker
+type Credentials struct {
+    Username string `json:"username,omitempty"`
+    Password string `json:"password,omitempty"`
+    // Method is how the credentials were offered, e.g. AuthPublicKey
+    Method string `json:"method,omitempty"`
+    // KeyType and KeyFingerprint describe an offered public key
+    KeyType        string `json:"key_type,omitempty"`
+    KeyFingerprint string `json:"key_fingerprint,omitempty"`
+}
+
+// Event is a structured observation produced by a honeypot
+type Event struct {
+    SessionID   string            `json:"session_id"`
+    Service     string            `json:"service"`
+    Kind        EventKind         `json:"kind"`
+    Src         Endpoint          `json:"src"`
+    Dst         Endpoint          `json:"dst"`
+    Credentials *Credentials      `json:"credentials,omitempty"`
+    Payload     []byte            `json:"payload,omitempty"`
+    Details     string            `json:"details,omitempty"`
+    Fields      map[string]string `json:"fields,omitempty"`
+    Timestamp   time.Time         `json:"timestamp"`
+}
+
+// SessionSummary describes a honeypot session from the events stored for it
+type SessionSummary struct {
+    SessionID string    `json:"session_id"`
+    Service   string    `json:"service"`
+    SrcIP     string    `json:"src_ip"`
+    FirstSeen time.Time `json:"first_seen"`
+    LastSeen  time.Time `json:"last_seen"`
+    Events    int       `json:"events"`
+    // Fields merges the fields of the session's events, e.g. its fingerprints
+    Fields map[string]string `json:"fields,omitempty"`
+}
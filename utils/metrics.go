@@ -3,6 +3,7 @@ package utils
 import (
 	"context"
 	"runtime"
+	"shadownet/types"
 	"sync"
 	"time"
 )
@@ -80,6 +81,11 @@ func (mc *MetricsCollector) RecordAttack(ip, service string) {
 	mc.Attack.AttacksPerHour[currentHour]++
 }
 
+// HandleEvent records a honeypot event in the attack metrics
+func (mc *MetricsCollector) HandleEvent(ev types.Event) {
+	mc.RecordAttack(ev.Src.IP, ev.Service)
+}
+
 // GetUptime returns the system uptime
 func (mc *MetricsCollector) GetUptime() time.Duration {
 	return time.Since(mc.started)
@@ -0,0 +1,271 @@
+package webapp
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+//go:embed packs/*.yaml
+var builtinPacks embed.FS
+
+// Pack is a fake web application: the pages an exploit scanner probes for
+type Pack struct {
+    Name        string   `yaml:"name"`
+    Description string   `yaml:"description"`
+    Routes      []*Route `yaml:"routes"`
+}
+
+// Route answers requests for one path. Body and header values are Go templates
+// executed with Data; bodies are HTML-escaped.
+type Route struct {
+    // Path is matched with path.Match, so "/wp-admin/*" covers one level below /wp-admin
+    Path string `yaml:"path"`
+    // Method restricts the route to one HTTP method; empty matches any
+    Method  string            `yaml:"method"`
+    Status  int               `yaml:"status"`
+    Headers map[string]string `yaml:"headers"`
+    Body    string            `yaml:"body"`
+    // Login names the form fields of a login form whose submissions are captured
+    Login *Login `yaml:"login"`
+    // BasicAuth is the realm of a route behind HTTP basic authentication, which never succeeds
+    BasicAuth string `yaml:"basic_auth"`
+
+    pack    string
+    body    *template.Template
+    headers map[string]*texttemplate.Template
+    realm   *texttemplate.Template
+}
+
+// Login names the username and password fields of a login form
+type Login struct {
+    Username string `yaml:"username"`
+    Password string `yaml:"password"`
+}
+
+// Data is what route templates can refer to
+type Data struct {
+    Method string
+    // Host is the Host header; ServerName is its host part and Port the port the request came in on
+    Host       string
+    ServerName string
+    Port       int
+    Path       string
+    Query      url.Values
+    Form       url.Values
+    // Username is the submitted login name, empty when nothing was submitted
+    Username string
+    // Hostname and Server describe the persona the sensor presents
+    Hostname string
+    Server   string
+    Now      time.Time
+}
+
+// Set is the routes of every enabled pack, in configuration order
+type Set struct {
+    routes []*Route
+}
+
+// Builtin returns the names of the packs compiled into the binary
+func Builtin() []string {
+    entries, _ := builtinPacks.ReadDir("packs")
+    names := make([]string, 0, len(entries))
+    for _, entry := range entries {
+        names = append(names, strings.TrimSuffix(entry.Name(), ".yaml"))
+    }
+    sort.Strings(names)
+    return names
+}
+
+// Load reads the named packs. A <name>.yaml file in dir takes precedence over
+// the built-in pack of the same name. When two packs route the same request,
+// the one named first wins.
+func Load(names []string, dir string) (*Set, error) {
+    set := &Set{}
+    for _, name := range names {
+        pack, err := loadPack(name, dir)
+        if err != nil {
+            return nil, fmt.Errorf("app pack %s: %v", name, err)
+        }
+        set.routes = append(set.routes, pack.Routes...)
+    }
+    return set, nil
+}
+
+// loadPack reads one pack from dir or the built-in packs
+func loadPack(name, dir string) (*Pack, error) {
+    if name == "" || strings.ContainsAny(name, `/\`) {
+        return nil, errors.New("invalid pack name")
+    }
+
+    var data []byte
+    var err error
+    if dir != "" {
+        data, err = os.ReadFile(filepath.Join(dir, name+".yaml"))
+    }
+    if dir == "" || errors.Is(err, os.ErrNotExist) {
+        data, err = builtinPacks.ReadFile("packs/" + name + ".yaml")
+        if errors.Is(err, os.ErrNotExist) {
+            return nil, fmt.Errorf("unknown pack (built-in: %s)", strings.Join(Builtin(), ", "))
+        }
+    }
+    if err != nil {
+        return nil, err
+    }
+    return Parse(data)
+}
+
+// Parse decodes a pack and compiles its templates
+func Parse(data []byte) (*Pack, error) {
+    var pack Pack
+    if err := yaml.Unmarshal(data, &pack); err != nil {
+        return nil, err
+    }
+    if pack.Name == "" {
+        return nil, errors.New("pack has no name")
+    }
+
+    for _, route := range pack.Routes {
+        if _, err := path.Match(route.Path, "/"); err != nil || !strings.HasPrefix(route.Path, "/") {
+            return nil, fmt.Errorf("invalid path %q", route.Path)
+        }
+        name := pack.Name + " " + route.Path
+        body, err := template.New(name).Parse(route.Body)
+        if err != nil {
+            return nil, err
+        }
+        route.pack = pack.Name
+        route.body = body
+        route.headers = make(map[string]*texttemplate.Template, len(route.Headers))
+        for key, value := range route.Headers {
+            header, err := texttemplate.New(name + " " + key).Parse(value)
+            if err != nil {
+                return nil, err
+            }
+            route.headers[key] = header
+        }
+        if route.BasicAuth != "" {
+            if route.realm, err = texttemplate.New(name + " realm").Parse(route.BasicAuth); err != nil {
+                return nil, err
+            }
+        }
+        if route.Status == 0 {
+            route.Status = http.StatusOK
+        }
+        route.Method = strings.ToUpper(route.Method)
+    }
+    return &pack, nil
+}
+
+// Match returns the first route for a request, or nil
+func (s *Set) Match(method, urlPath string) *Route {
+    if s == nil {
+        return nil
+    }
+    for _, route := range s.routes {
+        if route.Method != "" && route.Method != method {
+            continue
+        }
+        if ok, _ := path.Match(route.Path, urlPath); ok {
+            return route
+        }
+    }
+    return nil
+}
+
+// Pack returns the name of the pack the route belongs to
+func (r *Route) Pack() string {
+    return r.pack
+}
+
+// Credentials returns what was submitted to a login form or basic authentication.
+// The request form must already be parsed.
+func (r *Route) Credentials(req *http.Request) (username, password string, ok bool) {
+    if r.BasicAuth != "" {
+        if username, password, ok = req.BasicAuth(); ok {
+            return username, password, true
+        }
+    }
+    if r.Login == nil || req.Form == nil {
+        return "", "", false
+    }
+    _, hasUser := req.Form[r.Login.Username]
+    _, hasPass := req.Form[r.Login.Password]
+    if !hasUser && !hasPass {
+        return "", "", false
+    }
+    return req.Form.Get(r.Login.Username), req.Form.Get(r.Login.Password), true
+}
+
+// Render writes the route's response. Routes behind basic authentication
+// always answer 401 so every guess can be captured.
+func (r *Route) Render(w http.ResponseWriter, data Data) error {
+    var body bytes.Buffer
+    if err := r.body.Execute(&body, data); err != nil {
+        return err
+    }
+    for key, header := range r.headers {
+        var value bytes.Buffer
+        if err := header.Execute(&value, data); err != nil {
+            return err
+        }
+        w.Header().Set(key, value.String())
+    }
+    if w.Header().Get("Content-Type") == "" {
+        w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+    }
+
+    status := r.Status
+    if r.realm != nil {
+        var realm bytes.Buffer
+        if err := r.realm.Execute(&realm, data); err != nil {
+            return err
+        }
+        w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", realm.String()))
+        status = http.StatusUnauthorized
+    }
+    w.WriteHeader(status)
+    _, err := w.Write(body.Bytes())
+    return err
+}
+
+// Page is a standalone page template such as the persona's 404 page
+type Page struct {
+    tmpl *template.Template
+}
+
+// ParsePage compiles a page template
+func ParsePage(name, text string) (*Page, error) {
+    tmpl, err := template.New(name).Parse(text)
+    if err != nil {
+        return nil, err
+    }
+    return &Page{tmpl: tmpl}, nil
+}
+
+// Render writes the page with the given status
+func (p *Page) Render(w http.ResponseWriter, status int, data Data) error {
+    var body bytes.Buffer
+    if err := p.tmpl.Execute(&body, data); err != nil {
+        return err
+    }
+    if w.Header().Get("Content-Type") == "" {
+        w.Header().Set("Content-Type", "text/html")
+    }
+    w.WriteHeader(status)
+    _, err := w.Write(body.Bytes())
+    return err
+}
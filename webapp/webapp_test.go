@@ -0,0 +1,102 @@
+package webapp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuiltinPacksParse(t *testing.T) {
+    names := Builtin()
+    assert.Equal(t, []string{"jenkins", "owa", "phpmyadmin", "router", "wordpress"}, names)
+
+    set, err := Load(names, "")
+    require.NoError(t, err)
+    for _, route := range set.routes {
+        rec := httptest.NewRecorder()
+        data := Data{Method: "GET", Host: "203.0.113.5", Path: route.Path, Query: url.Values{}, Username: "admin"}
+        require.NoError(t, route.Render(rec, data), "%s %s", route.Pack(), route.Path)
+    }
+}
+
+func TestMatchHonoursMethodAndOrder(t *testing.T) {
+    set, err := Load([]string{"wordpress", "router"}, "")
+    require.NoError(t, err)
+
+    login := set.Match("POST", "/wp-login.php")
+    require.NotNil(t, login)
+    assert.NotNil(t, login.Login)
+    page := set.Match("GET", "/wp-login.php")
+    require.NotNil(t, page)
+    assert.Nil(t, page.Login)
+
+    assert.Equal(t, "wordpress", set.Match("GET", "/wp-admin/plugins.php").Pack())
+    assert.Equal(t, "router", set.Match("GET", "/").Pack())
+    assert.Nil(t, set.Match("GET", "/wp-admin/css/login.min.css"))
+    assert.Nil(t, (*Set)(nil).Match("GET", "/"))
+}
+
+func TestRouteRendersTemplatesAndCapturesLogins(t *testing.T) {
+    set, err := Load([]string{"wordpress", "router"}, "")
+    require.NoError(t, err)
+
+    req := httptest.NewRequest("POST", "/wp-login.php", strings.NewReader("log=<b>admin</b>&pwd=hunter2&wp-submit=Log+In"))
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    require.NoError(t, req.ParseForm())
+    route := set.Match(req.Method, req.URL.Path)
+    user, pass, ok := route.Credentials(req)
+    require.True(t, ok)
+    assert.Equal(t, "<b>admin</b>", user)
+    assert.Equal(t, "hunter2", pass)
+
+    rec := httptest.NewRecorder()
+    require.NoError(t, route.Render(rec, Data{Username: user, Hostname: "srv-web01"}))
+    assert.Equal(t, http.StatusOK, rec.Code)
+    assert.Contains(t, rec.Body.String(), "Log In &lsaquo; srv-web01")
+    // Submitted values are escaped so the page stays well formed
+    assert.Contains(t, rec.Body.String(), "the username <strong>&lt;b&gt;admin&lt;/b&gt;</strong> is incorrect")
+
+    redirect := set.Match("GET", "/wp-admin/users.php")
+    rec = httptest.NewRecorder()
+    require.NoError(t, redirect.Render(rec, Data{Path: "/wp-admin/users.php"}))
+    assert.Equal(t, http.StatusFound, rec.Code)
+    assert.Equal(t, "/wp-login.php?redirect_to=%2Fwp-admin%2Fusers.php&reauth=1", rec.Header().Get("Location"))
+
+    req = httptest.NewRequest("GET", "/", nil)
+    req.SetBasicAuth("admin", "admin")
+    route = set.Match(req.Method, req.URL.Path)
+    user, pass, ok = route.Credentials(req)
+    require.True(t, ok)
+    assert.Equal(t, "admin", user)
+    assert.Equal(t, "admin", pass)
+    rec = httptest.NewRecorder()
+    require.NoError(t, route.Render(rec, Data{}))
+    assert.Equal(t, http.StatusUnauthorized, rec.Code)
+    assert.Equal(t, `Basic realm="TP-LINK Wireless N Router WR841N"`, rec.Header().Get("WWW-Authenticate"))
+}
+
+func TestCustomPackOverridesBuiltin(t *testing.T) {
+    dir := t.TempDir()
+    pack := []byte("name: wordpress\nroutes:\n  - path: /wp-login.php\n    status: 503\n    body: \"down for maintenance on {{.Host}}\"\n")
+    require.NoError(t, os.WriteFile(filepath.Join(dir, "wordpress.yaml"), pack, 0644))
+
+    set, err := Load([]string{"wordpress", "jenkins"}, dir)
+    require.NoError(t, err)
+    rec := httptest.NewRecorder()
+    require.NoError(t, set.Match("GET", "/wp-login.php").Render(rec, Data{Host: "blog.example"}))
+    assert.Equal(t, 503, rec.Code)
+    assert.Equal(t, "down for maintenance on blog.example", rec.Body.String())
+    assert.NotNil(t, set.Match("GET", "/login"))
+
+    _, err = Load([]string{"drupal"}, dir)
+    assert.ErrorContains(t, err, "unknown pack")
+    _, err = Parse([]byte("name: bad\nroutes:\n  - path: wp-login.php\n"))
+    assert.ErrorContains(t, err, "invalid path")
+}